@@ -0,0 +1,210 @@
+package acme
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/acme"
+	"golang.org/x/crypto/acme/autocert"
+)
+
+// ALPNProto is the protocol ACME servers negotiate for TLS-ALPN-01
+// challenges. It must be in the server's NextProtos.
+const ALPNProto = acme.ALPNProto
+
+// DefaultDirectoryURL is Let's Encrypt's production directory
+const DefaultDirectoryURL = acme.LetsEncryptURL
+
+// Storage keeps the account key and certificates between restarts. Any
+// autocert.Cache can be used.
+type Storage = autocert.Cache
+
+// DirStorage stores everything as files in dir, created as needed
+func DirStorage(dir string) Storage {
+	return autocert.DirCache(dir)
+}
+
+// Config says which names to get certificates for and from where.
+// HTTPClient talks to the directory, for instance to trust a test CA.
+type Config struct {
+	Hosts        []string
+	Email        string
+	DirectoryURL string
+	Storage      Storage
+	RenewBefore  time.Duration
+	HTTPClient   *http.Client
+}
+
+// Manager obtains certificates for its hosts when they're first needed and
+// renews them before they expire. Challenges are answered by
+// GetCertificate for TLS-ALPN-01 and by HTTPHandler for HTTP-01.
+type Manager struct {
+	hosts    []string
+	autocert *autocert.Manager
+
+	ctx  context.Context // done once stopped
+	stop context.CancelFunc
+	wg   sync.WaitGroup // issuance started by Start
+}
+
+func New(config Config) (*Manager, error) {
+	if len(config.Hosts) == 0 {
+		return nil, errors.New("at least one host is required")
+	}
+	if config.Storage == nil {
+		return nil, errors.New("storage is required")
+	}
+	if config.DirectoryURL == "" {
+		config.DirectoryURL = DefaultDirectoryURL
+	}
+
+	hosts := make([]string, 0, len(config.Hosts))
+	for _, host := range config.Hosts {
+		host = normalize(host)
+		if strings.Contains(host, "*") {
+			return nil, fmt.Errorf("wildcard host %s needs a DNS-01 challenge, which isn't supported", host)
+		}
+		hosts = append(hosts, host)
+	}
+
+	// Requests to the CA fail once the manager stops, which ends issuance
+	// in progress and keeps renewals from starting
+	ctx, stop := context.WithCancel(context.Background())
+	client := config.HTTPClient
+	if client == nil {
+		client = http.DefaultClient
+	}
+	transport := client.Transport
+	if transport == nil {
+		transport = http.DefaultTransport
+	}
+	client = &http.Client{
+		Transport: stoppingTransport{base: transport, ctx: ctx},
+		Timeout:   client.Timeout,
+	}
+
+	return &Manager{
+		hosts: hosts,
+		ctx:   ctx,
+		stop:  stop,
+		autocert: &autocert.Manager{
+			Prompt:      autocert.AcceptTOS,
+			Cache:       config.Storage,
+			HostPolicy:  autocert.HostWhitelist(hosts...),
+			RenewBefore: config.RenewBefore,
+			Email:       config.Email,
+			Client: &acme.Client{
+				DirectoryURL: config.DirectoryURL,
+				HTTPClient:   client,
+			},
+		},
+	}, nil
+}
+
+// Handles reports whether the manager serves the certificate for hello,
+// either because its name is one of the hosts or because it's an ACME
+// server validating a challenge
+func (m *Manager) Handles(hello *tls.ClientHelloInfo) bool {
+	if len(hello.SupportedProtos) == 1 && hello.SupportedProtos[0] == ALPNProto {
+		return true
+	}
+	return slices.Contains(m.hosts, normalize(hello.ServerName))
+}
+
+// GetCertificate returns the certificate for hello, obtaining it first if
+// needed. It suits tls.Config.GetCertificate.
+func (m *Manager) GetCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	return m.autocert.GetCertificate(hello)
+}
+
+// HTTPHandler answers HTTP-01 challenges and passes other requests to
+// fallback. Without it only TLS-ALPN-01 challenges are used.
+func (m *Manager) HTTPHandler(fallback http.Handler) http.Handler {
+	return m.autocert.HTTPHandler(fallback)
+}
+
+// Start obtains or loads every host's certificate in the background so the
+// first client doesn't wait for issuance
+func (m *Manager) Start() {
+	for _, host := range m.hosts {
+		host := host
+		m.wg.Add(1)
+		go func() {
+			defer m.wg.Done()
+			if _, err := m.GetCertificate(helloFor(host)); err != nil && m.ctx.Err() == nil {
+				log.Printf("ACME certificate for %s not obtained: %v", host, err)
+			}
+		}()
+	}
+}
+
+// Stop cuts off the CA, failing issuance in progress and later renewals,
+// and waits for the issuance started by Start to end. Certificates already
+// obtained are still served.
+func (m *Manager) Stop() {
+	m.stop()
+	m.wg.Wait()
+}
+
+// stoppingTransport fails requests once ctx is done, including those
+// already in flight
+type stoppingTransport struct {
+	base http.RoundTripper
+	ctx  context.Context
+}
+
+func (t stoppingTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	if err := t.ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithCancel(r.Context())
+	stop := context.AfterFunc(t.ctx, cancel)
+	resp, err := t.base.RoundTrip(r.WithContext(ctx))
+	if err != nil {
+		stop()
+		cancel()
+		return nil, err
+	}
+	resp.Body = &stoppingBody{ReadCloser: resp.Body, release: func() {
+		stop()
+		cancel()
+	}}
+	return resp, nil
+}
+
+// stoppingBody releases its request's context once closed
+type stoppingBody struct {
+	io.ReadCloser
+	release func()
+}
+
+func (b *stoppingBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.release()
+	return err
+}
+
+// helloFor is the hello of a client that accepts ECDSA certificates, as
+// every modern client does
+func helloFor(host string) *tls.ClientHelloInfo {
+	return &tls.ClientHelloInfo{
+		ServerName:       host,
+		SignatureSchemes: []tls.SignatureScheme{tls.ECDSAWithP256AndSHA256},
+		SupportedCurves:  []tls.CurveID{tls.CurveP256},
+		CipherSuites:     []uint16{tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256},
+	}
+}
+
+func normalize(host string) string {
+	return strings.ToLower(strings.TrimSuffix(host, "."))
+}
@@ -0,0 +1,189 @@
+package acme
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestNewErrors(t *testing.T) {
+	tests := []struct {
+		name     string
+		config   Config
+		expected string
+	}{
+		{"no hosts", Config{Storage: DirStorage(t.TempDir())}, "host is required"},
+		{"no storage", Config{Hosts: []string{"example.com"}}, "storage is required"},
+		{"wildcard", Config{Hosts: []string{"*.example.com"}, Storage: DirStorage(t.TempDir())}, "DNS-01"},
+	}
+
+	for _, tt := range tests {
+		if _, err := New(tt.config); err == nil || !strings.Contains(err.Error(), tt.expected) {
+			t.Errorf("%s: expected error containing %q, got %v", tt.name, tt.expected, err)
+		}
+	}
+}
+
+func TestHandles(t *testing.T) {
+	m, err := New(Config{Hosts: []string{"www.example.com", "API.example.com."}, Storage: DirStorage(t.TempDir())})
+	if err != nil {
+		t.Fatalf("Failed to create manager: %v", err)
+	}
+
+	tests := []struct {
+		hello    *tls.ClientHelloInfo
+		expected bool
+	}{
+		{&tls.ClientHelloInfo{ServerName: "www.example.com"}, true},
+		{&tls.ClientHelloInfo{ServerName: "api.example.com"}, true},
+		{&tls.ClientHelloInfo{ServerName: "WWW.Example.com."}, true},
+		{&tls.ClientHelloInfo{ServerName: "other.example.com"}, false},
+		{&tls.ClientHelloInfo{}, false},
+		// ACME servers validating TLS-ALPN-01 only offer acme-tls/1
+		{&tls.ClientHelloInfo{ServerName: "other.example.com", SupportedProtos: []string{ALPNProto}}, true},
+	}
+
+	for _, tt := range tests {
+		if got := m.Handles(tt.hello); got != tt.expected {
+			t.Errorf("Expected Handles(%q, %v) to be %t", tt.hello.ServerName, tt.hello.SupportedProtos, tt.expected)
+		}
+	}
+}
+
+func TestHTTPHandler(t *testing.T) {
+	m, err := New(Config{Hosts: []string{"www.example.com"}, Storage: DirStorage(t.TempDir())})
+	if err != nil {
+		t.Fatalf("Failed to create manager: %v", err)
+	}
+	handler := m.HTTPHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusTeapot)
+	}))
+
+	tests := []struct {
+		host     string
+		path     string
+		expected int
+	}{
+		{"www.example.com", "/index.html", http.StatusTeapot},
+		{"www.example.com", "/.well-known/acme-challenge/unknown", http.StatusNotFound},
+		{"other.example.com", "/.well-known/acme-challenge/unknown", http.StatusForbidden},
+	}
+
+	for _, tt := range tests {
+		req := httptest.NewRequest("GET", tt.path, nil)
+		req.Host = tt.host
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+
+		if rec.Code != tt.expected {
+			t.Errorf("Expected %d for %s%s, got %d", tt.expected, tt.host, tt.path, rec.Code)
+		}
+	}
+}
+
+func TestStop(t *testing.T) {
+	// A directory that never answers
+	directory := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-r.Context().Done()
+	}))
+	defer directory.Close()
+
+	m, err := New(Config{
+		Hosts:        []string{"www.example.com", "api.example.com"},
+		DirectoryURL: directory.URL,
+		Storage:      DirStorage(t.TempDir()),
+	})
+	if err != nil {
+		t.Fatalf("Failed to create manager: %v", err)
+	}
+	m.Start()
+	time.Sleep(50 * time.Millisecond)
+
+	stopped := make(chan struct{})
+	go func() {
+		m.Stop()
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Expected Stop to end issuance in progress")
+	}
+
+	if _, err := m.GetCertificate(helloFor("www.example.com")); err == nil {
+		t.Error("Expected no issuance after Stop")
+	}
+}
+
+// TestPebble obtains a certificate from a local Pebble server. Pebble must
+// validate HTTP-01 on port 5002 and TLS-ALPN-01 on port 5001 of this host,
+// which are its defaults, and resolve ACME_TEST_HOST to it.
+func TestPebble(t *testing.T) {
+	directory := os.Getenv("ACME_TEST_DIRECTORY")
+	host := os.Getenv("ACME_TEST_HOST")
+	if directory == "" || host == "" {
+		t.Skip("ACME_TEST_DIRECTORY and ACME_TEST_HOST aren't set")
+	}
+
+	// Pebble's directory is served with a certificate from its own CA
+	client := &http.Client{Timeout: time.Minute}
+	if caFile := os.Getenv("ACME_TEST_CA"); caFile != "" {
+		pem, err := os.ReadFile(caFile)
+		if err != nil {
+			t.Fatalf("Failed to read CA: %v", err)
+		}
+		pool := x509.NewCertPool()
+		pool.AppendCertsFromPEM(pem)
+		client.Transport = &http.Transport{TLSClientConfig: &tls.Config{RootCAs: pool}}
+	}
+
+	m, err := New(Config{
+		Hosts:        []string{host},
+		DirectoryURL: directory,
+		Storage:      DirStorage(t.TempDir()),
+		HTTPClient:   client,
+	})
+	if err != nil {
+		t.Fatalf("Failed to create manager: %v", err)
+	}
+
+	httpLn, err := net.Listen("tcp", ":5002")
+	if err != nil {
+		t.Fatalf("Failed to listen for HTTP-01: %v", err)
+	}
+	httpServer := &http.Server{Handler: m.HTTPHandler(nil)}
+	go httpServer.Serve(httpLn)
+	defer httpServer.Close()
+
+	tlsLn, err := tls.Listen("tcp", ":5001", &tls.Config{GetCertificate: m.GetCertificate, NextProtos: []string{ALPNProto}})
+	if err != nil {
+		t.Fatalf("Failed to listen for TLS-ALPN-01: %v", err)
+	}
+	go func() {
+		for {
+			conn, err := tlsLn.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				conn.(*tls.Conn).Handshake()
+				conn.Close()
+			}()
+		}
+	}()
+	defer tlsLn.Close()
+
+	cert, err := m.GetCertificate(helloFor(host))
+	if err != nil {
+		t.Fatalf("Failed to obtain a certificate: %v", err)
+	}
+	if cert.Leaf == nil || cert.Leaf.VerifyHostname(host) != nil {
+		t.Errorf("Expected a certificate for %s, got %+v", host, cert.Leaf)
+	}
+}
@@ -2,41 +2,51 @@ package cache
 
 import (
 	"bytes"
+	"context"
+	"errors"
 	"fmt"
 	"io"
+	"log"
 	"net/http"
-	"sort"
+	"strconv"
 	"sync"
-	"sync/atomic"
 	"time"
 )
 
 type Cache struct {
-	items   sync.Map
-	size    atomic.Int64
-	maxSize int64
-	ttl     time.Duration
-}
-
-type cacheItem struct {
-	response *http.Response
-	body     []byte
-	size     int64
-	expires  time.Time
-	lastUsed time.Time
-	hits     atomic.Int64
-	mu       sync.RWMutex
+	store     Store // by key, with Vary markers under primary keys
+	ttl       time.Duration
+	cleanup   time.Duration
+	rules     []Rule
+	principal func(*http.Request) string
+	flights   sync.Map // primary key -> chan closed once its fetch is done
+	done      chan struct{}
+	closeOnce sync.Once
 }
 
 type Config struct {
-	MaxSize int64         // Maximum size in bytes
-	TTL     time.Duration // Time to live for cache entries
+	MaxSize         int64                      // Maximum size in bytes of the default store
+	TTL             time.Duration              // Lifetime of responses that don't give their own
+	CleanupInterval time.Duration              // How often expired entries are dropped (default 1m)
+	Rules           []Rule                     // The first rule matching a request applies
+	Principal       func(*http.Request) string // Who made a request, for keys that include it
+	Store           Store                      // Where entries are kept (default in memory)
 }
 
 func New(config Config) *Cache {
+	if config.CleanupInterval <= 0 {
+		config.CleanupInterval = time.Minute
+	}
+	if config.Store == nil {
+		config.Store = NewMemoryStore(config.MaxSize)
+	}
 	cache := &Cache{
-		maxSize: config.MaxSize,
-		ttl:     config.TTL,
+		store:     config.Store,
+		ttl:       config.TTL,
+		cleanup:   config.CleanupInterval,
+		rules:     config.Rules,
+		principal: config.Principal,
+		done:      make(chan struct{}),
 	}
 
 	// Start maintenance routine
@@ -45,9 +55,19 @@ func New(config Config) *Cache {
 	return cache
 }
 
+// Close stops the cache's maintenance and closes its store
+func (c *Cache) Close() error {
+	var err error
+	c.closeOnce.Do(func() {
+		close(c.done)
+		err = c.store.Close()
+	})
+	return err
+}
+
 func (c *Cache) Set(r *http.Request, resp *http.Response) error {
 	// Skip caching if response shouldn't be cached
-	if !isCacheable(r, resp) {
+	if !Cacheable(r, resp) {
 		return nil
 	}
 
@@ -57,127 +77,207 @@ func (c *Cache) Set(r *http.Request, resp *http.Response) error {
 		return fmt.Errorf("failed to copy response: %w", err)
 	}
 
-	item := &cacheItem{
-		response: resp,
-		body:     body,
-		size:     int64(len(body)),
-		expires:  time.Now().Add(c.ttl),
-		lastUsed: time.Now(),
+	rule := c.rule(r)
+	if rule != nil && rule.MaxSize > 0 && int64(len(body)) > rule.MaxSize {
+		return nil
 	}
 
-	// Check if adding this item would exceed max size
-	newSize := c.size.Load() + item.size
-	if c.maxSize > 0 && newSize > c.maxSize {
-		// Try to free up space
-		c.evict(item.size)
+	now := time.Now()
+	entry := c.newEntry(rule, resp.StatusCode, resp.Header, body, now)
+	if !entry.Expires.After(now) {
+		// Already stale and can't be revalidated, so it could never be
+		// served
+		return nil
+	}
 
-		// Check again after eviction
-		if c.size.Load()+item.size > c.maxSize {
-			return fmt.Errorf("cache full: cannot store item of size %d", item.size)
+	// Variants are stored under their own keys, found through a marker
+	// holding the latest Vary
+	ctx := r.Context()
+	key := c.primaryKey(r, rule)
+	if vary := varyHeaders(resp); len(vary) > 0 {
+		marker := &Entry{Vary: vary, Stored: now, Expires: entry.Expires}
+		if previous, ok := c.load(ctx, key); ok && previous.Vary != nil && previous.Expires.After(marker.Expires) {
+			marker.Expires = previous.Expires
+		}
+		if err := c.store.Set(ctx, key, marker); err != nil {
+			return err
 		}
+		key = variantKey(key, r, vary)
+	}
+	return c.store.Set(ctx, key, entry)
+}
+
+// newEntry computes the freshness of a response from its headers. Stale
+// entries are kept while they may still be served, or for staleRetention
+// if they carry a validator.
+func (c *Cache) newEntry(rule *Rule, status int, header http.Header, body []byte, now time.Time) *Entry {
+	var defaults Rule
+	if rule != nil {
+		defaults = *rule
+	}
+	ttl := c.ttl
+	if defaults.TTL > 0 {
+		ttl = defaults.TTL
+	}
+
+	resp := &http.Response{StatusCode: status, Header: header}
+	res := parseCacheControl(header)
+	age := initialAge(resp, now)
+	lifetime := freshnessLifetime(resp, res, now, ttl)
+	// no-cache responses must be revalidated before every use
+	if res.has("no-cache") {
+		lifetime = 0
+	}
+
+	entry := &Entry{
+		Status:   status,
+		Header:   header.Clone(),
+		Body:     body,
+		Stored:   now,
+		Age:      age,
+		Lifetime: lifetime,
+		Expires:  now.Add(lifetime - age),
+		NoStale:  res.has("must-revalidate") || res.has("proxy-revalidate") || res.has("s-maxage") || res.has("no-cache"),
+
+		StaleWhileRevalidate: defaults.StaleWhileRevalidate,
+		StaleIfError:         defaults.StaleIfError,
+	}
+	// The origin's directives win over the rule's (RFC 5861)
+	if window, ok := res.seconds("stale-while-revalidate"); ok {
+		entry.StaleWhileRevalidate = window
+	}
+	if window, ok := res.seconds("stale-if-error"); ok {
+		entry.StaleIfError = window
 	}
 
-	key := generateKey(r)
-	c.items.Store(key, item)
-	c.size.Add(item.size)
+	retention := max(entry.StaleWhileRevalidate, entry.StaleIfError)
+	if hasValidators(header) {
+		retention = max(retention, staleRetention)
+	}
+	entry.Expires = entry.Expires.Add(retention)
+	return entry
+}
 
-	return nil
+// lookup returns r's stored response and its key, following Vary markers
+func (c *Cache) lookup(r *http.Request) (string, *Entry, bool) {
+	ctx := r.Context()
+	key := c.primaryKey(r, c.rule(r))
+	entry, ok := c.load(ctx, key)
+	if ok && entry.Vary != nil {
+		key = variantKey(key, r, entry.Vary)
+		entry, ok = c.load(ctx, key)
+	}
+	return key, entry, ok
 }
 
-func (c *Cache) Get(r *http.Request) (*http.Response, bool) {
-	key := generateKey(r)
-	value, ok := c.items.Load(key)
-	if !ok {
+// load reads an entry from the store. Entries that can't be read are
+// misses, since the origin can still answer.
+func (c *Cache) load(ctx context.Context, key string) (*Entry, bool) {
+	entry, err := c.store.Get(ctx, key)
+	if err != nil {
+		if !errors.Is(err, ErrNotFound) && ctx.Err() == nil {
+			log.Printf("Cache store error: %v", err)
+		}
 		return nil, false
 	}
+	return entry, true
+}
 
-	item := value.(*cacheItem)
-
-	item.mu.RLock()
-	defer item.mu.RUnlock()
+// Get returns the cached response to r if the request's Cache-Control
+// lets it be used, or a 304 if r's own validators match it. Hits carry an
+// Age header.
+func (c *Cache) Get(r *http.Request) (*http.Response, bool) {
+	req := requestDirectives(r)
+	if req.has("no-store") || req.has("no-cache") {
+		return nil, false
+	}
 
-	// Check if expired
-	if time.Now().After(item.expires) {
-		c.items.Delete(key)
-		c.size.Add(-item.size)
+	now := time.Now()
+	key, entry, ok := c.lookup(r)
+	if !ok {
 		return nil, false
 	}
 
-	// Update stats
-	item.hits.Add(1)
-	item.lastUsed = time.Now()
+	age := entry.currentAge(now)
+	if !entry.usable(req, age) {
+		// Drop it once it's stale, unless it can be revalidated
+		if !now.Before(entry.Expires) {
+			c.store.Delete(r.Context(), key)
+		}
+		return nil, false
+	}
 
-	// Return a copy of the response
-	return copyResponseWithBody(item.response, item.body), true
+	return entry.respond(r, age), true
 }
 
-func (c *Cache) maintenance() {
-	ticker := time.NewTicker(time.Minute)
-	defer ticker.Stop()
+// respond returns a copy of the entry's response, or a 304 if r's own
+// validators match it
+func (entry *Entry) respond(r *http.Request, age time.Duration) *http.Response {
+	stored := &http.Response{
+		Status:     fmt.Sprintf("%d %s", entry.Status, http.StatusText(entry.Status)),
+		StatusCode: entry.Status,
+		Proto:      "HTTP/1.1",
+		ProtoMajor: 1,
+		ProtoMinor: 1,
+		Header:     entry.Header,
+		Request:    r,
+	}
 
-	for range ticker.C {
-		c.evictExpired()
+	var resp *http.Response
+	if notModified(r, entry.Header) {
+		resp = notModifiedResponse(stored)
+	} else {
+		resp = copyResponseWithBody(stored, entry.Body)
 	}
+	resp.Header.Set("Age", strconv.FormatInt(int64(age/time.Second), 10))
+	return resp
 }
 
-func (c *Cache) evictExpired() {
-	now := time.Now()
-	var keysToEvict []string
-
-	c.items.Range(func(key, value interface{}) bool {
-		item := value.(*cacheItem)
-		item.mu.RLock()
-		expired := now.After(item.expires)
-		item.mu.RUnlock()
+// currentAge is the entry's age at now (RFC 9111 section 4.2.3)
+func (entry *Entry) currentAge(now time.Time) time.Duration {
+	return entry.Age + now.Sub(entry.Stored)
+}
 
-		if expired {
-			keysToEvict = append(keysToEvict, key.(string))
-		}
+// usable reports whether an entry of the given age satisfies a request
+// with directives req (RFC 9111 sections 4.2 and 5.2.1)
+func (entry *Entry) usable(req directives, age time.Duration) bool {
+	fresh := entry.Lifetime - age
+	if maxAge, ok := req.seconds("max-age"); ok && age > maxAge {
+		return false
+	}
+	if minFresh, ok := req.seconds("min-fresh"); ok && fresh < minFresh {
+		return false
+	}
+	if fresh > 0 {
 		return true
-	})
-
-	for _, key := range keysToEvict {
-		if item, loaded := c.items.LoadAndDelete(key); loaded {
-			c.size.Add(-item.(*cacheItem).size)
-		}
 	}
-}
 
-func (c *Cache) evict(needed int64) {
-	type evictionCandidate struct {
-		key   string
-		item  *cacheItem
-		score float64
+	if entry.NoStale || !req.has("max-stale") {
+		return false
 	}
-
-	var candidates []evictionCandidate
-
-	// Collect candidates
-	c.items.Range(func(key, value interface{}) bool {
-		item := value.(*cacheItem)
-		score := float64(time.Since(item.lastUsed).Seconds()) / float64(item.hits.Load()+1)
-		candidates = append(candidates, evictionCandidate{
-			key:   key.(string),
-			item:  item,
-			score: score,
-		})
+	// max-stale without a value accepts any staleness
+	if req["max-stale"] == "" {
 		return true
-	})
+	}
+	maxStale, ok := req.seconds("max-stale")
+	return ok && -fresh <= maxStale
+}
 
-	// Sort by score (higher score = better eviction candidate)
-	sort.Slice(candidates, func(i, j int) bool {
-		return candidates[i].score > candidates[j].score
-	})
+func (c *Cache) maintenance() {
+	ticker := time.NewTicker(c.cleanup)
+	defer ticker.Stop()
 
-	// Evict until we have enough space
-	spaceFreed := int64(0)
-	for _, candidate := range candidates {
-		if spaceFreed >= needed {
-			break
-		}
-		if _, loaded := c.items.LoadAndDelete(candidate.key); loaded {
-			spaceFreed += candidate.item.size
-			c.size.Add(-candidate.item.size)
+	sw, ok := c.store.(sweeper)
+	if !ok {
+		// The store expires entries itself
+		return
+	}
+	for {
+		select {
+		case now := <-ticker.C:
+			sw.sweep(now)
+		case <-c.done:
+			return
 		}
 	}
 }
@@ -219,26 +319,3 @@ func copyResponseWithBody(resp *http.Response, body []byte) *http.Response {
 
 	return newResp
 }
-
-func generateKey(r *http.Request) string {
-	return r.Method + r.URL.String()
-}
-
-func isCacheable(r *http.Request, resp *http.Response) bool {
-	// Only cache GET requests
-	if r.Method != http.MethodGet {
-		return false
-	}
-
-	// Check response code
-	if resp.StatusCode != http.StatusOK {
-		return false
-	}
-
-	// Check cache control headers
-	if resp.Header.Get("Cache-Control") == "no-store" {
-		return false
-	}
-
-	return true
-}
@@ -2,12 +2,14 @@ package cache
 
 import (
 	"bytes"
+	"context"
 	"fmt"
 	"io"
 	"net/http"
 	"net/http/httptest"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 )
@@ -195,8 +197,9 @@ func TestCacheEviction(t *testing.T) {
 	}
 
 	// Verify size management
-	if cache.size.Load() > cache.maxSize {
-		t.Errorf("cache size %d exceeds max size %d", cache.size.Load(), cache.maxSize)
+	store := cache.store.(*MemoryStore)
+	if store.size.Load() > store.maxSize {
+		t.Errorf("cache size %d exceeds max size %d", store.size.Load(), store.maxSize)
 	}
 }
 
@@ -263,3 +266,463 @@ type mockCloser struct {
 func (m *mockCloser) Close() error {
 	return m.onClose()
 }
+
+func TestCacheable(t *testing.T) {
+	tests := []struct {
+		name     string
+		status   int
+		reqHdr   http.Header
+		respHdr  http.Header
+		expected bool
+	}{
+		{"ok", 200, nil, nil, true},
+		{"not found", 404, nil, nil, true},
+		{"gone", 410, nil, nil, true},
+		{"moved permanently", 301, nil, nil, true},
+		{"no content", 204, nil, nil, true},
+		{"non-authoritative", 203, nil, nil, true},
+		{"found without freshness", 302, nil, nil, false},
+		{"found with max-age", 302, nil, http.Header{"Cache-Control": {"max-age=60"}}, true},
+		{"server error", 500, nil, nil, false},
+		{"partial content", 206, nil, http.Header{"Cache-Control": {"max-age=60"}}, false},
+		{"no-store", 200, nil, http.Header{"Cache-Control": {"max-age=60, no-store"}}, false},
+		{"private", 200, nil, http.Header{"Cache-Control": {`private="Set-Cookie", max-age=60`}}, false},
+		{"no-cache", 200, nil, http.Header{"Cache-Control": {"No-Cache"}}, false},
+		{"vary star", 200, nil, http.Header{"Vary": {"*"}}, false},
+		{"request no-store", 200, http.Header{"Cache-Control": {"no-store"}}, nil, false},
+		{"authorization", 200, http.Header{"Authorization": {"Bearer x"}}, http.Header{"Cache-Control": {"max-age=60"}}, false},
+		{"authorization public", 200, http.Header{"Authorization": {"Bearer x"}}, http.Header{"Cache-Control": {"public"}}, true},
+		{"authorization s-maxage", 200, http.Header{"Authorization": {"Bearer x"}}, http.Header{"Cache-Control": {"s-maxage=60"}}, true},
+		{"authorization must-revalidate", 200, http.Header{"Authorization": {"Bearer x"}}, http.Header{"Cache-Control": {"must-revalidate, max-age=60"}}, true},
+	}
+
+	for _, tt := range tests {
+		req := httptest.NewRequest("GET", "/test", nil)
+		for k, v := range tt.reqHdr {
+			req.Header[k] = v
+		}
+		resp := createTestResponse(tt.status, "")
+		for k, v := range tt.respHdr {
+			resp.Header[k] = v
+		}
+
+		if got := Cacheable(req, resp); got != tt.expected {
+			t.Errorf("%s: expected cacheable %t, got %t", tt.name, tt.expected, got)
+		}
+	}
+}
+
+func TestFreshnessLifetime(t *testing.T) {
+	now := time.Now().Truncate(time.Second)
+	date := now.Format(http.TimeFormat)
+
+	tests := []struct {
+		name     string
+		header   http.Header
+		expected time.Duration
+	}{
+		{"fallback", http.Header{}, time.Minute},
+		{"max-age", http.Header{"Cache-Control": {"max-age=30"}}, 30 * time.Second},
+		{"s-maxage wins", http.Header{"Cache-Control": {"max-age=30, s-maxage=90"}}, 90 * time.Second},
+		{"max-age beats expires", http.Header{"Cache-Control": {"max-age=30"}, "Expires": {now.Add(time.Hour).Format(http.TimeFormat)}}, 30 * time.Second},
+		{"expires", http.Header{"Date": {date}, "Expires": {now.Add(time.Hour).Format(http.TimeFormat)}}, time.Hour},
+		{"invalid expires", http.Header{"Expires": {"0"}}, 0},
+		{"past expires", http.Header{"Date": {date}, "Expires": {now.Add(-time.Hour).Format(http.TimeFormat)}}, 0},
+		{"heuristic", http.Header{"Date": {date}, "Last-Modified": {now.Add(-100 * time.Second).Format(http.TimeFormat)}}, 10 * time.Second},
+		{"heuristic capped", http.Header{"Date": {date}, "Last-Modified": {now.Add(-24 * time.Hour).Format(http.TimeFormat)}}, time.Minute},
+		{"huge max-age", http.Header{"Cache-Control": {"max-age=99999999999999999999"}}, (1 << 31) * time.Second},
+	}
+
+	for _, tt := range tests {
+		resp := createTestResponse(200, "")
+		resp.Header = tt.header
+		if got := freshnessLifetime(resp, parseCacheControl(tt.header), now, time.Minute); got != tt.expected {
+			t.Errorf("%s: expected %v, got %v", tt.name, tt.expected, got)
+		}
+	}
+}
+
+func TestCacheRequestDirectives(t *testing.T) {
+	c := New(Config{TTL: time.Minute})
+
+	// Stored 40s old with 60s to live
+	resp := createTestResponse(200, "test data")
+	resp.Header.Set("Cache-Control", "max-age=60")
+	resp.Header.Set("Age", "40")
+	if err := c.Set(httptest.NewRequest("GET", "/test", nil), resp); err != nil {
+		t.Fatalf("failed to set cache: %v", err)
+	}
+
+	tests := []struct {
+		cacheControl string
+		pragma       string
+		expected     bool
+	}{
+		{"", "", true},
+		{"no-cache", "", false},
+		{"", "no-cache", false},
+		{"no-store", "", false},
+		{"max-age=60", "", true},
+		{"max-age=30", "", false},
+		{"min-fresh=10", "", true},
+		{"min-fresh=30", "", false},
+		{"only-if-cached", "", true},
+	}
+
+	for _, tt := range tests {
+		req := httptest.NewRequest("GET", "/test", nil)
+		if tt.cacheControl != "" {
+			req.Header.Set("Cache-Control", tt.cacheControl)
+		}
+		if tt.pragma != "" {
+			req.Header.Set("Pragma", tt.pragma)
+		}
+
+		cached, ok := c.Get(req)
+		if ok != tt.expected {
+			t.Errorf("Cache-Control %q, Pragma %q: expected hit %t, got %t", tt.cacheControl, tt.pragma, tt.expected, ok)
+			continue
+		}
+		if ok && cached.Header.Get("Age") != "40" {
+			t.Errorf("Expected Age 40, got %q", cached.Header.Get("Age"))
+		}
+	}
+}
+
+func TestCacheStale(t *testing.T) {
+	c := New(Config{TTL: time.Minute})
+
+	set := func(path, cacheControl string) {
+		resp := createTestResponse(200, "test data")
+		resp.Header.Set("Cache-Control", cacheControl)
+		resp.Header.Set("Age", "50")
+		if err := c.Set(httptest.NewRequest("GET", path, nil), resp); err != nil {
+			t.Fatalf("failed to set cache: %v", err)
+		}
+	}
+	get := func(path, cacheControl string) bool {
+		req := httptest.NewRequest("GET", path, nil)
+		req.Header.Set("Cache-Control", cacheControl)
+		_, ok := c.Get(req)
+		return ok
+	}
+
+	// Already stale when stored, so never kept
+	set("/expired", "max-age=10")
+	if _, ok := c.load(context.Background(), c.primaryKey(httptest.NewRequest("GET", "/expired", nil), nil)); ok {
+		t.Error("Expected a stale response not to be stored")
+	}
+
+	set("/stale", "max-age=51")
+	set("/strict", "max-age=51, must-revalidate")
+	time.Sleep(1100 * time.Millisecond)
+
+	if !get("/stale", "max-stale=5") {
+		t.Error("Expected max-stale=5 to accept a slightly stale response")
+	}
+	if !get("/stale", "max-stale") {
+		t.Error("Expected max-stale to accept any stale response")
+	}
+	if get("/strict", "max-stale") {
+		t.Error("Expected must-revalidate to forbid serving stale")
+	}
+	if get("/stale", "max-stale=0") {
+		t.Error("Expected max-stale=0 to refuse a stale response")
+	}
+	if get("/stale", "max-stale") {
+		t.Error("Expected a stale response to be dropped after a miss")
+	}
+}
+
+func TestCacheVary(t *testing.T) {
+	c := New(Config{TTL: time.Minute})
+
+	set := func(encoding, body string) {
+		req := httptest.NewRequest("GET", "/test", nil)
+		req.Header.Set("Accept-Encoding", encoding)
+		resp := createTestResponse(200, body)
+		resp.Header.Set("Vary", "Accept-Encoding")
+		resp.Header.Add("Vary", "accept-language")
+		if err := c.Set(req, resp); err != nil {
+			t.Fatalf("failed to set cache: %v", err)
+		}
+	}
+	get := func(encoding string) string {
+		req := httptest.NewRequest("GET", "/test", nil)
+		req.Header.Set("Accept-Encoding", encoding)
+		resp, ok := c.Get(req)
+		if !ok {
+			return ""
+		}
+		body, _ := io.ReadAll(resp.Body)
+		return string(body)
+	}
+
+	set("gzip, br", "compressed")
+	set("identity", "plain")
+
+	tests := []struct {
+		encoding string
+		expected string
+	}{
+		{"gzip, br", "compressed"},
+		{"gzip,br", "compressed"},
+		{"identity", "plain"},
+		{"br", ""},
+	}
+	for _, tt := range tests {
+		if got := get(tt.encoding); got != tt.expected {
+			t.Errorf("Accept-Encoding %q: expected %q, got %q", tt.encoding, tt.expected, got)
+		}
+	}
+
+	// A variant differing in another listed header misses
+	req := httptest.NewRequest("GET", "/test", nil)
+	req.Header.Set("Accept-Encoding", "identity")
+	req.Header.Set("Accept-Language", "fr")
+	if _, ok := c.Get(req); ok {
+		t.Error("Expected a different Accept-Language to miss")
+	}
+}
+
+func TestCacheKeyRules(t *testing.T) {
+	c := New(Config{
+		TTL: time.Minute,
+		Rules: []Rule{
+			{Path: "/shared/*", Key: KeyConfig{IgnoreHost: true, IgnoreQuery: []string{"utm_source"}}},
+			{Path: "/search", Key: KeyConfig{Query: []string{"q", "page"}}},
+			{Path: "/user/*", Key: KeyConfig{Headers: []string{"X-Tenant"}, Cookies: []string{"lang"}, Principal: true}},
+			{Path: "/small", MaxSize: 4},
+		},
+		Principal: func(r *http.Request) string { return r.Header.Get("Authorization") },
+	})
+
+	request := func(target string, header http.Header) *http.Request {
+		req := httptest.NewRequest("GET", target, nil)
+		for k, v := range header {
+			req.Header[k] = v
+		}
+		return req
+	}
+	set := func(req *http.Request) {
+		resp := createTestResponse(200, "test data")
+		resp.Header.Set("Cache-Control", "public, max-age=60")
+		if err := c.Set(req, resp); err != nil {
+			t.Fatalf("failed to set cache: %v", err)
+		}
+	}
+
+	tests := []struct {
+		name     string
+		stored   *http.Request
+		lookup   *http.Request
+		expected bool
+	}{
+		{"query order", request("/a?x=1&y=2", nil), request("/a?y=2&x=1", nil), true},
+		{"host by default", request("http://one.example.com/b", nil), request("http://two.example.com/b", nil), false},
+		{"absolute form", request("/b2", nil), request("http://example.com/b2", nil), false},
+		{"scheme", request("http://example.com/b3", nil), request("https://example.com/b3", nil), false},
+		{"ignored host", request("http://one.example.com/shared/c", nil), request("http://two.example.com/shared/c", nil), true},
+		{"ignored query", request("/shared/d?utm_source=x", nil), request("/shared/d", nil), true},
+		{"kept query", request("/search?q=go&session=1", nil), request("/search?session=2&q=go", nil), true},
+		{"kept query differs", request("/search?q=go", nil), request("/search?q=rust", nil), false},
+		{"header", request("/user/e", http.Header{"X-Tenant": {"a"}}), request("/user/e", http.Header{"X-Tenant": {"b"}}), false},
+		{"cookie", request("/user/f", http.Header{"Cookie": {"lang=en"}}), request("/user/f", http.Header{"Cookie": {"lang=de"}}), false},
+		{"same cookie", request("/user/g", http.Header{"Cookie": {"lang=en; id=1"}}), request("/user/g", http.Header{"Cookie": {"lang=en; id=2"}}), true},
+		{"principal", request("/user/h", http.Header{"Authorization": {"alice"}}), request("/user/h", http.Header{"Authorization": {"bob"}}), false},
+		{"same principal", request("/user/i", http.Header{"Authorization": {"alice"}}), request("/user/i", http.Header{"Authorization": {"alice"}}), true},
+		{"rule max size", request("/small", nil), request("/small", nil), false},
+	}
+
+	for _, tt := range tests {
+		set(tt.stored)
+		if _, ok := c.Get(tt.lookup); ok != tt.expected {
+			t.Errorf("%s: expected hit %t, got %t", tt.name, tt.expected, ok)
+		}
+	}
+}
+
+func TestRevalidation(t *testing.T) {
+	c := New(Config{TTL: time.Minute})
+	modified := time.Now().Add(-time.Hour).UTC().Format(http.TimeFormat)
+
+	resp := createTestResponse(200, "test data")
+	resp.Header.Set("Cache-Control", "no-cache")
+	resp.Header.Set("ETag", `"v1"`)
+	resp.Header.Set("Last-Modified", modified)
+	resp.Header.Set("X-Version", "1")
+	if err := c.Set(httptest.NewRequest("GET", "/test", nil), resp); err != nil {
+		t.Fatalf("failed to set cache: %v", err)
+	}
+
+	// A stale response with validators is kept but not served
+	req := httptest.NewRequest("GET", "/test", nil)
+	if _, ok := c.Get(req); ok {
+		t.Fatal("Expected a no-cache response to need revalidation")
+	}
+	conditional := c.Conditional(req)
+	if conditional.Header.Get("If-None-Match") != `"v1"` || conditional.Header.Get("If-Modified-Since") != modified {
+		t.Fatalf("Expected the stored validators, got %v", conditional.Header)
+	}
+	if c.Conditional(httptest.NewRequest("GET", "/other", nil)).Header.Get("If-None-Match") != "" {
+		t.Error("Expected no validators without a stored response")
+	}
+
+	// A 304 for another representation doesn't apply
+	other := createTestResponse(http.StatusNotModified, "")
+	other.Header.Set("ETag", `"v0"`)
+	if _, ok := c.Refresh(req, other); ok {
+		t.Error("Expected a 304 with another ETag not to refresh the response")
+	}
+
+	notModified := createTestResponse(http.StatusNotModified, "")
+	notModified.Header.Set("ETag", `"v1"`)
+	notModified.Header.Set("Cache-Control", "max-age=60")
+	notModified.Header.Set("X-Version", "2")
+	refreshed, ok := c.Refresh(req, notModified)
+	if !ok {
+		t.Fatal("Expected the 304 to refresh the response")
+	}
+	body, _ := io.ReadAll(refreshed.Body)
+	if refreshed.StatusCode != 200 || string(body) != "test data" || refreshed.Header.Get("X-Version") != "2" {
+		t.Errorf("Expected the stored body with merged headers, got %d %q %v", refreshed.StatusCode, body, refreshed.Header)
+	}
+
+	// Now fresh again, and answering the client's own validators
+	tests := []struct {
+		header   http.Header
+		expected int
+	}{
+		{nil, 200},
+		{http.Header{"If-None-Match": {`"v0", W/"v1"`}}, 304},
+		{http.Header{"If-None-Match": {"*"}}, 304},
+		{http.Header{"If-None-Match": {`"v0"`}, "If-Modified-Since": {modified}}, 200},
+		{http.Header{"If-Modified-Since": {modified}}, 304},
+		{http.Header{"If-Modified-Since": {time.Now().Add(-2 * time.Hour).UTC().Format(http.TimeFormat)}}, 200},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest("GET", "/test", nil)
+		for k, v := range tt.header {
+			req.Header[k] = v
+		}
+		cached, ok := c.Get(req)
+		if !ok {
+			t.Fatalf("%v: expected a hit", tt.header)
+		}
+		if cached.StatusCode != tt.expected {
+			t.Errorf("%v: expected %d, got %d", tt.header, tt.expected, cached.StatusCode)
+		}
+		if cached.StatusCode == 304 && cached.Header.Get("ETag") != `"v1"` {
+			t.Errorf("Expected the ETag on a 304, got %v", cached.Header)
+		}
+	}
+}
+
+func TestStaleWindows(t *testing.T) {
+	c := New(Config{
+		TTL:   time.Minute,
+		Rules: []Rule{{Path: "/rule/*", StaleWhileRevalidate: 30 * time.Second, StaleIfError: time.Minute}},
+	})
+
+	// Each response is stored 5s past its lifetime
+	set := func(path, cacheControl string) {
+		resp := createTestResponse(200, "test data")
+		resp.Header.Set("Cache-Control", cacheControl)
+		resp.Header.Set("Age", "15")
+		if err := c.Set(httptest.NewRequest("GET", path, nil), resp); err != nil {
+			t.Fatalf("failed to set cache: %v", err)
+		}
+	}
+	set("/swr", "max-age=10, stale-while-revalidate=30")
+	set("/short", "max-age=10, stale-while-revalidate=2, stale-if-error=2")
+	set("/sie", "max-age=10, stale-if-error=60")
+	set("/strict", "max-age=10, must-revalidate, stale-while-revalidate=30, stale-if-error=60")
+	set("/rule/a", "max-age=10")
+	set("/rule/b", "max-age=10, stale-while-revalidate=0")
+
+	tests := []struct {
+		path         string
+		cacheControl string
+		swr, sie     bool
+	}{
+		{"/swr", "", true, false},
+		{"/short", "", false, false},
+		{"/sie", "", false, true},
+		{"/strict", "", false, false},
+		{"/rule/a", "", true, true},
+		{"/rule/b", "", false, true},
+		{"/swr", "max-age=60", false, false},
+		{"/sie", "no-cache", false, false},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest("GET", tt.path, nil)
+		if tt.cacheControl != "" {
+			req.Header.Set("Cache-Control", tt.cacheControl)
+		}
+		if _, ok := c.Get(req); ok {
+			t.Errorf("%s: expected a stale response not to be a hit", tt.path)
+		}
+		if _, ok := c.StaleWhileRevalidate(req); ok != tt.swr {
+			t.Errorf("%s %q: expected stale-while-revalidate %t, got %t", tt.path, tt.cacheControl, tt.swr, ok)
+		}
+		if _, ok := c.StaleIfError(req); ok != tt.sie {
+			t.Errorf("%s %q: expected stale-if-error %t, got %t", tt.path, tt.cacheControl, tt.sie, ok)
+		}
+	}
+}
+
+func TestFill(t *testing.T) {
+	c := New(Config{TTL: time.Minute})
+	req := httptest.NewRequest("GET", "/test", nil)
+
+	done := c.Fill(req)
+	if done == nil {
+		t.Fatal("Expected the first request to fetch the response")
+	}
+	if c.TryFill(req) != nil {
+		t.Error("Expected TryFill to back off while a fetch is under way")
+	}
+	if c.Fill(httptest.NewRequest("GET", "/other", nil)) == nil {
+		t.Error("Expected another response to be fetched independently")
+	}
+	noStore := httptest.NewRequest("GET", "/test", nil)
+	noStore.Header.Set("Cache-Control", "no-store")
+	if c.Fill(noStore) == nil {
+		t.Error("Expected a no-store request not to wait")
+	}
+	if c.Fill(httptest.NewRequest("POST", "/test", nil)) == nil {
+		t.Error("Expected a POST not to wait")
+	}
+	authorized := httptest.NewRequest("GET", "/test", nil)
+	authorized.Header.Set("Authorization", "Bearer token")
+	if c.Fill(authorized) == nil {
+		t.Error("Expected an authorized request not to wait without the principal in the key")
+	}
+
+	var wg sync.WaitGroup
+	var waited atomic.Int64
+	for i := 0; i < 5; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if c.Fill(req) == nil {
+				waited.Add(1)
+			}
+		}()
+	}
+
+	time.Sleep(50 * time.Millisecond)
+	if got := waited.Load(); got != 0 {
+		t.Fatalf("Expected requests to wait for the fetch, %d returned early", got)
+	}
+	done()
+	done()
+	wg.Wait()
+	if got := waited.Load(); got != 5 {
+		t.Errorf("Expected 5 requests to have waited, got %d", got)
+	}
+
+	if again := c.Fill(req); again == nil {
+		t.Error("Expected a new fetch once the last one is done")
+	}
+}
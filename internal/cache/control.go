@@ -0,0 +1,204 @@
+package cache
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// heuristicFraction is the share of the time since Last-Modified that a
+// response without an explicit lifetime is considered fresh for
+const heuristicFraction = 10
+
+// heuristicStatuses may be cached without explicit freshness information
+// (RFC 9110 section 15.1). 206 is left out since ranges aren't cached.
+var heuristicStatuses = map[int]bool{
+	http.StatusOK:                   true,
+	http.StatusNonAuthoritativeInfo: true,
+	http.StatusNoContent:            true,
+	http.StatusMultipleChoices:      true,
+	http.StatusMovedPermanently:     true,
+	http.StatusPermanentRedirect:    true,
+	http.StatusNotFound:             true,
+	http.StatusMethodNotAllowed:     true,
+	http.StatusGone:                 true,
+	http.StatusRequestURITooLong:    true,
+	http.StatusNotImplemented:       true,
+}
+
+// directives holds the directives of a Cache-Control header by lower-cased
+// name. Directives without an argument map to "".
+type directives map[string]string
+
+func parseCacheControl(header http.Header) directives {
+	d := make(directives)
+	for _, line := range header.Values("Cache-Control") {
+		for len(line) > 0 {
+			var part string
+			part, line = nextDirective(line)
+			name, value, _ := strings.Cut(part, "=")
+			name = strings.ToLower(strings.TrimSpace(name))
+			if name == "" {
+				continue
+			}
+			value = strings.TrimSpace(value)
+			if len(value) >= 2 && value[0] == '"' && value[len(value)-1] == '"' {
+				value = value[1 : len(value)-1]
+			}
+			// The first occurrence of a repeated directive wins
+			if _, ok := d[name]; !ok {
+				d[name] = value
+			}
+		}
+	}
+	return d
+}
+
+// nextDirective splits s at the first comma outside a quoted string
+func nextDirective(s string) (string, string) {
+	quoted := false
+	for i := 0; i < len(s); i++ {
+		switch s[i] {
+		case '"':
+			quoted = !quoted
+		case '\\':
+			if quoted {
+				i++
+			}
+		case ',':
+			if !quoted {
+				return s[:i], s[i+1:]
+			}
+		}
+	}
+	return s, ""
+}
+
+// requestDirectives parses a request's Cache-Control, falling back to
+// Pragma: no-cache for HTTP/1.0 clients
+func requestDirectives(r *http.Request) directives {
+	d := parseCacheControl(r.Header)
+	if len(d) == 0 && strings.Contains(strings.ToLower(r.Header.Get("Pragma")), "no-cache") {
+		d["no-cache"] = ""
+	}
+	return d
+}
+
+func (d directives) has(name string) bool {
+	_, ok := d[name]
+	return ok
+}
+
+// seconds returns a delta-seconds argument. Values too large to represent
+// are capped rather than rejected (RFC 9111 section 1.2.2).
+func (d directives) seconds(name string) (time.Duration, bool) {
+	value, ok := d[name]
+	if !ok {
+		return 0, false
+	}
+	return parseSeconds(value)
+}
+
+func parseSeconds(value string) (time.Duration, bool) {
+	if value == "" || strings.Trim(value, "0123456789") != "" {
+		return 0, false
+	}
+	n, err := strconv.ParseInt(value, 10, 64)
+	if err != nil || n > int64(1<<31) {
+		n = 1 << 31
+	}
+	return time.Duration(n) * time.Second, true
+}
+
+// Cacheable reports whether a shared cache may store resp as the answer
+// to r (RFC 9111 section 3)
+func Cacheable(r *http.Request, resp *http.Response) bool {
+	if r.Method != http.MethodGet {
+		return false
+	}
+
+	req := requestDirectives(r)
+	res := parseCacheControl(resp.Header)
+
+	if req.has("no-store") || res.has("no-store") || res.has("private") {
+		return false
+	}
+	// no-cache responses need revalidation on every use, so are only kept
+	// when they can be revalidated
+	if res.has("no-cache") && !hasValidators(resp.Header) {
+		return false
+	}
+	if strings.Contains(resp.Header.Get("Vary"), "*") {
+		return false
+	}
+
+	// Responses to authenticated requests are only shared when the
+	// origin says so (RFC 9111 section 3.5)
+	if r.Header.Get("Authorization") != "" &&
+		!res.has("public") && !res.has("s-maxage") && !res.has("must-revalidate") {
+		return false
+	}
+
+	if heuristicStatuses[resp.StatusCode] {
+		return true
+	}
+	if resp.StatusCode < 200 || resp.StatusCode == http.StatusPartialContent || resp.StatusCode == http.StatusNotModified {
+		return false
+	}
+	return res.has("public") || res.has("s-maxage") || res.has("max-age") || resp.Header.Get("Expires") != ""
+}
+
+// OnlyIfCached reports whether r must be answered from the cache or not at
+// all
+func OnlyIfCached(r *http.Request) bool {
+	return requestDirectives(r).has("only-if-cached")
+}
+
+// freshnessLifetime is how long resp stays fresh after it was generated
+// (RFC 9111 section 4.2.1). Responses without explicit freshness get a
+// tenth of the time since they were last modified, at most fallback, or
+// fallback when that isn't known either.
+func freshnessLifetime(resp *http.Response, res directives, now time.Time, fallback time.Duration) time.Duration {
+	if lifetime, ok := res.seconds("s-maxage"); ok {
+		return lifetime
+	}
+	if lifetime, ok := res.seconds("max-age"); ok {
+		return lifetime
+	}
+	if value := resp.Header.Get("Expires"); value != "" {
+		// An invalid date, such as "0", means already expired
+		expires, err := http.ParseTime(value)
+		if err != nil {
+			return 0
+		}
+		return max(expires.Sub(responseDate(resp, now)), 0)
+	}
+
+	if modified, err := http.ParseTime(resp.Header.Get("Last-Modified")); err == nil {
+		lifetime := max(responseDate(resp, now).Sub(modified)/heuristicFraction, 0)
+		if fallback > 0 && lifetime > fallback {
+			lifetime = fallback
+		}
+		return lifetime
+	}
+	return fallback
+}
+
+// initialAge is how old resp already was when the cache received it
+// (RFC 9111 section 4.2.3)
+func initialAge(resp *http.Response, now time.Time) time.Duration {
+	apparent := max(now.Sub(responseDate(resp, now)), 0)
+	if age, ok := parseSeconds(strings.TrimSpace(resp.Header.Get("Age"))); ok && age > apparent {
+		return age
+	}
+	return apparent
+}
+
+// responseDate is the origin's Date, or now if it sent none
+func responseDate(resp *http.Response, now time.Time) time.Time {
+	if date, err := http.ParseTime(resp.Header.Get("Date")); err == nil {
+		return date
+	}
+	return now
+}
@@ -0,0 +1,243 @@
+package cache
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DiskStore keeps each entry in a file named by the hash of its key, in a
+// directory named by the hash's first byte. The index of entries is
+// rebuilt from the files when the store is opened, so entries survive
+// restarts. With a maximum size, the least recently used entries make room
+// for new ones.
+type DiskStore struct {
+	dir     string
+	maxSize int64
+
+	mu    sync.Mutex
+	index map[string]*diskEntry // by file name
+	size  int64
+}
+
+type diskEntry struct {
+	size     int64
+	expires  time.Time
+	lastUsed time.Time
+}
+
+// NewDiskStore opens the store in dir, creating it if needed, keeping up
+// to maxSize bytes of files, or any amount if maxSize is 0
+func NewDiskStore(dir string, maxSize int64) (*DiskStore, error) {
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return nil, fmt.Errorf("failed to create cache directory: %w", err)
+	}
+	s := &DiskStore{dir: dir, maxSize: maxSize, index: make(map[string]*diskEntry)}
+	if err := s.load(); err != nil {
+		return nil, fmt.Errorf("failed to load cache directory: %w", err)
+	}
+	return s, nil
+}
+
+// load indexes the entries on disk, removing those that expired or can't
+// be read and files left over from interrupted writes
+func (s *DiskStore) load() error {
+	now := time.Now()
+	err := filepath.WalkDir(s.dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+		name := d.Name()
+		if strings.HasSuffix(name, ".tmp") {
+			os.Remove(path)
+			return nil
+		}
+		if filepath.Dir(path) != s.shard(name) {
+			return nil
+		}
+
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		expires, err := readExpires(path)
+		if err != nil || !now.Before(expires) {
+			os.Remove(path)
+			return nil
+		}
+		s.index[name] = &diskEntry{size: info.Size(), expires: expires, lastUsed: info.ModTime()}
+		s.size += info.Size()
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.evict("")
+	return nil
+}
+
+func readExpires(path string) (time.Time, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return time.Time{}, err
+	}
+	defer f.Close()
+
+	rec, err := readRecord(f)
+	if err != nil {
+		return time.Time{}, err
+	}
+	return rec.Expires, nil
+}
+
+// shard is the directory holding the file with the given name
+func (s *DiskStore) shard(name string) string {
+	if len(name) != 64 {
+		return ""
+	}
+	return filepath.Join(s.dir, name[:2])
+}
+
+func (s *DiskStore) path(name string) string {
+	return filepath.Join(s.shard(name), name)
+}
+
+func (s *DiskStore) Get(_ context.Context, key string) (*Entry, error) {
+	name := hashKey(key)
+
+	s.mu.Lock()
+	entry, ok := s.index[name]
+	if ok {
+		entry.lastUsed = time.Now()
+	}
+	s.mu.Unlock()
+	if !ok {
+		return nil, ErrNotFound
+	}
+
+	data, err := os.ReadFile(s.path(name))
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return decodeEntry(key, data)
+}
+
+func (s *DiskStore) Set(_ context.Context, key string, entry *Entry) error {
+	data, err := encodeEntry(key, entry)
+	if err != nil {
+		return err
+	}
+	size := int64(len(data))
+	if s.maxSize > 0 && size > s.maxSize {
+		return fmt.Errorf("cache full: cannot store item of size %d", size)
+	}
+
+	// Entries are written aside and renamed into place, so readers never
+	// see one half written
+	name := hashKey(key)
+	shard := s.shard(name)
+	if err := os.MkdirAll(shard, 0o700); err != nil {
+		return err
+	}
+	f, err := os.CreateTemp(shard, name+".*.tmp")
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(data)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := os.Rename(f.Name(), s.path(name)); err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+	if previous, ok := s.index[name]; ok {
+		s.size -= previous.size
+	}
+	s.index[name] = &diskEntry{size: size, expires: entry.Expires, lastUsed: time.Now()}
+	s.size += size
+	s.evict(name)
+	return nil
+}
+
+func (s *DiskStore) Delete(_ context.Context, key string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.remove(hashKey(key))
+}
+
+func (s *DiskStore) Close() error {
+	return nil
+}
+
+func (s *DiskStore) sweep(now time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for name, entry := range s.index {
+		if now.After(entry.expires) {
+			s.remove(name)
+		}
+	}
+}
+
+// evict removes the least recently used entries until the store fits its
+// maximum size, sparing the one just stored
+func (s *DiskStore) evict(stored string) {
+	if s.maxSize <= 0 || s.size <= s.maxSize {
+		return
+	}
+
+	names := make([]string, 0, len(s.index))
+	for name := range s.index {
+		names = append(names, name)
+	}
+	sort.Slice(names, func(i, j int) bool {
+		return s.index[names[i]].lastUsed.Before(s.index[names[j]].lastUsed)
+	})
+	for _, name := range names {
+		if s.size <= s.maxSize {
+			break
+		}
+		if name != stored {
+			s.remove(name)
+		}
+	}
+}
+
+// remove deletes an entry's file and drops it from the index. The caller
+// holds s.mu.
+func (s *DiskStore) remove(name string) error {
+	entry, ok := s.index[name]
+	if !ok {
+		return nil
+	}
+	delete(s.index, name)
+	s.size -= entry.size
+
+	if err := os.Remove(s.path(name)); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,169 @@
+package cache
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"net/url"
+	"slices"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Rule applies to requests whose path matches Path, where a trailing "*"
+// matches any suffix, and whose method is in Methods (any if empty).
+// TTL, if set, replaces Config.TTL and MaxSize bounds each stored body.
+// StaleWhileRevalidate and StaleIfError apply to responses that don't
+// set those directives themselves.
+type Rule struct {
+	Path                 string
+	Methods              []string
+	TTL                  time.Duration
+	MaxSize              int64
+	StaleWhileRevalidate time.Duration
+	StaleIfError         time.Duration
+	Key                  KeyConfig
+}
+
+// KeyConfig says what identifies a cached response besides its method and
+// path. The host and query are included unless IgnoreHost is set or
+// Query lists the parameters to keep, all being kept if it's empty, and
+// IgnoreQuery those to drop. Kept parameters are sorted. The values of
+// Headers and Cookies are added, and with Principal set so is whoever
+// Config.Principal says made the request.
+type KeyConfig struct {
+	IgnoreHost  bool
+	Query       []string
+	IgnoreQuery []string
+	Headers     []string
+	Cookies     []string
+	Principal   bool
+}
+
+func (rule *Rule) matches(r *http.Request) bool {
+	if len(rule.Methods) > 0 && !slices.Contains(rule.Methods, r.Method) {
+		return false
+	}
+	if prefix, ok := strings.CutSuffix(rule.Path, "*"); ok {
+		return strings.HasPrefix(r.URL.Path, prefix)
+	}
+	return r.URL.Path == rule.Path
+}
+
+// rule returns the first rule matching r, or nil
+func (c *Cache) rule(r *http.Request) *Rule {
+	for i := range c.rules {
+		if c.rules[i].matches(r) {
+			return &c.rules[i]
+		}
+	}
+	return nil
+}
+
+// primaryKey identifies the responses to r, before their Vary headers are
+// taken into account
+func (c *Cache) primaryKey(r *http.Request, rule *Rule) string {
+	var key KeyConfig
+	if rule != nil {
+		key = rule.Key
+	}
+
+	var b strings.Builder
+	b.WriteString(r.Method)
+	b.WriteByte(' ')
+	// Absolute-form requests, as forward-proxy clients send, are keyed by
+	// scheme as well, apart from origin-form requests for the same host
+	if r.URL.IsAbs() {
+		b.WriteString(r.URL.Scheme)
+		b.WriteString("://")
+	}
+	if !key.IgnoreHost {
+		b.WriteString(strings.ToLower(requestHost(r)))
+	}
+	b.WriteString(r.URL.EscapedPath())
+	if query := normalizeQuery(r.URL.Query(), key); query != "" {
+		b.WriteByte('?')
+		b.WriteString(query)
+	}
+
+	for _, name := range key.Headers {
+		b.WriteString("\nheader:")
+		b.WriteString(strings.ToLower(name))
+		b.WriteByte('=')
+		b.WriteString(headerValue(r.Header, name))
+	}
+	for _, name := range key.Cookies {
+		b.WriteString("\ncookie:")
+		b.WriteString(name)
+		b.WriteByte('=')
+		if cookie, err := r.Cookie(name); err == nil {
+			b.WriteString(cookie.Value)
+		}
+	}
+	if key.Principal && c.principal != nil {
+		// Credentials aren't kept in the clear
+		sum := sha256.Sum256([]byte(c.principal(r)))
+		b.WriteString("\nprincipal=")
+		b.WriteString(hex.EncodeToString(sum[:]))
+	}
+	return b.String()
+}
+
+// variantKey extends a primary key with the request's values of the
+// headers named by a response's Vary (RFC 9111 section 4.1)
+func variantKey(primary string, r *http.Request, vary []string) string {
+	var b strings.Builder
+	b.WriteString(primary)
+	for _, name := range vary {
+		b.WriteString("\nvary:")
+		b.WriteString(name)
+		b.WriteByte('=')
+		b.WriteString(headerValue(r.Header, name))
+	}
+	return b.String()
+}
+
+// varyHeaders returns the sorted, lower-cased header names listed in
+// resp's Vary
+func varyHeaders(resp *http.Response) []string {
+	var names []string
+	for _, value := range resp.Header.Values("Vary") {
+		for _, name := range strings.Split(value, ",") {
+			if name = strings.ToLower(strings.TrimSpace(name)); name != "" && !slices.Contains(names, name) {
+				names = append(names, name)
+			}
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+// headerValue joins a header's values, ignoring whitespace around commas
+// so that equivalent lists match
+func headerValue(header http.Header, name string) string {
+	var parts []string
+	for _, value := range header.Values(name) {
+		for _, part := range strings.Split(value, ",") {
+			parts = append(parts, strings.TrimSpace(part))
+		}
+	}
+	return strings.Join(parts, ",")
+}
+
+func normalizeQuery(query url.Values, key KeyConfig) string {
+	for name := range query {
+		if len(key.Query) > 0 && !slices.Contains(key.Query, name) || slices.Contains(key.IgnoreQuery, name) {
+			delete(query, name)
+		}
+	}
+	// Encode sorts by name; values keep their order, which can matter
+	return query.Encode()
+}
+
+func requestHost(r *http.Request) string {
+	if r.Host != "" {
+		return r.Host
+	}
+	return r.URL.Host
+}
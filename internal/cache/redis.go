@@ -0,0 +1,53 @@
+package cache
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+// RedisStore keeps entries in Redis, where replicas can share them. Keys
+// are the hash of the entry's key after prefix, and Redis expires them
+// with their entries. Their total size is bounded by Redis's own
+// maxmemory policy.
+type RedisStore struct {
+	client redis.UniversalClient
+	prefix string
+}
+
+func NewRedisStore(client redis.UniversalClient, prefix string) *RedisStore {
+	return &RedisStore{client: client, prefix: prefix}
+}
+
+func (s *RedisStore) Get(ctx context.Context, key string) (*Entry, error) {
+	data, err := s.client.Get(ctx, s.prefix+hashKey(key)).Bytes()
+	if errors.Is(err, redis.Nil) {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return decodeEntry(key, data)
+}
+
+func (s *RedisStore) Set(ctx context.Context, key string, entry *Entry) error {
+	ttl := time.Until(entry.Expires)
+	if ttl <= 0 {
+		return s.Delete(ctx, key)
+	}
+	data, err := encodeEntry(key, entry)
+	if err != nil {
+		return err
+	}
+	return s.client.Set(ctx, s.prefix+hashKey(key), data, ttl).Err()
+}
+
+func (s *RedisStore) Delete(ctx context.Context, key string) error {
+	return s.client.Del(ctx, s.prefix+hashKey(key)).Err()
+}
+
+func (s *RedisStore) Close() error {
+	return s.client.Close()
+}
@@ -0,0 +1,223 @@
+package cache
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http/httptest"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+// fakeRedis speaks enough of the Redis protocol for RedisStore: GET, SET
+// with EX or PX, DEL and PING
+type fakeRedis struct {
+	listener net.Listener
+
+	mu      sync.Mutex
+	values  map[string]string
+	expires map[string]time.Time
+}
+
+func newFakeRedis(t *testing.T) *fakeRedis {
+	t.Helper()
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	f := &fakeRedis{listener: listener, values: make(map[string]string), expires: make(map[string]time.Time)}
+	t.Cleanup(func() { listener.Close() })
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go f.serve(conn)
+		}
+	}()
+	return f
+}
+
+func (f *fakeRedis) serve(conn net.Conn) {
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	for {
+		args, err := readCommand(r)
+		if err != nil {
+			return
+		}
+		conn.Write([]byte(f.execute(args)))
+	}
+}
+
+// readCommand reads an array of bulk strings
+func readCommand(r *bufio.Reader) ([]string, error) {
+	line, err := r.ReadString('\n')
+	if err != nil || !strings.HasPrefix(line, "*") {
+		return nil, fmt.Errorf("invalid command %q: %v", line, err)
+	}
+	n, _ := strconv.Atoi(strings.TrimSpace(line[1:]))
+	args := make([]string, n)
+	for i := range args {
+		line, err := r.ReadString('\n')
+		if err != nil || !strings.HasPrefix(line, "$") {
+			return nil, fmt.Errorf("invalid argument %q: %v", line, err)
+		}
+		size, _ := strconv.Atoi(strings.TrimSpace(line[1:]))
+		arg := make([]byte, size+2)
+		if _, err := io.ReadFull(r, arg); err != nil {
+			return nil, err
+		}
+		args[i] = string(arg[:size])
+	}
+	return args, nil
+}
+
+func (f *fakeRedis) execute(args []string) string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	switch strings.ToUpper(args[0]) {
+	case "PING":
+		return "+PONG\r\n"
+	case "GET":
+		value, ok := f.values[args[1]]
+		if !ok || !time.Now().Before(f.expires[args[1]]) {
+			return "$-1\r\n"
+		}
+		return fmt.Sprintf("$%d\r\n%s\r\n", len(value), value)
+	case "SET":
+		ttl := 24 * time.Hour
+		if len(args) == 5 {
+			n, _ := strconv.Atoi(args[4])
+			switch strings.ToUpper(args[3]) {
+			case "EX":
+				ttl = time.Duration(n) * time.Second
+			case "PX":
+				ttl = time.Duration(n) * time.Millisecond
+			}
+		}
+		f.values[args[1]] = args[2]
+		f.expires[args[1]] = time.Now().Add(ttl)
+		return "+OK\r\n"
+	case "DEL":
+		deleted := 0
+		for _, key := range args[1:] {
+			if _, ok := f.values[key]; ok {
+				delete(f.values, key)
+				deleted++
+			}
+		}
+		return fmt.Sprintf(":%d\r\n", deleted)
+	}
+	return fmt.Sprintf("-ERR unknown command '%s'\r\n", args[0])
+}
+
+// ttl returns how long the fake keeps key, or 0 if it doesn't hold it
+func (f *fakeRedis) ttl(key string) time.Duration {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if _, ok := f.values[key]; !ok {
+		return 0
+	}
+	return time.Until(f.expires[key])
+}
+
+// redisClient connects to REDIS_TEST_ADDR if it's set, and otherwise to a
+// fake, which is also returned
+func redisClient(t *testing.T) (*redis.Client, *fakeRedis) {
+	t.Helper()
+
+	addr := os.Getenv("REDIS_TEST_ADDR")
+	var fake *fakeRedis
+	if addr == "" {
+		fake = newFakeRedis(t)
+		addr = fake.listener.Addr().String()
+	}
+	client := redis.NewClient(&redis.Options{Addr: addr})
+	t.Cleanup(func() { client.Close() })
+	return client, fake
+}
+
+func TestRedisStore(t *testing.T) {
+	client, fake := redisClient(t)
+	prefix := fmt.Sprintf("test:%d:", time.Now().UnixNano())
+	store := NewRedisStore(client, prefix)
+	testStore(t, store)
+
+	// Redis expires entries with the store
+	entry := &Entry{Status: 200, Body: []byte("hello"), Expires: time.Now().Add(90 * time.Second)}
+	if err := store.Set(context.Background(), "expiring", entry); err != nil {
+		t.Fatalf("Failed to set entry: %v", err)
+	}
+	ttl, err := client.PTTL(context.Background(), prefix+hashKey("expiring")).Result()
+	if fake != nil {
+		ttl, err = fake.ttl(prefix+hashKey("expiring")), nil
+	}
+	if err != nil || ttl < 80*time.Second || ttl > 90*time.Second {
+		t.Errorf("Expected a TTL of about 90s, got %v, %v", ttl, err)
+	}
+}
+
+func TestCacheSharedStore(t *testing.T) {
+	client, _ := redisClient(t)
+	prefix := fmt.Sprintf("test:%d:", time.Now().UnixNano())
+
+	// Two replicas, each with a local tier in front of the shared one
+	replica := func() *Cache {
+		return New(Config{TTL: time.Minute, Store: NewTieredStore(NewMemoryStore(0), NewRedisStore(client, prefix), 50*time.Millisecond)})
+	}
+	first, second := replica(), replica()
+
+	req := httptest.NewRequest("GET", "/shared", nil)
+	resp := createTestResponse(200, "shared")
+	resp.Header.Set("ETag", `"v1"`)
+	if err := first.Set(req, resp); err != nil {
+		t.Fatalf("Failed to set cache: %v", err)
+	}
+
+	cached, ok := second.Get(req)
+	if !ok {
+		t.Fatal("Expected the other replica to hit")
+	}
+	if body, _ := io.ReadAll(cached.Body); string(body) != "shared" || cached.Header.Get("ETag") != `"v1"` {
+		t.Errorf("Expected the stored response, got %q with %v", body, cached.Header)
+	}
+	if _, err := second.store.(*TieredStore).local.Get(req.Context(), second.primaryKey(req, nil)); err != nil {
+		t.Errorf("Expected the entry to be kept locally, got %v", err)
+	}
+
+	// An update from one replica reaches the other once its local copy is
+	// past the local TTL
+	updated := createTestResponse(200, "updated")
+	updated.Header.Set("ETag", `"v2"`)
+	if err := first.Set(req, updated); err != nil {
+		t.Fatalf("Failed to set cache: %v", err)
+	}
+	time.Sleep(60 * time.Millisecond)
+	cached, ok = second.Get(req)
+	if !ok {
+		t.Fatal("Expected the other replica to hit")
+	}
+	if cached.Header.Get("ETag") != `"v2"` {
+		t.Errorf("Expected the updated response, got %v", cached.Header)
+	}
+
+	// An unreachable store is a miss rather than an error
+	broken := New(Config{Store: NewRedisStore(redis.NewClient(&redis.Options{Addr: "127.0.0.1:1", MaxRetries: -1}), prefix)})
+	defer broken.Close()
+	if _, ok := broken.Get(req); ok {
+		t.Error("Expected a miss from an unreachable store")
+	}
+}
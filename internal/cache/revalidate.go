@@ -0,0 +1,136 @@
+package cache
+
+import (
+	"log"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// staleRetention is how long stale responses with validators are kept for
+// revalidation
+const staleRetention = time.Hour
+
+// notModifiedHeaders are the stored headers repeated in a 304 (RFC 9110
+// section 15.4.5)
+var notModifiedHeaders = []string{"Cache-Control", "Content-Location", "Date", "ETag", "Expires", "Last-Modified", "Vary"}
+
+func hasValidators(header http.Header) bool {
+	return header.Get("ETag") != "" || header.Get("Last-Modified") != ""
+}
+
+// Conditional returns the request to send upstream for r: a copy
+// revalidating the stored response with its validators if there is one
+// that can't be used as is, or else r itself
+func (c *Cache) Conditional(r *http.Request) *http.Request {
+	if requestDirectives(r).has("no-store") {
+		return r
+	}
+	_, entry, ok := c.lookup(r)
+	if !ok {
+		return r
+	}
+
+	etag := entry.Header.Get("ETag")
+	modified := entry.Header.Get("Last-Modified")
+	if etag == "" && modified == "" {
+		return r
+	}
+
+	// The client's own validators are checked against the refreshed
+	// response instead
+	out := r.Clone(r.Context())
+	out.Header.Del("If-None-Match")
+	out.Header.Del("If-Modified-Since")
+	if etag != "" {
+		out.Header.Set("If-None-Match", etag)
+	}
+	if modified != "" {
+		out.Header.Set("If-Modified-Since", modified)
+	}
+	return out
+}
+
+// Refresh handles a 304 answering a request made by Conditional. The
+// stored response it validates takes the 304's headers and freshness, and
+// is returned as the answer to r. It reports false if no stored response
+// matches resp.
+func (c *Cache) Refresh(r *http.Request, resp *http.Response) (*http.Response, bool) {
+	now := time.Now()
+	key, entry, ok := c.lookup(r)
+	if !ok || !validates(resp.Header, entry.Header) {
+		return nil, false
+	}
+
+	header := entry.Header.Clone()
+	for name, values := range resp.Header {
+		if name != "Content-Length" {
+			header[name] = values
+		}
+	}
+
+	refreshed := c.newEntry(c.rule(r), entry.Status, header, entry.Body, now)
+	if err := c.store.Set(r.Context(), key, refreshed); err != nil {
+		log.Printf("Failed to store refreshed cache entry: %v", err)
+	}
+
+	return refreshed.respond(r, refreshed.currentAge(now)), true
+}
+
+// validates reports whether a 304 with header applies to a stored
+// response (RFC 9111 section 4.3.4)
+func validates(header, stored http.Header) bool {
+	if etag := header.Get("ETag"); etag != "" {
+		return etag == stored.Get("ETag")
+	}
+	modified := header.Get("Last-Modified")
+	return modified == "" || modified == stored.Get("Last-Modified")
+}
+
+// notModified evaluates r's If-None-Match, or else its If-Modified-Since,
+// against a stored response (RFC 9110 section 13.2.2)
+func notModified(r *http.Request, header http.Header) bool {
+	if values := r.Header.Values("If-None-Match"); len(values) > 0 {
+		etag := header.Get("ETag")
+		for _, value := range values {
+			for _, tag := range strings.Split(value, ",") {
+				tag = strings.TrimSpace(tag)
+				if tag == "*" || etag != "" && weakMatch(tag, etag) {
+					return true
+				}
+			}
+		}
+		return false
+	}
+
+	since, err := http.ParseTime(r.Header.Get("If-Modified-Since"))
+	if err != nil {
+		return false
+	}
+	modified, err := http.ParseTime(header.Get("Last-Modified"))
+	return err == nil && !modified.After(since)
+}
+
+// weakMatch compares entity tags ignoring their weakness
+func weakMatch(a, b string) bool {
+	return strings.TrimPrefix(a, "W/") == strings.TrimPrefix(b, "W/")
+}
+
+func notModifiedResponse(resp *http.Response) *http.Response {
+	out := &http.Response{
+		Status:     "304 Not Modified",
+		StatusCode: http.StatusNotModified,
+		Proto:      resp.Proto,
+		ProtoMajor: resp.ProtoMajor,
+		ProtoMinor: resp.ProtoMinor,
+		Header:     make(http.Header),
+		Body:       http.NoBody,
+		Request:    resp.Request,
+	}
+	for _, name := range notModifiedHeaders {
+		if values := resp.Header.Values(name); len(values) > 0 {
+			out.Header[http.CanonicalHeaderKey(name)] = values
+		}
+	}
+	return out
+}
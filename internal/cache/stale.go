@@ -0,0 +1,112 @@
+package cache
+
+import (
+	"net/http"
+	"sync"
+	"time"
+)
+
+// coalesceTimeout bounds how long a request waits for another one
+// fetching the same response before fetching it itself
+const coalesceTimeout = 5 * time.Second
+
+// StaleWhileRevalidate returns r's stored response if it's stale but may
+// be served while it's refreshed in the background
+func (c *Cache) StaleWhileRevalidate(r *http.Request) (*http.Response, bool) {
+	return c.stale(r, func(entry *Entry) time.Duration { return entry.StaleWhileRevalidate })
+}
+
+// StaleIfError returns r's stored response if it's stale but may be
+// served because the origin couldn't be reached or failed
+func (c *Cache) StaleIfError(r *http.Request) (*http.Response, bool) {
+	return c.stale(r, func(entry *Entry) time.Duration { return entry.StaleIfError })
+}
+
+func (c *Cache) stale(r *http.Request, window func(*Entry) time.Duration) (*http.Response, bool) {
+	// Clients asking for a fresh response don't get a stale one
+	req := requestDirectives(r)
+	if req.has("no-store") || req.has("no-cache") || req.has("max-age") || req.has("min-fresh") {
+		return nil, false
+	}
+
+	_, entry, ok := c.lookup(r)
+	if !ok || entry.NoStale {
+		return nil, false
+	}
+
+	age := entry.currentAge(time.Now())
+	staleness := age - entry.Lifetime
+	if staleness < 0 || staleness > window(entry) {
+		return nil, false
+	}
+	return entry.respond(r, age), true
+}
+
+// Fill lets one request at a time fetch the response to r from the
+// origin. The first caller gets a function to call once the response has
+// been stored, or found not to be cacheable; calling it again does
+// nothing. Later callers wait for that, or for coalesceTimeout, and get
+// nil; they should look in the cache again before fetching the response
+// themselves. Requests whose responses can't be stored don't wait.
+func (c *Cache) Fill(r *http.Request) func() {
+	if !c.storable(r) {
+		return func() {}
+	}
+
+	key := c.primaryKey(r, c.rule(r))
+	done, flight := c.startFlight(key)
+	if done != nil {
+		return done
+	}
+
+	timer := time.NewTimer(coalesceTimeout)
+	defer timer.Stop()
+	select {
+	case <-flight:
+	case <-timer.C:
+	case <-r.Context().Done():
+	}
+	return nil
+}
+
+// TryFill is Fill without waiting: it returns nil at once if another
+// request is fetching the response to r, or if r isn't a GET
+func (c *Cache) TryFill(r *http.Request) func() {
+	if r.Method != http.MethodGet {
+		return nil
+	}
+	done, _ := c.startFlight(c.primaryKey(r, c.rule(r)))
+	return done
+}
+
+// storable reports whether the response to r might be stored for the
+// requests sharing its key. Only GETs are, and responses to authenticated
+// requests are shared only if the origin allows it, so those are worth
+// waiting for only when the key tells the principals apart.
+func (c *Cache) storable(r *http.Request) bool {
+	if r.Method != http.MethodGet || requestDirectives(r).has("no-store") {
+		return false
+	}
+	if r.Header.Get("Authorization") == "" {
+		return true
+	}
+	rule := c.rule(r)
+	return rule != nil && rule.Key.Principal && c.principal != nil
+}
+
+// startFlight registers a fetch of key, returning the function ending it,
+// or else the channel of the fetch already under way
+func (c *Cache) startFlight(key string) (func(), <-chan struct{}) {
+	ch := make(chan struct{})
+	if flight, loaded := c.flights.LoadOrStore(key, ch); loaded {
+		return nil, flight.(chan struct{})
+	}
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			c.flights.Delete(key)
+			close(ch)
+		})
+	}, nil
+}
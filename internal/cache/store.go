@@ -0,0 +1,326 @@
+package cache
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// ErrNotFound is returned by a Store that holds no entry for a key
+var ErrNotFound = errors.New("cache entry not found")
+
+// entryFormat versions the encoding of entries kept outside the process
+const entryFormat = 1
+
+// Store holds the cache's entries by key. Implementations must be safe for
+// concurrent use. They may drop entries at any time, and should drop them
+// once they're past their Expires. Entries returned by Get are shared and
+// must not be modified.
+type Store interface {
+	Get(ctx context.Context, key string) (*Entry, error)
+	Set(ctx context.Context, key string, entry *Entry) error
+	Delete(ctx context.Context, key string) error
+	Close() error
+}
+
+// sweeper is implemented by stores that need to be told to drop expired
+// entries
+type sweeper interface {
+	sweep(now time.Time)
+}
+
+// Entry is a stored response and what the cache knows about its
+// freshness. An entry under a primary key whose response had a Vary is a
+// marker holding only Vary and Expires.
+type Entry struct {
+	Status   int           `json:"status,omitempty"`
+	Header   http.Header   `json:"header,omitempty"`
+	Body     []byte        `json:"-"`
+	Stored   time.Time     `json:"stored"`
+	Age      time.Duration `json:"age"` // age when stored
+	Lifetime time.Duration `json:"lifetime"`
+	Expires  time.Time     `json:"expires"` // when it may be dropped
+	NoStale  bool          `json:"noStale,omitempty"`
+	Vary     []string      `json:"vary,omitempty"`
+
+	// How long past its lifetime it may be served while it's refreshed,
+	// or when the origin fails
+	StaleWhileRevalidate time.Duration `json:"staleWhileRevalidate,omitempty"`
+	StaleIfError         time.Duration `json:"staleIfError,omitempty"`
+
+	localUntil time.Time // when a TieredStore looks past its local copy
+}
+
+// record is what's encoded ahead of an entry's body. The key guards
+// against hash collisions in stores that address entries by hash.
+type record struct {
+	Key string `json:"key"`
+	*Entry
+}
+
+// encodeEntry serializes an entry as a format byte, the length of its
+// JSON metadata and headers, those, and then its body
+func encodeEntry(key string, entry *Entry) ([]byte, error) {
+	meta, err := json.Marshal(record{Key: key, Entry: entry})
+	if err != nil {
+		return nil, err
+	}
+	data := make([]byte, 5, 5+len(meta)+len(entry.Body))
+	data[0] = entryFormat
+	binary.BigEndian.PutUint32(data[1:5], uint32(len(meta)))
+	data = append(data, meta...)
+	return append(data, entry.Body...), nil
+}
+
+func decodeEntry(key string, data []byte) (*Entry, error) {
+	r := bytes.NewReader(data)
+	rec, err := readRecord(r)
+	if err != nil {
+		return nil, err
+	}
+	if rec.Key != key {
+		return nil, ErrNotFound
+	}
+	rec.Body = data[len(data)-r.Len():]
+	return rec.Entry, nil
+}
+
+// readRecord reads the metadata of an encoded entry, leaving r at its body
+func readRecord(r io.Reader) (*record, error) {
+	var prefix [5]byte
+	if _, err := io.ReadFull(r, prefix[:]); err != nil {
+		return nil, fmt.Errorf("invalid cache entry: %w", err)
+	}
+	if prefix[0] != entryFormat {
+		return nil, fmt.Errorf("invalid cache entry: unknown format %d", prefix[0])
+	}
+	meta := make([]byte, binary.BigEndian.Uint32(prefix[1:]))
+	if _, err := io.ReadFull(r, meta); err != nil {
+		return nil, fmt.Errorf("invalid cache entry: %w", err)
+	}
+	rec := &record{Entry: &Entry{}}
+	if err := json.Unmarshal(meta, rec); err != nil {
+		return nil, fmt.Errorf("invalid cache entry: %w", err)
+	}
+	return rec, nil
+}
+
+// hashKey names an entry in stores that don't take arbitrary keys
+func hashKey(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
+
+// MemoryStore keeps entries in process. With a maximum size, the entries
+// used least, and least recently, make room for new ones.
+type MemoryStore struct {
+	items   sync.Map // key -> *memoryItem
+	size    atomic.Int64
+	maxSize int64
+}
+
+type memoryItem struct {
+	entry    *Entry
+	size     int64
+	lastUsed atomic.Int64
+	hits     atomic.Int64
+}
+
+// NewMemoryStore returns a store keeping up to maxSize bytes of bodies, or
+// any amount if maxSize is 0
+func NewMemoryStore(maxSize int64) *MemoryStore {
+	return &MemoryStore{maxSize: maxSize}
+}
+
+func (s *MemoryStore) Get(_ context.Context, key string) (*Entry, error) {
+	value, ok := s.items.Load(key)
+	if !ok {
+		return nil, ErrNotFound
+	}
+	item := value.(*memoryItem)
+	item.hits.Add(1)
+	item.lastUsed.Store(time.Now().UnixNano())
+	return item.entry, nil
+}
+
+func (s *MemoryStore) Set(_ context.Context, key string, entry *Entry) error {
+	item := &memoryItem{entry: entry, size: int64(len(entry.Body))}
+	item.lastUsed.Store(time.Now().UnixNano())
+
+	// Check if adding this item would exceed max size
+	if s.maxSize > 0 && s.size.Load()+item.size > s.maxSize {
+		// Try to free up space
+		s.evict(item.size)
+
+		// Check again after eviction
+		if s.size.Load()+item.size > s.maxSize {
+			return fmt.Errorf("cache full: cannot store item of size %d", item.size)
+		}
+	}
+
+	if previous, loaded := s.items.Swap(key, item); loaded {
+		// A refreshed entry keeps its standing
+		previousItem := previous.(*memoryItem)
+		item.hits.Store(previousItem.hits.Load())
+		s.size.Add(-previousItem.size)
+	}
+	s.size.Add(item.size)
+	return nil
+}
+
+func (s *MemoryStore) Delete(_ context.Context, key string) error {
+	if item, loaded := s.items.LoadAndDelete(key); loaded {
+		s.size.Add(-item.(*memoryItem).size)
+	}
+	return nil
+}
+
+func (s *MemoryStore) Close() error {
+	return nil
+}
+
+func (s *MemoryStore) sweep(now time.Time) {
+	var keysToEvict []string
+
+	s.items.Range(func(key, value interface{}) bool {
+		if now.After(value.(*memoryItem).entry.Expires) {
+			keysToEvict = append(keysToEvict, key.(string))
+		}
+		return true
+	})
+
+	for _, key := range keysToEvict {
+		s.Delete(context.Background(), key)
+	}
+}
+
+func (s *MemoryStore) evict(needed int64) {
+	type evictionCandidate struct {
+		key   string
+		item  *memoryItem
+		score float64
+	}
+
+	var candidates []evictionCandidate
+
+	// Collect candidates
+	s.items.Range(func(key, value interface{}) bool {
+		item := value.(*memoryItem)
+		score := float64(time.Since(time.Unix(0, item.lastUsed.Load())).Seconds()) / float64(item.hits.Load()+1)
+		candidates = append(candidates, evictionCandidate{
+			key:   key.(string),
+			item:  item,
+			score: score,
+		})
+		return true
+	})
+
+	// Sort by score (higher score = better eviction candidate)
+	sort.Slice(candidates, func(i, j int) bool {
+		return candidates[i].score > candidates[j].score
+	})
+
+	// Evict until we have enough space
+	spaceFreed := int64(0)
+	for _, candidate := range candidates {
+		if spaceFreed >= needed {
+			break
+		}
+		if s.items.CompareAndDelete(candidate.key, candidate.item) {
+			spaceFreed += candidate.item.size
+			s.size.Add(-candidate.item.size)
+		}
+	}
+}
+
+// TieredStore puts a local store in front of a shared one. Entries are
+// looked up locally first and copied there when found in the shared
+// store; writes and deletes go to both. Other replicas' writes and deletes
+// only reach the shared store, so local copies are looked up there again
+// once they're older than the local TTL, which bounds how long they can
+// differ from it. Should the shared store fail, local copies are used
+// until they expire.
+type TieredStore struct {
+	local    Store
+	shared   Store
+	localTTL time.Duration
+}
+
+// defaultLocalTTL is how long a TieredStore's local copies are used
+// without looking at the shared store
+const defaultLocalTTL = 5 * time.Second
+
+// NewTieredStore puts local in front of shared, using local copies for up
+// to localTTL (default 5s)
+func NewTieredStore(local, shared Store, localTTL time.Duration) *TieredStore {
+	if localTTL <= 0 {
+		localTTL = defaultLocalTTL
+	}
+	return &TieredStore{local: local, shared: shared, localTTL: localTTL}
+}
+
+func (s *TieredStore) Get(ctx context.Context, key string) (*Entry, error) {
+	local, localErr := s.local.Get(ctx, key)
+	if localErr == nil && time.Now().Before(local.localUntil) {
+		return local, nil
+	}
+	entry, err := s.shared.Get(ctx, key)
+	if errors.Is(err, ErrNotFound) {
+		s.local.Delete(ctx, key)
+		return nil, err
+	}
+	if err != nil {
+		// An unexpired local copy stands in while the shared store fails
+		if localErr == nil && time.Now().Before(local.Expires) {
+			log.Printf("Cache store error, using the local copy: %v", err)
+			return local, nil
+		}
+		return nil, err
+	}
+	s.setLocal(ctx, key, entry)
+	return entry, nil
+}
+
+func (s *TieredStore) Set(ctx context.Context, key string, entry *Entry) error {
+	if err := s.shared.Set(ctx, key, entry); err != nil {
+		return err
+	}
+	s.setLocal(ctx, key, entry)
+	return nil
+}
+
+// setLocal keeps a copy of entry locally for the local TTL. The local tier
+// only saves trips to the shared one, so it may well be too small for it.
+func (s *TieredStore) setLocal(ctx context.Context, key string, entry *Entry) {
+	local := *entry
+	local.localUntil = time.Now().Add(s.localTTL)
+	s.local.Set(ctx, key, &local)
+}
+
+func (s *TieredStore) Delete(ctx context.Context, key string) error {
+	return errors.Join(s.local.Delete(ctx, key), s.shared.Delete(ctx, key))
+}
+
+func (s *TieredStore) Close() error {
+	return errors.Join(s.local.Close(), s.shared.Close())
+}
+
+func (s *TieredStore) sweep(now time.Time) {
+	for _, tier := range []Store{s.local, s.shared} {
+		if sw, ok := tier.(sweeper); ok {
+			sw.sweep(now)
+		}
+	}
+}
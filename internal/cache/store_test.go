@@ -0,0 +1,251 @@
+package cache
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestEntryEncoding(t *testing.T) {
+	entry := &Entry{
+		Status:               200,
+		Header:               map[string][]string{"Etag": {`"v1"`}, "Set-Cookie": {"a=1", "b=2"}},
+		Body:                 []byte("body"),
+		Stored:               time.Now().Round(0),
+		Age:                  3 * time.Second,
+		Lifetime:             time.Minute,
+		Expires:              time.Now().Add(time.Hour).Round(0),
+		NoStale:              true,
+		StaleWhileRevalidate: 10 * time.Second,
+		StaleIfError:         20 * time.Second,
+	}
+
+	data, err := encodeEntry("key", entry)
+	if err != nil {
+		t.Fatalf("Failed to encode entry: %v", err)
+	}
+	decoded, err := decodeEntry("key", data)
+	if err != nil {
+		t.Fatalf("Failed to decode entry: %v", err)
+	}
+	if decoded.Status != 200 || string(decoded.Body) != "body" || len(decoded.Header["Set-Cookie"]) != 2 ||
+		!decoded.Stored.Equal(entry.Stored) || !decoded.Expires.Equal(entry.Expires) || decoded.Age != entry.Age ||
+		decoded.Lifetime != entry.Lifetime || !decoded.NoStale || decoded.StaleIfError != entry.StaleIfError {
+		t.Errorf("Expected %+v, got %+v", entry, decoded)
+	}
+
+	// An entry stored under another key, with the same hash, isn't used
+	if _, err := decodeEntry("other", data); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Expected ErrNotFound for another key, got %v", err)
+	}
+	if _, err := decodeEntry("key", data[:10]); err == nil {
+		t.Error("Expected a truncated entry to be rejected")
+	}
+}
+
+// testStore checks the basic operations of a store
+func testStore(t *testing.T, store Store) {
+	t.Helper()
+	ctx := context.Background()
+
+	if _, err := store.Get(ctx, "missing"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Expected ErrNotFound, got %v", err)
+	}
+
+	entry := &Entry{Status: 200, Body: []byte("hello"), Expires: time.Now().Add(time.Minute)}
+	if err := store.Set(ctx, "GET example.com/", entry); err != nil {
+		t.Fatalf("Failed to set entry: %v", err)
+	}
+	got, err := store.Get(ctx, "GET example.com/")
+	if err != nil || string(got.Body) != "hello" {
+		t.Fatalf("Expected the stored entry, got %v, %v", got, err)
+	}
+
+	if err := store.Delete(ctx, "GET example.com/"); err != nil {
+		t.Fatalf("Failed to delete entry: %v", err)
+	}
+	if _, err := store.Get(ctx, "GET example.com/"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Expected ErrNotFound after delete, got %v", err)
+	}
+}
+
+func TestMemoryStore(t *testing.T) {
+	testStore(t, NewMemoryStore(0))
+}
+
+func TestDiskStore(t *testing.T) {
+	dir := t.TempDir()
+	store, err := NewDiskStore(dir, 0)
+	if err != nil {
+		t.Fatalf("Failed to open store: %v", err)
+	}
+	testStore(t, store)
+
+	// Entries survive a restart, except those that expired
+	ctx := context.Background()
+	store.Set(ctx, "kept", &Entry{Status: 200, Body: []byte("kept"), Expires: time.Now().Add(time.Hour)})
+	store.Set(ctx, "expiring", &Entry{Status: 200, Body: []byte("expiring"), Expires: time.Now().Add(50 * time.Millisecond)})
+	os.WriteFile(filepath.Join(dir, "leftover.tmp"), []byte("partial"), 0o600)
+	time.Sleep(100 * time.Millisecond)
+
+	reopened, err := NewDiskStore(dir, 0)
+	if err != nil {
+		t.Fatalf("Failed to reopen store: %v", err)
+	}
+	if got, err := reopened.Get(ctx, "kept"); err != nil || string(got.Body) != "kept" {
+		t.Errorf("Expected the entry to survive a restart, got %v", err)
+	}
+	if _, err := reopened.Get(ctx, "expiring"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Expected the expired entry to be dropped, got %v", err)
+	}
+	if len(reopened.index) != 1 {
+		t.Errorf("Expected 1 indexed entry, got %d", len(reopened.index))
+	}
+	if _, err := os.Stat(filepath.Join(dir, "leftover.tmp")); !os.IsNotExist(err) {
+		t.Error("Expected the leftover temporary file to be removed")
+	}
+}
+
+func TestDiskStoreEviction(t *testing.T) {
+	ctx := context.Background()
+	entry := func(body string) *Entry {
+		return &Entry{Status: 200, Body: []byte(body), Expires: time.Now().Add(time.Hour)}
+	}
+	data, _ := encodeEntry("a", entry("0123456789"))
+
+	// Room for two entries, whose timestamps may encode a little longer
+	store, err := NewDiskStore(t.TempDir(), int64(2*len(data)+32))
+	if err != nil {
+		t.Fatalf("Failed to open store: %v", err)
+	}
+	store.Set(ctx, "a", entry("0123456789"))
+	time.Sleep(10 * time.Millisecond)
+	store.Set(ctx, "b", entry("0123456789"))
+	time.Sleep(10 * time.Millisecond)
+	store.Get(ctx, "a")
+	store.Set(ctx, "c", entry("0123456789"))
+
+	if _, err := store.Get(ctx, "b"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Expected the least recently used entry to be evicted, got %v", err)
+	}
+	for _, key := range []string{"a", "c"} {
+		if _, err := store.Get(ctx, key); err != nil {
+			t.Errorf("Expected %s to be kept, got %v", key, err)
+		}
+	}
+	if store.size > store.maxSize {
+		t.Errorf("Store size %d exceeds max size %d", store.size, store.maxSize)
+	}
+
+	if err := store.Set(ctx, "large", entry(string(make([]byte, 3*len(data))))); err == nil {
+		t.Error("Expected an entry larger than the store to be rejected")
+	}
+}
+
+func TestCacheDiskRestart(t *testing.T) {
+	dir := t.TempDir()
+	open := func() *Cache {
+		store, err := NewDiskStore(dir, 0)
+		if err != nil {
+			t.Fatalf("Failed to open store: %v", err)
+		}
+		return New(Config{TTL: time.Minute, Store: store})
+	}
+
+	c := open()
+	resp := createTestResponse(200, "persisted")
+	resp.Header.Set("Vary", "Accept-Encoding")
+	req := httptest.NewRequest("GET", "/persisted", nil)
+	req.Header.Set("Accept-Encoding", "gzip")
+	if err := c.Set(req, resp); err != nil {
+		t.Fatalf("Failed to set cache: %v", err)
+	}
+	c.Close()
+
+	c = open()
+	defer c.Close()
+	cached, ok := c.Get(req)
+	if !ok {
+		t.Fatal("Expected a hit after a restart")
+	}
+	if body, _ := io.ReadAll(cached.Body); string(body) != "persisted" {
+		t.Errorf("Expected %q, got %q", "persisted", body)
+	}
+	if cached.Header.Get("Vary") != "Accept-Encoding" {
+		t.Errorf("Expected the stored headers, got %v", cached.Header)
+	}
+}
+
+// failingStore fails every operation, as an unreachable shared store does
+type failingStore struct {
+	err error
+}
+
+func (s *failingStore) Get(context.Context, string) (*Entry, error) { return nil, s.err }
+func (s *failingStore) Set(context.Context, string, *Entry) error   { return s.err }
+func (s *failingStore) Delete(context.Context, string) error        { return s.err }
+func (s *failingStore) Close() error                                { return s.err }
+
+func TestTieredStore(t *testing.T) {
+	ctx := context.Background()
+	local, shared := NewMemoryStore(0), NewMemoryStore(0)
+	store := NewTieredStore(local, shared, 50*time.Millisecond)
+	testStore(t, store)
+
+	// Entries found in the shared tier are kept locally
+	shared.Set(ctx, "shared", &Entry{Status: 200, Body: []byte("shared"), Expires: time.Now().Add(time.Minute)})
+	if _, err := store.Get(ctx, "shared"); err != nil {
+		t.Fatalf("Expected the shared entry, got %v", err)
+	}
+	if _, err := local.Get(ctx, "shared"); err != nil {
+		t.Errorf("Expected the entry to be copied locally, got %v", err)
+	}
+
+	// Local copies are checked against the shared tier once they're older
+	// than the local TTL
+	shared.Set(ctx, "shared", &Entry{Status: 200, Body: []byte("updated"), Expires: time.Now().Add(time.Minute)})
+	if got, _ := store.Get(ctx, "shared"); string(got.Body) != "shared" {
+		t.Errorf("Expected the local copy within the local TTL, got %q", got.Body)
+	}
+	time.Sleep(60 * time.Millisecond)
+	if got, err := store.Get(ctx, "shared"); err != nil || string(got.Body) != "updated" {
+		t.Errorf("Expected the shared entry past the local TTL, got %v", err)
+	}
+	shared.Delete(ctx, "shared")
+	time.Sleep(60 * time.Millisecond)
+	if _, err := store.Get(ctx, "shared"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Expected a deleted shared entry to be gone past the local TTL, got %v", err)
+	}
+	if _, err := local.Get(ctx, "shared"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Expected the local copy to be dropped, got %v", err)
+	}
+
+	// Unexpired local copies stand in while the shared tier fails
+	failing := &failingStore{err: errors.New("connection refused")}
+	store = NewTieredStore(local, failing, time.Millisecond)
+	local.Set(ctx, "fresh", &Entry{Status: 200, Body: []byte("fresh"), Expires: time.Now().Add(time.Minute)})
+	local.Set(ctx, "expired", &Entry{Status: 200, Body: []byte("expired"), Expires: time.Now().Add(-time.Second)})
+	if got, err := store.Get(ctx, "fresh"); err != nil || string(got.Body) != "fresh" {
+		t.Errorf("Expected the local copy while the shared tier fails, got %v", err)
+	}
+	if _, err := store.Get(ctx, "expired"); !errors.Is(err, failing.err) {
+		t.Errorf("Expected the shared tier's error for an expired local copy, got %v", err)
+	}
+	if _, err := store.Get(ctx, "missing"); !errors.Is(err, failing.err) {
+		t.Errorf("Expected the shared tier's error without a local copy, got %v", err)
+	}
+
+	// A local tier too small for an entry doesn't stop it being stored
+	store = NewTieredStore(NewMemoryStore(1), shared, 0)
+	if err := store.Set(ctx, "large", &Entry{Status: 200, Body: []byte("large"), Expires: time.Now().Add(time.Minute)}); err != nil {
+		t.Errorf("Expected the entry to be stored in the shared tier, got %v", err)
+	}
+	if _, err := store.Get(ctx, "large"); err != nil {
+		t.Errorf("Expected the large entry, got %v", err)
+	}
+}
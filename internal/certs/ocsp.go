@@ -0,0 +1,135 @@
+package certs
+
+import (
+	"bytes"
+	"context"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"time"
+
+	"golang.org/x/crypto/ocsp"
+)
+
+const (
+	// ocspTimeout bounds each request to an OCSP responder
+	ocspTimeout = 10 * time.Second
+	// maxOCSPResponse bounds how much of a response is read
+	maxOCSPResponse = 1 << 20
+	// defaultOCSPLifetime is how long a response without a NextUpdate is
+	// used for
+	defaultOCSPLifetime = time.Hour
+)
+
+var errNoResponder = errors.New("certificate names no OCSP responder")
+
+// fetchOCSP asks responder, or else the certificate's own responder, for
+// cert's status. The response is checked against issuer.
+func fetchOCSP(client *http.Client, cert, issuer *x509.Certificate, responder string) (*ocsp.Response, []byte, error) {
+	if responder == "" {
+		if len(cert.OCSPServer) == 0 {
+			return nil, nil, errNoResponder
+		}
+		responder = cert.OCSPServer[0]
+	}
+
+	body, err := ocsp.CreateRequest(cert, issuer, nil)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), ocspTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, responder, bytes.NewReader(body))
+	if err != nil {
+		return nil, nil, err
+	}
+	req.Header.Set("Content-Type", "application/ocsp-request")
+	req.Header.Set("Accept", "application/ocsp-response")
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, nil, fmt.Errorf("OCSP responder %s returned %s", responder, resp.Status)
+	}
+
+	der, err := io.ReadAll(io.LimitReader(resp.Body, maxOCSPResponse))
+	if err != nil {
+		return nil, nil, err
+	}
+	parsed, err := ocsp.ParseResponseForCert(der, cert, issuer)
+	if err != nil {
+		return nil, nil, fmt.Errorf("OCSP response from %s: %w", responder, err)
+	}
+	return parsed, der, nil
+}
+
+// nextUpdate is when an OCSP response stops being current
+func nextUpdate(resp *ocsp.Response) time.Time {
+	if resp.NextUpdate.IsZero() {
+		return resp.ThisUpdate.Add(defaultOCSPLifetime)
+	}
+	return resp.NextUpdate
+}
+
+// staple fetches OCSP responses for the certificates whose staple is
+// missing or halfway to expiring. Expired staples are dropped rather than
+// served.
+func (s *Store) staple() {
+	if !s.config.OCSPStapling {
+		return
+	}
+
+	s.mu.RLock()
+	set := s.set
+	s.mu.RUnlock()
+
+	now := time.Now()
+	for _, e := range set.entries {
+		if now.After(e.nextUpdate) {
+			e.stapled.Store(nil)
+		}
+		if now.Before(e.refresh) || len(e.cert.Certificate) < 2 || len(e.cert.Leaf.OCSPServer) == 0 {
+			continue
+		}
+
+		issuer, err := x509.ParseCertificate(e.cert.Certificate[1])
+		if err != nil {
+			continue
+		}
+		resp, der, err := fetchOCSP(s.config.HTTPClient, e.cert.Leaf, issuer, "")
+		if err != nil {
+			log.Printf("OCSP staple for %s not refreshed: %v", e.file, err)
+			continue
+		}
+
+		e.nextUpdate = nextUpdate(resp)
+		e.refresh = resp.ThisUpdate.Add(e.nextUpdate.Sub(resp.ThisUpdate) / 2)
+		if resp.Status != ocsp.Good {
+			log.Printf("Warning: OCSP responder reports TLS certificate %s as %s", e.file, statusName(resp.Status))
+			e.stapled.Store(nil)
+			continue
+		}
+
+		stapled := *e.cert
+		stapled.OCSPStaple = der
+		e.stapled.Store(&stapled)
+	}
+}
+
+func statusName(status int) string {
+	switch status {
+	case ocsp.Good:
+		return "good"
+	case ocsp.Revoked:
+		return "revoked"
+	default:
+		return "unknown"
+	}
+}
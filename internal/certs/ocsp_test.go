@@ -0,0 +1,285 @@
+package certs
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"io"
+	"log"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ocsp"
+)
+
+// testCA issues certificates and answers OCSP requests for them
+type testCA struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+
+	mu       sync.Mutex
+	statuses map[string]int // by serial; unknown serials are good
+	requests atomic.Int64
+}
+
+func newTestCA(t *testing.T, name string) *testCA {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("Failed to generate key: %v", err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: name},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(24 * time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("Failed to create CA: %v", err)
+	}
+	cert, _ := x509.ParseCertificate(der)
+	return &testCA{cert: cert, key: key, statuses: make(map[string]int)}
+}
+
+// issue writes a certificate for name followed by the CA to dir/base.crt
+// and returns the pair and the parsed certificate
+func (ca *testCA) issue(t *testing.T, dir, base, ocspURL, name string) (Pair, *x509.Certificate) {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("Failed to generate key: %v", err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: name},
+		DNSNames:     []string{name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(24 * time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+	if ocspURL != "" {
+		template.OCSPServer = []string{ocspURL}
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, ca.cert, &key.PublicKey, ca.key)
+	if err != nil {
+		t.Fatalf("Failed to create certificate: %v", err)
+	}
+	cert, _ := x509.ParseCertificate(der)
+	keyDER, _ := x509.MarshalECPrivateKey(key)
+
+	var chain bytes.Buffer
+	pem.Encode(&chain, &pem.Block{Type: "CERTIFICATE", Bytes: der})
+	pem.Encode(&chain, &pem.Block{Type: "CERTIFICATE", Bytes: ca.cert.Raw})
+
+	pair := Pair{CertFile: filepath.Join(dir, base+".crt"), KeyFile: filepath.Join(dir, base+".key")}
+	os.WriteFile(pair.CertFile, chain.Bytes(), 0o600)
+	os.WriteFile(pair.KeyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0o600)
+	return pair, cert
+}
+
+func (ca *testCA) setStatus(cert *x509.Certificate, status int) {
+	ca.mu.Lock()
+	defer ca.mu.Unlock()
+	ca.statuses[cert.SerialNumber.String()] = status
+}
+
+// ServeHTTP answers OCSP requests, signing responses with the CA's key
+func (ca *testCA) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	ca.requests.Add(1)
+
+	body, _ := io.ReadAll(r.Body)
+	req, err := ocsp.ParseRequest(body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	ca.mu.Lock()
+	status := ca.statuses[req.SerialNumber.String()]
+	ca.mu.Unlock()
+
+	now := time.Now().Truncate(time.Minute)
+	template := ocsp.Response{
+		Status:       status,
+		SerialNumber: req.SerialNumber,
+		ThisUpdate:   now,
+		NextUpdate:   now.Add(time.Hour),
+	}
+	if status == ocsp.Revoked {
+		template.RevokedAt = now
+	}
+	der, err := ocsp.CreateResponse(ca.cert, ca.cert, template, ca.key)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/ocsp-response")
+	w.Write(der)
+}
+
+func TestOCSPStapling(t *testing.T) {
+	var logs bytes.Buffer
+	log.SetOutput(&logs)
+	defer log.SetOutput(os.Stderr)
+
+	ca := newTestCA(t, "Test CA")
+	responder := httptest.NewServer(ca)
+	defer responder.Close()
+
+	dir := t.TempDir()
+	stapledPair, stapledCert := ca.issue(t, dir, "stapled", responder.URL, "stapled.example.com")
+	plainPair, _ := ca.issue(t, dir, "plain", "", "plain.example.com")
+
+	store, err := New(Config{Pairs: []Pair{stapledPair, plainPair}, OCSPStapling: true})
+	if err != nil {
+		t.Fatalf("Failed to create store: %v", err)
+	}
+	store.staple()
+
+	cert, _ := store.GetCertificate(&tls.ClientHelloInfo{ServerName: "stapled.example.com"})
+	resp, err := ocsp.ParseResponseForCert(cert.OCSPStaple, stapledCert, ca.cert)
+	if err != nil || resp.Status != ocsp.Good {
+		t.Fatalf("Expected a good staple, got %v", err)
+	}
+	if cert, _ := store.GetCertificate(&tls.ClientHelloInfo{ServerName: "plain.example.com"}); cert.OCSPStaple != nil {
+		t.Error("Expected no staple for a certificate without a responder")
+	}
+
+	// A current staple isn't fetched again
+	store.staple()
+	if got := ca.requests.Load(); got != 1 {
+		t.Errorf("Expected 1 OCSP request, got %d", got)
+	}
+
+	// A revoked certificate loses its staple once it's refreshed
+	ca.setStatus(stapledCert, ocsp.Revoked)
+	store.set.exact["stapled.example.com"].refresh = time.Time{}
+	store.staple()
+
+	if cert, _ := store.GetCertificate(&tls.ClientHelloInfo{ServerName: "stapled.example.com"}); cert.OCSPStaple != nil {
+		t.Error("Expected the staple of a revoked certificate to be dropped")
+	}
+	if !strings.Contains(logs.String(), "revoked") {
+		t.Errorf("Expected a warning about the revocation, got %q", logs.String())
+	}
+}
+
+func TestRevocationCRL(t *testing.T) {
+	ca := newTestCA(t, "Test CA")
+	other := newTestCA(t, "Other CA")
+	dir := t.TempDir()
+	_, revoked := ca.issue(t, dir, "revoked", "", "revoked.example.com")
+	_, good := ca.issue(t, dir, "good", "", "good.example.com")
+	_, foreign := other.issue(t, dir, "foreign", "", "foreign.example.com")
+
+	writeCRL := func(name string, nextUpdate time.Time) string {
+		der, err := x509.CreateRevocationList(rand.Reader, &x509.RevocationList{
+			Number:     big.NewInt(1),
+			ThisUpdate: time.Now().Add(-2 * time.Hour),
+			NextUpdate: nextUpdate,
+			RevokedCertificateEntries: []x509.RevocationListEntry{
+				{SerialNumber: revoked.SerialNumber, RevocationTime: time.Now()},
+				{SerialNumber: foreign.SerialNumber, RevocationTime: time.Now()},
+			},
+		}, ca.cert, ca.key)
+		if err != nil {
+			t.Fatalf("Failed to create CRL: %v", err)
+		}
+		crlFile := filepath.Join(dir, name)
+		os.WriteFile(crlFile, pem.EncodeToMemory(&pem.Block{Type: "X509 CRL", Bytes: der}), 0o600)
+		return crlFile
+	}
+	crlFile := writeCRL("ca.crl", time.Now().Add(time.Hour))
+
+	checker, err := NewRevocationChecker(RevocationConfig{CRLFile: crlFile})
+	if err != nil {
+		t.Fatalf("Failed to create checker: %v", err)
+	}
+
+	if err := checker.Check([]*x509.Certificate{revoked, ca.cert}); !errors.Is(err, ErrRevoked) {
+		t.Errorf("Expected the listed certificate to be revoked, got %v", err)
+	}
+	if err := checker.Check([]*x509.Certificate{good, ca.cert}); err != nil {
+		t.Errorf("Expected an unlisted certificate to pass, got %v", err)
+	}
+	// The CRL only speaks for its own issuer, and only until its next
+	// update, so other statuses are unknown
+	if err := checker.Check([]*x509.Certificate{foreign, other.cert}); err == nil || errors.Is(err, ErrRevoked) {
+		t.Errorf("Expected another issuer's certificate to be unknown, got %v", err)
+	}
+	expired, err := NewRevocationChecker(RevocationConfig{CRLFile: writeCRL("expired.crl", time.Now().Add(-time.Hour))})
+	if err != nil {
+		t.Fatalf("Failed to create checker: %v", err)
+	}
+	if err := expired.Check([]*x509.Certificate{good, ca.cert}); err == nil || !strings.Contains(err.Error(), "expired") {
+		t.Errorf("Expected an expired CRL to fail the check, got %v", err)
+	}
+	failOpen, _ := NewRevocationChecker(RevocationConfig{CRLFile: crlFile, FailOpen: true})
+	if err := failOpen.Check([]*x509.Certificate{foreign, other.cert}); err != nil {
+		t.Errorf("Expected an unknown status to pass when failing open, got %v", err)
+	}
+
+	if _, err := NewRevocationChecker(RevocationConfig{CRLFile: filepath.Join(dir, "good.key")}); err == nil {
+		t.Error("Expected a file that isn't a CRL to be rejected")
+	}
+}
+
+func TestRevocationOCSP(t *testing.T) {
+	ca := newTestCA(t, "Test CA")
+	responder := httptest.NewServer(ca)
+	dir := t.TempDir()
+	_, revoked := ca.issue(t, dir, "revoked", responder.URL, "revoked.example.com")
+	_, good := ca.issue(t, dir, "good", responder.URL, "good.example.com")
+	ca.setStatus(revoked, ocsp.Revoked)
+
+	checker, err := NewRevocationChecker(RevocationConfig{OCSP: true})
+	if err != nil {
+		t.Fatalf("Failed to create checker: %v", err)
+	}
+
+	if err := checker.Check([]*x509.Certificate{revoked, ca.cert}); !errors.Is(err, ErrRevoked) {
+		t.Errorf("Expected the certificate to be revoked, got %v", err)
+	}
+	if err := checker.Check([]*x509.Certificate{good, ca.cert}); err != nil {
+		t.Errorf("Expected a good certificate to pass, got %v", err)
+	}
+
+	// Answers are reused until they expire
+	checker.Check([]*x509.Certificate{good, ca.cert})
+	if got := ca.requests.Load(); got != 2 {
+		t.Errorf("Expected 2 OCSP requests, got %d", got)
+	}
+
+	// An unreachable responder fails closed unless told otherwise
+	responder.Close()
+	_, fresh := ca.issue(t, dir, "fresh", responder.URL, "fresh.example.com")
+	if err := checker.Check([]*x509.Certificate{fresh, ca.cert}); err == nil {
+		t.Error("Expected an unknown status to fail the check")
+	}
+
+	failOpen, _ := NewRevocationChecker(RevocationConfig{OCSP: true, FailOpen: true})
+	if err := failOpen.Check([]*x509.Certificate{fresh, ca.cert}); err != nil {
+		t.Errorf("Expected an unknown status to pass when failing open, got %v", err)
+	}
+}
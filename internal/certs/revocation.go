@@ -0,0 +1,201 @@
+package certs
+
+import (
+	"bytes"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/ocsp"
+)
+
+// maxOCSPStatuses bounds how many OCSP answers are cached
+const maxOCSPStatuses = 10000
+
+// ErrRevoked is returned for certificates their issuer has revoked
+var ErrRevoked = errors.New("certificate revoked")
+
+// RevocationConfig says how certificates are checked for revocation.
+// CRLFile is a PEM or DER CRL, reread when it changes; it must be issued
+// by the issuer of the certificates checked and not past its NextUpdate.
+// OCSP asks Responder, or else each certificate's own responder. A status
+// that can't be learnt fails the check unless FailOpen is set.
+type RevocationConfig struct {
+	CRLFile    string
+	OCSP       bool
+	Responder  string
+	FailOpen   bool
+	HTTPClient *http.Client
+}
+
+// RevocationChecker checks verified chains against a CRL and OCSP. OCSP
+// responses are reused until they expire.
+type RevocationChecker struct {
+	config RevocationConfig
+
+	mu         sync.Mutex
+	crl        *x509.RevocationList
+	crlStamp   stamp
+	crlChecked time.Time
+	responses  map[string]ocspStatus
+}
+
+// ocspStatus is a cached OCSP answer
+type ocspStatus struct {
+	revoked    bool
+	nextUpdate time.Time
+}
+
+func NewRevocationChecker(config RevocationConfig) (*RevocationChecker, error) {
+	if config.CRLFile == "" && !config.OCSP {
+		return nil, errors.New("a CRL file or OCSP is required")
+	}
+	if config.HTTPClient == nil {
+		config.HTTPClient = &http.Client{Timeout: ocspTimeout}
+	}
+
+	c := &RevocationChecker{
+		config:    config,
+		responses: make(map[string]ocspStatus),
+	}
+	if config.CRLFile != "" {
+		if err := c.loadCRL(); err != nil {
+			return nil, err
+		}
+	}
+	return c, nil
+}
+
+// Check returns ErrRevoked if the leaf of chain, a verified chain whose
+// second certificate is the leaf's issuer, has been revoked
+func (c *RevocationChecker) Check(chain []*x509.Certificate) error {
+	if len(chain) < 2 {
+		return errors.New("chain has no issuer")
+	}
+	leaf, issuer := chain[0], chain[1]
+
+	err := c.checkCRL(leaf, issuer)
+	if err == nil && c.config.OCSP {
+		err = c.checkOCSP(leaf, issuer)
+	}
+	if err != nil && !errors.Is(err, ErrRevoked) && c.config.FailOpen {
+		return nil
+	}
+	return err
+}
+
+func (c *RevocationChecker) checkCRL(leaf, issuer *x509.Certificate) error {
+	if c.config.CRLFile == "" {
+		return nil
+	}
+
+	// A CRL that fails to load is logged and the previous one kept
+	c.mu.Lock()
+	if time.Since(c.crlChecked) > DefaultReloadInterval {
+		c.crlChecked = time.Now()
+		if err := c.loadCRL(); err != nil {
+			log.Printf("CRL reload failed, keeping the current CRL: %v", err)
+		}
+	}
+	crl := c.crl
+	c.mu.Unlock()
+
+	// The CRL says nothing of other issuers' certificates, nor of any
+	// once it's out of date
+	if !bytes.Equal(crl.RawIssuer, leaf.RawIssuer) {
+		return fmt.Errorf("CRL %s doesn't cover certificates issued by %s", c.config.CRLFile, issuer.Subject)
+	}
+	if !crl.NextUpdate.IsZero() && time.Now().After(crl.NextUpdate) {
+		return fmt.Errorf("CRL %s expired at %s", c.config.CRLFile, crl.NextUpdate.Format(time.RFC3339))
+	}
+	if err := crl.CheckSignatureFrom(issuer); err != nil {
+		return fmt.Errorf("CRL %s: %w", c.config.CRLFile, err)
+	}
+
+	for _, entry := range crl.RevokedCertificateEntries {
+		if entry.SerialNumber.Cmp(leaf.SerialNumber) == 0 {
+			return ErrRevoked
+		}
+	}
+	return nil
+}
+
+func (c *RevocationChecker) checkOCSP(leaf, issuer *x509.Certificate) error {
+	key := string(leaf.RawIssuer) + leaf.SerialNumber.String()
+
+	c.mu.Lock()
+	status, ok := c.responses[key]
+	c.mu.Unlock()
+
+	if !ok || time.Now().After(status.nextUpdate) {
+		resp, _, err := fetchOCSP(c.config.HTTPClient, leaf, issuer, c.config.Responder)
+		if err != nil {
+			return err
+		}
+		if resp.Status == ocsp.Unknown {
+			return errors.New("OCSP responder doesn't know the certificate")
+		}
+		status = ocspStatus{revoked: resp.Status == ocsp.Revoked, nextUpdate: nextUpdate(resp)}
+
+		c.mu.Lock()
+		if len(c.responses) >= maxOCSPStatuses {
+			c.pruneResponses()
+		}
+		c.responses[key] = status
+		c.mu.Unlock()
+	}
+
+	if status.revoked {
+		return ErrRevoked
+	}
+	return nil
+}
+
+// pruneResponses drops expired answers, or every answer if none has
+// expired. Callers hold c.mu.
+func (c *RevocationChecker) pruneResponses() {
+	now := time.Now()
+	for key, status := range c.responses {
+		if now.After(status.nextUpdate) {
+			delete(c.responses, key)
+		}
+	}
+	if len(c.responses) >= maxOCSPStatuses {
+		clear(c.responses)
+	}
+}
+
+// loadCRL reads the CRL if its file changed since it was last read.
+// Callers other than NewRevocationChecker hold c.mu.
+func (c *RevocationChecker) loadCRL() error {
+	info, err := os.Stat(c.config.CRLFile)
+	if err != nil {
+		return fmt.Errorf("loading CRL: %w", err)
+	}
+	st := stamp{modTime: info.ModTime(), size: info.Size()}
+	if st == c.crlStamp {
+		return nil
+	}
+
+	data, err := os.ReadFile(c.config.CRLFile)
+	if err != nil {
+		return fmt.Errorf("loading CRL: %w", err)
+	}
+	if block, _ := pem.Decode(data); block != nil {
+		data = block.Bytes
+	}
+
+	crl, err := x509.ParseRevocationList(data)
+	if err != nil {
+		return fmt.Errorf("parsing CRL %s: %w", c.config.CRLFile, err)
+	}
+	c.crl = crl
+	c.crlStamp = st
+	return nil
+}
@@ -0,0 +1,351 @@
+package certs
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"log"
+	"maps"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// DefaultReloadInterval is how often certificate files are checked for
+	// changes by default
+	DefaultReloadInterval = 30 * time.Second
+	// DefaultExpiryWarning is how close to expiring a certificate must be
+	// for a warning to be logged by default
+	DefaultExpiryWarning = 30 * 24 * time.Hour
+)
+
+// Pair names a certificate file and its key file
+type Pair struct {
+	CertFile string
+	KeyFile  string
+}
+
+// Config lists where certificates come from. Dir holds pairs named
+// <name>.crt and <name>.key. The first certificate listed, or else the
+// first in Dir by name, is served to clients that don't send a matching
+// SNI name. OCSPStapling staples the responses of each certificate's OCSP
+// responder, asked with HTTPClient.
+type Config struct {
+	Pairs          []Pair
+	Dir            string
+	ReloadInterval time.Duration
+	ExpiryWarning  time.Duration
+	OCSPStapling   bool
+	HTTPClient     *http.Client
+}
+
+// Expiry describes when a loaded certificate expires
+type Expiry struct {
+	File          string    `json:"file"`
+	Names         []string  `json:"names"`
+	NotAfter      time.Time `json:"not_after"`
+	DaysRemaining int       `json:"days_remaining"`
+}
+
+// Store serves certificates by SNI name and reloads them when their files
+// change. Connections keep the certificate they were handshaken with.
+type Store struct {
+	config Config
+
+	mu       sync.RWMutex
+	set      *certSet
+	stamps   map[string]stamp
+	warned   map[string]bool
+	stopOnce sync.Once
+	stopCh   chan struct{}
+}
+
+// certSet is one generation of loaded certificates
+type certSet struct {
+	exact    map[string]*entry
+	wildcard map[string]*entry // keyed by the suffix after "*."
+	fallback *entry
+	entries  []*entry
+	expiries []Expiry
+}
+
+// entry is a loaded certificate and its OCSP staple
+type entry struct {
+	file    string
+	cert    *tls.Certificate
+	stapled atomic.Pointer[tls.Certificate] // cert with a current staple
+
+	// Only used by the goroutine refreshing staples
+	refresh    time.Time // when the staple is next fetched
+	nextUpdate time.Time // when the staple expires
+}
+
+// current returns the certificate, stapled when a response is known
+func (e *entry) current() *tls.Certificate {
+	if cert := e.stapled.Load(); cert != nil {
+		return cert
+	}
+	return e.cert
+}
+
+// stamp identifies a version of a file
+type stamp struct {
+	modTime time.Time
+	size    int64
+}
+
+func New(config Config) (*Store, error) {
+	if config.ReloadInterval <= 0 {
+		config.ReloadInterval = DefaultReloadInterval
+	}
+	if config.ExpiryWarning <= 0 {
+		config.ExpiryWarning = DefaultExpiryWarning
+	}
+	if config.HTTPClient == nil {
+		config.HTTPClient = &http.Client{Timeout: ocspTimeout}
+	}
+
+	s := &Store{
+		config: config,
+		warned: make(map[string]bool),
+		stopCh: make(chan struct{}),
+	}
+	if err := s.Reload(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// Load reads a certificate and key, refusing expired certificates so
+// they're caught when loading rather than by clients
+func Load(certFile, keyFile string) (*tls.Certificate, error) {
+	if certFile == "" || keyFile == "" {
+		return nil, errors.New("certFile and keyFile are required")
+	}
+
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, fmt.Errorf("loading certificate: %w", err)
+	}
+	if cert.Leaf == nil {
+		if cert.Leaf, err = x509.ParseCertificate(cert.Certificate[0]); err != nil {
+			return nil, fmt.Errorf("parsing certificate %s: %w", certFile, err)
+		}
+	}
+	if time.Now().After(cert.Leaf.NotAfter) {
+		return nil, fmt.Errorf("certificate %s expired on %s", certFile, cert.Leaf.NotAfter.Format(time.RFC3339))
+	}
+	return &cert, nil
+}
+
+// Reload loads every certificate again. If any fails, the certificates
+// already loaded stay in use.
+func (s *Store) Reload() error {
+	pairs, err := s.pairs()
+	if err != nil {
+		return err
+	}
+	if len(pairs) == 0 {
+		return errors.New("no certificates configured")
+	}
+
+	// Stamp before loading so a change made meanwhile is seen next time
+	stamps, err := stampFiles(pairs)
+	if err != nil {
+		return err
+	}
+
+	set := &certSet{
+		exact:    make(map[string]*entry),
+		wildcard: make(map[string]*entry),
+	}
+	for _, pair := range pairs {
+		cert, err := Load(pair.CertFile, pair.KeyFile)
+		if err != nil {
+			return err
+		}
+		set.add(pair.CertFile, cert)
+	}
+
+	s.mu.Lock()
+	s.set = set
+	s.stamps = stamps
+	s.warned = make(map[string]bool)
+	s.mu.Unlock()
+
+	s.warnExpiring()
+	return nil
+}
+
+// GetCertificate picks the certificate for the client's SNI name, trying
+// an exact name, then a wildcard, then the fallback. It suits
+// tls.Config.GetCertificate.
+func (s *Store) GetCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	s.mu.RLock()
+	set := s.set
+	s.mu.RUnlock()
+
+	name := strings.ToLower(strings.TrimSuffix(hello.ServerName, "."))
+	if e, ok := set.exact[name]; ok {
+		return e.current(), nil
+	}
+	if _, parent, ok := strings.Cut(name, "."); ok {
+		if e, ok := set.wildcard[parent]; ok {
+			return e.current(), nil
+		}
+	}
+	return set.fallback.current(), nil
+}
+
+// Expiries lists the loaded certificates by expiry, soonest first
+func (s *Store) Expiries() []Expiry {
+	s.mu.RLock()
+	set := s.set
+	s.mu.RUnlock()
+
+	expiries := make([]Expiry, len(set.expiries))
+	for i, e := range set.expiries {
+		e.DaysRemaining = int(time.Until(e.NotAfter).Hours() / 24)
+		expiries[i] = e
+	}
+	return expiries
+}
+
+// Start watches the certificate files and reloads them when they change,
+// and keeps their OCSP staples current
+func (s *Store) Start() {
+	ticker := time.NewTicker(s.config.ReloadInterval)
+	go func() {
+		defer ticker.Stop()
+		s.staple()
+		for {
+			select {
+			case <-ticker.C:
+				s.check()
+			case <-s.stopCh:
+				return
+			}
+		}
+	}()
+}
+
+func (s *Store) Stop() {
+	s.stopOnce.Do(func() { close(s.stopCh) })
+}
+
+// check reloads the certificates if any file was added, removed or changed
+func (s *Store) check() {
+	pairs, err := s.pairs()
+	if err == nil {
+		var stamps map[string]stamp
+		if stamps, err = stampFiles(pairs); err == nil {
+			s.mu.RLock()
+			changed := !maps.Equal(stamps, s.stamps)
+			s.mu.RUnlock()
+
+			if changed {
+				if err = s.Reload(); err == nil {
+					log.Printf("Reloaded %d TLS certificates", len(pairs))
+				}
+			}
+		}
+	}
+	if err != nil {
+		log.Printf("Certificate reload failed, keeping current certificates: %v", err)
+	}
+
+	s.warnExpiring()
+	s.staple()
+}
+
+// warnExpiring logs each certificate close to expiring once per load
+func (s *Store) warnExpiring() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, e := range s.set.expiries {
+		remaining := time.Until(e.NotAfter)
+		if remaining < s.config.ExpiryWarning && !s.warned[e.File] {
+			s.warned[e.File] = true
+			log.Printf("Warning: TLS certificate %s for %s expires on %s (in %s)",
+				e.File, strings.Join(e.Names, ", "), e.NotAfter.Format(time.RFC3339), remaining.Round(time.Hour))
+		}
+	}
+}
+
+// pairs lists the configured pairs followed by those found in the
+// directory
+func (s *Store) pairs() ([]Pair, error) {
+	pairs := append([]Pair(nil), s.config.Pairs...)
+	if s.config.Dir == "" {
+		return pairs, nil
+	}
+
+	certFiles, err := filepath.Glob(filepath.Join(s.config.Dir, "*.crt"))
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(certFiles)
+	for _, certFile := range certFiles {
+		keyFile := strings.TrimSuffix(certFile, ".crt") + ".key"
+		if _, err := os.Stat(keyFile); err != nil {
+			return nil, fmt.Errorf("no key for certificate %s: %w", certFile, err)
+		}
+		pairs = append(pairs, Pair{CertFile: certFile, KeyFile: keyFile})
+	}
+	return pairs, nil
+}
+
+func stampFiles(pairs []Pair) (map[string]stamp, error) {
+	stamps := make(map[string]stamp, 2*len(pairs))
+	for _, pair := range pairs {
+		if pair.CertFile == "" || pair.KeyFile == "" {
+			return nil, errors.New("certFile and keyFile are required")
+		}
+		for _, file := range []string{pair.CertFile, pair.KeyFile} {
+			info, err := os.Stat(file)
+			if err != nil {
+				return nil, fmt.Errorf("loading certificate: %w", err)
+			}
+			stamps[file] = stamp{modTime: info.ModTime(), size: info.Size()}
+		}
+	}
+	return stamps, nil
+}
+
+// add indexes a certificate under each of its names. Earlier certificates
+// win when names overlap.
+func (set *certSet) add(file string, cert *tls.Certificate) {
+	e := &entry{file: file, cert: cert}
+	set.entries = append(set.entries, e)
+	if set.fallback == nil {
+		set.fallback = e
+	}
+
+	names := cert.Leaf.DNSNames
+	if len(names) == 0 && cert.Leaf.Subject.CommonName != "" {
+		names = []string{cert.Leaf.Subject.CommonName}
+	}
+	for _, name := range names {
+		name = strings.ToLower(name)
+		if suffix, ok := strings.CutPrefix(name, "*."); ok {
+			if _, exists := set.wildcard[suffix]; !exists {
+				set.wildcard[suffix] = e
+			}
+		} else if _, exists := set.exact[name]; !exists {
+			set.exact[name] = e
+		}
+	}
+
+	set.expiries = append(set.expiries, Expiry{File: file, Names: names, NotAfter: cert.Leaf.NotAfter})
+	sort.SliceStable(set.expiries, func(i, j int) bool {
+		return set.expiries[i].NotAfter.Before(set.expiries[j].NotAfter)
+	})
+}
@@ -0,0 +1,199 @@
+package certs
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"log"
+	"math/big"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// writeCert writes a self-signed certificate for names to dir/base.crt and
+// its key to dir/base.key
+func writeCert(t *testing.T, dir, base string, notAfter time.Time, names ...string) Pair {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("Failed to generate key: %v", err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: names[0]},
+		DNSNames:     names,
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     notAfter,
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("Failed to create certificate: %v", err)
+	}
+	keyDER, _ := x509.MarshalECPrivateKey(key)
+
+	pair := Pair{CertFile: filepath.Join(dir, base+".crt"), KeyFile: filepath.Join(dir, base+".key")}
+	os.WriteFile(pair.CertFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0o600)
+	os.WriteFile(pair.KeyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0o600)
+	return pair
+}
+
+// servedName returns the first name of the certificate served for sni
+func servedName(t *testing.T, s *Store, sni string) string {
+	t.Helper()
+
+	cert, err := s.GetCertificate(&tls.ClientHelloInfo{ServerName: sni})
+	if err != nil {
+		t.Fatalf("GetCertificate(%q) failed: %v", sni, err)
+	}
+	return cert.Leaf.DNSNames[0]
+}
+
+func TestGetCertificateBySNI(t *testing.T) {
+	dir := t.TempDir()
+	expires := time.Now().Add(90 * 24 * time.Hour)
+	store, err := New(Config{Pairs: []Pair{
+		writeCert(t, dir, "default", expires, "default.example.org"),
+		writeCert(t, dir, "wildcard", expires, "*.example.com"),
+		writeCert(t, dir, "api", expires, "api.example.com"),
+	}})
+	if err != nil {
+		t.Fatalf("Failed to create store: %v", err)
+	}
+
+	tests := []struct {
+		sni      string
+		expected string
+	}{
+		{"api.example.com", "api.example.com"},
+		{"API.Example.com.", "api.example.com"},
+		{"www.example.com", "*.example.com"},
+		{"a.b.example.com", "default.example.org"},
+		{"example.com", "default.example.org"},
+		{"", "default.example.org"},
+	}
+
+	for _, tt := range tests {
+		if got := servedName(t, store, tt.sni); got != tt.expected {
+			t.Errorf("Expected %s for SNI %q, got %s", tt.expected, tt.sni, got)
+		}
+	}
+}
+
+func TestLoadDirectory(t *testing.T) {
+	dir := t.TempDir()
+	expires := time.Now().Add(90 * 24 * time.Hour)
+	writeCert(t, dir, "b", expires, "b.example.com")
+	writeCert(t, dir, "a", expires, "a.example.com")
+
+	store, err := New(Config{Dir: dir})
+	if err != nil {
+		t.Fatalf("Failed to create store: %v", err)
+	}
+
+	if got := servedName(t, store, "b.example.com"); got != "b.example.com" {
+		t.Errorf("Expected b.example.com, got %s", got)
+	}
+	// The first file by name is the default
+	if got := servedName(t, store, "other.example.com"); got != "a.example.com" {
+		t.Errorf("Expected a.example.com as the default, got %s", got)
+	}
+
+	os.Remove(filepath.Join(dir, "a.key"))
+	if _, err := New(Config{Dir: dir}); err == nil {
+		t.Error("Expected a certificate without a key to be rejected")
+	}
+}
+
+func TestReloadOnChange(t *testing.T) {
+	dir := t.TempDir()
+	expires := time.Now().Add(90 * 24 * time.Hour)
+	pair := writeCert(t, dir, "site", expires, "old.example.com")
+
+	store, err := New(Config{Pairs: []Pair{pair}})
+	if err != nil {
+		t.Fatalf("Failed to create store: %v", err)
+	}
+	before, _ := store.GetCertificate(&tls.ClientHelloInfo{ServerName: "old.example.com"})
+
+	// Unchanged files aren't reloaded
+	store.check()
+	if after, _ := store.GetCertificate(&tls.ClientHelloInfo{}); after != before {
+		t.Error("Expected unchanged files to keep the loaded certificate")
+	}
+
+	writeCert(t, dir, "site", expires, "new.example.com")
+	later := time.Now().Add(time.Minute)
+	os.Chtimes(pair.CertFile, later, later)
+	store.check()
+
+	if got := servedName(t, store, "new.example.com"); got != "new.example.com" {
+		t.Errorf("Expected the rotated certificate, got %s", got)
+	}
+
+	// A broken file keeps the current certificates in place
+	os.WriteFile(pair.CertFile, []byte("not a certificate"), 0o600)
+	store.check()
+
+	if got := servedName(t, store, "new.example.com"); got != "new.example.com" {
+		t.Errorf("Expected the previous certificate after a failed reload, got %s", got)
+	}
+}
+
+func TestExpiries(t *testing.T) {
+	var logs bytes.Buffer
+	log.SetOutput(&logs)
+	defer log.SetOutput(os.Stderr)
+
+	dir := t.TempDir()
+	store, err := New(Config{
+		Pairs: []Pair{
+			writeCert(t, dir, "later", time.Now().Add(90*24*time.Hour), "later.example.com"),
+			writeCert(t, dir, "soon", time.Now().Add(5*24*time.Hour), "soon.example.com"),
+		},
+		ExpiryWarning: 10 * 24 * time.Hour,
+	})
+	if err != nil {
+		t.Fatalf("Failed to create store: %v", err)
+	}
+
+	expiries := store.Expiries()
+	if len(expiries) != 2 || expiries[0].Names[0] != "soon.example.com" {
+		t.Fatalf("Expected the soonest expiry first, got %+v", expiries)
+	}
+	if expiries[0].DaysRemaining != 4 {
+		t.Errorf("Expected 4 full days remaining, got %d", expiries[0].DaysRemaining)
+	}
+
+	if !strings.Contains(logs.String(), "soon.example.com") || strings.Contains(logs.String(), "later.example.com") {
+		t.Errorf("Expected a warning for the expiring certificate only, got %q", logs.String())
+	}
+
+	// Each certificate is warned about once per load
+	logs.Reset()
+	store.check()
+	if logs.Len() != 0 {
+		t.Errorf("Expected no repeated warning, got %q", logs.String())
+	}
+}
+
+func TestLoadRejectsExpired(t *testing.T) {
+	pair := writeCert(t, t.TempDir(), "expired", time.Now().Add(-time.Minute), "expired.example.com")
+
+	if _, err := Load(pair.CertFile, pair.KeyFile); err == nil || !strings.Contains(err.Error(), "expired") {
+		t.Errorf("Expected an expired certificate to be rejected, got %v", err)
+	}
+	if _, err := New(Config{}); err == nil {
+		t.Error("Expected a store without certificates to be rejected")
+	}
+}
@@ -1,9 +1,14 @@
 package circuitbreaker
 
 import (
+	"bufio"
+	"io"
+	"net"
 	"net/http"
 	"sync"
 	"time"
+
+	"github.com/oabraham1/go-http-proxy/internal/grpc"
 )
 
 type State int
@@ -113,14 +118,24 @@ func (cb *CircuitBreaker) Reset() {
 func (cb *CircuitBreaker) Wrap(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		if !cb.Allow() {
-			http.Error(w, "Service Unavailable", http.StatusServiceUnavailable)
+			if grpc.IsGRPC(r.Header.Get("Content-Type")) {
+				grpc.WriteError(w, grpc.Unavailable, "Service Unavailable")
+			} else {
+				http.Error(w, "Service Unavailable", http.StatusServiceUnavailable)
+			}
 			return
 		}
 
 		sw := &statusWriter{ResponseWriter: w}
 		next.ServeHTTP(sw, r)
 
-		if sw.status >= 500 {
+		// gRPC calls fail with a 200 and report the outcome in grpc-status
+		status := sw.status
+		if code, _, ok := grpc.Status(sw.Header()); ok && status == http.StatusOK {
+			status = grpc.HTTPStatus(code)
+		}
+
+		if status >= 500 {
 			cb.Failure()
 		} else {
 			cb.Success()
@@ -145,3 +160,31 @@ func (w *statusWriter) Write(b []byte) (int, error) {
 	}
 	return w.ResponseWriter.Write(b)
 }
+
+func (w *statusWriter) ReadFrom(src io.Reader) (int64, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	return io.Copy(w.ResponseWriter, src)
+}
+
+func (w *statusWriter) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (w *statusWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	h, ok := w.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, http.ErrNotSupported
+	}
+	// The connection leaves HTTP, so there is no failure to report
+	w.status = http.StatusSwitchingProtocols
+	return h.Hijack()
+}
+
+// Unwrap lets http.ResponseController reach the underlying writer
+func (w *statusWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
@@ -1,6 +1,9 @@
 package circuitbreaker
 
 import (
+	"io"
+	"net/http"
+	"net/http/httptest"
 	"testing"
 	"time"
 )
@@ -122,3 +125,54 @@ func TestStateTransitions(t *testing.T) {
 		t.Errorf("state after success = %v, want %v", state, StateClosed)
 	}
 }
+
+func TestWrapPreservesWriterInterfaces(t *testing.T) {
+	cb := New("test", 1, time.Second)
+
+	handler := cb.Wrap(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if _, ok := w.(http.Hijacker); !ok {
+			t.Error("expected wrapped writer to implement http.Hijacker")
+		}
+		if _, ok := w.(io.ReaderFrom); !ok {
+			t.Error("expected wrapped writer to implement io.ReaderFrom")
+		}
+		w.Write([]byte("chunk"))
+		w.(http.Flusher).Flush()
+	}))
+
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest("GET", "/", nil))
+
+	if !rec.Flushed {
+		t.Error("expected response to be flushed")
+	}
+	if cb.GetState() != StateClosed {
+		t.Errorf("expected breaker to stay closed, got %v", cb.GetState())
+	}
+}
+
+func TestWrapCountsGRPCFailures(t *testing.T) {
+	cb := New("test", 1, time.Minute)
+
+	handler := cb.Wrap(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/grpc")
+		w.Header().Set("Trailer", "Grpc-Status")
+		w.WriteHeader(http.StatusOK)
+		w.Header().Set("Grpc-Status", "14")
+	}))
+
+	req := httptest.NewRequest("POST", "/pkg.Service/Method", nil)
+	req.Header.Set("Content-Type", "application/grpc")
+
+	handler.ServeHTTP(httptest.NewRecorder(), req)
+	if cb.GetState() != StateOpen {
+		t.Fatalf("expected UNAVAILABLE to open the breaker, got %v", cb.GetState())
+	}
+
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+	if rec.Code != http.StatusOK || rec.Header().Get("Grpc-Status") != "14" {
+		t.Errorf("expected a gRPC UNAVAILABLE rejection, got %d with grpc-status %q",
+			rec.Code, rec.Header().Get("Grpc-Status"))
+	}
+}
@@ -1,6 +1,7 @@
 package config
 
 import (
+	"fmt"
 	"os"
 	"time"
 
@@ -14,8 +15,15 @@ type Config struct {
         WriteTimeout   time.Duration `yaml:"writeTimeout"`
         MaxHeaderBytes int           `yaml:"maxHeaderBytes"`
         TLS           *TLSConfig    `yaml:"tls,omitempty"`  // Add TLS config here
+        // H2C accepts cleartext HTTP/2, with prior knowledge or through an
+        // h2c upgrade, as native gRPC clients expect
+        H2C           bool          `yaml:"h2c"`
+        HTTP3         *HTTP3Config  `yaml:"http3,omitempty"`
     } `yaml:"server"`
 
+    // ResponseTimeout bounds the wait for an upstream response's headers;
+    // streamed bodies may take longer, and gRPC calls are bounded by their
+    // grpc-timeout instead.
     Proxy struct {
         MaxIdleConns        int           `yaml:"maxIdleConns"`
         MaxConnsPerHost     int           `yaml:"maxConnsPerHost"`
@@ -29,6 +37,17 @@ type Config struct {
         Timeout     time.Duration `yaml:"timeout"`
     } `yaml:"circuitBreaker"`
 
+    // TrustedProxies lists the addresses or CIDRs of proxies in front of
+    // this one whose X-Forwarded-* and Forwarded headers are believed.
+    // Those headers are replaced when sent by anyone else.
+    TrustedProxies []string `yaml:"trustedProxies,omitempty"`
+
+    ForwardProxy *ForwardProxyConfig `yaml:"forwardProxy,omitempty"`
+
+    LoadBalancer LoadBalancerConfig `yaml:"loadBalancer"`
+    HealthCheck  HealthCheckConfig  `yaml:"healthCheck"`
+    Retry        *RetryConfig       `yaml:"retries,omitempty"`
+
     Tracing struct {
         Enabled     bool    `yaml:"enabled"`
         ServiceName string  `yaml:"serviceName"`
@@ -36,10 +55,7 @@ type Config struct {
         SampleRate  float64 `yaml:"sampleRate"`
     } `yaml:"tracing"`
 
-    Cache struct {
-        Enabled bool          `yaml:"enabled"`
-        TTL     time.Duration `yaml:"ttl"`
-    } `yaml:"cache"`
+    Cache CacheConfig `yaml:"cache"`
 
     RateLimit struct {
         Enabled bool    `yaml:"enabled"`
@@ -61,17 +77,303 @@ type Config struct {
             AllowCredentials bool     `yaml:"allowCredentials"`
             MaxAge          int      `yaml:"maxAge"`
         } `yaml:"cors"`
+        JWT *JWTConfig `yaml:"jwt,omitempty"`
     } `yaml:"security"`
 
     Services map[string]ServiceConfig `yaml:"services"`
 }
 
+// ServiceConfig describes an upstream service. Protocol is auto (default)
+// to negotiate HTTP/2 over TLS and use HTTP/1.1 otherwise, h2c to speak
+// HTTP/2 with prior knowledge over cleartext, or h2 to require HTTP/2 over
+// TLS. gRPC backends need h2c or h2. TLS sets how HTTPS backends are
+// reached.
 type ServiceConfig struct {
-    URL            string            `yaml:"url"`
-    Timeout        time.Duration     `yaml:"timeout"`
-    RateLimit      *RateLimitConfig  `yaml:"rateLimit,omitempty"`
-    CircuitBreaker *BreakerConfig    `yaml:"circuitBreaker,omitempty"`
-    Headers        map[string]string `yaml:"headers,omitempty"`
+    URL            string              `yaml:"url"`
+    Protocol       string              `yaml:"protocol,omitempty"`
+    Routes         []RouteConfig       `yaml:"routes,omitempty"`
+    Backends       []BackendConfig     `yaml:"backends,omitempty"`
+    LoadBalancer   *LoadBalancerConfig `yaml:"loadBalancer,omitempty"`
+    HealthCheck    *HealthCheckConfig  `yaml:"healthCheck,omitempty"`
+    Outlier        *OutlierConfig      `yaml:"outlierDetection,omitempty"`
+    Retry          *RetryConfig        `yaml:"retries,omitempty"`
+    Hedge          *HedgeConfig        `yaml:"hedging,omitempty"`
+    Timeout        time.Duration       `yaml:"timeout"`
+    RateLimit      *RateLimitConfig    `yaml:"rateLimit,omitempty"`
+    CircuitBreaker *BreakerConfig      `yaml:"circuitBreaker,omitempty"`
+    Headers        map[string]string   `yaml:"headers,omitempty"`
+    TLS            *UpstreamTLSConfig  `yaml:"tls,omitempty"`
+}
+
+// UpstreamTLSConfig is the TLS a service's backends are reached with.
+// CertFile and KeyFile are a client certificate presented to backends that
+// require one, and CAFile replaces the system roots when verifying them.
+// ServerName overrides the name verified and sent as SNI.
+// InsecureSkipVerify turns verification off and is meant for testing.
+type UpstreamTLSConfig struct {
+    CertFile           string `yaml:"certFile,omitempty"`
+    KeyFile            string `yaml:"keyFile,omitempty"`
+    CAFile             string `yaml:"caFile,omitempty"`
+    ServerName         string `yaml:"serverName,omitempty"`
+    InsecureSkipVerify bool   `yaml:"insecureSkipVerify"`
+}
+
+// RouteConfig matches requests to a service. Services without routes are
+// served under /<service>. Host may start with "*." to match any subdomain.
+// PathType is prefix (default), exact or regex; prefix and exact paths may
+// use templates such as /api/users/{id}. An empty header or query value
+// only requires presence. Routes are tried by descending Priority, longer
+// paths first. Timeout, RateLimit and Retry replace the service's; Auth
+// requires a Bearer token valid for Security.JWT. Cache set to true caches
+// responses even when the global cache is disabled, and set to false
+// bypasses it. GRPCService matches gRPC calls to a fully qualified
+// service ("pkg.Service"), narrowed by GRPCMethod, in place of Path.
+// GRPCWeb also accepts gRPC-Web calls from browsers, translated to gRPC for
+// the backend, with CORS preflights answered from Security.CORS.
+// ClientCert needs Server.TLS.ClientCAFile and is request (default) to
+// accept requests with or without a client certificate, require to insist
+// on one, or verify to insist on one issued by the client CA.
+type RouteConfig struct {
+    Name        string            `yaml:"name,omitempty"`
+    Host        string            `yaml:"host,omitempty"`
+    Path        string            `yaml:"path"`
+    PathType    string            `yaml:"pathType,omitempty"`
+    Methods     []string          `yaml:"methods,omitempty"`
+    Headers     map[string]string `yaml:"headers,omitempty"`
+    Query       map[string]string `yaml:"query,omitempty"`
+    SourceCIDRs []string          `yaml:"sourceCIDRs,omitempty"`
+    Priority    int               `yaml:"priority"`
+    Timeout     time.Duration     `yaml:"timeout,omitempty"`
+    Auth        bool              `yaml:"auth"`
+    Cache       *bool             `yaml:"cache,omitempty"`
+    RateLimit   *RateLimitConfig  `yaml:"rateLimit,omitempty"`
+    Retry       *RetryConfig      `yaml:"retries,omitempty"`
+    Rewrite     *RewriteConfig    `yaml:"rewrite,omitempty"`
+    GRPCService string            `yaml:"grpcService,omitempty"`
+    GRPCMethod  string            `yaml:"grpcMethod,omitempty"`
+    GRPCWeb     bool              `yaml:"grpcWeb"`
+    ClientCert  string            `yaml:"clientCert,omitempty"`
+
+    // FlushInterval bounds how long streamed response data may wait before
+    // it is flushed to the client; negative flushes after every write.
+    // Event streams and bodies of unknown length are always flushed at once.
+    FlushInterval time.Duration `yaml:"flushInterval,omitempty"`
+
+    Upgrade *UpgradeConfig `yaml:"upgrade,omitempty"`
+}
+
+// JWTConfig validates the Bearer tokens of routes with Auth. Tokens must be
+// signed with Secret using HS256, HS384 or HS512 and unexpired; Issuer and
+// Audience, when set, must match their iss and aud claims.
+type JWTConfig struct {
+    Secret   string `yaml:"secret"`
+    Issuer   string `yaml:"issuer,omitempty"`
+    Audience string `yaml:"audience,omitempty"`
+}
+
+// UpgradeConfig limits the upgraded connections, such as WebSockets, a
+// route carries. Subprotocols lists the WebSocket subprotocols clients may
+// negotiate; empty allows any. MaxConnections of zero is unlimited, and
+// tunnels idle for IdleTimeout (default 5m) in both directions are closed.
+type UpgradeConfig struct {
+    Subprotocols   []string      `yaml:"subprotocols,omitempty"`
+    MaxConnections int           `yaml:"maxConnections"`
+    IdleTimeout    time.Duration `yaml:"idleTimeout"`
+}
+
+// RewriteConfig changes the path sent upstream before it is joined to the
+// backend URL's path. StripPrefix, ReplacePrefix and Regex are exclusive;
+// ReplacePrefix swaps the route's literal prefix path, and Replacement may
+// reference Regex capture groups as $1 or ${name}. AddPrefix is applied
+// last. HostHeader is preserve (default) to forward the client's Host or
+// upstream to send the backend's.
+type RewriteConfig struct {
+    StripPrefix   string `yaml:"stripPrefix,omitempty"`
+    ReplacePrefix string `yaml:"replacePrefix,omitempty"`
+    Regex         string `yaml:"regex,omitempty"`
+    Replacement   string `yaml:"replacement,omitempty"`
+    AddPrefix     string `yaml:"addPrefix,omitempty"`
+    HostHeader    string `yaml:"hostHeader,omitempty"`
+}
+
+// ForwardProxyConfig lets clients reach arbitrary destinations through
+// absolute-form requests and CONNECT tunnels. Hosts are exact names or
+// "*.example.com"; deny lists win, and empty allow lists allow anything
+// but ports, which default to 80 and 443. CIDRs apply to the resolved
+// addresses, and loopback, link-local, private and unspecified ones are
+// denied unless AllowCIDRs covers them. Credentials maps users to
+// passwords for Proxy-Authorization basic auth, which is off without any.
+// Connection and bandwidth (bytes per second) limits apply per user, or per
+// address without auth. Tunnels idle for IdleTimeout (default 5m) are
+// closed.
+type ForwardProxyConfig struct {
+    Enabled            bool              `yaml:"enabled"`
+    AllowHosts         []string          `yaml:"allowHosts,omitempty"`
+    DenyHosts          []string          `yaml:"denyHosts,omitempty"`
+    AllowPorts         []int             `yaml:"allowPorts,omitempty"`
+    AllowCIDRs         []string          `yaml:"allowCIDRs,omitempty"`
+    DenyCIDRs          []string          `yaml:"denyCIDRs,omitempty"`
+    Credentials        map[string]string `yaml:"credentials,omitempty"`
+    Realm              string            `yaml:"realm,omitempty"`
+    MaxConnsPerClient  int               `yaml:"maxConnsPerClient"`
+    BandwidthPerClient int               `yaml:"bandwidthPerClient"`
+    IdleTimeout        time.Duration     `yaml:"idleTimeout"`
+    Intercept          *InterceptConfig  `yaml:"intercept,omitempty"`
+}
+
+// InterceptConfig terminates CONNECT tunnels with leaf certificates signed
+// by a local CA, so the decrypted requests go through filters, the cache
+// and logging. Clients must trust the CA. CacheSize bounds the leaf
+// certificates kept (default 1000). Bypass lists hosts, in the forward
+// proxy's host syntax, that are tunnelled untouched, such as those that pin
+// their certificates.
+type InterceptConfig struct {
+    Enabled    bool     `yaml:"enabled"`
+    CACertFile string   `yaml:"caCertFile"`
+    CAKeyFile  string   `yaml:"caKeyFile"`
+    CacheSize  int      `yaml:"cacheSize"`
+    Bypass     []string `yaml:"bypass,omitempty"`
+}
+
+// BackendConfig is one upstream host of a service. Services that list
+// backends ignore URL.
+type BackendConfig struct {
+    URL    string `yaml:"url"`
+    Weight int    `yaml:"weight"`
+}
+
+// CacheConfig enables the response cache. TTL is the lifetime of responses
+// that don't give their own, MaxSize bounds the bytes kept in memory or on
+// disk (0 is unlimited) and CleanupInterval is how often expired responses
+// are dropped (default 1m). The first of Rules matching a request applies.
+type CacheConfig struct {
+    Enabled         bool             `yaml:"enabled"`
+    TTL             time.Duration    `yaml:"ttl"`
+    MaxSize         int64            `yaml:"maxSize"`
+    CleanupInterval time.Duration    `yaml:"cleanupInterval"`
+    Rules           []CacheRule      `yaml:"rules,omitempty"`
+    Store           CacheStoreConfig `yaml:"store"`
+}
+
+// CacheStoreConfig selects where cached responses are kept: "memory" (the
+// default), "disk" under Dir, which survives restarts, or "redis", which
+// replicas share. LocalMaxSize, if set, puts an in-memory tier of that
+// many bytes in front of a disk or Redis store. That tier looks at the
+// store again once its copy is LocalTTL old (default 5s), so other
+// replicas' updates and purges can take that long to show. While the store
+// fails, unexpired copies keep being served.
+type CacheStoreConfig struct {
+    Type         string           `yaml:"type"`
+    Dir          string           `yaml:"dir,omitempty"`
+    Redis        CacheRedisConfig `yaml:"redis,omitempty"`
+    LocalMaxSize int64            `yaml:"localMaxSize"`
+    LocalTTL     time.Duration    `yaml:"localTTL,omitempty"`
+}
+
+// CacheRedisConfig locates the Redis server of a shared cache. Keys start
+// with Prefix (default "go-http-proxy:cache:").
+type CacheRedisConfig struct {
+    Addr     string `yaml:"addr"`
+    Username string `yaml:"username,omitempty"`
+    Password string `yaml:"password,omitempty"`
+    DB       int    `yaml:"db"`
+    Prefix   string `yaml:"prefix,omitempty"`
+}
+
+// CacheRule applies to requests whose path matches Path, where a trailing
+// "*" matches any suffix, and whose method is in Methods (any if empty).
+// TTL replaces the cache's and MaxSize bounds each body kept.
+// StaleWhileRevalidate and StaleIfError say how long past their lifetime
+// responses may be served while they're refreshed or when the origin
+// fails, unless the origin sets those directives itself. Responses are
+// keyed by method, host, path and sorted query: IgnoreHost leaves the host
+// out, Query keeps only the listed parameters, IgnoreQuery drops some and
+// Headers adds the values of request headers. VaryBy adds "principal" (the
+// client certificate or credentials), "cookie:<name>" or "header:<name>";
+// a bare name is a header.
+type CacheRule struct {
+    Path                 string        `yaml:"path"`
+    Methods              []string      `yaml:"methods,omitempty"`
+    TTL                  time.Duration `yaml:"ttl"`
+    MaxSize              int64         `yaml:"maxSize"`
+    StaleWhileRevalidate time.Duration `yaml:"staleWhileRevalidate"`
+    StaleIfError         time.Duration `yaml:"staleIfError"`
+    IgnoreHost           bool          `yaml:"ignoreHost"`
+    Query                []string      `yaml:"query,omitempty"`
+    IgnoreQuery          []string      `yaml:"ignoreQuery,omitempty"`
+    Headers              []string      `yaml:"headers,omitempty"`
+    VaryBy               []string      `yaml:"varyBy,omitempty"`
+}
+
+// LoadBalancerConfig selects how requests are spread across backends.
+// Algorithm is one of round-robin, weighted-round-robin, least-connections,
+// random-two-choices or consistent-hash. HashKey applies to consistent-hash
+// only: ip (default), path, header:<name> or cookie:<name>.
+type LoadBalancerConfig struct {
+    Algorithm string `yaml:"algorithm"`
+    HashKey   string `yaml:"hashKey,omitempty"`
+}
+
+// HealthCheckConfig configures active health checks. The top-level block
+// provides defaults; a service's block overrides them field by field.
+// Only services with a block, or every service when the top-level one is
+// set, are checked and have failing backends taken out of rotation.
+// Probes use the service's protocol and TLS settings and are bounded by
+// Timeout as a whole. ExpectedStatus is a single code or an inclusive
+// range such as "200-399".
+type HealthCheckConfig struct {
+    Path               string            `yaml:"path"`
+    Method             string            `yaml:"method,omitempty"`
+    ExpectedStatus     string            `yaml:"expectedStatus,omitempty"`
+    BodyContains       string            `yaml:"bodyContains,omitempty"`
+    Interval           time.Duration     `yaml:"interval"`
+    Timeout            time.Duration     `yaml:"timeout"`
+    HealthyThreshold   int               `yaml:"healthyThreshold"`
+    UnhealthyThreshold int               `yaml:"unhealthyThreshold"`
+    Headers            map[string]string `yaml:"headers,omitempty"`
+}
+
+// OutlierConfig ejects backends based on the outcome of live requests.
+// Each detector is off while its threshold is zero.
+type OutlierConfig struct {
+    Consecutive5xx           int           `yaml:"consecutive5xx"`
+    ConsecutiveGatewayErrors int           `yaml:"consecutiveGatewayErrors"`
+    SuccessRateStdevFactor   float64       `yaml:"successRateStdevFactor"`
+    SuccessRateMinHosts      int           `yaml:"successRateMinHosts"`
+    SuccessRateRequestVolume int           `yaml:"successRateRequestVolume"`
+    Interval                 time.Duration `yaml:"interval"`
+    BaseEjectionTime         time.Duration `yaml:"baseEjectionTime"`
+    MaxEjectionTime          time.Duration `yaml:"maxEjectionTime"`
+    MaxEjectionPercent       int           `yaml:"maxEjectionPercent"`
+}
+
+// RetryConfig controls retries of failed upstream attempts. A route's
+// block replaces its service's, which replaces the top-level one. RetryOn
+// lists conditions from connect-failure, reset, gateway-error and 5xx;
+// StatusCodes adds specific codes. Retries in flight are held to
+// BudgetPercent of the requests in flight, though MinRetries are always
+// allowed.
+type RetryConfig struct {
+    MaxAttempts        int           `yaml:"maxAttempts"`
+    RetryOn            []string      `yaml:"retryOn,omitempty"`
+    StatusCodes        []int         `yaml:"statusCodes,omitempty"`
+    BackoffBase        time.Duration `yaml:"backoffBase"`
+    BackoffMax         time.Duration `yaml:"backoffMax"`
+    RetryNonIdempotent bool          `yaml:"retryNonIdempotent"`
+    BudgetPercent      float64       `yaml:"budgetPercent"`
+    MinRetries         int           `yaml:"minRetries"`
+    MaxBodyBytes       int64         `yaml:"maxBodyBytes"`
+}
+
+// HedgeConfig sends a second attempt to another backend when the first is
+// slow to answer. Delay is a fixed wait; Percentile derives the wait from
+// the service's recent latencies, using Delay until enough are observed.
+// MaxInFlight caps the hedges under way, each counting until it's cancelled
+// or its response has been sent. Only idempotent requests are hedged.
+type HedgeConfig struct {
+    Delay       time.Duration `yaml:"delay"`
+    Percentile  float64       `yaml:"percentile"`
+    MaxInFlight int           `yaml:"maxInFlight"`
 }
 
 type RateLimitConfig struct {
@@ -84,12 +386,84 @@ type BreakerConfig struct {
     Timeout     time.Duration `yaml:"timeout"`
 }
 
+// HTTP3Config serves HTTP/3 over QUIC next to the TCP listener, with the
+// same TLS settings, which must be enabled. Port is the UDP port and
+// defaults to the server's port. TCP responses advertise it in Alt-Svc.
+type HTTP3Config struct {
+    Enabled bool `yaml:"enabled"`
+    Port    int  `yaml:"port,omitempty"`
+}
+
+// TLSConfig terminates HTTPS. Versions are "1.0" to "1.3"; MinVersion
+// defaults to 1.2 and MaxVersion to the newest. CipherSuites takes Go's
+// names for TLS 1.2 suites, as TLS 1.3 suites aren't configurable. Curves
+// takes X25519, P-256, P-384 and P-521, and ALPN defaults to h2 and
+// http/1.1. A RedirectPort serves plain HTTP that redirects to HTTPS.
+//
+// Certificates are picked by SNI name, exact names before wildcards, from
+// CertFile, Certificates and the <name>.crt/<name>.key pairs in CertDir.
+// The first one is the default for other names. Files are checked every
+// ReloadInterval (default 30s) and reloaded when they change, and a warning
+// is logged for certificates within ExpiryWarning (default 720h) of expiry.
+//
+// OCSPStapling staples each certificate's OCSP response, refreshed
+// halfway to its expiry.
+//
+// ClientCAFile asks clients for certificates, which are verified against
+// its CAs and checked per route by RouteConfig.ClientCert, and
+// ClientRevocation rejects revoked ones. ACME obtains certificates for its
+// hosts in addition to, or instead of, the files.
 type TLSConfig struct {
-    Enabled      bool     `yaml:"enabled"`
-    CertFile     string   `yaml:"certFile"`
-    KeyFile      string   `yaml:"keyFile"`
-    MinVersion   string   `yaml:"minVersion"`
-    CipherSuites []string `yaml:"cipherSuites"`
+    Enabled          bool                `yaml:"enabled"`
+    CertFile         string              `yaml:"certFile"`
+    KeyFile          string              `yaml:"keyFile"`
+    Certificates     []CertificateConfig `yaml:"certificates,omitempty"`
+    CertDir          string              `yaml:"certDir,omitempty"`
+    ReloadInterval   time.Duration       `yaml:"reloadInterval,omitempty"`
+    ExpiryWarning    time.Duration       `yaml:"expiryWarning,omitempty"`
+    MinVersion       string              `yaml:"minVersion"`
+    MaxVersion       string              `yaml:"maxVersion,omitempty"`
+    CipherSuites     []string            `yaml:"cipherSuites"`
+    Curves           []string            `yaml:"curves,omitempty"`
+    ALPN             []string            `yaml:"alpn,omitempty"`
+    RedirectPort     int                 `yaml:"redirectPort,omitempty"`
+    OCSPStapling     bool                `yaml:"ocspStapling"`
+    ClientCAFile     string              `yaml:"clientCAFile,omitempty"`
+    ClientRevocation *RevocationConfig   `yaml:"clientRevocation,omitempty"`
+    ACME             *ACMEConfig         `yaml:"acme,omitempty"`
+}
+
+// RevocationConfig checks client certificates against CRLFile, a PEM or
+// DER CRL reread when it changes, and with OCSP against Responder or else
+// each certificate's own responder. Certificates whose status can't be
+// learnt are rejected unless FailOpen is set.
+type RevocationConfig struct {
+    CRLFile   string `yaml:"crlFile,omitempty"`
+    OCSP      bool   `yaml:"ocsp"`
+    Responder string `yaml:"responder,omitempty"`
+    FailOpen  bool   `yaml:"failOpen"`
+}
+
+// ACMEConfig gets and renews certificates for Hosts from an ACME CA.
+// DirectoryURL defaults to Let's Encrypt, and DirectoryCAFile lets a test
+// CA such as Pebble be trusted. The account key and certificates are kept
+// in StorageDir and renewed RenewBefore expiry (default 720h). TLS-ALPN-01
+// challenges are answered on the HTTPS port and HTTP-01 challenges on
+// RedirectPort; without RedirectPort only TLS-ALPN-01 is used.
+type ACMEConfig struct {
+    Enabled         bool          `yaml:"enabled"`
+    Hosts           []string      `yaml:"hosts"`
+    Email           string        `yaml:"email,omitempty"`
+    DirectoryURL    string        `yaml:"directoryURL,omitempty"`
+    DirectoryCAFile string        `yaml:"directoryCAFile,omitempty"`
+    StorageDir      string        `yaml:"storageDir"`
+    RenewBefore     time.Duration `yaml:"renewBefore,omitempty"`
+}
+
+// CertificateConfig is a certificate served for the names it covers
+type CertificateConfig struct {
+    CertFile string `yaml:"certFile"`
+    KeyFile  string `yaml:"keyFile"`
 }
 
 func Load(path string) (*Config, error) {
@@ -102,6 +476,35 @@ func Load(path string) (*Config, error) {
     if err := yaml.Unmarshal(data, &config); err != nil {
         return nil, err
     }
+    if err := config.validate(); err != nil {
+        return nil, err
+    }
 
     return &config, nil
 }
+
+// validate rejects settings that load but can't work or aren't safe.
+// Credentials can't be allowed from any CORS origin, and routes with Auth
+// need Security.JWT, as nothing else could validate their tokens.
+func (c *Config) validate() error {
+    cors := c.Security.CORS
+    if cors.Enabled && cors.AllowCredentials {
+        for _, origin := range cors.AllowedOrigins {
+            if origin == "*" {
+                return fmt.Errorf("security.cors: allowCredentials needs origins listed by name, not \"*\"")
+            }
+        }
+    }
+
+    if c.Security.JWT != nil {
+        return nil
+    }
+    for service, sc := range c.Services {
+        for _, rc := range sc.Routes {
+            if rc.Auth {
+                return fmt.Errorf("service %s route %s: auth requires security.jwt", service, rc.Path)
+            }
+        }
+    }
+    return nil
+}
@@ -0,0 +1,218 @@
+package egress
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"net"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestCheckHost(t *testing.T) {
+	policy, err := New(Config{
+		AllowHosts: []string{"*.example.com", "api.test"},
+		DenyHosts:  []string{"admin.example.com"},
+		AllowPorts: []int{443, 8443},
+		DenyCIDRs:  []string{"10.0.0.0/8"},
+	})
+	if err != nil {
+		t.Fatalf("Failed to create policy: %v", err)
+	}
+
+	tests := []struct {
+		name    string
+		host    string
+		port    int
+		allowed bool
+	}{
+		{"wildcard subdomain", "www.example.com", 443, true},
+		{"exact host", "API.test", 8443, true},
+		{"wildcard excludes apex", "example.com", 443, false},
+		{"denied host", "admin.example.com", 443, false},
+		{"unlisted host", "other.org", 443, false},
+		{"port not allowed", "www.example.com", 80, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := policy.CheckHost(tt.host, tt.port)
+			if tt.allowed && err != nil {
+				t.Errorf("Expected %s:%d to be allowed, got %v", tt.host, tt.port, err)
+			}
+			if !tt.allowed && !errors.Is(err, ErrDenied) {
+				t.Errorf("Expected %s:%d to be denied, got %v", tt.host, tt.port, err)
+			}
+		})
+	}
+}
+
+func TestCheckIP(t *testing.T) {
+	policy, err := New(Config{
+		AllowCIDRs: []string{"192.168.0.0/16", "127.0.0.0/8"},
+		DenyCIDRs:  []string{"192.168.1.0/24"},
+	})
+	if err != nil {
+		t.Fatalf("Failed to create policy: %v", err)
+	}
+
+	tests := []struct {
+		ip      string
+		allowed bool
+	}{
+		{"192.168.2.10", true},
+		{"127.0.0.1", true},
+		{"192.168.1.10", false},
+		{"8.8.8.8", false},
+	}
+
+	for _, tt := range tests {
+		err := policy.CheckIP(net.ParseIP(tt.ip))
+		if (err == nil) != tt.allowed {
+			t.Errorf("Expected allowed=%v for %s, got %v", tt.allowed, tt.ip, err)
+		}
+	}
+
+	// Literal addresses are checked against the CIDRs before dialling
+	if err := policy.CheckHost("192.168.1.10", 443); !errors.Is(err, ErrDenied) {
+		t.Errorf("Expected literal address to be denied, got %v", err)
+	}
+}
+
+func TestCheckIPInternalAddresses(t *testing.T) {
+	policy, err := New(Config{})
+	if err != nil {
+		t.Fatalf("Failed to create policy: %v", err)
+	}
+
+	tests := []struct {
+		ip      string
+		allowed bool
+	}{
+		{"8.8.8.8", true},
+		{"2001:4860:4860::8888", true},
+		{"127.0.0.1", false},
+		{"::1", false},
+		{"10.1.2.3", false},
+		{"172.16.0.1", false},
+		{"192.168.1.1", false},
+		{"fd00::1", false},
+		{"169.254.169.254", false},
+		{"fe80::1", false},
+		{"0.0.0.0", false},
+		{"::", false},
+		{"::ffff:127.0.0.1", false},
+	}
+
+	for _, tt := range tests {
+		err := policy.CheckIP(net.ParseIP(tt.ip))
+		if (err == nil) != tt.allowed {
+			t.Errorf("Expected allowed=%v for %s, got %v", tt.allowed, tt.ip, err)
+		}
+	}
+
+	// A literal internal address is refused before any dial
+	if err := policy.CheckHost("169.254.169.254", 80); !errors.Is(err, ErrDenied) {
+		t.Errorf("Expected metadata address to be denied, got %v", err)
+	}
+}
+
+func TestNewRejectsInvalidConfig(t *testing.T) {
+	if _, err := New(Config{AllowCIDRs: []string{"not-a-cidr"}}); err == nil {
+		t.Error("Expected invalid CIDR to be rejected")
+	}
+	if _, err := New(Config{AllowPorts: []int{70000}}); err == nil {
+		t.Error("Expected invalid port to be rejected")
+	}
+}
+
+func TestDialContextChecksResolvedAddress(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	defer ln.Close()
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			conn.Close()
+		}
+	}()
+	port := ln.Addr().(*net.TCPAddr).Port
+	addr := net.JoinHostPort("localhost", strconv.Itoa(port))
+
+	// Loopback is only reachable when allowed explicitly
+	defaults, _ := New(Config{AllowPorts: []int{port}})
+	if _, err := defaults.DialContext(context.Background(), "tcp", addr); !errors.Is(err, ErrDenied) {
+		t.Errorf("Expected loopback address to be denied by default, got %v", err)
+	}
+
+	allowLoopback, _ := New(Config{
+		AllowPorts: []int{port},
+		AllowCIDRs: []string{"127.0.0.0/8", "::1/128"},
+	})
+	conn, err := allowLoopback.DialContext(context.Background(), "tcp", addr)
+	if err != nil {
+		t.Fatalf("Expected dial to succeed, got %v", err)
+	}
+	conn.Close()
+
+	denyLoopback, _ := New(Config{
+		AllowPorts: []int{port},
+		AllowCIDRs: []string{"127.0.0.0/8", "::1/128"},
+		DenyCIDRs:  []string{"127.0.0.0/8", "::1/128"},
+	})
+	if _, err := denyLoopback.DialContext(context.Background(), "tcp", addr); !errors.Is(err, ErrDenied) {
+		t.Errorf("Expected loopback address to be denied, got %v", err)
+	}
+}
+
+func TestLimiterConnections(t *testing.T) {
+	limiter := NewLimiter(2, 0)
+
+	first, err := limiter.Acquire("alice")
+	if err != nil {
+		t.Fatalf("Expected first connection, got %v", err)
+	}
+	if _, err := limiter.Acquire("alice"); err != nil {
+		t.Fatalf("Expected second connection, got %v", err)
+	}
+	if _, err := limiter.Acquire("alice"); !errors.Is(err, ErrTooManyConnections) {
+		t.Errorf("Expected third connection to be refused, got %v", err)
+	}
+	if _, err := limiter.Acquire("bob"); err != nil {
+		t.Errorf("Expected other clients to be unaffected, got %v", err)
+	}
+
+	first.Release()
+	if _, err := limiter.Acquire("alice"); err != nil {
+		t.Errorf("Expected released connection to be reusable, got %v", err)
+	}
+}
+
+func TestLimiterBandwidth(t *testing.T) {
+	limiter := NewLimiter(0, 1000)
+	client, _ := limiter.Acquire("alice")
+	defer client.Release()
+
+	data := bytes.Repeat([]byte("x"), 1500)
+	start := time.Now()
+	got, err := io.ReadAll(client.Reader(context.Background(), bytes.NewReader(data)))
+	if err != nil {
+		t.Fatalf("Failed to read: %v", err)
+	}
+	elapsed := time.Since(start)
+
+	if len(got) != len(data) {
+		t.Errorf("Expected %d bytes, got %d", len(data), len(got))
+	}
+	// The first 1000 bytes fill the burst; the rest wait half a second
+	if elapsed < 400*time.Millisecond {
+		t.Errorf("Expected reads to be throttled, took %v", elapsed)
+	}
+}
@@ -0,0 +1,104 @@
+package egress
+
+import (
+	"context"
+	"errors"
+	"io"
+	"sync"
+
+	"golang.org/x/time/rate"
+)
+
+// ErrTooManyConnections is returned when a client already has as many
+// connections open as it may
+var ErrTooManyConnections = errors.New("too many connections")
+
+// Limiter caps the concurrent connections and the bandwidth of each
+// client. A zero limit is unlimited.
+type Limiter struct {
+	maxConns  int
+	bandwidth int // bytes per second
+
+	mu      sync.Mutex
+	clients map[string]*Client
+}
+
+// Client is a client's share of a Limiter. Its bandwidth is shared by all
+// its connections.
+type Client struct {
+	limiter *Limiter
+	key     string
+	conns   int
+	bucket  *rate.Limiter
+}
+
+func NewLimiter(maxConns, bandwidth int) *Limiter {
+	return &Limiter{
+		maxConns:  maxConns,
+		bandwidth: bandwidth,
+		clients:   make(map[string]*Client),
+	}
+}
+
+// Acquire reserves a connection for the client identified by key. Release
+// must be called once the connection is done.
+func (l *Limiter) Acquire(key string) (*Client, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	c, ok := l.clients[key]
+	if !ok {
+		c = &Client{limiter: l, key: key}
+		if l.bandwidth > 0 {
+			c.bucket = rate.NewLimiter(rate.Limit(l.bandwidth), l.bandwidth)
+		}
+		l.clients[key] = c
+	}
+
+	if l.maxConns > 0 && c.conns >= l.maxConns {
+		return nil, ErrTooManyConnections
+	}
+	c.conns++
+	return c, nil
+}
+
+// Release returns a connection. Clients without connections are forgotten.
+func (c *Client) Release() {
+	l := c.limiter
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	c.conns--
+	if c.conns <= 0 {
+		delete(l.clients, c.key)
+	}
+}
+
+// Reader throttles reads from r to the client's bandwidth
+func (c *Client) Reader(ctx context.Context, r io.Reader) io.Reader {
+	if c.bucket == nil {
+		return r
+	}
+	return &throttledReader{ctx: ctx, r: r, bucket: c.bucket}
+}
+
+type throttledReader struct {
+	ctx    context.Context
+	r      io.Reader
+	bucket *rate.Limiter
+}
+
+func (t *throttledReader) Read(p []byte) (int, error) {
+	// A single read may not take more than the bucket holds
+	if burst := t.bucket.Burst(); len(p) > burst {
+		p = p[:burst]
+	}
+
+	n, err := t.r.Read(p)
+	if n > 0 {
+		if werr := t.bucket.WaitN(t.ctx, n); werr != nil && err == nil {
+			err = werr
+		}
+	}
+	return n, err
+}
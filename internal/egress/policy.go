@@ -0,0 +1,190 @@
+package egress
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// ErrDenied is returned for destinations the policy doesn't allow
+var ErrDenied = errors.New("destination not allowed")
+
+// defaultPorts are the destination ports allowed when none are configured
+var defaultPorts = []int{80, 443}
+
+// Config describes the destinations a forward proxy may reach. Hosts are
+// exact names or "*.example.com" for any subdomain. Deny rules win over
+// allow rules, and empty allow lists allow everything except AllowPorts,
+// which defaults to 80 and 443. CIDRs apply to the resolved addresses;
+// loopback, link-local, private and unspecified addresses are denied
+// unless AllowCIDRs covers them.
+type Config struct {
+	AllowHosts []string
+	DenyHosts  []string
+	AllowPorts []int
+	AllowCIDRs []string
+	DenyCIDRs  []string
+}
+
+// Policy decides which destinations may be reached
+type Policy struct {
+	allowHosts []string
+	denyHosts  []string
+	ports      map[int]bool
+	allowNets  []*net.IPNet
+	denyNets   []*net.IPNet
+	resolver   *net.Resolver
+	dialer     net.Dialer
+}
+
+func New(config Config) (*Policy, error) {
+	p := &Policy{
+		allowHosts: config.AllowHosts,
+		denyHosts:  config.DenyHosts,
+		ports:      make(map[int]bool),
+		resolver:   net.DefaultResolver,
+	}
+
+	ports := config.AllowPorts
+	if len(ports) == 0 {
+		ports = defaultPorts
+	}
+	for _, port := range ports {
+		if port < 1 || port > 65535 {
+			return nil, fmt.Errorf("invalid port %d", port)
+		}
+		p.ports[port] = true
+	}
+
+	var err error
+	if p.allowNets, err = parseCIDRs(config.AllowCIDRs); err != nil {
+		return nil, err
+	}
+	if p.denyNets, err = parseCIDRs(config.DenyCIDRs); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+// CheckHost reports whether a destination host and port may be reached,
+// before its addresses are known
+func (p *Policy) CheckHost(host string, port int) error {
+	if !p.ports[port] {
+		return fmt.Errorf("%w: port %d", ErrDenied, port)
+	}
+
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	if MatchHost(p.denyHosts, host) {
+		return fmt.Errorf("%w: host %s", ErrDenied, host)
+	}
+	if len(p.allowHosts) > 0 && !MatchHost(p.allowHosts, host) {
+		return fmt.Errorf("%w: host %s", ErrDenied, host)
+	}
+
+	if ip := net.ParseIP(host); ip != nil {
+		return p.CheckIP(ip)
+	}
+	return nil
+}
+
+// CheckIP reports whether a resolved destination address may be reached
+func (p *Policy) CheckIP(ip net.IP) error {
+	if containsIP(p.denyNets, ip) {
+		return fmt.Errorf("%w: address %s", ErrDenied, ip)
+	}
+	if containsIP(p.allowNets, ip) {
+		return nil
+	}
+	if len(p.allowNets) > 0 {
+		return fmt.Errorf("%w: address %s", ErrDenied, ip)
+	}
+	if internal(ip) {
+		return fmt.Errorf("%w: internal address %s", ErrDenied, ip)
+	}
+	return nil
+}
+
+// internal reports whether ip is only reachable from inside the proxy's
+// network, the proxy itself and cloud metadata endpoints included
+func internal(ip net.IP) bool {
+	return ip.IsLoopback() || ip.IsPrivate() || ip.IsUnspecified() ||
+		ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast()
+}
+
+// DialContext connects to addr after checking the host, port and every
+// address it resolves to. The checked address is dialled, so a second DNS
+// answer can't point the connection elsewhere.
+func (p *Policy) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	host, portStr, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	port, err := strconv.Atoi(portStr)
+	if err != nil {
+		return nil, fmt.Errorf("invalid port %q", portStr)
+	}
+	if err := p.CheckHost(host, port); err != nil {
+		return nil, err
+	}
+
+	addrs, err := p.resolver.LookupIPAddr(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+
+	var lastErr error = fmt.Errorf("%w: %s has no allowed address", ErrDenied, host)
+	for _, ip := range addrs {
+		if err := p.CheckIP(ip.IP); err != nil {
+			lastErr = err
+			continue
+		}
+
+		conn, err := p.dialer.DialContext(ctx, network, net.JoinHostPort(ip.IP.String(), portStr))
+		if err == nil {
+			return conn, nil
+		}
+		lastErr = err
+	}
+	return nil, lastErr
+}
+
+// MatchHost reports whether host matches one of patterns, which are exact
+// names or "*.example.com" for any subdomain. Case is ignored.
+func MatchHost(patterns []string, host string) bool {
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	for _, pattern := range patterns {
+		pattern = strings.ToLower(pattern)
+		if suffix, ok := strings.CutPrefix(pattern, "*"); ok {
+			if len(host) > len(suffix) && strings.HasSuffix(host, suffix) {
+				return true
+			}
+		} else if pattern == host {
+			return true
+		}
+	}
+	return false
+}
+
+func containsIP(networks []*net.IPNet, ip net.IP) bool {
+	for _, network := range networks {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+func parseCIDRs(cidrs []string) ([]*net.IPNet, error) {
+	networks := make([]*net.IPNet, 0, len(cidrs))
+	for _, cidr := range cidrs {
+		_, network, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, fmt.Errorf("invalid CIDR: %w", err)
+		}
+		networks = append(networks, network)
+	}
+	return networks, nil
+}
@@ -0,0 +1,115 @@
+package grpc
+
+import (
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestParseTimeout(t *testing.T) {
+	tests := []struct {
+		value   string
+		want    time.Duration
+		wantErr bool
+	}{
+		{value: "1H", want: time.Hour},
+		{value: "2M", want: 2 * time.Minute},
+		{value: "5S", want: 5 * time.Second},
+		{value: "100m", want: 100 * time.Millisecond},
+		{value: "250u", want: 250 * time.Microsecond},
+		{value: "99999999n", want: 99999999 * time.Nanosecond},
+		{value: "99999999H", want: math.MaxInt64},
+		{value: "10", wantErr: true},
+		{value: "m", wantErr: true},
+		{value: "10s", wantErr: true},
+		{value: "-1S", wantErr: true},
+		{value: "123456789S", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.value, func(t *testing.T) {
+			got, err := ParseTimeout(tt.value)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("ParseTimeout(%q) error = %v, wantErr %v", tt.value, err, tt.wantErr)
+			}
+			if err == nil && got != tt.want {
+				t.Errorf("ParseTimeout(%q) = %v, want %v", tt.value, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestStatus(t *testing.T) {
+	tests := []struct {
+		name        string
+		header      http.Header
+		wantCode    Code
+		wantMessage string
+		wantOK      bool
+	}{
+		{name: "missing", header: http.Header{}, wantOK: false},
+		{
+			name:     "header",
+			header:   http.Header{"Grpc-Status": {"0"}},
+			wantCode: OK, wantOK: true,
+		},
+		{
+			name:     "encoded message",
+			header:   http.Header{"Grpc-Status": {"14"}, "Grpc-Message": {"backend%20down"}},
+			wantCode: Unavailable, wantMessage: "backend down", wantOK: true,
+		},
+		{
+			name:     "undeclared trailer",
+			header:   http.Header{http.TrailerPrefix + "Grpc-Status": {"4"}},
+			wantCode: DeadlineExceeded, wantOK: true,
+		},
+		{
+			name:     "malformed",
+			header:   http.Header{"Grpc-Status": {"oops"}},
+			wantCode: Unknown, wantOK: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			code, message, ok := Status(tt.header)
+			if ok != tt.wantOK || code != tt.wantCode || message != tt.wantMessage {
+				t.Errorf("Status() = %v, %q, %v, want %v, %q, %v",
+					code, message, ok, tt.wantCode, tt.wantMessage, tt.wantOK)
+			}
+		})
+	}
+}
+
+func TestWriteError(t *testing.T) {
+	rec := httptest.NewRecorder()
+	WriteError(rec, Unavailable, "no backend: 100% busy")
+
+	if rec.Code != http.StatusOK {
+		t.Errorf("expected status 200, got %d", rec.Code)
+	}
+
+	code, message, ok := Status(rec.Header())
+	if !ok || code != Unavailable || message != "no backend: 100% busy" {
+		t.Errorf("expected UNAVAILABLE round trip, got %v %q %v", code, message, ok)
+	}
+	if got := rec.Header().Get("Grpc-Message"); got != "no backend: 100%25 busy" {
+		t.Errorf("expected percent-encoded message, got %q", got)
+	}
+}
+
+func TestIsGRPC(t *testing.T) {
+	for contentType, want := range map[string]bool{
+		"application/grpc":       true,
+		"application/grpc+proto": true,
+		"application/grpc-web":   false,
+		"application/grpcfoo":    false,
+		"application/json":       false,
+	} {
+		if got := IsGRPC(contentType); got != want {
+			t.Errorf("IsGRPC(%q) = %v, want %v", contentType, got, want)
+		}
+	}
+}
@@ -0,0 +1,240 @@
+package grpc
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/binary"
+	"io"
+	"net/http"
+	"strings"
+)
+
+// Content types of gRPC-Web requests. The text variant base64-encodes the
+// body in both directions.
+const (
+	WebContentType     = "application/grpc-web"
+	WebTextContentType = "application/grpc-web-text"
+)
+
+// trailerFlag marks the frame that carries trailers in a gRPC-Web body
+const trailerFlag = 0x80
+
+// IsWeb reports whether a Content-Type denotes gRPC-Web, binary or text
+func IsWeb(contentType string) bool {
+	return hasMediaType(contentType, WebContentType) || hasMediaType(contentType, WebTextContentType)
+}
+
+func hasMediaType(contentType, mediaType string) bool {
+	return contentType == mediaType ||
+		strings.HasPrefix(contentType, mediaType+"+") ||
+		strings.HasPrefix(contentType, mediaType+";")
+}
+
+// WebHandler translates gRPC-Web calls into native gRPC for next, and its
+// responses back. Trailers are moved into the final frame of the body, as
+// browsers can't read HTTP trailers. Other requests pass through untouched.
+func WebHandler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		contentType := r.Header.Get("Content-Type")
+		if !IsWeb(contentType) {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		text := hasMediaType(contentType, WebTextContentType)
+		mediaType := WebContentType
+		if text {
+			mediaType = WebTextContentType
+		}
+		suffix := strings.TrimPrefix(contentType, mediaType)
+
+		r = r.Clone(r.Context())
+		r.Header.Set("Content-Type", ContentType+suffix)
+		r.Header.Set("Te", "trailers")
+		if text {
+			r.Body = &textDecoder{src: r.Body}
+			r.ContentLength = -1
+			r.Header.Del("Content-Length")
+		}
+
+		ww := &webResponseWriter{ResponseWriter: w, text: text}
+		next.ServeHTTP(ww, r)
+		ww.finish()
+	})
+}
+
+// webResponseWriter turns a native gRPC response into a gRPC-Web one
+type webResponseWriter struct {
+	http.ResponseWriter
+	text         bool
+	wroteHeader  bool
+	trailersOnly bool
+	declared     []string
+}
+
+func (w *webResponseWriter) WriteHeader(code int) {
+	if w.wroteHeader {
+		return
+	}
+	w.wroteHeader = true
+
+	h := w.Header()
+	if contentType := h.Get("Content-Type"); IsGRPC(contentType) {
+		mediaType := WebContentType
+		if w.text {
+			mediaType = WebTextContentType
+		}
+		h.Set("Content-Type", mediaType+strings.TrimPrefix(contentType, ContentType))
+	}
+
+	// Trailers travel in the body, so the HTTP response declares none
+	for _, field := range h.Values("Trailer") {
+		for _, name := range strings.Split(field, ",") {
+			if name = strings.TrimSpace(name); name != "" {
+				w.declared = append(w.declared, http.CanonicalHeaderKey(name))
+			}
+		}
+	}
+	h.Del("Trailer")
+	h.Del("Content-Length")
+
+	// A status in the headers means there is no body and no trailers
+	w.trailersOnly = h.Get("Grpc-Status") != ""
+
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *webResponseWriter) Write(b []byte) (int, error) {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+	if !w.text {
+		return w.ResponseWriter.Write(b)
+	}
+
+	// Each write becomes its own padded base64 chunk, which gRPC-Web
+	// clients decode as they arrive
+	if _, err := io.WriteString(w.ResponseWriter, base64.StdEncoding.EncodeToString(b)); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+func (w *webResponseWriter) Flush() {
+	http.NewResponseController(w.ResponseWriter).Flush()
+}
+
+// Unwrap lets http.ResponseController reach the underlying writer
+func (w *webResponseWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// finish writes the trailers frame once the handler is done
+func (w *webResponseWriter) finish() {
+	if !w.wroteHeader || w.trailersOnly {
+		return
+	}
+
+	h := w.Header()
+	trailers := make(http.Header)
+	for _, name := range w.declared {
+		if values, ok := h[name]; ok {
+			trailers[name] = values
+			delete(h, name)
+		}
+	}
+	for key, values := range h {
+		if name, ok := strings.CutPrefix(key, http.TrailerPrefix); ok {
+			trailers[http.CanonicalHeaderKey(name)] = values
+			delete(h, key)
+		}
+	}
+
+	w.Write(trailerFrame(trailers))
+}
+
+// trailerFrame encodes trailers as the final frame of a gRPC-Web body
+func trailerFrame(trailers http.Header) []byte {
+	var block bytes.Buffer
+	for name, values := range trailers {
+		for _, value := range values {
+			block.WriteString(strings.ToLower(name))
+			block.WriteString(": ")
+			block.WriteString(value)
+			block.WriteString("\r\n")
+		}
+	}
+
+	frame := make([]byte, 5, 5+block.Len())
+	frame[0] = trailerFlag
+	binary.BigEndian.PutUint32(frame[1:], uint32(block.Len()))
+	return append(frame, block.Bytes()...)
+}
+
+// textDecoder decodes a grpc-web-text request body. Clients may send it as
+// several padded base64 chunks, so padding doesn't end the stream.
+type textDecoder struct {
+	src     io.ReadCloser
+	pending []byte // base64 not decoded yet
+	decoded []byte // decoded but not read yet
+	err     error
+}
+
+func (d *textDecoder) Read(p []byte) (int, error) {
+	for len(d.decoded) == 0 {
+		if d.err != nil {
+			return 0, d.err
+		}
+
+		buf := make([]byte, 4096)
+		n, err := d.src.Read(buf)
+		for _, c := range buf[:n] {
+			if c != '\r' && c != '\n' && c != ' ' && c != '\t' {
+				d.pending = append(d.pending, c)
+			}
+		}
+
+		complete := len(d.pending) / 4 * 4
+		decoded, decodeErr := decodeChunks(d.pending[:complete])
+		d.decoded = decoded
+		d.pending = append(d.pending[:0], d.pending[complete:]...)
+
+		switch {
+		case decodeErr != nil:
+			d.err = decodeErr
+		case err == io.EOF && len(d.pending) > 0:
+			d.err = io.ErrUnexpectedEOF
+		case err != nil:
+			d.err = err
+		}
+	}
+
+	n := copy(p, d.decoded)
+	d.decoded = d.decoded[n:]
+	return n, nil
+}
+
+func (d *textDecoder) Close() error {
+	return d.src.Close()
+}
+
+// decodeChunks decodes whole base64 quanta that may contain padding
+// between chunks
+func decodeChunks(data []byte) ([]byte, error) {
+	var out []byte
+	for len(data) > 0 {
+		end := len(data)
+		if i := bytes.IndexByte(data, '='); i >= 0 {
+			end = (i/4 + 1) * 4
+		}
+
+		chunk := make([]byte, base64.StdEncoding.DecodedLen(end))
+		n, err := base64.StdEncoding.Decode(chunk, data[:end])
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, chunk[:n]...)
+		data = data[end:]
+	}
+	return out, nil
+}
@@ -0,0 +1,137 @@
+package grpc
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/binary"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// nativeEcho answers like a gRPC backend behind the proxy, echoing the
+// request body and declaring its trailers
+func nativeEcho(t *testing.T) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if got := r.Header.Get("Content-Type"); got != "application/grpc+proto" {
+			t.Errorf("expected native content type, got %q", got)
+		}
+		if got := r.Header.Get("Te"); got != "trailers" {
+			t.Errorf("expected Te: trailers, got %q", got)
+		}
+
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			t.Errorf("reading body: %v", err)
+		}
+
+		w.Header().Set("Content-Type", "application/grpc+proto")
+		w.Header().Set("Trailer", "Grpc-Status")
+		w.WriteHeader(http.StatusOK)
+		w.Write(body)
+		w.Header().Set("Grpc-Status", "0")
+		w.Header().Set(http.TrailerPrefix+"Grpc-Message", "done")
+	})
+}
+
+// splitTrailers separates the data frames of a gRPC-Web body from its
+// trailers frame
+func splitTrailers(t *testing.T, body []byte) ([]byte, string) {
+	t.Helper()
+	for i := 0; i+5 <= len(body); {
+		size := int(binary.BigEndian.Uint32(body[i+1 : i+5]))
+		if body[i]&trailerFlag != 0 {
+			return body[:i], string(body[i+5 : i+5+size])
+		}
+		i += 5 + size
+	}
+	t.Fatalf("no trailers frame in %q", body)
+	return nil, ""
+}
+
+func TestWebHandler(t *testing.T) {
+	message := []byte{0, 0, 0, 0, 3, 'a', 'b', 'c'}
+	handler := WebHandler(nativeEcho(t))
+
+	t.Run("binary", func(t *testing.T) {
+		req := httptest.NewRequest("POST", "/pkg.Service/Method", bytes.NewReader(message))
+		req.Header.Set("Content-Type", "application/grpc-web+proto")
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+
+		if got := rec.Header().Get("Content-Type"); got != "application/grpc-web+proto" {
+			t.Errorf("expected grpc-web content type, got %q", got)
+		}
+		if rec.Header().Get("Trailer") != "" || len(rec.Result().Trailer) != 0 {
+			t.Errorf("expected no HTTP trailers, got %v", rec.Result().Trailer)
+		}
+
+		data, trailers := splitTrailers(t, rec.Body.Bytes())
+		if !bytes.Equal(data, message) {
+			t.Errorf("expected data %q, got %q", message, data)
+		}
+		if !strings.Contains(trailers, "grpc-status: 0\r\n") || !strings.Contains(trailers, "grpc-message: done\r\n") {
+			t.Errorf("unexpected trailers frame %q", trailers)
+		}
+	})
+
+	t.Run("text", func(t *testing.T) {
+		// Two padded chunks, as browsers may send them
+		encoded := base64.StdEncoding.EncodeToString(message[:4]) + base64.StdEncoding.EncodeToString(message[4:])
+		req := httptest.NewRequest("POST", "/pkg.Service/Method", strings.NewReader(encoded))
+		req.Header.Set("Content-Type", "application/grpc-web-text+proto")
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+
+		if got := rec.Header().Get("Content-Type"); got != "application/grpc-web-text+proto" {
+			t.Errorf("expected grpc-web-text content type, got %q", got)
+		}
+
+		body, err := decodeChunks(rec.Body.Bytes())
+		if err != nil {
+			t.Fatalf("response is not base64: %v", err)
+		}
+		data, trailers := splitTrailers(t, body)
+		if !bytes.Equal(data, message) {
+			t.Errorf("expected data %q, got %q", message, data)
+		}
+		if !strings.Contains(trailers, "grpc-status: 0\r\n") {
+			t.Errorf("unexpected trailers frame %q", trailers)
+		}
+	})
+
+	t.Run("trailers-only", func(t *testing.T) {
+		handler := WebHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			WriteError(w, Unavailable, "down")
+		}))
+		req := httptest.NewRequest("POST", "/pkg.Service/Method", nil)
+		req.Header.Set("Content-Type", "application/grpc-web")
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+
+		if rec.Header().Get("Grpc-Status") != "14" || rec.Body.Len() != 0 {
+			t.Errorf("expected status in headers and an empty body, got %v %q", rec.Header(), rec.Body.Bytes())
+		}
+		if got := rec.Header().Get("Content-Type"); got != "application/grpc-web" {
+			t.Errorf("expected grpc-web content type, got %q", got)
+		}
+	})
+
+	t.Run("other requests untouched", func(t *testing.T) {
+		handler := WebHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if _, ok := w.(*webResponseWriter); ok {
+				t.Error("expected the writer to be left alone")
+			}
+		}))
+		handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+	})
+}
+
+func TestTextDecoderRejectsTruncatedInput(t *testing.T) {
+	d := &textDecoder{src: io.NopCloser(strings.NewReader("YWJjZA=="[:6]))}
+	if _, err := io.ReadAll(d); err != io.ErrUnexpectedEOF {
+		t.Errorf("expected io.ErrUnexpectedEOF, got %v", err)
+	}
+}
@@ -6,8 +6,9 @@ import (
 	"io"
 	"net/http"
 	"net/url"
+	"strconv"
+	"strings"
 	"sync"
-	"sync/atomic"
 	"time"
 )
 
@@ -17,6 +18,48 @@ type Status struct {
 	Message   string    `json:"message,omitempty"`
 }
 
+// CheckConfig describes how a target is probed. Zero values fall back to
+// GET <url>/health expecting a 2xx within the checker's interval, with a
+// single result enough to flip the verdict.
+type CheckConfig struct {
+	Path               string
+	Method             string
+	ExpectedStatus     string // A single code ("204") or an inclusive range ("200-399")
+	BodyContains       string
+	Interval           time.Duration
+	Timeout            time.Duration
+	HealthyThreshold   int
+	UnhealthyThreshold int
+	Headers            map[string]string
+}
+
+// Target is a single endpoint of a service probed by the checker
+type Target struct {
+	Service string
+	URL     string
+	Check   CheckConfig
+
+	// Transport reaches targets that need their own protocol or TLS
+	// settings; others are probed over HTTP/1.1
+	Transport http.RoundTripper
+
+	// OnChange is called whenever the target's verdict flips
+	OnChange func(Status)
+}
+
+type target struct {
+	Target
+	client    *http.Client
+	statusMin int
+	statusMax int
+
+	status    Status
+	checked   bool
+	successes int
+	failures  int
+	mu        sync.Mutex
+}
+
 type Metrics struct {
 	healthyServices   int64
 	unhealthyServices int64
@@ -26,7 +69,7 @@ type Metrics struct {
 }
 
 type Checker struct {
-	services map[string]string
+	targets  []*target
 	status   sync.Map
 	client   *http.Client
 	interval time.Duration
@@ -34,9 +77,11 @@ type Checker struct {
 	stopCh   chan struct{}
 }
 
+// maxBodyBytes bounds how much of a health check response is read
+const maxBodyBytes = 64 * 1024
+
 func NewChecker(services map[string]string, interval time.Duration) *Checker {
-	return &Checker{
-		services: services,
+	c := &Checker{
 		client: &http.Client{
 			Timeout: 5 * time.Second,
 			Transport: &http.Transport{
@@ -55,21 +100,74 @@ func NewChecker(services map[string]string, interval time.Duration) *Checker {
 		metrics:  &Metrics{},
 		stopCh:   make(chan struct{}),
 	}
+
+	for name, url := range services {
+		// The default check config is always valid
+		_ = c.AddTarget(Target{Service: name, URL: url})
+	}
+
+	return c
 }
 
+// AddTarget registers an endpoint to probe. It must be called before Start.
+func (c *Checker) AddTarget(t Target) error {
+	statusMin, statusMax, err := parseStatusRange(t.Check.ExpectedStatus)
+	if err != nil {
+		return fmt.Errorf("health check for %s: %w", t.Service, err)
+	}
+
+	// A check's own timeout replaces the client's, response headers
+	// included
+	client := c.client
+	if t.Transport != nil || t.Check.Timeout > 0 {
+		transport := t.Transport
+		if transport == nil {
+			defaultTransport := c.client.Transport.(*http.Transport).Clone()
+			defaultTransport.ResponseHeaderTimeout = t.Check.Timeout
+			transport = defaultTransport
+		}
+		timeout := c.client.Timeout
+		if t.Check.Timeout > 0 {
+			timeout = t.Check.Timeout
+		}
+		client = &http.Client{Timeout: timeout, Transport: transport}
+	}
+
+	c.targets = append(c.targets, &target{
+		Target:    t,
+		client:    client,
+		statusMin: statusMin,
+		statusMax: statusMax,
+		status:    Status{Healthy: true},
+	})
+	return nil
+}
+
+// Start probes every target immediately and then on its interval
 func (c *Checker) Start() {
-	ticker := time.NewTicker(c.interval)
-	go func() {
-		defer ticker.Stop()
-		for {
-			select {
-			case <-ticker.C:
-				c.checkServices()
-			case <-c.stopCh:
-				return
-			}
+	for _, t := range c.targets {
+		go c.run(t)
+	}
+}
+
+func (c *Checker) run(t *target) {
+	interval := t.Check.Interval
+	if interval <= 0 {
+		interval = c.interval
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		c.checkTarget(t)
+
+		select {
+		case <-ticker.C:
+		case <-c.stopCh:
+			return
 		}
-	}()
+	}
 }
 
 func (c *Checker) Stop() {
@@ -82,39 +180,107 @@ func (c *Checker) Stop() {
 	}
 }
 
-func (c *Checker) checkServices() {
-	healthy := int64(0)
-	unhealthy := int64(0)
+func (c *Checker) checkTarget(t *target) {
 	start := time.Now()
+	result := c.checkService(t)
+
+	t.mu.Lock()
+	if result.Healthy {
+		t.successes++
+		t.failures = 0
+	} else {
+		t.failures++
+		t.successes = 0
+	}
 
-	var wg sync.WaitGroup
-	for name, url := range c.services {
-		wg.Add(1)
-		go func(name, url string) {
-			defer wg.Done()
-			status := c.checkService(url)
-			c.status.Store(name, status)
-
-			if status.Healthy {
-				atomic.AddInt64(&healthy, 1)
-			} else {
-				atomic.AddInt64(&unhealthy, 1)
-			}
-		}(name, url)
+	healthy := t.status.Healthy
+	if !healthy && t.successes >= threshold(t.Check.HealthyThreshold) {
+		healthy = true
+	} else if healthy && t.failures >= threshold(t.Check.UnhealthyThreshold) {
+		healthy = false
+	}
+	changed := healthy != t.status.Healthy
+
+	t.status = Status{
+		Healthy:   healthy,
+		LastCheck: result.LastCheck,
+		Message:   result.Message,
 	}
+	t.checked = true
+	status := t.status
+	t.mu.Unlock()
 
-	wg.Wait()
+	if changed && t.OnChange != nil {
+		t.OnChange(status)
+	}
+
+	c.updateService(t.Service)
 
-	// Update metrics
 	c.metrics.mu.Lock()
-	c.metrics.healthyServices = healthy
-	c.metrics.unhealthyServices = unhealthy
 	c.metrics.totalChecks++
 	c.metrics.lastCheckDuration = time.Since(start)
 	c.metrics.mu.Unlock()
 }
 
-func (c *Checker) checkService(url string) Status {
+// updateService recomputes a service's status from its targets. A service
+// stays healthy while at least one of its targets is.
+func (c *Checker) updateService(service string) {
+	var status Status
+	total, unhealthy := 0, 0
+	var lastFailure string
+
+	for _, t := range c.targets {
+		if t.Service != service {
+			continue
+		}
+
+		t.mu.Lock()
+		ts, checked := t.status, t.checked
+		t.mu.Unlock()
+
+		if !checked {
+			continue
+		}
+
+		total++
+		if ts.LastCheck.After(status.LastCheck) {
+			status.LastCheck = ts.LastCheck
+		}
+		if ts.Healthy {
+			status.Healthy = true
+		} else {
+			unhealthy++
+			lastFailure = ts.Message
+		}
+	}
+
+	switch {
+	case total == 1:
+		status.Message = lastFailure
+	case unhealthy > 0:
+		status.Message = fmt.Sprintf("%d of %d backends unhealthy: %s", unhealthy, total, lastFailure)
+	}
+
+	c.status.Store(service, status)
+
+	healthy := int64(0)
+	unhealthyServices := int64(0)
+	c.status.Range(func(_, value interface{}) bool {
+		if value.(Status).Healthy {
+			healthy++
+		} else {
+			unhealthyServices++
+		}
+		return true
+	})
+
+	c.metrics.mu.Lock()
+	c.metrics.healthyServices = healthy
+	c.metrics.unhealthyServices = unhealthyServices
+	c.metrics.mu.Unlock()
+}
+
+func (c *Checker) checkService(t *target) Status {
 	// Initialize status with current time
 	status := Status{
 		LastCheck: time.Now(),
@@ -122,47 +288,102 @@ func (c *Checker) checkService(url string) Status {
 	}
 
 	// Validate URL format first
-	_, err := validateURL(url)
+	_, err := validateURL(t.URL)
 	if err != nil {
 		status.Message = fmt.Sprintf("Invalid URL: %v", err)
 		return status
 	}
 
-	ctx, cancel := context.WithTimeout(context.Background(), c.client.Timeout)
+	timeout := t.Check.Timeout
+	if timeout <= 0 {
+		timeout = t.client.Timeout
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
 	defer cancel()
 
-	req, err := http.NewRequestWithContext(ctx, "GET", url+"/health", nil)
+	method := t.Check.Method
+	if method == "" {
+		method = http.MethodGet
+	}
+	path := t.Check.Path
+	if path == "" {
+		path = "/health"
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, strings.TrimSuffix(t.URL, "/")+path, nil)
 	if err != nil {
 		status.Message = fmt.Sprintf("Failed to create request: %v", err)
 		return status
 	}
 
 	req.Header.Set("User-Agent", "ProxyHealthCheck/1.0")
+	for k, v := range t.Check.Headers {
+		if http.CanonicalHeaderKey(k) == "Host" {
+			req.Host = v
+			continue
+		}
+		req.Header.Set(k, v)
+	}
 
-	resp, err := c.client.Do(req)
+	resp, err := t.client.Do(req)
 	if err != nil {
 		status.Message = fmt.Sprintf("Request failed: %v", err)
 		return status
 	}
 	defer resp.Body.Close()
 
-	// Read and discard body with timeout
-	bodyReader := io.LimitReader(resp.Body, 1024) // Limit body read to 1KB
-	_, err = io.Copy(io.Discard, bodyReader)
+	// Read a bounded amount of the body, keeping it for the content check
+	body, err := io.ReadAll(io.LimitReader(resp.Body, maxBodyBytes))
 	if err != nil {
 		status.Message = fmt.Sprintf("Failed to read response body: %v", err)
 		return status
 	}
 
-	if resp.StatusCode != http.StatusOK {
+	if resp.StatusCode < t.statusMin || resp.StatusCode > t.statusMax {
 		status.Message = fmt.Sprintf("Unexpected status code: %s", resp.Status)
 		return status
 	}
 
+	if t.Check.BodyContains != "" && !strings.Contains(string(body), t.Check.BodyContains) {
+		status.Message = fmt.Sprintf("Response body does not contain %q", t.Check.BodyContains)
+		return status
+	}
+
 	status.Healthy = true
 	return status
 }
 
+// parseStatusRange parses "200" or "200-399", defaulting to any 2xx
+func parseStatusRange(s string) (int, int, error) {
+	if s == "" {
+		return 200, 299, nil
+	}
+
+	first, last, isRange := strings.Cut(s, "-")
+	low, err := strconv.Atoi(strings.TrimSpace(first))
+	if err != nil {
+		return 0, 0, fmt.Errorf("invalid expected status %q", s)
+	}
+	high := low
+	if isRange {
+		if high, err = strconv.Atoi(strings.TrimSpace(last)); err != nil {
+			return 0, 0, fmt.Errorf("invalid expected status %q", s)
+		}
+	}
+
+	if low < 100 || high > 599 || low > high {
+		return 0, 0, fmt.Errorf("invalid expected status %q", s)
+	}
+	return low, high, nil
+}
+
+func threshold(n int) int {
+	if n < 1 {
+		return 1
+	}
+	return n
+}
+
 // validateURL checks if the URL is valid
 func validateURL(rawURL string) (*url.URL, error) {
 	parsedURL, err := url.Parse(rawURL)
@@ -203,7 +424,7 @@ func (c *Checker) WaitForFirstCheck(timeout time.Duration) error {
 		case <-timeoutCh:
 			return fmt.Errorf("timeout waiting for first health check")
 		case <-ticker.C:
-			if c.metrics.totalChecks > 0 {
+			if c.allChecked() {
 				return nil
 			}
 		case <-c.stopCh:
@@ -212,6 +433,18 @@ func (c *Checker) WaitForFirstCheck(timeout time.Duration) error {
 	}
 }
 
+func (c *Checker) allChecked() bool {
+	for _, t := range c.targets {
+		t.mu.Lock()
+		checked := t.checked
+		t.mu.Unlock()
+		if !checked {
+			return false
+		}
+	}
+	return true
+}
+
 func (c *Checker) GetStatus(service string) (Status, bool) {
 	if status, ok := c.status.Load(service); ok {
 		return status.(Status), true
@@ -228,6 +461,23 @@ func (c *Checker) GetAllStatus() map[string]Status {
 	return result
 }
 
+// GetBackendStatus returns the status of each checked target of a service,
+// keyed by URL
+func (c *Checker) GetBackendStatus(service string) map[string]Status {
+	result := make(map[string]Status)
+	for _, t := range c.targets {
+		if t.Service != service {
+			continue
+		}
+		t.mu.Lock()
+		if t.checked {
+			result[t.URL] = t.status
+		}
+		t.mu.Unlock()
+	}
+	return result
+}
+
 // GetMetrics returns the current health check metrics
 func (c *Checker) GetMetrics() HealthMetrics {
 	c.metrics.mu.RLock()
@@ -1,11 +1,18 @@
 package health
 
 import (
+	"context"
+	"crypto/tls"
+	"net"
 	"net/http"
 	"net/http/httptest"
 	"strings"
+	"sync/atomic"
 	"testing"
 	"time"
+
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
 )
 
 func TestHealthChecker(t *testing.T) {
@@ -236,3 +243,231 @@ func TestHealthCheckerVariousInvalidURLs(t *testing.T) {
 		})
 	}
 }
+
+func TestHealthCheckerThresholds(t *testing.T) {
+	var failing atomic.Bool
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if failing.Load() {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer server.Close()
+
+	changes := make(chan Status, 10)
+	checker := NewChecker(nil, 20*time.Millisecond)
+	err := checker.AddTarget(Target{
+		Service: "test",
+		URL:     server.URL,
+		Check: CheckConfig{
+			HealthyThreshold:   2,
+			UnhealthyThreshold: 3,
+		},
+		OnChange: func(status Status) { changes <- status },
+	})
+	if err != nil {
+		t.Fatalf("failed to add target: %v", err)
+	}
+
+	failing.Store(true)
+	checker.Start()
+	defer checker.Stop()
+
+	select {
+	case status := <-changes:
+		if status.Healthy {
+			t.Fatal("expected first change to mark the target unhealthy")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("timed out waiting for target to become unhealthy")
+	}
+
+	if total := checker.GetMetrics().TotalChecks; total < 3 {
+		t.Errorf("target ejected after %d checks, want at least 3", total)
+	}
+
+	failing.Store(false)
+
+	select {
+	case status := <-changes:
+		if !status.Healthy {
+			t.Fatal("expected second change to mark the target healthy")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("timed out waiting for target to recover")
+	}
+
+	if status, ok := checker.GetStatus("test"); !ok || !status.Healthy {
+		t.Error("expected service to be reported healthy after recovery")
+	}
+}
+
+func TestHealthCheckerCheckConfig(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/ready" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		if r.Header.Get("X-Health-Check") != "true" {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		w.WriteHeader(http.StatusAccepted)
+		w.Write([]byte(`{"status":"ready"}`))
+	}))
+	defer server.Close()
+
+	tests := []struct {
+		name        string
+		check       CheckConfig
+		wantHealthy bool
+		wantMsg     string
+	}{
+		{
+			name: "matching config",
+			check: CheckConfig{
+				Path:           "/ready",
+				ExpectedStatus: "200-299",
+				BodyContains:   `"ready"`,
+				Headers:        map[string]string{"X-Health-Check": "true"},
+			},
+			wantHealthy: true,
+		},
+		{
+			name: "unexpected status",
+			check: CheckConfig{
+				Path:           "/ready",
+				ExpectedStatus: "200",
+				Headers:        map[string]string{"X-Health-Check": "true"},
+			},
+			wantMsg: "Unexpected status code",
+		},
+		{
+			name: "missing body substring",
+			check: CheckConfig{
+				Path:         "/ready",
+				BodyContains: "alive",
+				Headers:      map[string]string{"X-Health-Check": "true"},
+			},
+			wantMsg: "does not contain",
+		},
+		{
+			name: "missing custom header",
+			check: CheckConfig{
+				Path: "/ready",
+			},
+			wantMsg: "Unexpected status code",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			checker := NewChecker(nil, time.Second)
+			if err := checker.AddTarget(Target{Service: "test", URL: server.URL, Check: tt.check}); err != nil {
+				t.Fatalf("failed to add target: %v", err)
+			}
+			checker.Start()
+			defer checker.Stop()
+
+			if err := checker.WaitForFirstCheck(time.Second); err != nil {
+				t.Fatalf("Failed to wait for first check: %v", err)
+			}
+
+			status := checker.GetBackendStatus("test")[server.URL]
+			if status.Healthy != tt.wantHealthy {
+				t.Errorf("got healthy %v, want %v (%s)", status.Healthy, tt.wantHealthy, status.Message)
+			}
+			if !strings.Contains(status.Message, tt.wantMsg) {
+				t.Errorf("expected message containing %q, got %q", tt.wantMsg, status.Message)
+			}
+		})
+	}
+}
+
+func TestHealthCheckerTargetClient(t *testing.T) {
+	// Answers only HTTP/2 over cleartext
+	h2cOnly := httptest.NewServer(h2c.NewHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.ProtoMajor != 2 {
+			w.WriteHeader(http.StatusHTTPVersionNotSupported)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	}), &http2.Server{}))
+	defer h2cOnly.Close()
+
+	// Takes longer than the default response header timeout
+	slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(2500 * time.Millisecond)
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer slow.Close()
+
+	h2cTransport := &http2.Transport{
+		AllowHTTP: true,
+		DialTLSContext: func(ctx context.Context, network, addr string, _ *tls.Config) (net.Conn, error) {
+			var d net.Dialer
+			return d.DialContext(ctx, network, addr)
+		},
+	}
+
+	tests := []struct {
+		name        string
+		target      Target
+		wantHealthy bool
+	}{
+		{
+			name:   "h2c without transport",
+			target: Target{URL: h2cOnly.URL},
+		},
+		{
+			name:        "h2c with transport",
+			target:      Target{URL: h2cOnly.URL, Transport: h2cTransport},
+			wantHealthy: true,
+		},
+		{
+			name:   "slow within default timeout",
+			target: Target{URL: slow.URL},
+		},
+		{
+			name:        "slow within check timeout",
+			target:      Target{URL: slow.URL, Check: CheckConfig{Timeout: 4 * time.Second}},
+			wantHealthy: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			checker := NewChecker(nil, time.Minute)
+			tt.target.Service = "test"
+			if err := checker.AddTarget(tt.target); err != nil {
+				t.Fatalf("failed to add target: %v", err)
+			}
+			checker.Start()
+			defer checker.Stop()
+
+			if err := checker.WaitForFirstCheck(5 * time.Second); err != nil {
+				t.Fatalf("Failed to wait for first check: %v", err)
+			}
+
+			status := checker.GetBackendStatus("test")[tt.target.URL]
+			if status.Healthy != tt.wantHealthy {
+				t.Errorf("got healthy %v, want %v (%s)", status.Healthy, tt.wantHealthy, status.Message)
+			}
+		})
+	}
+}
+
+func TestHealthCheckerInvalidExpectedStatus(t *testing.T) {
+	for _, expected := range []string{"abc", "500-200", "200-", "99"} {
+		checker := NewChecker(nil, time.Second)
+		err := checker.AddTarget(Target{
+			Service: "test",
+			URL:     "http://localhost",
+			Check:   CheckConfig{ExpectedStatus: expected},
+		})
+		if err == nil {
+			t.Errorf("expected an error for expected status %q", expected)
+		}
+	}
+}
@@ -0,0 +1,125 @@
+package hedge
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// windowSize is the number of recent latencies the percentile is taken over
+	windowSize = 1000
+	// minSamples is the number of latencies needed before trusting the percentile
+	minSamples = 20
+	// recomputeEvery controls how many observations the cached percentile lives for
+	recomputeEvery = 50
+)
+
+// Config describes when a second attempt is sent
+type Config struct {
+	Delay       time.Duration // Fixed delay, also used until enough latencies are observed
+	Percentile  float64       // Hedge when an attempt is slower than this percentile of recent latencies
+	MaxInFlight int           // Cap on concurrent hedged attempts
+}
+
+// Hedger decides when a slow upstream attempt deserves a second one
+type Hedger struct {
+	config   Config
+	inFlight atomic.Int64
+
+	mu         sync.Mutex
+	samples    []time.Duration
+	next       int
+	observed   int
+	cached     time.Duration
+	cachedSeen int
+}
+
+func New(config Config) (*Hedger, error) {
+	if config.Delay <= 0 && config.Percentile <= 0 {
+		return nil, fmt.Errorf("hedging needs a delay or a latency percentile")
+	}
+	if config.Percentile < 0 || config.Percentile >= 100 {
+		return nil, fmt.Errorf("invalid hedging percentile %v", config.Percentile)
+	}
+	if config.MaxInFlight <= 0 {
+		config.MaxInFlight = 10
+	}
+
+	return &Hedger{
+		config:  config,
+		samples: make([]time.Duration, 0, windowSize),
+	}, nil
+}
+
+// Delay returns how long to wait for the first attempt before hedging. It
+// reports false while there is neither a fixed delay nor enough samples to
+// derive one.
+func (h *Hedger) Delay() (time.Duration, bool) {
+	if h.config.Percentile <= 0 {
+		return h.config.Delay, true
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if len(h.samples) < minSamples {
+		return h.config.Delay, h.config.Delay > 0
+	}
+
+	if h.cached == 0 || h.observed-h.cachedSeen >= recomputeEvery {
+		sorted := make([]time.Duration, len(h.samples))
+		copy(sorted, h.samples)
+		sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+
+		idx := int(math.Ceil(h.config.Percentile/100*float64(len(sorted)))) - 1
+		if idx < 0 {
+			idx = 0
+		}
+		h.cached = sorted[idx]
+		h.cachedSeen = h.observed
+	}
+
+	return h.cached, true
+}
+
+// Observe records the latency of a completed attempt
+func (h *Hedger) Observe(latency time.Duration) {
+	if h.config.Percentile <= 0 {
+		return
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if len(h.samples) < windowSize {
+		h.samples = append(h.samples, latency)
+	} else {
+		h.samples[h.next] = latency
+		h.next = (h.next + 1) % windowSize
+	}
+	h.observed++
+}
+
+// TryHedge reserves a slot for a hedged attempt, returning false when the
+// cap is reached. A successful reservation must be returned with Done.
+func (h *Hedger) TryHedge() bool {
+	if h.inFlight.Add(1) > int64(h.config.MaxInFlight) {
+		h.inFlight.Add(-1)
+		return false
+	}
+	return true
+}
+
+// Done returns a slot reserved with TryHedge
+func (h *Hedger) Done() {
+	h.inFlight.Add(-1)
+}
+
+// InFlight returns the number of hedged attempts currently running
+func (h *Hedger) InFlight() int64 {
+	return h.inFlight.Load()
+}
@@ -0,0 +1,97 @@
+package hedge
+
+import (
+	"testing"
+	"time"
+)
+
+func TestNewInvalidConfig(t *testing.T) {
+	tests := []struct {
+		name   string
+		config Config
+	}{
+		{name: "no delay or percentile", config: Config{}},
+		{name: "negative percentile", config: Config{Delay: time.Millisecond, Percentile: -1}},
+		{name: "percentile of 100", config: Config{Percentile: 100}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := New(tt.config); err == nil {
+				t.Error("expected error")
+			}
+		})
+	}
+}
+
+func TestDelay(t *testing.T) {
+	t.Run("fixed delay", func(t *testing.T) {
+		h, err := New(Config{Delay: 50 * time.Millisecond})
+		if err != nil {
+			t.Fatalf("failed to create hedger: %v", err)
+		}
+
+		if delay, ok := h.Delay(); !ok || delay != 50*time.Millisecond {
+			t.Errorf("expected 50ms delay, got %v (%v)", delay, ok)
+		}
+	})
+
+	t.Run("percentile without samples", func(t *testing.T) {
+		h, err := New(Config{Percentile: 95})
+		if err != nil {
+			t.Fatalf("failed to create hedger: %v", err)
+		}
+
+		if _, ok := h.Delay(); ok {
+			t.Error("expected no delay before enough samples are observed")
+		}
+	})
+
+	t.Run("percentile falls back to fixed delay", func(t *testing.T) {
+		h, err := New(Config{Delay: 10 * time.Millisecond, Percentile: 95})
+		if err != nil {
+			t.Fatalf("failed to create hedger: %v", err)
+		}
+
+		if delay, ok := h.Delay(); !ok || delay != 10*time.Millisecond {
+			t.Errorf("expected 10ms fallback delay, got %v (%v)", delay, ok)
+		}
+	})
+
+	t.Run("percentile of observed latencies", func(t *testing.T) {
+		h, err := New(Config{Percentile: 90})
+		if err != nil {
+			t.Fatalf("failed to create hedger: %v", err)
+		}
+
+		for i := 1; i <= 100; i++ {
+			h.Observe(time.Duration(i) * time.Millisecond)
+		}
+
+		if delay, ok := h.Delay(); !ok || delay != 90*time.Millisecond {
+			t.Errorf("expected 90ms delay, got %v (%v)", delay, ok)
+		}
+	})
+}
+
+func TestMaxInFlight(t *testing.T) {
+	h, err := New(Config{Delay: time.Millisecond, MaxInFlight: 2})
+	if err != nil {
+		t.Fatalf("failed to create hedger: %v", err)
+	}
+
+	if !h.TryHedge() || !h.TryHedge() {
+		t.Fatal("expected two hedges to be allowed")
+	}
+	if h.TryHedge() {
+		t.Error("expected third hedge to be refused")
+	}
+
+	h.Done()
+	if !h.TryHedge() {
+		t.Error("expected hedge to be allowed after one finished")
+	}
+	if h.InFlight() != 2 {
+		t.Errorf("expected 2 hedges in flight, got %d", h.InFlight())
+	}
+}
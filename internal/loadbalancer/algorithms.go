@@ -0,0 +1,272 @@
+package loadbalancer
+
+import (
+	"fmt"
+	"hash/crc32"
+	"math/rand"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// roundRobinBalancer cycles through backends in order
+type roundRobinBalancer struct {
+	backends []*Backend
+	next     atomic.Uint64
+}
+
+func newRoundRobin(backends []*Backend) *roundRobinBalancer {
+	return &roundRobinBalancer{backends: backends}
+}
+
+func (b *roundRobinBalancer) Next(r *http.Request) (*Backend, error) {
+	// Cycle over the available backends only, so the neighbour of an
+	// unavailable backend doesn't absorb its share of the traffic
+	candidates := available(b.backends)
+	if len(candidates) == 0 {
+		return nil, ErrNoBackend
+	}
+
+	n := b.next.Add(1) - 1
+	return candidates[n%uint64(len(candidates))], nil
+}
+
+func (b *roundRobinBalancer) Backends() []*Backend {
+	return b.backends
+}
+
+// weightedRoundRobinBalancer implements smooth weighted round-robin, spreading
+// picks of heavier backends evenly instead of sending them in bursts
+type weightedRoundRobinBalancer struct {
+	backends []*Backend
+	current  []int
+	mu       sync.Mutex
+}
+
+func newWeightedRoundRobin(backends []*Backend) *weightedRoundRobinBalancer {
+	return &weightedRoundRobinBalancer{
+		backends: backends,
+		current:  make([]int, len(backends)),
+	}
+}
+
+func (b *weightedRoundRobinBalancer) Next(r *http.Request) (*Backend, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	total := 0
+	best := -1
+	for i, backend := range b.backends {
+		if !backend.Available() {
+			continue
+		}
+		b.current[i] += backend.Weight
+		total += backend.Weight
+		if best < 0 || b.current[i] > b.current[best] {
+			best = i
+		}
+	}
+
+	if best < 0 {
+		return nil, ErrNoBackend
+	}
+
+	b.current[best] -= total
+	return b.backends[best], nil
+}
+
+func (b *weightedRoundRobinBalancer) Backends() []*Backend {
+	return b.backends
+}
+
+// leastConnectionsBalancer picks the backend with the fewest in-flight
+// requests relative to its weight
+type leastConnectionsBalancer struct {
+	backends []*Backend
+	next     atomic.Uint64
+}
+
+func newLeastConnections(backends []*Backend) *leastConnectionsBalancer {
+	return &leastConnectionsBalancer{backends: backends}
+}
+
+func (b *leastConnectionsBalancer) Next(r *http.Request) (*Backend, error) {
+	n := uint64(len(b.backends))
+	// Rotate the starting point so ties don't always land on the first backend
+	start := b.next.Add(1) - 1
+
+	var best *Backend
+	for i := uint64(0); i < n; i++ {
+		backend := b.backends[(start+i)%n]
+		if !backend.Available() {
+			continue
+		}
+		if best == nil || lessLoaded(backend, best) {
+			best = backend
+		}
+	}
+
+	if best == nil {
+		return nil, ErrNoBackend
+	}
+	return best, nil
+}
+
+func (b *leastConnectionsBalancer) Backends() []*Backend {
+	return b.backends
+}
+
+// randomTwoChoicesBalancer samples two backends at random and picks the less
+// loaded one, avoiding the herd behaviour of a global least-connections scan
+type randomTwoChoicesBalancer struct {
+	backends []*Backend
+}
+
+func newRandomTwoChoices(backends []*Backend) *randomTwoChoicesBalancer {
+	return &randomTwoChoicesBalancer{backends: backends}
+}
+
+func (b *randomTwoChoicesBalancer) Next(r *http.Request) (*Backend, error) {
+	candidates := available(b.backends)
+
+	switch len(candidates) {
+	case 0:
+		return nil, ErrNoBackend
+	case 1:
+		return candidates[0], nil
+	}
+
+	i := rand.Intn(len(candidates))
+	j := rand.Intn(len(candidates) - 1)
+	if j >= i {
+		j++
+	}
+
+	if lessLoaded(candidates[j], candidates[i]) {
+		return candidates[j], nil
+	}
+	return candidates[i], nil
+}
+
+func (b *randomTwoChoicesBalancer) Backends() []*Backend {
+	return b.backends
+}
+
+// consistentHashBalancer maps a request key onto a hash ring so the same key
+// keeps landing on the same backend while the pool is stable
+type consistentHashBalancer struct {
+	backends []*Backend
+	ring     []uint32
+	owners   map[uint32]*Backend
+	key      func(*http.Request) string
+}
+
+// replicasPerBackend is the number of ring points given to the heaviest backend
+const replicasPerBackend = 100
+
+func newConsistentHash(backends []*Backend, hashKey string) (*consistentHashBalancer, error) {
+	key, err := hashKeyFunc(hashKey)
+	if err != nil {
+		return nil, err
+	}
+
+	maxWeight := 0
+	for _, backend := range backends {
+		if backend.Weight > maxWeight {
+			maxWeight = backend.Weight
+		}
+	}
+
+	b := &consistentHashBalancer{
+		backends: backends,
+		owners:   make(map[uint32]*Backend),
+		key:      key,
+	}
+
+	for _, backend := range backends {
+		replicas := replicasPerBackend * backend.Weight / maxWeight
+		if replicas < 1 {
+			replicas = 1
+		}
+		for i := 0; i < replicas; i++ {
+			point := crc32.ChecksumIEEE([]byte(backend.String() + "#" + strconv.Itoa(i)))
+			if _, taken := b.owners[point]; taken {
+				continue
+			}
+			b.owners[point] = backend
+			b.ring = append(b.ring, point)
+		}
+	}
+
+	sort.Slice(b.ring, func(i, j int) bool { return b.ring[i] < b.ring[j] })
+
+	return b, nil
+}
+
+func (b *consistentHashBalancer) Next(r *http.Request) (*Backend, error) {
+	hash := crc32.ChecksumIEEE([]byte(b.key(r)))
+	start := sort.Search(len(b.ring), func(i int) bool { return b.ring[i] >= hash })
+
+	// Walk clockwise past unavailable backends
+	for i := 0; i < len(b.ring); i++ {
+		backend := b.owners[b.ring[(start+i)%len(b.ring)]]
+		if backend.Available() {
+			return backend, nil
+		}
+	}
+	return nil, ErrNoBackend
+}
+
+func (b *consistentHashBalancer) Backends() []*Backend {
+	return b.backends
+}
+
+func hashKeyFunc(hashKey string) (func(*http.Request) string, error) {
+	kind, name, _ := strings.Cut(hashKey, ":")
+
+	switch kind {
+	case "", "ip":
+		return clientIP, nil
+	case "path":
+		return func(r *http.Request) string { return r.URL.Path }, nil
+	case "header":
+		if name == "" {
+			return nil, fmt.Errorf("hash key %q is missing a header name", hashKey)
+		}
+		return func(r *http.Request) string {
+			if v := r.Header.Get(name); v != "" {
+				return v
+			}
+			return clientIP(r)
+		}, nil
+	case "cookie":
+		if name == "" {
+			return nil, fmt.Errorf("hash key %q is missing a cookie name", hashKey)
+		}
+		return func(r *http.Request) string {
+			if c, err := r.Cookie(name); err == nil {
+				return c.Value
+			}
+			return clientIP(r)
+		}, nil
+	default:
+		return nil, fmt.Errorf("unknown hash key %q", hashKey)
+	}
+}
+
+func clientIP(r *http.Request) string {
+	if host, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+		return host
+	}
+	return r.RemoteAddr
+}
+
+// lessLoaded reports whether a has fewer in-flight requests per unit of
+// weight than b
+func lessLoaded(a, b *Backend) bool {
+	return a.ActiveRequests()*int64(b.Weight) < b.ActiveRequests()*int64(a.Weight)
+}
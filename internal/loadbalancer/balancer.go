@@ -0,0 +1,146 @@
+package loadbalancer
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sync/atomic"
+)
+
+// Supported load-balancing algorithms
+const (
+	RoundRobin         = "round-robin"
+	WeightedRoundRobin = "weighted-round-robin"
+	LeastConnections   = "least-connections"
+	RandomTwoChoices   = "random-two-choices"
+	ConsistentHash     = "consistent-hash"
+)
+
+// ErrNoBackend is returned when no backend is available to serve a request
+var ErrNoBackend = errors.New("no backend available")
+
+// Balancer picks the backend that should serve a request
+type Balancer interface {
+	Next(*http.Request) (*Backend, error)
+	Backends() []*Backend
+}
+
+// Config selects and tunes a balancing algorithm
+type Config struct {
+	Algorithm string // One of the algorithm constants, round-robin if empty
+	HashKey   string // Consistent-hash key: "ip", "path", "header:<name>" or "cookie:<name>"
+}
+
+// Backend is a single upstream host behind a service
+type Backend struct {
+	URL    *url.URL
+	Weight int
+
+	active  atomic.Int64
+	healthy atomic.Bool
+	ejected atomic.Bool
+}
+
+// NewBackend parses rawURL into a backend. Weights below 1 are treated as 1.
+func NewBackend(rawURL string, weight int) (*Backend, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid backend URL %q: %w", rawURL, err)
+	}
+	if u.Scheme == "" || u.Host == "" {
+		return nil, fmt.Errorf("invalid backend URL %q: missing scheme or host", rawURL)
+	}
+
+	if weight < 1 {
+		weight = 1
+	}
+
+	b := &Backend{
+		URL:    u,
+		Weight: weight,
+	}
+	b.healthy.Store(true)
+
+	return b, nil
+}
+
+// Acquire records an in-flight request against the backend
+func (b *Backend) Acquire() {
+	b.active.Add(1)
+}
+
+// Release records the completion of an in-flight request
+func (b *Backend) Release() {
+	b.active.Add(-1)
+}
+
+// ActiveRequests returns the number of in-flight requests
+func (b *Backend) ActiveRequests() int64 {
+	return b.active.Load()
+}
+
+// Available reports whether the backend may receive traffic: it must pass
+// its health checks and not be ejected by outlier detection
+func (b *Backend) Available() bool {
+	return b.Healthy() && !b.Ejected()
+}
+
+// Healthy reports the latest health check verdict for the backend
+func (b *Backend) Healthy() bool {
+	return b.healthy.Load()
+}
+
+// SetHealthy records a health check verdict, adding the backend to or
+// removing it from rotation
+func (b *Backend) SetHealthy(healthy bool) {
+	b.healthy.Store(healthy)
+}
+
+// Ejected reports whether outlier detection has taken the backend out of
+// rotation
+func (b *Backend) Ejected() bool {
+	return b.ejected.Load()
+}
+
+// SetEjected records an outlier detection ejection or its expiry
+func (b *Backend) SetEjected(ejected bool) {
+	b.ejected.Store(ejected)
+}
+
+func (b *Backend) String() string {
+	return b.URL.String()
+}
+
+// New creates a balancer for the given backends
+func New(config Config, backends []*Backend) (Balancer, error) {
+	if len(backends) == 0 {
+		return nil, fmt.Errorf("at least one backend is required")
+	}
+
+	switch config.Algorithm {
+	case "", RoundRobin:
+		return newRoundRobin(backends), nil
+	case WeightedRoundRobin:
+		return newWeightedRoundRobin(backends), nil
+	case LeastConnections:
+		return newLeastConnections(backends), nil
+	case RandomTwoChoices:
+		return newRandomTwoChoices(backends), nil
+	case ConsistentHash:
+		return newConsistentHash(backends, config.HashKey)
+	default:
+		return nil, fmt.Errorf("unknown load-balancing algorithm %q", config.Algorithm)
+	}
+}
+
+// available returns the backends currently eligible for traffic
+func available(backends []*Backend) []*Backend {
+	result := make([]*Backend, 0, len(backends))
+	for _, b := range backends {
+		if b.Available() {
+			result = append(result, b)
+		}
+	}
+	return result
+}
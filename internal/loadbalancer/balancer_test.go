@@ -0,0 +1,215 @@
+package loadbalancer
+
+import (
+	"fmt"
+	"net/http/httptest"
+	"testing"
+)
+
+func newTestBackends(t *testing.T, weights ...int) []*Backend {
+	t.Helper()
+	backends := make([]*Backend, 0, len(weights))
+	for i, weight := range weights {
+		b, err := NewBackend(fmt.Sprintf("http://backend%d:80", i), weight)
+		if err != nil {
+			t.Fatalf("failed to create backend: %v", err)
+		}
+		backends = append(backends, b)
+	}
+	return backends
+}
+
+func pickCounts(t *testing.T, b Balancer, n int) map[*Backend]int {
+	t.Helper()
+	counts := make(map[*Backend]int)
+	for i := 0; i < n; i++ {
+		backend, err := b.Next(httptest.NewRequest("GET", "/", nil))
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		counts[backend]++
+	}
+	return counts
+}
+
+func TestRoundRobin(t *testing.T) {
+	backends := newTestBackends(t, 1, 1, 1)
+	b, err := New(Config{Algorithm: RoundRobin}, backends)
+	if err != nil {
+		t.Fatalf("failed to create balancer: %v", err)
+	}
+
+	for i := 0; i < 6; i++ {
+		got, _ := b.Next(httptest.NewRequest("GET", "/", nil))
+		if want := backends[i%3]; got != want {
+			t.Errorf("pick %d: got %s, want %s", i, got, want)
+		}
+	}
+
+	// Unavailable backends are skipped
+	backends[1].SetHealthy(false)
+	counts := pickCounts(t, b, 10)
+	if counts[backends[1]] != 0 {
+		t.Errorf("unavailable backend received %d requests", counts[backends[1]])
+	}
+	if counts[backends[0]] != 5 || counts[backends[2]] != 5 {
+		t.Errorf("expected an even split across available backends, got %v/%v",
+			counts[backends[0]], counts[backends[2]])
+	}
+}
+
+func TestWeightedRoundRobin(t *testing.T) {
+	backends := newTestBackends(t, 100, 100, 50)
+	b, err := New(Config{Algorithm: WeightedRoundRobin}, backends)
+	if err != nil {
+		t.Fatalf("failed to create balancer: %v", err)
+	}
+
+	counts := pickCounts(t, b, 500)
+	want := []int{200, 200, 100}
+	for i, backend := range backends {
+		if counts[backend] != want[i] {
+			t.Errorf("backend %d: got %d picks, want %d", i, counts[backend], want[i])
+		}
+	}
+}
+
+func TestLeastConnections(t *testing.T) {
+	backends := newTestBackends(t, 1, 1, 1)
+	b, err := New(Config{Algorithm: LeastConnections}, backends)
+	if err != nil {
+		t.Fatalf("failed to create balancer: %v", err)
+	}
+
+	backends[0].Acquire()
+	backends[0].Acquire()
+	backends[2].Acquire()
+
+	for i := 0; i < 5; i++ {
+		got, _ := b.Next(httptest.NewRequest("GET", "/", nil))
+		if got != backends[1] {
+			t.Errorf("pick %d: got %s, want least loaded %s", i, got, backends[1])
+		}
+	}
+
+	backends[0].Release()
+	backends[0].Release()
+	backends[1].Acquire()
+	backends[1].Acquire()
+
+	got, _ := b.Next(httptest.NewRequest("GET", "/", nil))
+	if got != backends[0] {
+		t.Errorf("got %s, want least loaded %s", got, backends[0])
+	}
+}
+
+func TestRandomTwoChoices(t *testing.T) {
+	backends := newTestBackends(t, 1, 1)
+	b, err := New(Config{Algorithm: RandomTwoChoices}, backends)
+	if err != nil {
+		t.Fatalf("failed to create balancer: %v", err)
+	}
+
+	// With two backends both are always sampled, so the idle one must win
+	backends[0].Acquire()
+	for i := 0; i < 10; i++ {
+		got, _ := b.Next(httptest.NewRequest("GET", "/", nil))
+		if got != backends[1] {
+			t.Errorf("pick %d: got %s, want %s", i, got, backends[1])
+		}
+	}
+
+	backends[1].SetHealthy(false)
+	got, _ := b.Next(httptest.NewRequest("GET", "/", nil))
+	if got != backends[0] {
+		t.Errorf("got %s, want only available backend %s", got, backends[0])
+	}
+}
+
+func TestConsistentHash(t *testing.T) {
+	backends := newTestBackends(t, 1, 1, 1, 1)
+	b, err := New(Config{Algorithm: ConsistentHash, HashKey: "header:X-User"}, backends)
+	if err != nil {
+		t.Fatalf("failed to create balancer: %v", err)
+	}
+
+	assignments := make(map[string]*Backend)
+	for i := 0; i < 100; i++ {
+		user := fmt.Sprintf("user-%d", i)
+		req := httptest.NewRequest("GET", "/", nil)
+		req.Header.Set("X-User", user)
+		backend, err := b.Next(req)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		assignments[user] = backend
+
+		// The same key must map to the same backend
+		again, _ := b.Next(req)
+		if again != backend {
+			t.Errorf("key %s moved from %s to %s", user, backend, again)
+		}
+	}
+
+	// Removing one backend only remaps the keys it owned
+	removed := backends[0]
+	removed.SetHealthy(false)
+	for user, before := range assignments {
+		req := httptest.NewRequest("GET", "/", nil)
+		req.Header.Set("X-User", user)
+		after, _ := b.Next(req)
+		if after == removed {
+			t.Errorf("key %s routed to unavailable backend", user)
+		}
+		if before != removed && after != before {
+			t.Errorf("key %s moved from %s to %s although its backend stayed up", user, before, after)
+		}
+	}
+}
+
+func TestNoBackendAvailable(t *testing.T) {
+	algorithms := []string{RoundRobin, WeightedRoundRobin, LeastConnections, RandomTwoChoices, ConsistentHash}
+
+	for _, algorithm := range algorithms {
+		t.Run(algorithm, func(t *testing.T) {
+			backends := newTestBackends(t, 1, 1)
+			b, err := New(Config{Algorithm: algorithm}, backends)
+			if err != nil {
+				t.Fatalf("failed to create balancer: %v", err)
+			}
+
+			for _, backend := range backends {
+				backend.SetHealthy(false)
+			}
+
+			if _, err := b.Next(httptest.NewRequest("GET", "/", nil)); err != ErrNoBackend {
+				t.Errorf("got error %v, want %v", err, ErrNoBackend)
+			}
+		})
+	}
+}
+
+func TestNewErrors(t *testing.T) {
+	tests := []struct {
+		name     string
+		config   Config
+		backends int
+	}{
+		{name: "unknown algorithm", config: Config{Algorithm: "fastest"}, backends: 1},
+		{name: "no backends", config: Config{}, backends: 0},
+		{name: "bad hash key", config: Config{Algorithm: ConsistentHash, HashKey: "header"}, backends: 1},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			weights := make([]int, tt.backends)
+			if _, err := New(tt.config, newTestBackends(t, weights...)); err == nil {
+				t.Error("expected an error")
+			}
+		})
+	}
+
+	if _, err := NewBackend("backend:80", 1); err == nil {
+		t.Error("expected an error for a backend URL without scheme")
+	}
+}
@@ -1,10 +1,17 @@
 package middleware
 
 import (
+	"bufio"
 	"encoding/json"
+	"io"
+	"log"
+	"net"
 	"net/http"
+	"strconv"
+	"strings"
 	"time"
 
+	"github.com/golang-jwt/jwt/v4"
 	"github.com/opentracing/opentracing-go"
 	"github.com/opentracing/opentracing-go/ext"
 	"golang.org/x/time/rate"
@@ -97,8 +104,9 @@ func (m *LoggingMiddleware) Wrap(next http.Handler) http.Handler {
 			Timestamp: start,
 		}
 
-		// Log as JSON
-		json.NewEncoder(rw).Encode(entry)
+		// Log as JSON. The response body is left alone, as framed
+		// protocols such as gRPC can't carry trailing data.
+		json.NewEncoder(log.Writer()).Encode(entry)
 	})
 }
 
@@ -134,6 +142,37 @@ func (m *AuthMiddleware) Wrap(next http.Handler) http.Handler {
 	})
 }
 
+// JWTValidator accepts Bearer tokens signed with an HMAC secret that
+// haven't expired and, when set, name its issuer and audience
+type JWTValidator struct {
+	secret   []byte
+	issuer   string
+	audience string
+}
+
+func NewJWTValidator(secret, issuer, audience string) *JWTValidator {
+	return &JWTValidator{secret: []byte(secret), issuer: issuer, audience: audience}
+}
+
+func (v *JWTValidator) ValidateToken(header string) bool {
+	raw, ok := strings.CutPrefix(header, "Bearer ")
+	if !ok {
+		return false
+	}
+
+	claims := jwt.MapClaims{}
+	token, err := jwt.ParseWithClaims(raw, claims, func(*jwt.Token) (interface{}, error) {
+		return v.secret, nil
+	}, jwt.WithValidMethods([]string{"HS256", "HS384", "HS512"}))
+	if err != nil || !token.Valid {
+		return false
+	}
+	if v.issuer != "" && !claims.VerifyIssuer(v.issuer, true) {
+		return false
+	}
+	return v.audience == "" || claims.VerifyAudience(v.audience, true)
+}
+
 // Helper types
 type LogEntry struct {
 	Method    string        `json:"method"`
@@ -153,3 +192,202 @@ func (rw *responseWriter) WriteHeader(status int) {
 	rw.status = status
 	rw.ResponseWriter.WriteHeader(status)
 }
+
+func (rw *responseWriter) ReadFrom(src io.Reader) (int64, error) {
+	return io.Copy(rw.ResponseWriter, src)
+}
+
+func (rw *responseWriter) Flush() {
+	if f, ok := rw.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (rw *responseWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	h, ok := rw.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, http.ErrNotSupported
+	}
+	rw.status = http.StatusSwitchingProtocols
+	return h.Hijack()
+}
+
+// Unwrap lets http.ResponseController reach the underlying writer
+func (rw *responseWriter) Unwrap() http.ResponseWriter {
+	return rw.ResponseWriter
+}
+
+// SecurityHeadersMiddleware adds headers that keep browsers from framing
+// responses, sniffing their types or downgrading to plain HTTP, and a
+// Content-Security-Policy if one is given. Headers the backend sets itself
+// are left alone.
+type SecurityHeadersMiddleware struct {
+	headers map[string]string
+}
+
+func NewSecurityHeaders(csp string) *SecurityHeadersMiddleware {
+	headers := map[string]string{
+		"X-Frame-Options":           "DENY",
+		"X-Content-Type-Options":    "nosniff",
+		"X-XSS-Protection":          "1; mode=block",
+		"Strict-Transport-Security": "max-age=31536000; includeSubDomains",
+	}
+	if csp != "" {
+		headers["Content-Security-Policy"] = csp
+	}
+	return &SecurityHeadersMiddleware{headers: headers}
+}
+
+func (m *SecurityHeadersMiddleware) Wrap(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		next.ServeHTTP(&securityHeadersWriter{ResponseWriter: w, headers: m.headers}, r)
+	})
+}
+
+// securityHeadersWriter adds its headers when the response starts, once
+// the backend's have been copied
+type securityHeadersWriter struct {
+	http.ResponseWriter
+	headers     map[string]string
+	wroteHeader bool
+}
+
+func (w *securityHeadersWriter) WriteHeader(status int) {
+	if !w.wroteHeader {
+		w.wroteHeader = true
+		h := w.Header()
+		for name, value := range w.headers {
+			if h.Get(name) == "" {
+				h.Set(name, value)
+			}
+		}
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *securityHeadersWriter) Write(b []byte) (int, error) {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+func (w *securityHeadersWriter) Flush() {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (w *securityHeadersWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	h, ok := w.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, http.ErrNotSupported
+	}
+	w.wroteHeader = true
+	return h.Hijack()
+}
+
+// Unwrap lets http.ResponseController reach the underlying writer
+func (w *securityHeadersWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// CORSMiddleware answers preflight requests and adds CORS headers to
+// responses for allowed origins
+type CORSMiddleware struct {
+	config CORSConfig
+}
+
+// CORSConfig describes which cross-origin requests browsers may make.
+// AllowedOrigins may contain "*" to allow any origin, though only the
+// origins listed by name may send credentials. Without AllowedHeaders,
+// only CORS-safelisted request headers are allowed.
+type CORSConfig struct {
+	AllowedOrigins   []string
+	AllowedMethods   []string
+	AllowedHeaders   []string
+	ExposedHeaders   []string
+	AllowCredentials bool
+	MaxAge           int // Seconds a preflight result may be cached
+}
+
+func NewCORS(config CORSConfig) *CORSMiddleware {
+	if len(config.AllowedMethods) == 0 {
+		config.AllowedMethods = []string{http.MethodGet, http.MethodHead, http.MethodPost}
+	}
+	return &CORSMiddleware{
+		config: config,
+	}
+}
+
+// IsPreflight reports whether r is a CORS preflight request
+func IsPreflight(r *http.Request) bool {
+	return r.Method == http.MethodOptions &&
+		r.Header.Get("Origin") != "" &&
+		r.Header.Get("Access-Control-Request-Method") != ""
+}
+
+func (m *CORSMiddleware) Wrap(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		origin := r.Header.Get("Origin")
+		if origin == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		h := w.Header()
+		h.Add("Vary", "Origin")
+
+		preflight := IsPreflight(r)
+		listed := m.listsOrigin(origin)
+		if !listed && !m.listsOrigin("*") {
+			if preflight {
+				http.Error(w, "Origin not allowed", http.StatusForbidden)
+				return
+			}
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		// Any origin gets a literal "*", which browsers never pair with
+		// credentials, so only listed origins can send them
+		if listed {
+			h.Set("Access-Control-Allow-Origin", origin)
+			if m.config.AllowCredentials {
+				h.Set("Access-Control-Allow-Credentials", "true")
+			}
+		} else {
+			h.Set("Access-Control-Allow-Origin", "*")
+		}
+
+		if !preflight {
+			if len(m.config.ExposedHeaders) > 0 {
+				h.Set("Access-Control-Expose-Headers", strings.Join(m.config.ExposedHeaders, ", "))
+			}
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		h.Set("Access-Control-Allow-Methods", strings.Join(m.config.AllowedMethods, ", "))
+		if len(m.config.AllowedHeaders) > 0 {
+			h.Set("Access-Control-Allow-Headers", strings.Join(m.config.AllowedHeaders, ", "))
+		}
+		if m.config.MaxAge > 0 {
+			h.Set("Access-Control-Max-Age", strconv.Itoa(m.config.MaxAge))
+		}
+		w.WriteHeader(http.StatusNoContent)
+	})
+}
+
+// listsOrigin reports whether AllowedOrigins names origin
+func (m *CORSMiddleware) listsOrigin(origin string) bool {
+	for _, allowed := range m.config.AllowedOrigins {
+		if strings.EqualFold(allowed, origin) {
+			return true
+		}
+	}
+	return false
+}
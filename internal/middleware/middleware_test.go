@@ -1,10 +1,13 @@
 package middleware
 
 import (
+	"io"
 	"net/http"
 	"net/http/httptest"
 	"testing"
+	"time"
 
+	"github.com/golang-jwt/jwt/v4"
 	"golang.org/x/time/rate"
 )
 
@@ -104,6 +107,32 @@ func TestLoggingMiddleware(t *testing.T) {
 	}
 }
 
+// TestLoggingMiddlewarePreservesFlusher checks that streaming handlers can
+// still flush through the logging wrapper
+func TestLoggingMiddlewarePreservesFlusher(t *testing.T) {
+	logging := NewLogging()
+
+	handler := logging.Wrap(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if _, ok := w.(http.Hijacker); !ok {
+			t.Error("expected wrapped writer to implement http.Hijacker")
+		}
+		if _, ok := w.(io.ReaderFrom); !ok {
+			t.Error("expected wrapped writer to implement io.ReaderFrom")
+		}
+		w.Write([]byte("data: event\n\n"))
+		if err := http.NewResponseController(w).Flush(); err != nil {
+			t.Errorf("expected flush to succeed; got %v", err)
+		}
+	}))
+
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest("GET", "/events", nil))
+
+	if !rec.Flushed {
+		t.Error("expected response to be flushed")
+	}
+}
+
 // TestAuthMiddleware tests the authentication middleware
 func TestAuthMiddleware(t *testing.T) {
 	validator := &mockTokenValidator{
@@ -156,6 +185,58 @@ func TestAuthMiddleware(t *testing.T) {
 	}
 }
 
+func TestJWTValidator(t *testing.T) {
+	sign := func(secret string, method jwt.SigningMethod, claims jwt.MapClaims) string {
+		token, err := jwt.NewWithClaims(method, claims).SignedString([]byte(secret))
+		if err != nil {
+			t.Fatalf("Failed to sign token: %v", err)
+		}
+		return "Bearer " + token
+	}
+	exp := time.Now().Add(time.Hour).Unix()
+	validator := NewJWTValidator("secret", "https://auth.example.com/", "api")
+
+	tests := []struct {
+		name   string
+		header string
+		want   bool
+	}{
+		{
+			name:   "valid token",
+			header: sign("secret", jwt.SigningMethodHS256, jwt.MapClaims{"exp": exp, "iss": "https://auth.example.com/", "aud": "api"}),
+			want:   true,
+		},
+		{
+			name:   "expired token",
+			header: sign("secret", jwt.SigningMethodHS256, jwt.MapClaims{"exp": time.Now().Add(-time.Hour).Unix(), "iss": "https://auth.example.com/", "aud": "api"}),
+		},
+		{
+			name:   "wrong secret",
+			header: sign("other", jwt.SigningMethodHS256, jwt.MapClaims{"exp": exp, "iss": "https://auth.example.com/", "aud": "api"}),
+		},
+		{
+			name:   "wrong issuer",
+			header: sign("secret", jwt.SigningMethodHS512, jwt.MapClaims{"exp": exp, "iss": "https://evil.example.com/", "aud": "api"}),
+		},
+		{
+			name:   "wrong audience",
+			header: sign("secret", jwt.SigningMethodHS256, jwt.MapClaims{"exp": exp, "iss": "https://auth.example.com/", "aud": "other"}),
+		},
+		{
+			name:   "not a bearer token",
+			header: "Basic dXNlcjpwYXNz",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := validator.ValidateToken(tt.header); got != tt.want {
+				t.Errorf("expected %v; got %v", tt.want, got)
+			}
+		})
+	}
+}
+
 // TestMiddlewareChain tests the chaining of multiple middleware
 func TestMiddlewareChain(t *testing.T) {
 	var executionOrder []string
@@ -262,3 +343,96 @@ func TestConcurrentRateLimit(t *testing.T) {
 		t.Error("expected some requests to be rejected")
 	}
 }
+
+// TestCORSMiddleware checks preflight answers and headers on actual requests
+func TestCORSMiddleware(t *testing.T) {
+	cors := NewCORS(CORSConfig{
+		AllowedOrigins: []string{"https://app.example.com"},
+		AllowedMethods: []string{"POST"},
+		ExposedHeaders: []string{"Grpc-Status"},
+		MaxAge:         600,
+	})
+
+	var reached bool
+	handler := cors.Wrap(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		reached = true
+	}))
+
+	preflight := func(origin string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("OPTIONS", "/pkg.Service/Method", nil)
+		req.Header.Set("Origin", origin)
+		req.Header.Set("Access-Control-Request-Method", "POST")
+		req.Header.Set("Access-Control-Request-Headers", "content-type, x-grpc-web")
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		return rec
+	}
+
+	rec := preflight("https://app.example.com")
+	if rec.Code != http.StatusNoContent || reached {
+		t.Errorf("expected preflight to be answered with 204; got %d (reached handler: %v)", rec.Code, reached)
+	}
+	if got := rec.Header().Get("Access-Control-Allow-Origin"); got != "https://app.example.com" {
+		t.Errorf("expected allowed origin to be echoed; got %q", got)
+	}
+	if got := rec.Header().Get("Access-Control-Allow-Headers"); got != "" {
+		t.Errorf("expected requested headers not to be echoed; got %q", got)
+	}
+	if got := rec.Header().Get("Access-Control-Max-Age"); got != "600" {
+		t.Errorf("expected max age 600; got %q", got)
+	}
+
+	if rec := preflight("https://evil.example.com"); rec.Code != http.StatusForbidden {
+		t.Errorf("expected preflight from unknown origin to be rejected; got %d", rec.Code)
+	}
+
+	req := httptest.NewRequest("POST", "/pkg.Service/Method", nil)
+	req.Header.Set("Origin", "https://app.example.com")
+	rec = httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+	if !reached {
+		t.Error("expected actual request to reach the handler")
+	}
+	if got := rec.Header().Get("Access-Control-Expose-Headers"); got != "Grpc-Status" {
+		t.Errorf("expected exposed headers; got %q", got)
+	}
+}
+
+func TestCORSAnyOrigin(t *testing.T) {
+	cors := NewCORS(CORSConfig{
+		AllowedOrigins:   []string{"*", "https://app.example.com"},
+		AllowedHeaders:   []string{"Content-Type"},
+		AllowCredentials: true,
+	})
+	handler := cors.Wrap(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+	tests := []struct {
+		origin          string
+		wantOrigin      string
+		wantCredentials string
+	}{
+		{origin: "https://app.example.com", wantOrigin: "https://app.example.com", wantCredentials: "true"},
+		{origin: "https://evil.example.com", wantOrigin: "*"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.origin, func(t *testing.T) {
+			req := httptest.NewRequest("OPTIONS", "/", nil)
+			req.Header.Set("Origin", tt.origin)
+			req.Header.Set("Access-Control-Request-Method", "GET")
+			req.Header.Set("Access-Control-Request-Headers", "x-secret")
+			rec := httptest.NewRecorder()
+			handler.ServeHTTP(rec, req)
+
+			if got := rec.Header().Get("Access-Control-Allow-Origin"); got != tt.wantOrigin {
+				t.Errorf("expected allowed origin %q; got %q", tt.wantOrigin, got)
+			}
+			if got := rec.Header().Get("Access-Control-Allow-Credentials"); got != tt.wantCredentials {
+				t.Errorf("expected credentials %q; got %q", tt.wantCredentials, got)
+			}
+			if got := rec.Header().Get("Access-Control-Allow-Headers"); got != "Content-Type" {
+				t.Errorf("expected only the configured headers; got %q", got)
+			}
+		})
+	}
+}
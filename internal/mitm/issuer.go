@@ -0,0 +1,172 @@
+package mitm
+
+import (
+	"container/list"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// DefaultCacheSize is the number of leaf certificates kept by default
+	DefaultCacheSize = 1000
+
+	// leafValidity is how long issued leaf certificates are valid for
+	leafValidity = 24 * time.Hour
+	// renewBefore replaces cached leaves this close to expiring
+	renewBefore = time.Hour
+)
+
+// Issuer signs leaf certificates for intercepted hosts and keeps the most
+// recently used ones. All leaves share one key, so issuing a certificate
+// costs a signature rather than a key generation.
+type Issuer struct {
+	ca   *CA
+	key  crypto.Signer
+	size int
+
+	mu      sync.Mutex
+	order   *list.List // most recently used first
+	entries map[string]*list.Element
+}
+
+type issued struct {
+	host string
+	cert *tls.Certificate
+}
+
+func NewIssuer(ca *CA, size int) (*Issuer, error) {
+	if size <= 0 {
+		size = DefaultCacheSize
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Issuer{
+		ca:      ca,
+		key:     key,
+		size:    size,
+		order:   list.New(),
+		entries: make(map[string]*list.Element),
+	}, nil
+}
+
+// Certificate returns a leaf certificate for host, issuing one if none is
+// cached or the cached one is about to expire
+func (i *Issuer) Certificate(host string) (*tls.Certificate, error) {
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	if host == "" {
+		return nil, errors.New("no host to issue a certificate for")
+	}
+
+	i.mu.Lock()
+	if elem, ok := i.entries[host]; ok {
+		entry := elem.Value.(*issued)
+		if time.Until(entry.cert.Leaf.NotAfter) > renewBefore {
+			i.order.MoveToFront(elem)
+			i.mu.Unlock()
+			return entry.cert, nil
+		}
+	}
+	i.mu.Unlock()
+
+	// Sign outside the lock; a host issued twice concurrently just keeps
+	// the later certificate
+	cert, err := i.issue(host)
+	if err != nil {
+		return nil, err
+	}
+
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	if elem, ok := i.entries[host]; ok {
+		elem.Value = &issued{host: host, cert: cert}
+		i.order.MoveToFront(elem)
+		return cert, nil
+	}
+
+	i.entries[host] = i.order.PushFront(&issued{host: host, cert: cert})
+	for i.order.Len() > i.size {
+		oldest := i.order.Back()
+		i.order.Remove(oldest)
+		delete(i.entries, oldest.Value.(*issued).host)
+	}
+	return cert, nil
+}
+
+// Len returns the number of cached certificates
+func (i *Issuer) Len() int {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	return i.order.Len()
+}
+
+// TLSConfig returns a server configuration that presents a certificate for
+// the SNI name, or for defaultHost when the client sends none
+func (i *Issuer) TLSConfig(defaultHost string) *tls.Config {
+	return &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		NextProtos: []string{"http/1.1"},
+		GetCertificate: func(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+			host := hello.ServerName
+			if host == "" {
+				host = defaultHost
+			}
+			return i.Certificate(host)
+		},
+	}
+}
+
+func (i *Issuer) issue(host string) (*tls.Certificate, error) {
+	serial, err := randomSerial()
+	if err != nil {
+		return nil, err
+	}
+
+	notAfter := time.Now().Add(leafValidity)
+	if notAfter.After(i.ca.cert.NotAfter) {
+		notAfter = i.ca.cert.NotAfter
+	}
+
+	template := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: host},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     notAfter,
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	if ip := net.ParseIP(host); ip != nil {
+		template.IPAddresses = []net.IP{ip}
+	} else {
+		template.DNSNames = []string{host}
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, i.ca.cert, i.key.Public(), i.ca.key)
+	if err != nil {
+		return nil, err
+	}
+	leaf, err := x509.ParseCertificate(der)
+	if err != nil {
+		return nil, err
+	}
+
+	return &tls.Certificate{
+		Certificate: [][]byte{der, i.ca.cert.Raw},
+		PrivateKey:  i.key,
+		Leaf:        leaf,
+	}, nil
+}
@@ -0,0 +1,119 @@
+package mitm
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func newTestIssuer(t *testing.T, size int) (*CA, *Issuer) {
+	t.Helper()
+
+	ca, err := GenerateCA("Test CA", time.Hour*24)
+	if err != nil {
+		t.Fatalf("Failed to generate CA: %v", err)
+	}
+	issuer, err := NewIssuer(ca, size)
+	if err != nil {
+		t.Fatalf("Failed to create issuer: %v", err)
+	}
+	return ca, issuer
+}
+
+func TestIssuedCertificatesVerify(t *testing.T) {
+	ca, issuer := newTestIssuer(t, 10)
+
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.Certificate())
+
+	tests := []string{"www.example.com", "127.0.0.1"}
+	for _, host := range tests {
+		cert, err := issuer.Certificate(host)
+		if err != nil {
+			t.Fatalf("Failed to issue certificate for %s: %v", host, err)
+		}
+
+		if _, err := cert.Leaf.Verify(x509.VerifyOptions{DNSName: host, Roots: roots}); err != nil {
+			t.Errorf("Expected certificate for %s to verify, got %v", host, err)
+		}
+		if cert.Leaf.NotAfter.After(ca.Certificate().NotAfter) {
+			t.Errorf("Expected leaf for %s not to outlive the CA", host)
+		}
+	}
+}
+
+func TestIssuerCache(t *testing.T) {
+	_, issuer := newTestIssuer(t, 2)
+
+	first, _ := issuer.Certificate("a.example.com")
+	again, _ := issuer.Certificate("A.example.com.")
+	if first != again {
+		t.Error("Expected the cached certificate to be reused")
+	}
+
+	issuer.Certificate("b.example.com")
+	issuer.Certificate("a.example.com") // a is now the most recently used
+	issuer.Certificate("c.example.com") // evicts b
+
+	if got := issuer.Len(); got != 2 {
+		t.Errorf("Expected 2 cached certificates, got %d", got)
+	}
+	if cert, _ := issuer.Certificate("a.example.com"); cert != first {
+		t.Error("Expected the recently used certificate to survive eviction")
+	}
+}
+
+func TestTLSConfigUsesSNI(t *testing.T) {
+	_, issuer := newTestIssuer(t, 10)
+	config := issuer.TLSConfig("fallback.example.com")
+
+	tests := []struct {
+		serverName string
+		expected   string
+	}{
+		{"api.example.com", "api.example.com"},
+		{"", "fallback.example.com"},
+	}
+
+	for _, tt := range tests {
+		cert, err := config.GetCertificate(&tls.ClientHelloInfo{ServerName: tt.serverName})
+		if err != nil {
+			t.Fatalf("GetCertificate failed: %v", err)
+		}
+		if got := cert.Leaf.DNSNames[0]; got != tt.expected {
+			t.Errorf("Expected certificate for %s, got %s", tt.expected, got)
+		}
+	}
+}
+
+func TestLoadCA(t *testing.T) {
+	ca, _ := newTestIssuer(t, 1)
+	certPEM, keyPEM, err := ca.EncodePEM()
+	if err != nil {
+		t.Fatalf("Failed to encode CA: %v", err)
+	}
+
+	dir := t.TempDir()
+	certFile := filepath.Join(dir, "ca.pem")
+	keyFile := filepath.Join(dir, "ca-key.pem")
+	os.WriteFile(certFile, certPEM, 0o600)
+	os.WriteFile(keyFile, keyPEM, 0o600)
+
+	loaded, err := LoadCA(certFile, keyFile)
+	if err != nil {
+		t.Fatalf("Failed to load CA: %v", err)
+	}
+	if !loaded.Certificate().Equal(ca.Certificate()) {
+		t.Error("Expected the loaded CA to match the generated one")
+	}
+
+	// A leaf certificate can't act as the CA
+	issuer, _ := NewIssuer(loaded, 1)
+	leaf, _ := issuer.Certificate("example.com")
+	if _, err := NewCA(leaf.Leaf, issuer.key); err == nil {
+		t.Error("Expected a leaf certificate to be rejected as a CA")
+	}
+}
@@ -0,0 +1,267 @@
+package outlier
+
+import (
+	"log"
+	"math"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/oabraham1/go-http-proxy/internal/loadbalancer"
+)
+
+// Config controls when a backend is ejected. A zero threshold disables the
+// corresponding detector; success-rate detection is enabled by setting
+// SuccessRateStdevFactor.
+type Config struct {
+	Consecutive5xx           int           // Ejects after this many 5xx or failed requests in a row
+	ConsecutiveGatewayErrors int           // Ejects after this many 502/503/504 or failed requests in a row
+	SuccessRateStdevFactor   float64       // Ejects hosts below mean - factor*stdev of the pool's success rate
+	SuccessRateMinHosts      int           // Hosts with enough volume needed to evaluate success rate
+	SuccessRateRequestVolume int           // Requests a host needs in the window to be evaluated
+	Interval                 time.Duration // Success-rate window and ejection review period
+	BaseEjectionTime         time.Duration // First ejection length, doubled on each repeat
+	MaxEjectionTime          time.Duration // Upper bound on an ejection
+	MaxEjectionPercent       int           // Share of the pool that may be ejected at once
+}
+
+type hostStats struct {
+	backend *loadbalancer.Backend
+
+	consecutive5xx     int
+	consecutiveGateway int
+	requests           int
+	successes          int
+
+	ejected      bool
+	ejections    int
+	ejectedUntil time.Time
+}
+
+// Detector watches live traffic to a service's backends and ejects those
+// that misbehave
+type Detector struct {
+	service string
+	config  Config
+	hosts   map[*loadbalancer.Backend]*hostStats
+	order   []*hostStats
+	mu      sync.Mutex
+	stopCh  chan struct{}
+	now     func() time.Time
+}
+
+func New(service string, config Config, backends []*loadbalancer.Backend) *Detector {
+	if config.SuccessRateMinHosts <= 0 {
+		config.SuccessRateMinHosts = 5
+	}
+	if config.SuccessRateRequestVolume <= 0 {
+		config.SuccessRateRequestVolume = 100
+	}
+	if config.Interval <= 0 {
+		config.Interval = 10 * time.Second
+	}
+	if config.BaseEjectionTime <= 0 {
+		config.BaseEjectionTime = 30 * time.Second
+	}
+	if config.MaxEjectionTime <= 0 {
+		config.MaxEjectionTime = 300 * time.Second
+	}
+	if config.MaxEjectionTime < config.BaseEjectionTime {
+		config.MaxEjectionTime = config.BaseEjectionTime
+	}
+	if config.MaxEjectionPercent <= 0 {
+		config.MaxEjectionPercent = 10
+	}
+
+	d := &Detector{
+		service: service,
+		config:  config,
+		hosts:   make(map[*loadbalancer.Backend]*hostStats),
+		stopCh:  make(chan struct{}),
+		now:     time.Now,
+	}
+
+	for _, backend := range backends {
+		h := &hostStats{backend: backend}
+		d.hosts[backend] = h
+		d.order = append(d.order, h)
+	}
+
+	return d
+}
+
+func (d *Detector) Start() {
+	ticker := time.NewTicker(d.config.Interval)
+	go func() {
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				d.evaluate(d.now())
+			case <-d.stopCh:
+				return
+			}
+		}
+	}()
+}
+
+func (d *Detector) Stop() {
+	select {
+	case <-d.stopCh:
+		// Already stopped
+		return
+	default:
+		close(d.stopCh)
+	}
+}
+
+// Record feeds the outcome of one upstream attempt to the detector. err is
+// the transport error, if any; otherwise statusCode is the response status.
+func (d *Detector) Record(backend *loadbalancer.Backend, statusCode int, err error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	h, ok := d.hosts[backend]
+	if !ok {
+		return
+	}
+
+	serverError := err != nil || statusCode >= 500
+	gatewayError := err != nil ||
+		statusCode == http.StatusBadGateway ||
+		statusCode == http.StatusServiceUnavailable ||
+		statusCode == http.StatusGatewayTimeout
+
+	h.requests++
+	if serverError {
+		h.consecutive5xx++
+	} else {
+		h.successes++
+		h.consecutive5xx = 0
+	}
+	if gatewayError {
+		h.consecutiveGateway++
+	} else {
+		h.consecutiveGateway = 0
+	}
+
+	now := d.now()
+	switch {
+	case d.config.Consecutive5xx > 0 && h.consecutive5xx >= d.config.Consecutive5xx:
+		d.eject(h, now, "consecutive 5xx")
+	case d.config.ConsecutiveGatewayErrors > 0 && h.consecutiveGateway >= d.config.ConsecutiveGatewayErrors:
+		d.eject(h, now, "consecutive gateway errors")
+	}
+}
+
+// evaluate restores backends whose ejection has expired, runs success-rate
+// detection over the window that just ended and starts a new window
+func (d *Detector) evaluate(now time.Time) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	for _, h := range d.order {
+		if h.ejected && !now.Before(h.ejectedUntil) {
+			h.ejected = false
+			h.backend.SetEjected(false)
+			log.Printf("Outlier detection restored backend %s of service %s", h.backend, d.service)
+		} else if !h.ejected && h.ejections > 0 {
+			// A host that behaves lets its back-off decay again
+			h.ejections--
+		}
+	}
+
+	if d.config.SuccessRateStdevFactor > 0 {
+		d.evaluateSuccessRate(now)
+	}
+
+	for _, h := range d.order {
+		h.requests = 0
+		h.successes = 0
+	}
+}
+
+func (d *Detector) evaluateSuccessRate(now time.Time) {
+	var eligible []*hostStats
+	var rates []float64
+	for _, h := range d.order {
+		if !h.ejected && h.requests >= d.config.SuccessRateRequestVolume {
+			eligible = append(eligible, h)
+			rates = append(rates, float64(h.successes)/float64(h.requests))
+		}
+	}
+
+	if len(eligible) < d.config.SuccessRateMinHosts {
+		return
+	}
+
+	mean := 0.0
+	for _, rate := range rates {
+		mean += rate
+	}
+	mean /= float64(len(rates))
+
+	variance := 0.0
+	for _, rate := range rates {
+		variance += (rate - mean) * (rate - mean)
+	}
+	stdev := math.Sqrt(variance / float64(len(rates)))
+
+	threshold := mean - d.config.SuccessRateStdevFactor*stdev
+	for i, h := range eligible {
+		if rates[i] < threshold {
+			d.eject(h, now, "low success rate")
+		}
+	}
+}
+
+// eject removes a host from rotation for an exponentially growing period,
+// unless that would exceed the maximum ejection percentage. Callers must
+// hold d.mu.
+func (d *Detector) eject(h *hostStats, now time.Time, reason string) {
+	if h.ejected {
+		return
+	}
+
+	ejected := 0
+	for _, other := range d.order {
+		if other.ejected {
+			ejected++
+		}
+	}
+	if ejected*100/len(d.order) >= d.config.MaxEjectionPercent {
+		return
+	}
+
+	duration := d.config.BaseEjectionTime
+	for i := 0; i < h.ejections && duration < d.config.MaxEjectionTime; i++ {
+		duration *= 2
+	}
+	if duration > d.config.MaxEjectionTime {
+		duration = d.config.MaxEjectionTime
+	}
+
+	h.ejected = true
+	h.ejections++
+	h.ejectedUntil = now.Add(duration)
+	h.consecutive5xx = 0
+	h.consecutiveGateway = 0
+	h.backend.SetEjected(true)
+
+	log.Printf("Outlier detection ejected backend %s of service %s for %v: %s",
+		h.backend, d.service, duration, reason)
+}
+
+// Ejected returns the number of currently ejected backends
+func (d *Detector) Ejected() int {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	ejected := 0
+	for _, h := range d.order {
+		if h.ejected {
+			ejected++
+		}
+	}
+	return ejected
+}
@@ -0,0 +1,198 @@
+package outlier
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/oabraham1/go-http-proxy/internal/loadbalancer"
+)
+
+func newTestBackends(t *testing.T, n int) []*loadbalancer.Backend {
+	t.Helper()
+	backends := make([]*loadbalancer.Backend, 0, n)
+	for i := 0; i < n; i++ {
+		b, err := loadbalancer.NewBackend(fmt.Sprintf("http://backend%d:80", i), 1)
+		if err != nil {
+			t.Fatalf("failed to create backend: %v", err)
+		}
+		backends = append(backends, b)
+	}
+	return backends
+}
+
+func TestConsecutiveErrors(t *testing.T) {
+	tests := []struct {
+		name      string
+		config    Config
+		outcomes  []int // Status codes; 0 stands for a transport error
+		wantEject bool
+	}{
+		{
+			name:      "consecutive 5xx",
+			config:    Config{Consecutive5xx: 3, MaxEjectionPercent: 100},
+			outcomes:  []int{500, 503, 500},
+			wantEject: true,
+		},
+		{
+			name:      "success resets the streak",
+			config:    Config{Consecutive5xx: 3, MaxEjectionPercent: 100},
+			outcomes:  []int{500, 500, 200, 500, 500},
+			wantEject: false,
+		},
+		{
+			name:      "gateway errors",
+			config:    Config{ConsecutiveGatewayErrors: 2, MaxEjectionPercent: 100},
+			outcomes:  []int{0, 504},
+			wantEject: true,
+		},
+		{
+			name:      "500 is not a gateway error",
+			config:    Config{ConsecutiveGatewayErrors: 2, MaxEjectionPercent: 100},
+			outcomes:  []int{502, 500, 502},
+			wantEject: false,
+		},
+		{
+			name:      "disabled detectors",
+			config:    Config{MaxEjectionPercent: 100},
+			outcomes:  []int{500, 500, 500, 500, 500, 500},
+			wantEject: false,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			backends := newTestBackends(t, 2)
+			d := New("test", tt.config, backends)
+
+			for _, code := range tt.outcomes {
+				if code == 0 {
+					d.Record(backends[0], 0, errors.New("connection refused"))
+				} else {
+					d.Record(backends[0], code, nil)
+				}
+			}
+
+			if backends[0].Ejected() != tt.wantEject {
+				t.Errorf("got ejected %v, want %v", backends[0].Ejected(), tt.wantEject)
+			}
+			if tt.wantEject && backends[0].Available() {
+				t.Error("ejected backend should not be available")
+			}
+			if backends[1].Ejected() {
+				t.Error("unrelated backend should not be ejected")
+			}
+		})
+	}
+}
+
+func TestEjectionBackoff(t *testing.T) {
+	backends := newTestBackends(t, 2)
+	d := New("test", Config{
+		Consecutive5xx:     1,
+		BaseEjectionTime:   time.Second,
+		MaxEjectionTime:    3 * time.Second,
+		MaxEjectionPercent: 100,
+	}, backends)
+
+	now := time.Now()
+	d.now = func() time.Time { return now }
+	wantDurations := []time.Duration{time.Second, 2 * time.Second, 3 * time.Second}
+
+	for i, want := range wantDurations {
+		d.Record(backends[0], 500, nil)
+		if !backends[0].Ejected() {
+			t.Fatalf("ejection %d: expected backend to be ejected", i+1)
+		}
+
+		if got := d.hosts[backends[0]].ejectedUntil.Sub(now); got != want {
+			t.Errorf("ejection %d: lasts %v, want %v", i+1, got, want)
+		}
+
+		// Still ejected just before expiry, restored afterwards
+		d.evaluate(now.Add(want - 10*time.Millisecond))
+		if !backends[0].Ejected() {
+			t.Errorf("ejection %d: restored too early", i+1)
+		}
+		now = now.Add(want)
+		d.evaluate(now)
+		if backends[0].Ejected() {
+			t.Errorf("ejection %d: expected backend to be restored", i+1)
+		}
+	}
+}
+
+func TestMaxEjectionPercent(t *testing.T) {
+	backends := newTestBackends(t, 4)
+	d := New("test", Config{Consecutive5xx: 1, MaxEjectionPercent: 50}, backends)
+
+	for _, b := range backends {
+		d.Record(b, 500, nil)
+	}
+
+	if got := d.Ejected(); got != 2 {
+		t.Errorf("got %d ejected backends, want 2", got)
+	}
+}
+
+func TestSuccessRate(t *testing.T) {
+	backends := newTestBackends(t, 5)
+	d := New("test", Config{
+		SuccessRateStdevFactor:   1.5,
+		SuccessRateMinHosts:      5,
+		SuccessRateRequestVolume: 50,
+		MaxEjectionPercent:       100,
+	}, backends)
+
+	// Four backends succeed 98% of the time, the last only 60%
+	for i, b := range backends {
+		failures := 2
+		if i == len(backends)-1 {
+			failures = 40
+		}
+		for n := 0; n < 100; n++ {
+			code := 200
+			if n < failures {
+				code = 500
+			}
+			d.Record(b, code, nil)
+		}
+	}
+
+	d.evaluate(time.Now())
+
+	for i, b := range backends {
+		want := i == len(backends)-1
+		if b.Ejected() != want {
+			t.Errorf("backend %d: got ejected %v, want %v", i, b.Ejected(), want)
+		}
+	}
+
+	// The window is reset, so a quiet interval ejects nobody else
+	d.evaluate(time.Now())
+	if got := d.Ejected(); got != 1 {
+		t.Errorf("got %d ejected backends after an empty window, want 1", got)
+	}
+}
+
+func TestSuccessRateMinHosts(t *testing.T) {
+	backends := newTestBackends(t, 3)
+	d := New("test", Config{
+		SuccessRateStdevFactor:   1,
+		SuccessRateMinHosts:      5,
+		SuccessRateRequestVolume: 10,
+		MaxEjectionPercent:       100,
+	}, backends)
+
+	for n := 0; n < 20; n++ {
+		d.Record(backends[0], 200, nil)
+		d.Record(backends[1], 200, nil)
+		d.Record(backends[2], 500, nil)
+	}
+	d.evaluate(time.Now())
+
+	if got := d.Ejected(); got != 0 {
+		t.Errorf("got %d ejected backends with too few hosts, want 0", got)
+	}
+}
@@ -0,0 +1,282 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+	"github.com/oabraham1/go-http-proxy/internal/cache"
+	"github.com/oabraham1/go-http-proxy/internal/config"
+	"github.com/oabraham1/go-http-proxy/pkg/filters"
+)
+
+// newCacheConfig translates the cache settings shared by the global cache
+// and the one routes opt into
+func newCacheConfig(cc config.CacheConfig) (cache.Config, error) {
+	rules := make([]cache.Rule, 0, len(cc.Rules))
+	for _, rc := range cc.Rules {
+		if rc.Path == "" {
+			return cache.Config{}, errors.New("cache rule is missing a path")
+		}
+
+		key := cache.KeyConfig{
+			IgnoreHost:  rc.IgnoreHost,
+			Query:       rc.Query,
+			IgnoreQuery: rc.IgnoreQuery,
+			Headers:     append([]string(nil), rc.Headers...),
+		}
+		for _, part := range rc.VaryBy {
+			kind, name, found := strings.Cut(part, ":")
+			switch {
+			case part == "principal":
+				key.Principal = true
+			case found && kind == "cookie" && name != "":
+				key.Cookies = append(key.Cookies, name)
+			case found && kind == "header" && name != "":
+				key.Headers = append(key.Headers, name)
+			case !found && part != "":
+				key.Headers = append(key.Headers, part)
+			default:
+				return cache.Config{}, fmt.Errorf("cache rule %s: invalid varyBy %q", rc.Path, part)
+			}
+		}
+
+		rules = append(rules, cache.Rule{
+			Path:                 rc.Path,
+			Methods:              rc.Methods,
+			TTL:                  rc.TTL,
+			MaxSize:              rc.MaxSize,
+			StaleWhileRevalidate: rc.StaleWhileRevalidate,
+			StaleIfError:         rc.StaleIfError,
+			Key:                  key,
+		})
+	}
+
+	return cache.Config{
+		MaxSize:         cc.MaxSize,
+		TTL:             cc.TTL,
+		CleanupInterval: cc.CleanupInterval,
+		Rules:           rules,
+		Principal:       cachePrincipal,
+	}, nil
+}
+
+// defaultRedisPrefix starts the keys of a Redis cache store without a
+// prefix of its own
+const defaultRedisPrefix = "go-http-proxy:cache:"
+
+// newCacheStore opens the store the cache keeps responses in
+func newCacheStore(cc config.CacheConfig) (cache.Store, error) {
+	sc := cc.Store
+	var store cache.Store
+	switch sc.Type {
+	case "", "memory":
+		return cache.NewMemoryStore(cc.MaxSize), nil
+	case "disk":
+		if sc.Dir == "" {
+			return nil, errors.New("disk store is missing a dir")
+		}
+		disk, err := cache.NewDiskStore(sc.Dir, cc.MaxSize)
+		if err != nil {
+			return nil, err
+		}
+		store = disk
+	case "redis":
+		if sc.Redis.Addr == "" {
+			return nil, errors.New("redis store is missing an addr")
+		}
+		prefix := sc.Redis.Prefix
+		if prefix == "" {
+			prefix = defaultRedisPrefix
+		}
+		store = cache.NewRedisStore(redis.NewClient(&redis.Options{
+			Addr:     sc.Redis.Addr,
+			Username: sc.Redis.Username,
+			Password: sc.Redis.Password,
+			DB:       sc.Redis.DB,
+		}), prefix)
+	default:
+		return nil, fmt.Errorf("unknown store type %q", sc.Type)
+	}
+
+	if sc.LocalMaxSize > 0 {
+		store = cache.NewTieredStore(cache.NewMemoryStore(sc.LocalMaxSize), store, sc.LocalTTL)
+	}
+	return store, nil
+}
+
+// cachePrincipal identifies who made a request for cache keys: the
+// verified client certificate, or else the credentials sent
+func cachePrincipal(r *http.Request) string {
+	if cert := filters.ClientCertFromContext(r.Context()); cert != nil && cert.Verified {
+		return "cert:" + cert.Fingerprint
+	}
+	if auth := r.Header.Get("Authorization"); auth != "" {
+		return "auth:" + auth
+	}
+	if auth := r.Header.Get("Proxy-Authorization"); auth != "" {
+		return "proxy:" + auth
+	}
+	return ""
+}
+
+// errNotCached answers only-if-cached requests the cache can't satisfy
+var errNotCached = HTTPError{Code: http.StatusGatewayTimeout, Message: "Not cached"}
+
+// fetchFunc sends a request upstream
+type fetchFunc func(*http.Request) (*http.Response, []Attempt, error)
+
+// serveCached answers r from c when it can, and otherwise writes the
+// response fetch gets for the request to send upstream, keeping it in c if
+// it's cacheable. Concurrent misses for a response wait for one fetch, a
+// 304 revalidating a stored response refreshes it, and stale responses
+// stand in while they're refreshed or when the origin fails, as far as
+// their stale-while-revalidate and stale-if-error allow. c may be nil. It
+// writes error responses itself and reports whether the cache answered.
+func (p *Proxy) serveCached(lw *loggedResponseWriter, r *http.Request, c *cache.Cache, flushInterval time.Duration, fetch fetchFunc) (bool, []Attempt, error) {
+	outReq := r
+	var filled func()
+	if c != nil {
+		if cached, ok := c.Get(r); ok {
+			p.metrics.cacheHits.Add(1)
+			p.writeResponse(lw, cached, flushInterval)
+			return true, nil, nil
+		}
+		if cache.OnlyIfCached(r) {
+			p.metrics.cacheMisses.Add(1)
+			p.handleError(lw, r, errNotCached)
+			return false, nil, errNotCached
+		}
+		if stale, ok := c.StaleWhileRevalidate(r); ok {
+			p.metrics.cacheHits.Add(1)
+			p.writeResponse(lw, stale, flushInterval)
+			p.refreshCache(r, c, fetch)
+			return true, nil, nil
+		}
+
+		// Only one request fetches the response; the rest look again
+		// once it's stored
+		if filled = c.Fill(r); filled != nil {
+			defer filled()
+		} else if cached, ok := c.Get(r); ok {
+			p.metrics.cacheHits.Add(1)
+			p.writeResponse(lw, cached, flushInterval)
+			return true, nil, nil
+		}
+		p.metrics.cacheMisses.Add(1)
+		outReq = c.Conditional(r)
+	}
+
+	resp, attempts, err := fetch(outReq)
+	if c != nil && (err != nil || originFailed(resp)) {
+		if stale, ok := c.StaleIfError(r); ok {
+			if resp != nil {
+				resp.Body.Close()
+			}
+			p.writeResponse(lw, stale, flushInterval)
+			return true, attempts, nil
+		}
+	}
+	if err != nil {
+		p.handleError(lw, r, err)
+		return false, attempts, err
+	}
+	defer resp.Body.Close()
+
+	if outReq != r && resp.StatusCode == http.StatusNotModified {
+		if refreshed, ok := c.Refresh(r, resp); ok {
+			p.writeResponse(lw, refreshed, flushInterval)
+			return false, attempts, nil
+		}
+	}
+
+	// Keep a copy of cacheable responses as they stream through
+	var capture *captureBody
+	if c != nil && cacheCandidate(r, resp) {
+		capture = &captureBody{ReadCloser: resp.Body, limit: maxCachedBodyBytes}
+		resp.Body = capture
+	} else if filled != nil {
+		// Nothing will be stored, so waiting requests needn't wait for
+		// the body
+		filled()
+	}
+
+	if err := p.writeResponse(lw, resp, flushInterval); err != nil {
+		// The status line is already out, so abort the response rather
+		// than let a truncated body look complete
+		panic(http.ErrAbortHandler)
+	}
+
+	if capture != nil {
+		if cached := capture.cachedResponse(resp); cached != nil {
+			c.Set(r, cached)
+		}
+	}
+	return false, attempts, nil
+}
+
+// refreshCache revalidates or refetches the stale response to r in the
+// background, unless another request is already fetching it
+func (p *Proxy) refreshCache(r *http.Request, c *cache.Cache, fetch fetchFunc) {
+	done := c.TryFill(r)
+	if done == nil {
+		return
+	}
+
+	// The refresh outlives the client's request
+	bg := r.Clone(context.WithoutCancel(r.Context()))
+	go func() {
+		defer done()
+
+		outReq := c.Conditional(bg)
+		resp, _, err := fetch(outReq)
+		if err != nil {
+			log.Printf("Background cache refresh of %s failed: %v", bg.URL, err)
+			return
+		}
+		defer resp.Body.Close()
+
+		if outReq != bg && resp.StatusCode == http.StatusNotModified {
+			c.Refresh(bg, resp)
+			return
+		}
+		if !cacheCandidate(bg, resp) {
+			return
+		}
+		body, err := io.ReadAll(io.LimitReader(resp.Body, maxCachedBodyBytes+1))
+		if err != nil || len(body) > maxCachedBodyBytes {
+			return
+		}
+		resp.Body = io.NopCloser(bytes.NewReader(body))
+		c.Set(bg, resp)
+	}()
+}
+
+// originFailed reports whether resp is an error that stale-if-error
+// covers (RFC 5861 section 4)
+func originFailed(resp *http.Response) bool {
+	switch resp.StatusCode {
+	case http.StatusInternalServerError, http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return true
+	}
+	return false
+}
+
+// cacheCandidate reports whether a response is worth capturing for the
+// cache. Streams and bodies known to be too large are passed through.
+func cacheCandidate(r *http.Request, resp *http.Response) bool {
+	if !cache.Cacheable(r, resp) {
+		return false
+	}
+	if resp.ContentLength > maxCachedBodyBytes {
+		return false
+	}
+	return !isEventStream(resp)
+}
@@ -0,0 +1,572 @@
+package proxy
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/oabraham1/go-http-proxy/internal/cache"
+	"github.com/oabraham1/go-http-proxy/internal/circuitbreaker"
+	"github.com/oabraham1/go-http-proxy/internal/config"
+)
+
+func TestCacheSemantics(t *testing.T) {
+	var hits atomic.Int64
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hits.Add(1)
+		switch r.URL.Path {
+		case "/missing":
+			w.Header().Set("Cache-Control", "max-age=60")
+			w.WriteHeader(http.StatusNotFound)
+		case "/private":
+			w.Header().Set("Cache-Control", "private, max-age=60")
+		case "/public":
+			w.Header().Set("Cache-Control", "public, max-age=60")
+		case "/aged":
+			w.Header().Set("Cache-Control", "max-age=60")
+			w.Header().Set("Age", "30")
+		default:
+			w.Header().Set("Cache-Control", "max-age=60")
+		}
+		w.Write([]byte("ok"))
+	}))
+	defer backend.Close()
+
+	cfg := &config.Config{
+		Services: map[string]config.ServiceConfig{
+			"api": {
+				URL:    backend.URL,
+				Routes: []config.RouteConfig{{Path: "/", Cache: boolPtr(true)}},
+			},
+		},
+	}
+	proxy, err := New(cfg)
+	if err != nil {
+		t.Fatalf("Failed to create proxy: %v", err)
+	}
+	handler := proxy.handler()
+
+	do := func(path string, header http.Header) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", "http://proxy.local"+path, nil)
+		for k, v := range header {
+			req.Header[k] = v
+		}
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		return rec
+	}
+	upstream := func(path string, header http.Header) int64 {
+		before := hits.Load()
+		do(path, header)
+		do(path, header)
+		return hits.Load() - before
+	}
+
+	tests := []struct {
+		name     string
+		path     string
+		header   http.Header
+		expected int64
+	}{
+		{"fresh", "/fresh", nil, 1},
+		{"not found", "/missing", nil, 1},
+		{"private", "/private", nil, 2},
+		{"request no-cache", "/no-cache", http.Header{"Cache-Control": {"no-cache"}}, 2},
+		{"authorization", "/auth", http.Header{"Authorization": {"Bearer x"}}, 2},
+		{"authorization public", "/public", http.Header{"Authorization": {"Bearer x"}}, 1},
+	}
+	for _, tt := range tests {
+		if got := upstream(tt.path, tt.header); got != tt.expected {
+			t.Errorf("%s: expected %d upstream requests, got %d", tt.name, tt.expected, got)
+		}
+	}
+
+	do("/aged", nil)
+	if rec := do("/aged", nil); rec.Header().Get("Age") != "30" {
+		t.Errorf("Expected Age 30 on a hit, got %q", rec.Header().Get("Age"))
+	}
+
+	onlyIfCached := http.Header{"Cache-Control": {"only-if-cached"}}
+	if rec := do("/uncached", onlyIfCached); rec.Code != http.StatusGatewayTimeout {
+		t.Errorf("Expected 504 for an uncached only-if-cached request, got %d", rec.Code)
+	}
+	if rec := do("/fresh", onlyIfCached); rec.Code != http.StatusOK {
+		t.Errorf("Expected a cached only-if-cached request to succeed, got %d", rec.Code)
+	}
+}
+
+func TestCacheRules(t *testing.T) {
+	var hits atomic.Int64
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hits.Add(1)
+		w.Header().Set("Cache-Control", "public, max-age=60")
+		w.Write([]byte("ok"))
+	}))
+	defer backend.Close()
+
+	cfg := &config.Config{
+		Cache: config.CacheConfig{
+			Enabled: true,
+			Rules: []config.CacheRule{
+				{Path: "/products*", VaryBy: []string{"principal", "X-Region"}},
+			},
+		},
+		Services: map[string]config.ServiceConfig{
+			"api": {URL: backend.URL, Routes: []config.RouteConfig{{Path: "/"}}},
+		},
+	}
+	proxy, err := New(cfg)
+	if err != nil {
+		t.Fatalf("Failed to create proxy: %v", err)
+	}
+	handler := proxy.handler()
+
+	do := func(token, region string) {
+		req := httptest.NewRequest("GET", "http://proxy.local/products", nil)
+		req.Header.Set("Authorization", token)
+		req.Header.Set("X-Region", region)
+		handler.ServeHTTP(httptest.NewRecorder(), req)
+	}
+	do("alice", "eu")
+	do("alice", "eu")
+	do("bob", "eu")
+	do("alice", "us")
+	if got := hits.Load(); got != 3 {
+		t.Errorf("Expected 3 upstream requests, got %d", got)
+	}
+
+	for _, varyBy := range []string{"cookie:", "header:", "query:page"} {
+		cfg.Cache.Rules[0].VaryBy = []string{varyBy}
+		if _, err := New(cfg); err == nil {
+			t.Errorf("Expected varyBy %q to be rejected", varyBy)
+		}
+	}
+}
+
+func TestCacheStores(t *testing.T) {
+	var hits atomic.Int64
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hits.Add(1)
+		w.Header().Set("Cache-Control", "max-age=60")
+		w.Write([]byte("ok"))
+	}))
+	defer backend.Close()
+
+	cfg := &config.Config{
+		Cache: config.CacheConfig{
+			Enabled: true,
+			Store:   config.CacheStoreConfig{Type: "disk", Dir: t.TempDir()},
+		},
+		Services: map[string]config.ServiceConfig{
+			"api": {URL: backend.URL, Routes: []config.RouteConfig{{Path: "/"}}},
+		},
+	}
+
+	// Responses on disk outlive the proxy that stored them
+	for i := 0; i < 2; i++ {
+		proxy, err := New(cfg)
+		if err != nil {
+			t.Fatalf("Failed to create proxy: %v", err)
+		}
+		rec := httptest.NewRecorder()
+		proxy.handler().ServeHTTP(rec, httptest.NewRequest("GET", "http://proxy.local/persisted", nil))
+		if rec.Body.String() != "ok" {
+			t.Errorf("Expected %q, got %q", "ok", rec.Body.String())
+		}
+		proxy.cache.Close()
+	}
+	if got := hits.Load(); got != 1 {
+		t.Errorf("Expected 1 upstream request, got %d", got)
+	}
+
+	tiered, err := newCacheStore(config.CacheConfig{Store: config.CacheStoreConfig{Type: "redis", Redis: config.CacheRedisConfig{Addr: "127.0.0.1:6379"}, LocalMaxSize: 1 << 20}})
+	if err != nil {
+		t.Fatalf("Failed to create store: %v", err)
+	}
+	if _, ok := tiered.(*cache.TieredStore); !ok {
+		t.Errorf("Expected a tiered store, got %T", tiered)
+	}
+	tiered.Close()
+
+	for _, sc := range []config.CacheStoreConfig{{Type: "disk"}, {Type: "redis"}, {Type: "memcached"}} {
+		cfg.Cache.Store = sc
+		if _, err := New(cfg); err == nil {
+			t.Errorf("Expected store %+v to be rejected", sc)
+		}
+	}
+}
+
+func TestCacheRevalidation(t *testing.T) {
+	var full, notModified atomic.Int64
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Cache-Control", "no-cache")
+		w.Header().Set("ETag", `"v1"`)
+		if r.Header.Get("If-None-Match") == `"v1"` {
+			notModified.Add(1)
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		full.Add(1)
+		w.Write([]byte("payload"))
+	}))
+	defer backend.Close()
+
+	cfg := &config.Config{
+		Cache: config.CacheConfig{Enabled: true},
+		Services: map[string]config.ServiceConfig{
+			"api": {URL: backend.URL, Routes: []config.RouteConfig{{Path: "/"}}},
+		},
+	}
+	proxy, err := New(cfg)
+	if err != nil {
+		t.Fatalf("Failed to create proxy: %v", err)
+	}
+	handler := proxy.handler()
+
+	do := func(ifNoneMatch string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", "http://proxy.local/doc", nil)
+		if ifNoneMatch != "" {
+			req.Header.Set("If-None-Match", ifNoneMatch)
+		}
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		return rec
+	}
+
+	do("")
+	if rec := do(""); rec.Code != http.StatusOK || rec.Body.String() != "payload" {
+		t.Errorf("Expected the revalidated body, got %d %q", rec.Code, rec.Body.String())
+	}
+	if rec := do(`"v1"`); rec.Code != http.StatusNotModified || rec.Body.Len() != 0 {
+		t.Errorf("Expected 304 for a matching client validator, got %d %q", rec.Code, rec.Body.String())
+	}
+	if rec := do(`"v0"`); rec.Code != http.StatusOK || rec.Body.String() != "payload" {
+		t.Errorf("Expected the full body for a stale client validator, got %d %q", rec.Code, rec.Body.String())
+	}
+	if full.Load() != 1 || notModified.Load() != 3 {
+		t.Errorf("Expected 1 full fetch and 3 revalidations, got %d and %d", full.Load(), notModified.Load())
+	}
+}
+
+func TestRouteCacheOptOut(t *testing.T) {
+	var hits atomic.Int64
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hits.Add(1)
+		w.Header().Set("Cache-Control", "max-age=60")
+		w.Write([]byte("ok"))
+	}))
+	defer backend.Close()
+
+	cfg := &config.Config{
+		Cache: config.CacheConfig{Enabled: true},
+		Services: map[string]config.ServiceConfig{
+			"api": {
+				URL: backend.URL,
+				Routes: []config.RouteConfig{
+					{Path: "/live", Cache: boolPtr(false)},
+					{Path: "/"},
+				},
+			},
+		},
+	}
+	proxy, err := New(cfg)
+	if err != nil {
+		t.Fatalf("Failed to create proxy: %v", err)
+	}
+	handler := proxy.handler()
+
+	for _, tt := range []struct {
+		path     string
+		wantHits int64
+	}{
+		{path: "/live", wantHits: 2},
+		{path: "/doc", wantHits: 1},
+	} {
+		hits.Store(0)
+		for i := 0; i < 2; i++ {
+			handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "http://proxy.local"+tt.path, nil))
+		}
+		if hits.Load() != tt.wantHits {
+			t.Errorf("%s: expected %d upstream requests, got %d", tt.path, tt.wantHits, hits.Load())
+		}
+	}
+}
+
+func TestCacheCoalescing(t *testing.T) {
+	var hits atomic.Int64
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hits.Add(1)
+		time.Sleep(100 * time.Millisecond)
+		if r.URL.Path == "/private" {
+			w.Header().Set("Cache-Control", "private")
+		} else {
+			w.Header().Set("Cache-Control", "max-age=60")
+		}
+		w.Write([]byte("ok"))
+	}))
+	defer backend.Close()
+
+	cfg := &config.Config{
+		Cache: config.CacheConfig{Enabled: true},
+		Services: map[string]config.ServiceConfig{
+			"api": {URL: backend.URL, Routes: []config.RouteConfig{{Path: "/"}}},
+		},
+	}
+	proxy, err := New(cfg)
+	if err != nil {
+		t.Fatalf("Failed to create proxy: %v", err)
+	}
+	handler := proxy.handler()
+
+	burst := func(path string) {
+		var wg sync.WaitGroup
+		for i := 0; i < 10; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				rec := httptest.NewRecorder()
+				handler.ServeHTTP(rec, httptest.NewRequest("GET", "http://proxy.local"+path, nil))
+				if rec.Code != http.StatusOK || rec.Body.String() != "ok" {
+					t.Errorf("Expected 200 ok, got %d %q", rec.Code, rec.Body.String())
+				}
+			}()
+		}
+		wg.Wait()
+	}
+
+	burst("/popular")
+	if got := hits.Load(); got != 1 {
+		t.Errorf("Expected 1 upstream request for concurrent misses, got %d", got)
+	}
+
+	// Uncacheable responses are fetched for every request
+	hits.Store(0)
+	burst("/private")
+	if got := hits.Load(); got != 10 {
+		t.Errorf("Expected 10 upstream requests for a private response, got %d", got)
+	}
+}
+
+func TestCacheCoalescingSkipsUnstorable(t *testing.T) {
+	const concurrency = 5
+
+	tests := []struct {
+		name   string
+		method string
+		path   string
+		auth   func(i int) string
+	}{
+		{"POST", "POST", "/submit", func(int) string { return "" }},
+		{"authorized GET", "GET", "/account", func(i int) string { return fmt.Sprintf("Bearer user%d", i) }},
+	}
+
+	// Each path answers only once every request of its burst has
+	// arrived, which requests held back for one another never do
+	type barrier struct {
+		arrived atomic.Int64
+		all     chan struct{}
+	}
+	barriers := make(map[string]*barrier)
+	for _, tt := range tests {
+		barriers[tt.path] = &barrier{all: make(chan struct{})}
+	}
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b := barriers[r.URL.Path]
+		if b.arrived.Add(1) == concurrency {
+			close(b.all)
+		}
+		select {
+		case <-b.all:
+		case <-time.After(time.Second):
+			w.WriteHeader(http.StatusGatewayTimeout)
+			return
+		}
+		w.Header().Set("Cache-Control", "public, max-age=60")
+		w.Write([]byte("ok"))
+	}))
+	defer backend.Close()
+
+	cfg := &config.Config{
+		Cache: config.CacheConfig{Enabled: true},
+		Services: map[string]config.ServiceConfig{
+			"api": {URL: backend.URL, Routes: []config.RouteConfig{{Path: "/"}}},
+		},
+	}
+	proxy, err := New(cfg)
+	if err != nil {
+		t.Fatalf("Failed to create proxy: %v", err)
+	}
+	handler := proxy.handler()
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var wg sync.WaitGroup
+			for i := 0; i < concurrency; i++ {
+				wg.Add(1)
+				go func(i int) {
+					defer wg.Done()
+					req := httptest.NewRequest(tt.method, "http://proxy.local"+tt.path, nil)
+					if auth := tt.auth(i); auth != "" {
+						req.Header.Set("Authorization", auth)
+					}
+					rec := httptest.NewRecorder()
+					handler.ServeHTTP(rec, req)
+					if rec.Code != http.StatusOK {
+						t.Errorf("Expected concurrent requests to reach the backend together, got %d", rec.Code)
+					}
+				}(i)
+			}
+			wg.Wait()
+		})
+	}
+}
+
+func TestCacheStaleServing(t *testing.T) {
+	var version, hits atomic.Int64
+	var failing atomic.Bool
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hits.Add(1)
+		if failing.Load() {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		// Stale as soon as it's stored
+		w.Header().Set("Age", "2")
+		if r.URL.Path == "/swr" {
+			w.Header().Set("Cache-Control", "max-age=1, stale-while-revalidate=60")
+		} else {
+			w.Header().Set("Cache-Control", "max-age=1")
+		}
+		fmt.Fprintf(w, "v%d", version.Add(1))
+	}))
+	defer backend.Close()
+
+	cfg := &config.Config{
+		Cache: config.CacheConfig{
+			Enabled: true,
+			Rules:   []config.CacheRule{{Path: "/sie", StaleIfError: time.Minute}},
+		},
+		Services: map[string]config.ServiceConfig{
+			"api": {URL: backend.URL, Routes: []config.RouteConfig{{Path: "/"}}},
+		},
+	}
+	proxy, err := New(cfg)
+	if err != nil {
+		t.Fatalf("Failed to create proxy: %v", err)
+	}
+	handler := proxy.handler()
+
+	do := func(path string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, httptest.NewRequest("GET", "http://proxy.local"+path, nil))
+		return rec
+	}
+
+	t.Run("stale-while-revalidate", func(t *testing.T) {
+		do("/swr")
+		if rec := do("/swr"); rec.Body.String() != "v1" {
+			t.Errorf("Expected the stale response, got %q", rec.Body.String())
+		}
+
+		// The stale hit refreshed the response in the background
+		deadline := time.Now().Add(time.Second)
+		for hits.Load() < 2 && time.Now().Before(deadline) {
+			time.Sleep(10 * time.Millisecond)
+		}
+		time.Sleep(20 * time.Millisecond)
+		if rec := do("/swr"); rec.Body.String() != "v2" {
+			t.Errorf("Expected the refreshed response, got %q", rec.Body.String())
+		}
+	})
+
+	t.Run("stale-if-error", func(t *testing.T) {
+		first := do("/sie").Body.String()
+		failing.Store(true)
+		defer failing.Store(false)
+
+		if rec := do("/sie"); rec.Code != http.StatusOK || rec.Body.String() != first {
+			t.Errorf("Expected the stale response when the origin fails, got %d %q", rec.Code, rec.Body.String())
+		}
+		if rec := do("/swr-less"); rec.Code != http.StatusServiceUnavailable {
+			t.Errorf("Expected the origin's error without a stale response, got %d", rec.Code)
+		}
+	})
+}
+
+func TestCacheCircuitBreaker(t *testing.T) {
+	var hits atomic.Int64
+	var failing atomic.Bool
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hits.Add(1)
+		if failing.Load() {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		if r.URL.Path == "/stale" {
+			// Stale as soon as it's stored
+			w.Header().Set("Age", "2")
+			w.Header().Set("Cache-Control", "max-age=1, stale-if-error=60")
+		} else {
+			w.Header().Set("Cache-Control", "max-age=60")
+		}
+		w.Write([]byte(r.URL.Path))
+	}))
+	defer backend.Close()
+
+	cfg := &config.Config{
+		Cache: config.CacheConfig{Enabled: true},
+		Services: map[string]config.ServiceConfig{
+			"api": {
+				URL:            backend.URL,
+				CircuitBreaker: &config.BreakerConfig{MaxFailures: 1, Timeout: time.Minute},
+				Routes:         []config.RouteConfig{{Path: "/"}},
+			},
+		},
+	}
+	proxy, err := New(cfg)
+	if err != nil {
+		t.Fatalf("Failed to create proxy: %v", err)
+	}
+	handler := proxy.handler()
+
+	do := func(path string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, httptest.NewRequest("GET", "http://proxy.local"+path, nil))
+		return rec
+	}
+
+	do("/fresh")
+	do("/stale")
+
+	// The origin's failure opens the breaker, and the stale response
+	// stands in for it
+	failing.Store(true)
+	if rec := do("/stale"); rec.Code != http.StatusOK || rec.Body.String() != "/stale" {
+		t.Errorf("Expected the stale response when the origin fails, got %d %q", rec.Code, rec.Body.String())
+	}
+	if state := proxy.breakers["api"].GetState(); state != circuitbreaker.StateOpen {
+		t.Fatalf("Expected the breaker to open, got state %v", state)
+	}
+
+	// With the breaker open, the cache still answers without the origin
+	before := hits.Load()
+	if rec := do("/stale"); rec.Code != http.StatusOK || rec.Body.String() != "/stale" {
+		t.Errorf("Expected the stale response while the breaker is open, got %d %q", rec.Code, rec.Body.String())
+	}
+	if rec := do("/fresh"); rec.Code != http.StatusOK || rec.Body.String() != "/fresh" {
+		t.Errorf("Expected the fresh response while the breaker is open, got %d %q", rec.Code, rec.Body.String())
+	}
+	if rec := do("/uncached"); rec.Code != http.StatusServiceUnavailable {
+		t.Errorf("Expected 503 without a cached response, got %d", rec.Code)
+	}
+	if got := hits.Load(); got != before {
+		t.Errorf("Expected no upstream requests while the breaker is open, got %d", got-before)
+	}
+	if state := proxy.breakers["api"].GetState(); state != circuitbreaker.StateOpen {
+		t.Errorf("Expected cached responses to leave the breaker open, got state %v", state)
+	}
+}
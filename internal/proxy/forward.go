@@ -0,0 +1,299 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/oabraham1/go-http-proxy/internal/loadbalancer"
+	"github.com/oabraham1/go-http-proxy/internal/retry"
+)
+
+// errResponseTimeout fails attempts whose response headers took longer than
+// Proxy.ResponseTimeout
+var errResponseTimeout = HTTPError{Code: http.StatusGatewayTimeout, Message: "Upstream response timeout"}
+
+const (
+	// maxDrainBytes bounds how much of a discarded response is read so its
+	// connection can be reused
+	maxDrainBytes = 64 * 1024
+	// defaultMaxReplayBytes bounds the body buffered for hedged requests of
+	// services without a retry policy
+	defaultMaxReplayBytes = 1 << 20
+)
+
+func (p *Proxy) forwardRequest(r *http.Request, rt *route) (*http.Response, []Attempt, error) {
+	service := rt.service
+	balancer := p.balancers[service]
+	policy := rt.retry
+	hedger := p.hedgers[service]
+
+	// Retries and hedges need a replayable body, so buffer it up to the
+	// limit. Requests that can't be replayed stream their body through
+	// untouched and are sent once.
+	retryable := policy != nil && policy.AllowsMethod(r.Method)
+	hedgeable := hedger != nil && retry.IsIdempotent(r.Method)
+
+	if policy != nil {
+		defer policy.Budget().Begin()()
+	}
+
+	maxAttempts := 1
+	var body []byte
+	if retryable || hedgeable {
+		limit := int64(defaultMaxReplayBytes)
+		if policy != nil {
+			limit = policy.MaxBodyBytes()
+		}
+
+		buffered, ok, err := bufferBody(r, limit)
+		if err != nil {
+			return nil, nil, err
+		}
+		if !ok {
+			retryable, hedgeable = false, false
+		}
+		if retryable {
+			maxAttempts = policy.MaxAttempts()
+		}
+		body = buffered
+	}
+
+	var attempts []Attempt
+	tried := make(map[*loadbalancer.Backend]bool)
+
+	for attempt := 1; ; attempt++ {
+		backend, err := nextBackend(balancer, r, tried)
+		if err != nil {
+			return nil, attempts, HTTPError{Code: http.StatusServiceUnavailable, Message: "No backend available"}
+		}
+		tried[backend] = true
+
+		var resp *http.Response
+		if hedgeable {
+			resp, err = p.hedgedRoundTrip(r, rt, backend, body, tried, &attempts)
+		} else {
+			outReq := p.outboundRequest(r, backend, rt)
+			setBody(outReq, body)
+
+			start := time.Now()
+			resp, err = p.roundTrip(outReq, service, backend, rt.timeout(r))
+			attempts = append(attempts, newAttempt(backend, start, resp, err))
+			if hedger != nil && err == nil {
+				hedger.Observe(time.Since(start))
+			}
+		}
+
+		if attempt > 1 {
+			policy.Budget().RetryDone()
+		}
+
+		if attempt >= maxAttempts || r.Context().Err() != nil {
+			return resp, attempts, err
+		}
+		if err != nil && !policy.RetryableError(err) {
+			return resp, attempts, err
+		}
+		if err == nil && !policy.RetryableStatus(resp.StatusCode) {
+			return resp, attempts, err
+		}
+		if !policy.Budget().TryRetry() {
+			return resp, attempts, err
+		}
+
+		if resp != nil {
+			discard(resp)
+		}
+
+		timer := time.NewTimer(policy.Backoff(attempt))
+		select {
+		case <-timer.C:
+		case <-r.Context().Done():
+			timer.Stop()
+			policy.Budget().RetryDone()
+			return nil, attempts, r.Context().Err()
+		}
+	}
+}
+
+// nextBackend picks a backend for the next attempt, preferring one that
+// hasn't been tried yet for this request
+func nextBackend(balancer loadbalancer.Balancer, r *http.Request, tried map[*loadbalancer.Backend]bool) (*loadbalancer.Backend, error) {
+	backend, err := balancer.Next(r)
+	if err != nil {
+		return nil, err
+	}
+
+	for i := 1; tried[backend] && i < len(balancer.Backends()); i++ {
+		candidate, err := balancer.Next(r)
+		if err != nil {
+			break
+		}
+		if !tried[candidate] {
+			return candidate, nil
+		}
+	}
+	return backend, nil
+}
+
+// outboundRequest builds the request sent to a backend
+func (p *Proxy) outboundRequest(r *http.Request, backend *loadbalancer.Backend, rt *route) *http.Request {
+	outReq := r.Clone(r.Context())
+	outReq.RequestURI = ""
+	outReq.URL.Scheme = backend.URL.Scheme
+	outReq.URL.Host = backend.URL.Host
+	rt.rewriteURL(outReq.URL, backend.URL)
+
+	if rt.upstreamHost {
+		outReq.Host = backend.URL.Host
+	}
+
+	// Strip hop-by-hop headers, but keep telling the backend we accept
+	// trailers
+	removeHopHeaders(outReq.Header)
+	for _, te := range r.Header.Values("Te") {
+		if strings.Contains(strings.ToLower(te), "trailers") {
+			outReq.Header.Set("Te", "trailers")
+			break
+		}
+	}
+
+	// Add configured headers
+	for k, v := range rt.cfg.Headers {
+		outReq.Header.Set(k, v)
+	}
+
+	// Add X-Forwarded, Forwarded and Via headers
+	p.setForwardedHeaders(outReq, r)
+
+	return outReq
+}
+
+// roundTrip sends a single attempt to a backend. The backend stays
+// acquired, and the attempt's deadline running, until the response body is
+// closed. Proxy.ResponseTimeout only bounds the wait for the response
+// headers, so streamed bodies can outlive it. gRPC calls are left to their
+// grpc-timeout and the client, as streams may not send headers until the
+// client has sent messages.
+func (p *Proxy) roundTrip(outReq *http.Request, service string, backend *loadbalancer.Backend, timeout time.Duration) (*http.Response, error) {
+	parent := outReq.Context()
+	var ctx context.Context
+	var cancel context.CancelFunc
+	if timeout > 0 {
+		ctx, cancel = context.WithTimeout(parent, timeout)
+	} else {
+		ctx, cancel = context.WithCancel(parent)
+	}
+	outReq = outReq.WithContext(ctx)
+
+	var headerTimer *time.Timer
+	if d := p.cfg.Proxy.ResponseTimeout; d > 0 && !isGRPCRequest(outReq) {
+		headerTimer = time.AfterFunc(d, cancel)
+	}
+
+	backend.Acquire()
+	resp, err := p.clientFor(service).Do(outReq)
+	if headerTimer != nil && !headerTimer.Stop() {
+		// The headers were late, even if they just made it
+		if err == nil {
+			resp.Body.Close()
+		}
+		resp, err = nil, errResponseTimeout
+	}
+	p.recordOutcome(parent, service, backend, resp, err)
+	if err != nil {
+		backend.Release()
+		cancel()
+		return nil, err
+	}
+
+	removeHopHeaders(resp.Header)
+	addVia(resp.Header, resp.ProtoMajor, resp.ProtoMinor)
+
+	resp.Body = &releasingBody{
+		ReadCloser: resp.Body,
+		release: func() {
+			backend.Release()
+			cancel()
+		},
+	}
+
+	return resp, nil
+}
+
+// setBody gives an outbound request its own reader over a buffered body
+func setBody(outReq *http.Request, body []byte) {
+	if body == nil {
+		return
+	}
+
+	outReq.Body = io.NopCloser(bytes.NewReader(body))
+	outReq.ContentLength = int64(len(body))
+	outReq.GetBody = func() (io.ReadCloser, error) {
+		return io.NopCloser(bytes.NewReader(body)), nil
+	}
+}
+
+// discard drains and closes a response that won't be sent to the client
+func discard(resp *http.Response) {
+	io.Copy(io.Discard, io.LimitReader(resp.Body, maxDrainBytes))
+	resp.Body.Close()
+}
+
+// bufferBody reads the request body so it can be replayed. It reports false
+// when the body exceeds limit, in which case r.Body still yields the full
+// body for a single attempt.
+func bufferBody(r *http.Request, limit int64) ([]byte, bool, error) {
+	if r.Body == nil || r.Body == http.NoBody {
+		return nil, true, nil
+	}
+
+	body, err := io.ReadAll(io.LimitReader(r.Body, limit+1))
+	if err != nil {
+		return nil, false, err
+	}
+
+	if int64(len(body)) > limit {
+		r.Body = struct {
+			io.Reader
+			io.Closer
+		}{io.MultiReader(bytes.NewReader(body), r.Body), r.Body}
+		return nil, false, nil
+	}
+
+	r.Body.Close()
+	return body, true, nil
+}
+
+// recordOutcome reports an upstream attempt to the service's outlier
+// detector. Attempts abandoned by the client, or cancelled because a hedge
+// won, say nothing about the backend.
+func (p *Proxy) recordOutcome(ctx context.Context, service string, backend *loadbalancer.Backend, resp *http.Response, err error) {
+	detector, ok := p.outliers[service]
+	if !ok || ctx.Err() != nil {
+		return
+	}
+
+	if err != nil {
+		detector.Record(backend, 0, err)
+		return
+	}
+	detector.Record(backend, resp.StatusCode, nil)
+}
+
+// releasingBody runs release once when the upstream response body is closed
+type releasingBody struct {
+	io.ReadCloser
+	release func()
+	once    sync.Once
+}
+
+func (b *releasingBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.once.Do(b.release)
+	return err
+}
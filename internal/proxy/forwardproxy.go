@@ -0,0 +1,502 @@
+package proxy
+
+import (
+	"context"
+	"crypto/subtle"
+	"crypto/tls"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/oabraham1/go-http-proxy/internal/egress"
+	"github.com/oabraham1/go-http-proxy/internal/mitm"
+)
+
+const (
+	// forwardProxyService names forward-proxy traffic in logs
+	forwardProxyService = "forward-proxy"
+	// connectDialTimeout bounds connecting to a CONNECT destination
+	connectDialTimeout = 30 * time.Second
+	// interceptHandshakeTimeout bounds the client's TLS handshake with an
+	// intercepting tunnel
+	interceptHandshakeTimeout = 10 * time.Second
+
+	connectEstablished = "HTTP/1.1 200 Connection Established\r\n\r\n"
+)
+
+// forwardProxy serves clients that use the proxy to reach other hosts
+type forwardProxy struct {
+	policy      *egress.Policy
+	limiter     *egress.Limiter
+	transport   *http.Transport
+	credentials map[string]string
+	realm       string
+	idleTimeout time.Duration
+	issuer      *mitm.Issuer // nil unless tunnels are intercepted
+	bypass      []string
+}
+
+func (p *Proxy) initForwardProxy() error {
+	fc := p.cfg.ForwardProxy
+	if fc == nil || !fc.Enabled {
+		return nil
+	}
+
+	policy, err := egress.New(egress.Config{
+		AllowHosts: fc.AllowHosts,
+		DenyHosts:  fc.DenyHosts,
+		AllowPorts: fc.AllowPorts,
+		AllowCIDRs: fc.AllowCIDRs,
+		DenyCIDRs:  fc.DenyCIDRs,
+	})
+	if err != nil {
+		return fmt.Errorf("forward proxy: %w", err)
+	}
+
+	fp := &forwardProxy{
+		policy:  policy,
+		limiter: egress.NewLimiter(fc.MaxConnsPerClient, fc.BandwidthPerClient),
+		transport: &http.Transport{
+			DialContext:         policy.DialContext,
+			MaxIdleConns:        p.cfg.Proxy.MaxIdleConns,
+			IdleConnTimeout:     p.cfg.Proxy.IdleConnTimeout,
+			TLSHandshakeTimeout: p.cfg.Proxy.TLSHandshakeTimeout,
+			DisableCompression:  true,
+			ForceAttemptHTTP2:   true,
+		},
+		credentials: fc.Credentials,
+		realm:       fc.Realm,
+		idleTimeout: fc.IdleTimeout,
+	}
+	if fp.realm == "" {
+		fp.realm = viaPseudonym
+	}
+	if fp.idleTimeout <= 0 {
+		fp.idleTimeout = defaultUpgradeIdleTimeout
+	}
+
+	if ic := fc.Intercept; ic != nil && ic.Enabled {
+		ca, err := mitm.LoadCA(ic.CACertFile, ic.CAKeyFile)
+		if err != nil {
+			return fmt.Errorf("forward proxy: %w", err)
+		}
+		if fp.issuer, err = mitm.NewIssuer(ca, ic.CacheSize); err != nil {
+			return fmt.Errorf("forward proxy: %w", err)
+		}
+		fp.bypass = ic.Bypass
+	}
+
+	p.forward = fp
+	return nil
+}
+
+// isForwardProxyRequest reports whether r asks for another host, either as
+// a CONNECT or with an absolute-form request URI
+func isForwardProxyRequest(r *http.Request) bool {
+	return r.Method == http.MethodConnect || r.URL.IsAbs()
+}
+
+// forwardProxyHandler sends forward-proxy requests to the forward proxy and
+// everything else to next
+func (p *Proxy) forwardProxyHandler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if isForwardProxyRequest(r) {
+			p.handleForwardProxy(w, r)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func (p *Proxy) handleForwardProxy(w http.ResponseWriter, r *http.Request) {
+	start := time.Now()
+	fp := p.forward
+	lw := p.wrapResponseWriter(w)
+
+	var t *tunnel
+	var cacheHit, intercepted bool
+	var err error
+	defer func() {
+		entry := p.newLogEntry(start, lw, r, forwardProxyService, cacheHit, nil, err)
+		entry.ExtraData["destination"] = r.Host
+		if intercepted {
+			entry.ExtraData["intercepted"] = true
+		}
+		if t != nil {
+			entry.TunnelUp = t.up.Load()
+			entry.TunnelDown = t.down.Load()
+		}
+		p.writeLog(entry)
+	}()
+
+	p.metrics.activeRequests.Add(1)
+	defer p.metrics.activeRequests.Add(-1)
+	p.metrics.requests.Add(1)
+	p.metrics.countProtocol(r)
+
+	user, ok := fp.authenticate(r)
+	if !ok {
+		err = errors.New("proxy authentication failed")
+		lw.Header().Set("Proxy-Authenticate", fmt.Sprintf("Basic realm=%q", fp.realm))
+		http.Error(lw, "Proxy authentication required", http.StatusProxyAuthRequired)
+		return
+	}
+
+	key := user
+	if key == "" {
+		key = r.RemoteAddr
+		if ip := p.trusted.clientIP(r); ip != nil {
+			key = ip.String()
+		}
+	}
+	client, err := fp.limiter.Acquire(key)
+	if err != nil {
+		p.handleError(lw, r, HTTPError{Code: http.StatusTooManyRequests, Message: "Too many connections"})
+		return
+	}
+	defer client.Release()
+
+	host, port, err := destination(r)
+	if err != nil {
+		p.handleError(lw, r, HTTPError{Code: http.StatusBadRequest, Message: "Invalid destination"})
+		return
+	}
+	if err = fp.policy.CheckHost(host, port); err != nil {
+		p.handleError(lw, r, HTTPError{Code: http.StatusForbidden, Message: "Destination not allowed"})
+		return
+	}
+
+	if r.Method != http.MethodConnect {
+		cacheHit, err = p.exchange(lw, r, client)
+		return
+	}
+	if r.ProtoMajor != 1 {
+		err = HTTPError{Code: http.StatusHTTPVersionNotSupported, Message: "CONNECT requires HTTP/1.1"}
+		p.handleError(lw, r, err)
+		return
+	}
+
+	if fp.intercepts(host) {
+		intercepted = true
+		err = p.interceptTunnel(lw, r, host, client)
+	} else {
+		t, err = p.connectTunnel(lw, r, client)
+	}
+	if err != nil && !lw.hijacked {
+		p.handleError(lw, r, destinationError(err))
+	}
+}
+
+// exchange relays a request to its destination through the filters and
+// the cache. It writes error responses itself and reports whether the
+// cache answered.
+func (p *Proxy) exchange(lw *loggedResponseWriter, r *http.Request, client *egress.Client) (bool, error) {
+	for _, filter := range p.filters {
+		if err := filter.Process(r); err != nil {
+			p.handleError(lw, r, err)
+			return false, err
+		}
+	}
+
+	hit, _, err := p.serveCached(lw, r, p.cache, 0, func(out *http.Request) (*http.Response, []Attempt, error) {
+		outReq := out.Clone(out.Context())
+		outReq.RequestURI = ""
+		removeHopHeaders(outReq.Header)
+		addVia(outReq.Header, out.ProtoMajor, out.ProtoMinor)
+		if out.Body != nil && out.Body != http.NoBody {
+			outReq.Body = readCloser{client.Reader(out.Context(), out.Body), out.Body}
+		}
+
+		resp, err := p.forward.transport.RoundTrip(outReq)
+		if err != nil {
+			return nil, nil, destinationError(err)
+		}
+
+		removeHopHeaders(resp.Header)
+		addVia(resp.Header, resp.ProtoMajor, resp.ProtoMinor)
+		resp.Body = readCloser{client.Reader(out.Context(), resp.Body), resp.Body}
+		return resp, nil, nil
+	})
+	return hit, err
+}
+
+// connectTunnel dials a CONNECT destination and relays bytes between it and
+// the client. The returned tunnel is nil if the client was never answered.
+func (p *Proxy) connectTunnel(lw *loggedResponseWriter, r *http.Request, client *egress.Client) (*tunnel, error) {
+	ctx, cancel := context.WithTimeout(r.Context(), connectDialTimeout)
+	backConn, err := p.forward.policy.DialContext(ctx, "tcp", r.Host)
+	cancel()
+	if err != nil {
+		return nil, err
+	}
+
+	conn, brw, err := http.NewResponseController(lw).Hijack()
+	if err != nil {
+		backConn.Close()
+		return nil, err
+	}
+	defer conn.Close()
+	lw.statusCode = http.StatusOK
+	conn.SetDeadline(time.Time{})
+
+	t := &tunnel{
+		client:      readWriteCloser{client.Reader(context.Background(), conn), conn, conn},
+		backend:     readWriteCloser{client.Reader(context.Background(), backConn), backConn, backConn},
+		idleTimeout: p.forward.idleTimeout,
+	}
+
+	if _, err := io.WriteString(conn, connectEstablished); err != nil {
+		backConn.Close()
+		return t, err
+	}
+
+	// Pass on anything the client sent right behind the CONNECT
+	if buffered := brw.Reader.Buffered(); buffered > 0 {
+		data, _ := brw.Reader.Peek(buffered)
+		n, err := backConn.Write(data)
+		t.up.Add(int64(n))
+		if err != nil {
+			backConn.Close()
+			return t, err
+		}
+	}
+
+	if !p.trackTunnel(t) {
+		t.close()
+		return t, nil
+	}
+	defer p.untrackTunnel(t)
+
+	t.run()
+	return t, nil
+}
+
+// intercepts reports whether CONNECT tunnels to host are decrypted
+func (fp *forwardProxy) intercepts(host string) bool {
+	return fp.issuer != nil && !egress.MatchHost(fp.bypass, host)
+}
+
+// interceptTunnel answers a CONNECT itself and terminates the client's TLS
+// session with a certificate for the destination. Each decrypted request
+// is then relayed like an absolute-form one.
+func (p *Proxy) interceptTunnel(lw *loggedResponseWriter, r *http.Request, host string, client *egress.Client) error {
+	conn, brw, err := http.NewResponseController(lw).Hijack()
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	lw.statusCode = http.StatusOK
+
+	if _, err := io.WriteString(conn, connectEstablished); err != nil {
+		return err
+	}
+
+	// The client may have sent its hello right behind the CONNECT
+	tlsConn := tls.Server(bufferedConn{conn, brw.Reader}, p.forward.issuer.TLSConfig(host))
+	conn.SetDeadline(time.Now().Add(interceptHandshakeTimeout))
+	if err := tlsConn.HandshakeContext(r.Context()); err != nil {
+		return fmt.Errorf("TLS handshake: %w", err)
+	}
+	conn.SetDeadline(time.Time{})
+
+	listener := newConnListener(tlsConn)
+	server := &http.Server{
+		Handler:        withoutClientCert(p.interceptedHandler(r.Host, client)),
+		IdleTimeout:    p.forward.idleTimeout,
+		MaxHeaderBytes: p.cfg.Server.MaxHeaderBytes,
+		ConnState: func(_ net.Conn, state http.ConnState) {
+			if state == http.StateClosed || state == http.StateHijacked {
+				listener.Close()
+			}
+		},
+	}
+
+	if !p.trackTunnel(server) {
+		return nil
+	}
+	defer p.untrackTunnel(server)
+
+	if err := server.Serve(listener); !errors.Is(err, net.ErrClosed) && !errors.Is(err, http.ErrServerClosed) {
+		return err
+	}
+	return nil
+}
+
+// interceptedHandler relays and logs the requests decrypted from a tunnel
+// to authority. Requests must name the tunnel's host, so they can't reach,
+// or be cached for, another.
+func (p *Proxy) interceptedHandler(authority string, client *egress.Client) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		lw := p.wrapResponseWriter(w)
+		r.URL.Scheme = "https"
+		r.URL.Host = authority
+
+		var cacheHit bool
+		var err error
+		defer func() {
+			entry := p.newLogEntry(start, lw, r, forwardProxyService, cacheHit, nil, err)
+			entry.ExtraData["destination"] = authority
+			entry.ExtraData["intercepted"] = true
+			p.writeLog(entry)
+		}()
+
+		p.metrics.activeRequests.Add(1)
+		defer p.metrics.activeRequests.Add(-1)
+		p.metrics.requests.Add(1)
+		p.metrics.countProtocol(r)
+
+		if !sameAuthority(r.Host, authority) {
+			err = HTTPError{Code: http.StatusMisdirectedRequest, Message: "Host doesn't match the tunnel"}
+			p.handleError(lw, r, err)
+			return
+		}
+		cacheHit, err = p.exchange(lw, r, client)
+	})
+}
+
+// sameAuthority reports whether the Host of a request decrypted from a
+// tunnel names the tunnel's authority, whose port defaults to 443
+func sameAuthority(host, authority string) bool {
+	split := func(s string) (string, string) {
+		if h, port, err := net.SplitHostPort(s); err == nil {
+			return h, port
+		}
+		return s, "443"
+	}
+	host, port := split(host)
+	wantHost, wantPort := split(authority)
+	return strings.EqualFold(host, wantHost) && port == wantPort
+}
+
+// authenticate checks the client's Proxy-Authorization credentials. It
+// returns the user, which is empty when auth is off.
+func (fp *forwardProxy) authenticate(r *http.Request) (string, bool) {
+	if len(fp.credentials) == 0 {
+		return "", true
+	}
+
+	scheme, encoded, ok := strings.Cut(r.Header.Get("Proxy-Authorization"), " ")
+	if !ok || !strings.EqualFold(scheme, "Basic") {
+		return "", false
+	}
+	decoded, err := base64.StdEncoding.DecodeString(strings.TrimSpace(encoded))
+	if err != nil {
+		return "", false
+	}
+	user, password, ok := strings.Cut(string(decoded), ":")
+	if !ok {
+		return "", false
+	}
+
+	expected, known := fp.credentials[user]
+	if !known {
+		// Compare anyway so unknown users take as long as known ones
+		expected = "\x00" + password
+	}
+	if subtle.ConstantTimeCompare([]byte(password), []byte(expected)) != 1 || !known {
+		return "", false
+	}
+	return user, true
+}
+
+// destination returns the host and port a forward-proxy request is for
+func destination(r *http.Request) (string, int, error) {
+	host, portStr, err := net.SplitHostPort(r.Host)
+	if err != nil {
+		if r.Method == http.MethodConnect {
+			return "", 0, err
+		}
+		host, portStr = r.Host, "80"
+		if r.URL.Scheme == "https" {
+			portStr = "443"
+		}
+	}
+
+	port, err := strconv.Atoi(portStr)
+	if err != nil || host == "" {
+		return "", 0, fmt.Errorf("invalid destination %q", r.Host)
+	}
+	return host, port, nil
+}
+
+// destinationError turns a failure to reach a destination into the error
+// shown to the client
+func destinationError(err error) error {
+	var httpErr HTTPError
+	switch {
+	case errors.As(err, &httpErr):
+		return httpErr
+	case errors.Is(err, egress.ErrDenied):
+		return HTTPError{Code: http.StatusForbidden, Message: "Destination not allowed"}
+	case errors.Is(err, context.DeadlineExceeded):
+		return HTTPError{Code: http.StatusGatewayTimeout, Message: "Destination timed out"}
+	default:
+		return HTTPError{Code: http.StatusBadGateway, Message: "Destination unreachable"}
+	}
+}
+
+// readCloser reads through a wrapper while closing the original
+type readCloser struct {
+	io.Reader
+	io.Closer
+}
+
+// readWriteCloser reads through a wrapper while writing to and closing the
+// original
+type readWriteCloser struct {
+	io.Reader
+	io.Writer
+	io.Closer
+}
+
+// bufferedConn reads through a buffer that may already hold some of the
+// connection's data
+type bufferedConn struct {
+	net.Conn
+	r io.Reader
+}
+
+func (c bufferedConn) Read(b []byte) (int, error) {
+	return c.r.Read(b)
+}
+
+// connListener hands a single connection to an http.Server and then blocks
+// until it is closed
+type connListener struct {
+	conn      net.Conn
+	accepted  sync.Once
+	closeOnce sync.Once
+	done      chan struct{}
+}
+
+func newConnListener(conn net.Conn) *connListener {
+	return &connListener{conn: conn, done: make(chan struct{})}
+}
+
+func (l *connListener) Accept() (net.Conn, error) {
+	var conn net.Conn
+	l.accepted.Do(func() { conn = l.conn })
+	if conn != nil {
+		return conn, nil
+	}
+
+	<-l.done
+	return nil, net.ErrClosed
+}
+
+func (l *connListener) Close() error {
+	l.closeOnce.Do(func() { close(l.done) })
+	return nil
+}
+
+func (l *connListener) Addr() net.Addr {
+	return l.conn.LocalAddr()
+}
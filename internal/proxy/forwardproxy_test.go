@@ -0,0 +1,482 @@
+package proxy
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/oabraham1/go-http-proxy/internal/cache"
+	"github.com/oabraham1/go-http-proxy/internal/config"
+	"github.com/oabraham1/go-http-proxy/internal/mitm"
+	"github.com/oabraham1/go-http-proxy/pkg/filters"
+)
+
+// syncBuffer is a bytes.Buffer that is safe to share with the log package
+type syncBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+// newForwardProxy serves a proxy in forward-proxy mode that may reach the
+// given test server, loopback addresses included
+func newForwardProxy(t *testing.T, backend *httptest.Server, fc config.ForwardProxyConfig) (*Proxy, *httptest.Server) {
+	t.Helper()
+
+	port := backend.Listener.Addr().(*net.TCPAddr).Port
+	fc.Enabled = true
+	fc.AllowPorts = append(fc.AllowPorts, port)
+	fc.AllowCIDRs = append(fc.AllowCIDRs, "127.0.0.0/8")
+
+	cfg := &config.Config{ForwardProxy: &fc}
+	proxy, err := New(cfg)
+	if err != nil {
+		t.Fatalf("Failed to create proxy: %v", err)
+	}
+	server := httptest.NewServer(proxy.server.Handler)
+	t.Cleanup(server.Close)
+	return proxy, server
+}
+
+func forwardClient(t *testing.T, proxyURL string) *http.Client {
+	t.Helper()
+
+	u, err := url.Parse(proxyURL)
+	if err != nil {
+		t.Fatalf("Invalid proxy URL: %v", err)
+	}
+	return &http.Client{
+		Transport: &http.Transport{Proxy: http.ProxyURL(u)},
+		Timeout:   5 * time.Second,
+	}
+}
+
+func TestForwardProxyAbsoluteForm(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Proxy-Connection") != "" {
+			t.Error("Expected Proxy-Connection to be removed")
+		}
+		w.Write([]byte("hello " + r.URL.Path))
+	}))
+	defer backend.Close()
+
+	_, proxy := newForwardProxy(t, backend, config.ForwardProxyConfig{})
+
+	resp, err := forwardClient(t, proxy.URL).Get(backend.URL + "/greeting")
+	if err != nil {
+		t.Fatalf("Request failed: %v", err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK || string(body) != "hello /greeting" {
+		t.Errorf("Expected 200 %q, got %d %q", "hello /greeting", resp.StatusCode, body)
+	}
+	if via := resp.Header.Get("Via"); !strings.Contains(via, viaPseudonym) {
+		t.Errorf("Expected Via to name the proxy, got %q", via)
+	}
+}
+
+func TestForwardProxyCacheKeyspace(t *testing.T) {
+	handler := func(name string) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Cache-Control", "max-age=60")
+			w.Write([]byte(name))
+		})
+	}
+	service := httptest.NewServer(handler("service"))
+	defer service.Close()
+	destination := httptest.NewServer(handler("destination"))
+	defer destination.Close()
+
+	cfg := &config.Config{
+		Cache: config.CacheConfig{Enabled: true},
+		ForwardProxy: &config.ForwardProxyConfig{
+			Enabled:    true,
+			AllowPorts: []int{destination.Listener.Addr().(*net.TCPAddr).Port},
+			AllowCIDRs: []string{"127.0.0.0/8"},
+		},
+		Services: map[string]config.ServiceConfig{
+			"api": {URL: service.URL, Routes: []config.RouteConfig{{Path: "/"}}},
+		},
+	}
+	proxy, err := New(cfg)
+	if err != nil {
+		t.Fatalf("Failed to create proxy: %v", err)
+	}
+	server := httptest.NewServer(proxy.server.Handler)
+	defer server.Close()
+
+	// A reverse-proxied response for the destination's host and path
+	req, _ := http.NewRequest("GET", server.URL+"/page", nil)
+	req.Host = destination.Listener.Addr().String()
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("Request failed: %v", err)
+	}
+	resp.Body.Close()
+
+	// isn't what forward-proxy clients of that URL get
+	resp, err = forwardClient(t, server.URL).Get(destination.URL + "/page")
+	if err != nil {
+		t.Fatalf("Request failed: %v", err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if string(body) != "destination" {
+		t.Errorf("Expected the destination's response, got %q", body)
+	}
+}
+
+func TestForwardProxyConnect(t *testing.T) {
+	logs := &syncBuffer{}
+	log.SetOutput(logs)
+	defer log.SetOutput(io.Discard)
+
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("tunnelled"))
+	}))
+	defer backend.Close()
+
+	_, proxy := newForwardProxy(t, backend, config.ForwardProxyConfig{})
+
+	// The client speaks plain HTTP through the tunnel so the bytes can be
+	// counted exactly
+	conn, err := net.Dial("tcp", proxy.Listener.Addr().String())
+	if err != nil {
+		t.Fatalf("Dial failed: %v", err)
+	}
+	defer conn.Close()
+
+	target := backend.Listener.Addr().String()
+	io.WriteString(conn, "CONNECT "+target+" HTTP/1.1\r\nHost: "+target+"\r\n\r\n")
+
+	reader := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(reader, nil)
+	if err != nil {
+		t.Fatalf("Failed to read CONNECT response: %v", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("Expected 200, got %d", resp.StatusCode)
+	}
+
+	request := "GET / HTTP/1.1\r\nHost: " + target + "\r\nConnection: close\r\n\r\n"
+	io.WriteString(conn, request)
+	resp, err = http.ReadResponse(reader, nil)
+	if err != nil {
+		t.Fatalf("Failed to read tunnelled response: %v", err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if string(body) != "tunnelled" {
+		t.Errorf("Expected %q, got %q", "tunnelled", body)
+	}
+	conn.Close()
+
+	// The entry is logged once the tunnel has closed
+	var entry LogEntry
+	deadline := time.Now().Add(2 * time.Second)
+	for entry.TunnelUp == 0 && time.Now().Before(deadline) {
+		for _, line := range strings.Split(logs.String(), "\n") {
+			if i := strings.Index(line, "{"); i >= 0 && strings.Contains(line, forwardProxyService) {
+				json.Unmarshal([]byte(line[i:]), &entry)
+			}
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	if entry.TunnelUp != int64(len(request)) {
+		t.Errorf("Expected %d bytes up, got %d", len(request), entry.TunnelUp)
+	}
+	if entry.TunnelDown <= int64(len("tunnelled")) {
+		t.Errorf("Expected the whole response to be counted down, got %d bytes", entry.TunnelDown)
+	}
+	if entry.StatusCode != http.StatusOK {
+		t.Errorf("Expected status 200 to be logged, got %d", entry.StatusCode)
+	}
+}
+
+func TestForwardProxyPolicy(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		t.Error("Expected denied request not to reach the backend")
+	}))
+	defer backend.Close()
+
+	tests := []struct {
+		name   string
+		config config.ForwardProxyConfig
+	}{
+		{"denied host", config.ForwardProxyConfig{DenyHosts: []string{"127.0.0.1"}}},
+		{"host not allowed", config.ForwardProxyConfig{AllowHosts: []string{"*.example.com"}}},
+		{"denied CIDR", config.ForwardProxyConfig{DenyCIDRs: []string{"127.0.0.0/8"}}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, proxy := newForwardProxy(t, backend, tt.config)
+
+			resp, err := forwardClient(t, proxy.URL).Get(backend.URL)
+			if err != nil {
+				t.Fatalf("Request failed: %v", err)
+			}
+			resp.Body.Close()
+
+			if resp.StatusCode != http.StatusForbidden {
+				t.Errorf("Expected 403, got %d", resp.StatusCode)
+			}
+		})
+	}
+
+	// Ports outside the allowed list are refused too
+	_, proxy := newForwardProxy(t, backend, config.ForwardProxyConfig{})
+	resp, err := forwardClient(t, proxy.URL).Get("http://127.0.0.1:1/")
+	if err != nil {
+		t.Fatalf("Request failed: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusForbidden {
+		t.Errorf("Expected 403 for a disallowed port, got %d", resp.StatusCode)
+	}
+}
+
+func TestForwardProxyAuth(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Proxy-Authorization") != "" {
+			t.Error("Expected Proxy-Authorization not to reach the backend")
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer backend.Close()
+
+	_, proxy := newForwardProxy(t, backend, config.ForwardProxyConfig{
+		Credentials: map[string]string{"alice": "secret"},
+		Realm:       "egress",
+	})
+
+	tests := []struct {
+		name     string
+		user     *url.Userinfo
+		expected int
+	}{
+		{"no credentials", nil, http.StatusProxyAuthRequired},
+		{"wrong password", url.UserPassword("alice", "wrong"), http.StatusProxyAuthRequired},
+		{"unknown user", url.UserPassword("bob", "secret"), http.StatusProxyAuthRequired},
+		{"valid credentials", url.UserPassword("alice", "secret"), http.StatusNoContent},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			u, _ := url.Parse(proxy.URL)
+			u.User = tt.user
+			client := forwardClient(t, u.String())
+
+			resp, err := client.Get(backend.URL)
+			if err != nil {
+				t.Fatalf("Request failed: %v", err)
+			}
+			resp.Body.Close()
+
+			if resp.StatusCode != tt.expected {
+				t.Errorf("Expected %d, got %d", tt.expected, resp.StatusCode)
+			}
+			if tt.expected == http.StatusProxyAuthRequired {
+				if got := resp.Header.Get("Proxy-Authenticate"); got != `Basic realm="egress"` {
+					t.Errorf("Expected a Basic challenge, got %q", got)
+				}
+			}
+		})
+	}
+}
+
+func TestForwardProxyConnectionLimit(t *testing.T) {
+	release := make(chan struct{})
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+	}))
+	defer backend.Close()
+	defer close(release)
+
+	_, proxy := newForwardProxy(t, backend, config.ForwardProxyConfig{MaxConnsPerClient: 1})
+	client := forwardClient(t, proxy.URL)
+
+	// Hold one connection open through a tunnel
+	conn, err := net.Dial("tcp", proxy.Listener.Addr().String())
+	if err != nil {
+		t.Fatalf("Dial failed: %v", err)
+	}
+	defer conn.Close()
+	target := backend.Listener.Addr().String()
+	io.WriteString(conn, "CONNECT "+target+" HTTP/1.1\r\nHost: "+target+"\r\n\r\n")
+	if resp, err := http.ReadResponse(bufio.NewReader(conn), nil); err != nil || resp.StatusCode != http.StatusOK {
+		t.Fatalf("Expected tunnel to open, got %v", err)
+	}
+
+	resp, err := client.Get(backend.URL)
+	if err != nil {
+		t.Fatalf("Request failed: %v", err)
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusTooManyRequests {
+		t.Errorf("Expected 429, got %d", resp.StatusCode)
+	}
+}
+
+// writeTestCA writes a freshly generated interception CA and returns the
+// paths of its certificate and key files along with a pool trusting it
+func writeTestCA(t *testing.T) (string, string, *x509.CertPool) {
+	t.Helper()
+
+	ca, err := mitm.GenerateCA("Test Interception CA", 24*time.Hour)
+	if err != nil {
+		t.Fatalf("Failed to generate CA: %v", err)
+	}
+	certPEM, keyPEM, err := ca.EncodePEM()
+	if err != nil {
+		t.Fatalf("Failed to encode CA: %v", err)
+	}
+
+	dir := t.TempDir()
+	certFile := filepath.Join(dir, "ca.pem")
+	keyFile := filepath.Join(dir, "ca-key.pem")
+	os.WriteFile(certFile, certPEM, 0o600)
+	os.WriteFile(keyFile, keyPEM, 0o600)
+
+	pool := x509.NewCertPool()
+	pool.AddCert(ca.Certificate())
+	return certFile, keyFile, pool
+}
+
+func TestForwardProxyIntercept(t *testing.T) {
+	logs := &syncBuffer{}
+	log.SetOutput(logs)
+	defer log.SetOutput(io.Discard)
+
+	var hits atomic.Int64
+	backend := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hits.Add(1)
+		w.Write([]byte("secret " + r.Header.Get("X-Inspected")))
+	}))
+	defer backend.Close()
+
+	certFile, keyFile, caPool := writeTestCA(t)
+	proxy, server := newForwardProxy(t, backend, config.ForwardProxyConfig{
+		Intercept: &config.InterceptConfig{Enabled: true, CACertFile: certFile, CAKeyFile: keyFile},
+	})
+	proxy.forward.transport.TLSClientConfig = backend.Client().Transport.(*http.Transport).TLSClientConfig
+	proxy.filters = append(proxy.filters, filters.NewHeaderFilter(map[string]string{"X-Inspected": "yes"}))
+	proxy.cache = cache.New(cache.Config{TTL: time.Minute})
+
+	// The client trusts only the interception CA, so it can't reach the
+	// backend without the proxy's certificate
+	proxyURL, _ := url.Parse(server.URL)
+	client := &http.Client{
+		Transport: &http.Transport{
+			Proxy:           http.ProxyURL(proxyURL),
+			TLSClientConfig: &tls.Config{RootCAs: caPool},
+		},
+		Timeout: 5 * time.Second,
+	}
+
+	for i := 0; i < 2; i++ {
+		resp, err := client.Get(backend.URL + "/data")
+		if err != nil {
+			t.Fatalf("Request %d failed: %v", i, err)
+		}
+		body, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+
+		if string(body) != "secret yes" {
+			t.Errorf("Expected filtered request to return %q, got %q", "secret yes", body)
+		}
+		if resp.TLS == nil || resp.TLS.PeerCertificates[0].Issuer.CommonName != "Test Interception CA" {
+			t.Error("Expected the proxy's certificate to be presented")
+		}
+	}
+
+	if got := hits.Load(); got != 1 {
+		t.Errorf("Expected the second request to be served from cache, backend saw %d", got)
+	}
+
+	// A forged Host reaches neither the destination nor the cache
+	req, _ := http.NewRequest("GET", backend.URL+"/data", nil)
+	req.Host = "other.example.com"
+	resp, err := client.Do(req)
+	if err != nil {
+		t.Fatalf("Request failed: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusMisdirectedRequest || hits.Load() != 1 {
+		t.Errorf("Expected 421 without reaching the backend, got %d after %d requests", resp.StatusCode, hits.Load())
+	}
+
+	// Decrypted requests are logged with their path
+	deadline := time.Now().Add(2 * time.Second)
+	for !strings.Contains(logs.String(), `"path":"/data"`) && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if !strings.Contains(logs.String(), `"intercepted":true`) || !strings.Contains(logs.String(), `"path":"/data"`) {
+		t.Errorf("Expected intercepted requests to be logged, got %s", logs.String())
+	}
+}
+
+func TestForwardProxyInterceptBypass(t *testing.T) {
+	backend := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("pinned"))
+	}))
+	defer backend.Close()
+
+	certFile, keyFile, _ := writeTestCA(t)
+	_, server := newForwardProxy(t, backend, config.ForwardProxyConfig{
+		Intercept: &config.InterceptConfig{
+			Enabled:    true,
+			CACertFile: certFile,
+			CAKeyFile:  keyFile,
+			Bypass:     []string{"127.0.0.1"},
+		},
+	})
+
+	// Trusting only the backend's own certificate proves the tunnel wasn't
+	// intercepted
+	transport := backend.Client().Transport.(*http.Transport).Clone()
+	proxyURL, _ := url.Parse(server.URL)
+	transport.Proxy = http.ProxyURL(proxyURL)
+	client := &http.Client{Transport: transport, Timeout: 5 * time.Second}
+
+	resp, err := client.Get(backend.URL)
+	if err != nil {
+		t.Fatalf("Request failed: %v", err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+
+	if string(body) != "pinned" {
+		t.Errorf("Expected %q, got %q", "pinned", body)
+	}
+}
@@ -0,0 +1,92 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/oabraham1/go-http-proxy/internal/grpc"
+	"github.com/oabraham1/go-http-proxy/internal/middleware"
+)
+
+// isGRPCRequest reports whether r is a native gRPC call
+func isGRPCRequest(r *http.Request) bool {
+	return grpc.IsGRPC(r.Header.Get("Content-Type"))
+}
+
+// timeout returns the deadline of an upstream attempt: the route's timeout,
+// shortened to the deadline a gRPC client sent in grpc-timeout
+func (rt *route) timeout(r *http.Request) time.Duration {
+	timeout := rt.cfg.Timeout
+
+	if value := r.Header.Get("Grpc-Timeout"); value != "" && isGRPCRequest(r) {
+		if d, err := grpc.ParseTimeout(value); err == nil && (timeout <= 0 || d < timeout) {
+			timeout = d
+		}
+	}
+	return timeout
+}
+
+// writeGRPCError fails a gRPC call the way gRPC clients understand, with a
+// status in the response headers rather than an HTTP error code
+func writeGRPCError(w http.ResponseWriter, err error) {
+	code, message := grpc.Unknown, "Internal Server Error"
+
+	var httpErr HTTPError
+	switch {
+	case errors.As(err, &httpErr):
+		code, message = grpc.FromHTTPStatus(httpErr.Code), httpErr.Message
+	case errors.Is(err, context.DeadlineExceeded):
+		code, message = grpc.DeadlineExceeded, "Upstream deadline exceeded"
+	case errors.Is(err, context.Canceled):
+		code, message = grpc.Canceled, "Call cancelled"
+	default:
+		code, message = grpc.Unavailable, "Upstream unavailable"
+	}
+
+	grpc.WriteError(w, code, message)
+}
+
+// grpcLogFields adds the outcome of a gRPC call to a log entry. Failed calls
+// are logged as errors even though their HTTP status is 200.
+func grpcLogFields(entry *LogEntry, h http.Header) {
+	code, message, ok := grpc.Status(h)
+	if !ok {
+		return
+	}
+
+	entry.ExtraData["grpc_status"] = code.String()
+	if message != "" {
+		entry.ExtraData["grpc_message"] = message
+	}
+	if code != grpc.OK && entry.Error == "" {
+		entry.Error = fmt.Sprintf("grpc %s: %s", code, message)
+	}
+}
+
+// grpcWebCORS extends the configured CORS policy with the methods and
+// headers gRPC-Web clients rely on
+func (p *Proxy) grpcWebCORS() middleware.CORSConfig {
+	cors := p.cfg.Security.CORS
+	return middleware.CORSConfig{
+		AllowedOrigins:   cors.AllowedOrigins,
+		AllowedMethods:   appendMissing(cors.AllowedMethods, http.MethodPost),
+		AllowedHeaders:   appendMissing(cors.AllowedHeaders, "Content-Type", "X-Grpc-Web", "X-User-Agent", "Grpc-Timeout"),
+		ExposedHeaders:   appendMissing(cors.ExposedHeaders, "Grpc-Status", "Grpc-Message"),
+		AllowCredentials: cors.AllowCredentials,
+		MaxAge:           cors.MaxAge,
+	}
+}
+
+// appendMissing adds the values not yet in list, compared case-insensitively
+func appendMissing(list []string, values ...string) []string {
+	out := append([]string(nil), list...)
+	for _, value := range values {
+		if !containsFold(out, value) {
+			out = append(out, value)
+		}
+	}
+	return out
+}
@@ -0,0 +1,231 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
+
+	"github.com/oabraham1/go-http-proxy/internal/config"
+)
+
+// grpcFrame wraps a message in the gRPC length-prefixed framing
+func grpcFrame(msg string) []byte {
+	frame := []byte{0, 0, 0, 0, byte(len(msg))}
+	return append(frame, msg...)
+}
+
+// h2cClient speaks HTTP/2 with prior knowledge over cleartext
+func h2cClient() *http.Client {
+	return &http.Client{
+		Transport: &http2.Transport{
+			AllowHTTP: true,
+			DialTLSContext: func(ctx context.Context, network, addr string, _ *tls.Config) (net.Conn, error) {
+				var d net.Dialer
+				return d.DialContext(ctx, network, addr)
+			},
+		},
+	}
+}
+
+func TestGRPCProxying(t *testing.T) {
+	backend := httptest.NewServer(h2c.NewHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.ProtoMajor != 2 {
+			t.Errorf("Expected HTTP/2 upstream, got %s", r.Proto)
+		}
+		if r.Header.Get("Te") != "trailers" {
+			t.Errorf("Expected Te: trailers upstream, got %q", r.Header.Get("Te"))
+		}
+
+		switch r.URL.Path {
+		case "/test.Echo/Say":
+			body, _ := io.ReadAll(r.Body)
+			w.Header().Set("Content-Type", "application/grpc")
+			w.Write(body)
+			w.Header().Set(http.TrailerPrefix+"Grpc-Status", "0")
+			w.Header().Set(http.TrailerPrefix+"Grpc-Message", "")
+		case "/test.Echo/Slow":
+			<-r.Context().Done()
+		case "/test.Echo/Stream":
+			// Like a stream that answers once the client has sent enough,
+			// after longer than the proxy's response timeout
+			time.Sleep(200 * time.Millisecond)
+			w.Header().Set("Content-Type", "application/grpc")
+			w.Write(grpcFrame("late"))
+			w.Header().Set(http.TrailerPrefix+"Grpc-Status", "0")
+		}
+	}), &http2.Server{}))
+	defer backend.Close()
+
+	cfg := &config.Config{
+		Services: map[string]config.ServiceConfig{
+			"echo": {
+				URL:      backend.URL,
+				Protocol: "h2c",
+				Timeout:  5 * time.Second,
+				Routes:   []config.RouteConfig{{GRPCService: "test.Echo"}},
+			},
+		},
+	}
+	cfg.Server.H2C = true
+	cfg.Proxy.ResponseTimeout = 100 * time.Millisecond
+	proxy, err := New(cfg)
+	if err != nil {
+		t.Fatalf("Failed to create proxy: %v", err)
+	}
+	server := httptest.NewServer(proxy.server.Handler)
+	defer server.Close()
+
+	client := h2cClient()
+	call := func(t *testing.T, method, timeout string) *http.Response {
+		t.Helper()
+		req, _ := http.NewRequest("POST", server.URL+"/test.Echo/"+method, bytes.NewReader(grpcFrame("hello")))
+		req.Header.Set("Content-Type", "application/grpc")
+		req.Header.Set("Te", "trailers")
+		if timeout != "" {
+			req.Header.Set("Grpc-Timeout", timeout)
+		}
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Fatalf("Call failed: %v", err)
+		}
+		return resp
+	}
+
+	t.Run("trailers passed through", func(t *testing.T) {
+		resp := call(t, "Say", "")
+		defer resp.Body.Close()
+
+		body, _ := io.ReadAll(resp.Body)
+		if !bytes.Equal(body, grpcFrame("hello")) {
+			t.Errorf("Expected echoed frame, got %q", body)
+		}
+		if got := resp.Trailer.Get("Grpc-Status"); got != "0" {
+			t.Errorf("Expected trailer grpc-status 0, got %q", got)
+		}
+	})
+
+	t.Run("grpc-timeout bounds the upstream call", func(t *testing.T) {
+		start := time.Now()
+		resp := call(t, "Slow", "50m")
+		defer resp.Body.Close()
+		io.Copy(io.Discard, resp.Body)
+
+		if elapsed := time.Since(start); elapsed > 2*time.Second {
+			t.Errorf("Expected the call to end near its deadline, took %v", elapsed)
+		}
+		if got := resp.Header.Get("Grpc-Status"); got != "4" {
+			t.Errorf("Expected grpc-status 4 (DEADLINE_EXCEEDED), got %q", got)
+		}
+	})
+
+	t.Run("streams outlive the response timeout", func(t *testing.T) {
+		resp := call(t, "Stream", "")
+		defer resp.Body.Close()
+
+		body, _ := io.ReadAll(resp.Body)
+		if !bytes.Equal(body, grpcFrame("late")) {
+			t.Errorf("Expected the streamed frame, got %q", body)
+		}
+		if got := resp.Trailer.Get("Grpc-Status"); got != "0" {
+			t.Errorf("Expected trailer grpc-status 0, got %q", got)
+		}
+	})
+
+	t.Run("route requires gRPC content type", func(t *testing.T) {
+		resp, err := client.Post(server.URL+"/test.Echo/Say", "application/json", nil)
+		if err != nil {
+			t.Fatalf("Request failed: %v", err)
+		}
+		defer resp.Body.Close()
+
+		if resp.StatusCode != http.StatusNotFound {
+			t.Errorf("Expected status 404, got %d", resp.StatusCode)
+		}
+	})
+}
+
+func TestGRPCWebProxying(t *testing.T) {
+	backend := httptest.NewServer(h2c.NewHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if got := r.Header.Get("Content-Type"); got != "application/grpc+proto" {
+			t.Errorf("Expected native gRPC upstream, got %q", got)
+		}
+		body, _ := io.ReadAll(r.Body)
+		w.Header().Set("Content-Type", "application/grpc+proto")
+		w.Write(body)
+		w.Header().Set(http.TrailerPrefix+"Grpc-Status", "0")
+	}), &http2.Server{}))
+	defer backend.Close()
+
+	cfg := &config.Config{
+		Services: map[string]config.ServiceConfig{
+			"echo": {
+				URL:      backend.URL,
+				Protocol: "h2c",
+				Routes:   []config.RouteConfig{{GRPCService: "test.Echo", GRPCWeb: true}},
+			},
+		},
+	}
+	cfg.Security.CORS.Enabled = true
+	cfg.Security.CORS.AllowedOrigins = []string{"https://app.example.com"}
+	proxy, err := New(cfg)
+	if err != nil {
+		t.Fatalf("Failed to create proxy: %v", err)
+	}
+	server := httptest.NewServer(proxy.handler())
+	defer server.Close()
+
+	t.Run("preflight", func(t *testing.T) {
+		req, _ := http.NewRequest("OPTIONS", server.URL+"/test.Echo/Say", nil)
+		req.Header.Set("Origin", "https://app.example.com")
+		req.Header.Set("Access-Control-Request-Method", "POST")
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("Preflight failed: %v", err)
+		}
+		resp.Body.Close()
+
+		if resp.StatusCode != http.StatusNoContent {
+			t.Errorf("Expected status 204, got %d", resp.StatusCode)
+		}
+		if got := resp.Header.Get("Access-Control-Allow-Methods"); got != "POST" {
+			t.Errorf("Expected POST to be allowed, got %q", got)
+		}
+		if got := resp.Header.Get("Access-Control-Allow-Headers"); got != "Content-Type, X-Grpc-Web, X-User-Agent, Grpc-Timeout" {
+			t.Errorf("Expected gRPC-Web headers to be allowed, got %q", got)
+		}
+	})
+
+	t.Run("call over HTTP/1.1", func(t *testing.T) {
+		req, _ := http.NewRequest("POST", server.URL+"/test.Echo/Say", bytes.NewReader(grpcFrame("hello")))
+		req.Header.Set("Content-Type", "application/grpc-web+proto")
+		req.Header.Set("Origin", "https://app.example.com")
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("Call failed: %v", err)
+		}
+		defer resp.Body.Close()
+
+		if got := resp.Header.Get("Content-Type"); got != "application/grpc-web+proto" {
+			t.Errorf("Expected grpc-web content type, got %q", got)
+		}
+		if got := resp.Header.Get("Access-Control-Expose-Headers"); got != "Grpc-Status, Grpc-Message" {
+			t.Errorf("Expected gRPC headers to be exposed, got %q", got)
+		}
+
+		body, _ := io.ReadAll(resp.Body)
+		want := append(grpcFrame("hello"), 0x80, 0, 0, 0, 16)
+		want = append(want, "grpc-status: 0\r\n"...)
+		if !bytes.Equal(body, want) {
+			t.Errorf("Expected body %q, got %q", want, body)
+		}
+	})
+}
@@ -1,17 +1,19 @@
 package proxy
 
 import (
-	"context"
 	"encoding/json"
 	"fmt"
 	"io"
 	"log"
-	"net"
 	"net/http"
+	"sync"
 	"time"
 
 	"github.com/gorilla/mux"
-	"github.com/oabraham1/go-http-proxy/internal/config"
+	"github.com/oabraham1/go-http-proxy/internal/certs"
+	"github.com/oabraham1/go-http-proxy/internal/circuitbreaker"
+	"github.com/oabraham1/go-http-proxy/internal/grpc"
+	"github.com/oabraham1/go-http-proxy/internal/middleware"
 )
 
 type HTTPError struct {
@@ -24,18 +26,24 @@ func (e HTTPError) Error() string {
 }
 
 type HealthStatus struct {
-	Status    string          `json:"status"`
-	Services  map[string]bool `json:"services"`
-	Timestamp time.Time       `json:"timestamp"`
+	Status    string                     `json:"status"`
+	Services  map[string]bool            `json:"services"`
+	Backends  map[string]map[string]bool `json:"backends,omitempty"`
+	Timestamp time.Time                  `json:"timestamp"`
 }
 
 type ProxyMetrics struct {
-	Requests       int64     `json:"requests"`
-	CacheHits      int64     `json:"cache_hits"`
-	CacheMisses    int64     `json:"cache_misses"`
-	Errors         int64     `json:"errors"`
-	LastError      time.Time `json:"last_error,omitempty"`
-	ActiveRequests int64     `json:"active_requests"`
+	Requests       int64            `json:"requests"`
+	CacheHits      int64            `json:"cache_hits"`
+	CacheMisses    int64            `json:"cache_misses"`
+	Errors         int64            `json:"errors"`
+	LastError      time.Time        `json:"last_error,omitempty"`
+	ActiveRequests int64            `json:"active_requests"`
+	Hedges         int64            `json:"hedges"`
+	HedgeWins      int64            `json:"hedge_wins"`
+	UpgradedConns  int64            `json:"upgraded_connections"`
+	Protocols      map[string]int64 `json:"protocols"`
+	Certificates   []certs.Expiry   `json:"certificates,omitempty"`
 }
 
 func (p *Proxy) handler() http.Handler {
@@ -43,6 +51,10 @@ func (p *Proxy) handler() http.Handler {
 
 	// Add middleware chain
 	var handler http.Handler = router
+	if p.forward != nil {
+		handler = p.forwardProxyHandler(handler)
+	}
+	handler = withoutClientCert(handler)
 	for i := len(p.middlewares) - 1; i >= 0; i-- {
 		handler = p.middlewares[i].Wrap(handler)
 	}
@@ -57,13 +69,12 @@ func (p *Proxy) configureRoutes(router *mux.Router) {
 	router.HandleFunc("/health", p.handleHealth).Methods("GET")
 	router.HandleFunc("/metrics", p.handleMetrics).Methods("GET")
 
-	for service, cfg := range p.cfg.Services {
-		handler := p.serviceHandler(service, cfg)
-		router.PathPrefix("/" + service).Handler(handler)
+	for _, rt := range p.routes {
+		rt.register(router, p.routeHandler(rt))
 	}
 }
 
-func (p *Proxy) serviceHandler(service string, cfg config.ServiceConfig) http.Handler {
+func (p *Proxy) routeHandler(rt *route) http.Handler {
 	var baseHandler http.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		// Apply service-specific filters
 		for _, filter := range p.filters {
@@ -73,19 +84,37 @@ func (p *Proxy) serviceHandler(service string, cfg config.ServiceConfig) http.Ha
 			}
 		}
 
-		p.handleRequest(w, r, service, cfg)
+		p.handleRequest(w, r, rt)
 	})
 
-	if breaker, exists := p.breakers[service]; exists {
-		baseHandler = breaker.Wrap(baseHandler)
+	if rt.limiter != nil {
+		baseHandler = rt.limiter.Wrap(baseHandler)
+	}
+
+	if rt.config.GRPCWeb {
+		baseHandler = grpc.WebHandler(baseHandler)
+	}
+
+	if rt.config.Auth {
+		baseHandler = middleware.NewAuth(tokenValidator{p}).Wrap(baseHandler)
+	}
+
+	if p.clientCAs != nil {
+		baseHandler = p.clientCertHandler(rt, baseHandler)
+	}
+
+	// Preflights carry no credentials, so answer them before auth
+	if rt.cors != nil {
+		baseHandler = rt.cors.Wrap(baseHandler)
 	}
 
 	return baseHandler
 }
 
-func (p *Proxy) handleRequest(w http.ResponseWriter, r *http.Request, service string, cfg config.ServiceConfig) {
+func (p *Proxy) handleRequest(w http.ResponseWriter, r *http.Request, rt *route) {
 	start := time.Now()
 	var cacheHit bool
+	var attempts []Attempt
 	var err error
 
 	// Wrap the response writer to capture status code and size
@@ -93,82 +122,124 @@ func (p *Proxy) handleRequest(w http.ResponseWriter, r *http.Request, service st
 
 	// Defer logging until the end of the request
 	defer func() {
-		p.logRequest(start, lw, r, service, cacheHit, err)
+		p.logRequest(start, lw, r, rt.service, cacheHit, attempts, err)
 	}()
 
 	p.metrics.activeRequests.Add(1)
 	defer p.metrics.activeRequests.Add(-1)
 	p.metrics.requests.Add(1)
+	p.metrics.countProtocol(r)
 
-	// Check cache
-	if p.cache != nil {
-		if cached, ok := p.cache.Get(r); ok {
-			cacheHit = true
-			p.metrics.cacheHits.Add(1)
-			p.writeResponse(lw, cached)
-			return
-		}
-		p.metrics.cacheMisses.Add(1)
-	}
+	breaker := p.breakers[rt.service]
 
-	// Forward request
-	resp, err := p.forwardRequest(r, cfg)
-	if err != nil {
-		p.handleError(lw, r, err)
+	// Upgrades bypass the cache and take over the connection
+	if isUpgrade(r) {
+		if breaker != nil && !breaker.Allow() {
+			err = errCircuitOpen
+		} else {
+			attempts, err = p.handleUpgrade(lw, r, rt)
+			countOutcome(breaker, err, lw.statusCode)
+		}
+		if err != nil {
+			p.handleError(lw, r, err)
+		}
 		return
 	}
-	defer resp.Body.Close()
 
-	// Cache response if appropriate
-	if p.cache != nil && resp.StatusCode == http.StatusOK {
-		p.cache.Set(r, resp)
-	}
-
-	p.writeResponse(lw, resp)
+	// The breaker guards the fetch rather than the route, so cached
+	// responses are still served while it's open, and stale ones stand in
+	// for the fetches it fails
+	cacheHit, attempts, err = p.serveCached(lw, r, rt.cache, rt.config.FlushInterval, func(out *http.Request) (*http.Response, []Attempt, error) {
+		if breaker != nil && !breaker.Allow() {
+			return nil, nil, errCircuitOpen
+		}
+		resp, attempts, err := p.forwardRequest(out, rt)
+		if breaker != nil {
+			if err != nil {
+				countOutcome(breaker, err, 0)
+			} else {
+				resp.Body = &outcomeBody{ReadCloser: resp.Body, resp: resp, breaker: breaker}
+			}
+		}
+		return resp, attempts, err
+	})
 }
 
-func (p *Proxy) forwardRequest(r *http.Request, cfg config.ServiceConfig) (*http.Response, error) {
-	// Clone the request
-	outReq := r.Clone(r.Context())
-	outReq.RequestURI = ""
+// errCircuitOpen fails requests to a service whose circuit breaker is open
+var errCircuitOpen = HTTPError{Code: http.StatusServiceUnavailable, Message: "Service Unavailable"}
 
-	// Set timeout if configured
-	if cfg.Timeout > 0 {
-		ctx, cancel := context.WithTimeout(outReq.Context(), cfg.Timeout)
-		defer cancel()
-		outReq = outReq.WithContext(ctx)
+// countOutcome records the status a request was answered with, or the one
+// its error is answered with, against its service's circuit breaker, if it
+// has one
+func countOutcome(breaker *circuitbreaker.CircuitBreaker, err error, status int) {
+	if breaker == nil {
+		return
 	}
-
-	// Add configured headers
-	for k, v := range cfg.Headers {
-		outReq.Header.Set(k, v)
+	if err != nil {
+		status = http.StatusInternalServerError
+		if httpErr, ok := err.(HTTPError); ok {
+			status = httpErr.Code
+		}
 	}
 
-	// Add X-Forwarded headers
-	if clientIP, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
-		if prior := outReq.Header.Get("X-Forwarded-For"); prior != "" {
-			clientIP = prior + ", " + clientIP
-		}
-		outReq.Header.Set("X-Forwarded-For", clientIP)
+	if status >= 500 {
+		breaker.Failure()
+	} else {
+		breaker.Success()
 	}
+}
 
-	return p.client.Do(outReq)
+// outcomeBody counts a response against its service's circuit breaker
+// once it's closed, by when a gRPC call's trailers carry its outcome
+type outcomeBody struct {
+	io.ReadCloser
+	resp    *http.Response
+	breaker *circuitbreaker.CircuitBreaker
+	once    sync.Once
+}
+
+func (b *outcomeBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.once.Do(func() {
+		// gRPC calls fail with a 200 and report the outcome in grpc-status
+		status := b.resp.StatusCode
+		code, _, ok := grpc.Status(b.resp.Header)
+		if !ok {
+			code, _, ok = grpc.Status(b.resp.Trailer)
+		}
+		if ok && status == http.StatusOK {
+			status = grpc.HTTPStatus(code)
+		}
+		countOutcome(b.breaker, nil, status)
+	})
+	return err
 }
 
 func (p *Proxy) handleHealth(w http.ResponseWriter, r *http.Request) {
 	health := HealthStatus{
 		Status:    "ok",
 		Services:  make(map[string]bool),
+		Backends:  make(map[string]map[string]bool),
 		Timestamp: time.Now(),
 	}
 
-	for name, cfg := range p.cfg.Services {
-		if breaker, exists := p.breakers[name]; exists {
-			health.Services[name] = breaker.Allow()
-		} else {
-			_, err := http.Head(cfg.URL)
-			health.Services[name] = err == nil
+	// Report the health checker's cached verdicts. Services that have not
+	// been checked yet are assumed healthy, as they are for routing.
+	for name, balancer := range p.balancers {
+		healthy := true
+		if status, ok := p.healthCheck.GetStatus(name); ok {
+			healthy = status.Healthy
+		}
+		if breaker, exists := p.breakers[name]; exists && breaker.GetState() == circuitbreaker.StateOpen {
+			healthy = false
+		}
+		health.Services[name] = healthy
+
+		backends := make(map[string]bool)
+		for _, backend := range balancer.Backends() {
+			backends[backend.String()] = backend.Healthy()
 		}
+		health.Backends[name] = backends
 	}
 
 	for _, healthy := range health.Services {
@@ -189,23 +260,20 @@ func (p *Proxy) handleMetrics(w http.ResponseWriter, r *http.Request) {
 		Errors:         p.metrics.errors.Load(),
 		LastError:      time.Unix(p.metrics.lastError.Load(), 0),
 		ActiveRequests: p.metrics.activeRequests.Load(),
+		Hedges:         p.metrics.hedges.Load(),
+		HedgeWins:      p.metrics.hedgeWins.Load(),
+		UpgradedConns:  p.metrics.upgradedConns.Load(),
+		Protocols: map[string]int64{
+			"http1": p.metrics.http1Requests.Load(),
+			"http2": p.metrics.http2Requests.Load(),
+			"http3": p.metrics.http3Requests.Load(),
+		},
 	}
-
-	p.writeJSON(w, metrics)
-}
-
-func (p *Proxy) writeResponse(w http.ResponseWriter, resp *http.Response) {
-	for k, vv := range resp.Header {
-		for _, v := range vv {
-			w.Header().Add(k, v)
-		}
+	if p.certs != nil {
+		metrics.Certificates = p.certs.Expiries()
 	}
 
-	w.WriteHeader(resp.StatusCode)
-
-	if resp.Body != nil {
-		io.Copy(w, resp.Body)
-	}
+	p.writeJSON(w, metrics)
 }
 
 func (p *Proxy) writeJSON(w http.ResponseWriter, v interface{}) {
@@ -221,6 +289,11 @@ func (p *Proxy) handleError(w http.ResponseWriter, r *http.Request, err error) {
 
 	log.Printf("Error handling request %s %s: %v", r.Method, r.URL.Path, err)
 
+	if isGRPCRequest(r) {
+		writeGRPCError(w, err)
+		return
+	}
+
 	code := http.StatusInternalServerError
 	msg := "Internal Server Error"
 
@@ -0,0 +1,215 @@
+package proxy
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/textproto"
+	"strings"
+)
+
+// viaPseudonym identifies the proxy in Via headers
+const viaPseudonym = "go-http-proxy"
+
+// hopHeaders are meaningful only for a single connection and are never
+// forwarded (RFC 7230, section 6.1)
+var hopHeaders = []string{
+	"Connection",
+	"Proxy-Connection",
+	"Keep-Alive",
+	"Proxy-Authenticate",
+	"Proxy-Authorization",
+	"Te",
+	"Trailer",
+	"Transfer-Encoding",
+	"Upgrade",
+}
+
+// forwardingHeaders describe the client and are only accepted from
+// trusted proxies
+var forwardingHeaders = []string{
+	"Forwarded",
+	"X-Forwarded-For",
+	"X-Forwarded-Proto",
+	"X-Forwarded-Host",
+	"X-Forwarded-Port",
+}
+
+// removeHopHeaders deletes hop-by-hop headers, including any listed in
+// Connection
+func removeHopHeaders(h http.Header) {
+	for _, field := range h.Values("Connection") {
+		for _, name := range strings.Split(field, ",") {
+			if name = textproto.TrimString(name); name != "" {
+				h.Del(name)
+			}
+		}
+	}
+
+	for _, name := range hopHeaders {
+		h.Del(name)
+	}
+}
+
+// trustedProxies lists the networks whose forwarding headers are believed
+type trustedProxies []*net.IPNet
+
+func parseTrustedProxies(cidrs []string) (trustedProxies, error) {
+	var trusted trustedProxies
+	for _, cidr := range cidrs {
+		if !strings.Contains(cidr, "/") {
+			if ip := net.ParseIP(cidr); ip != nil && ip.To4() != nil {
+				cidr += "/32"
+			} else {
+				cidr += "/128"
+			}
+		}
+
+		_, network, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, fmt.Errorf("invalid trusted proxy: %w", err)
+		}
+		trusted = append(trusted, network)
+	}
+	return trusted, nil
+}
+
+func (t trustedProxies) contains(ip net.IP) bool {
+	if ip == nil {
+		return false
+	}
+	for _, network := range t {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// clientIP returns the address of the client. Requests relayed by trusted
+// proxies are attributed to the right-most untrusted X-Forwarded-For entry.
+func (t trustedProxies) clientIP(r *http.Request) net.IP {
+	ip := remoteIP(r)
+	if !t.contains(ip) {
+		return ip
+	}
+
+	hops := strings.Split(strings.Join(r.Header.Values("X-Forwarded-For"), ","), ",")
+	for i := len(hops) - 1; i >= 0; i-- {
+		hop := net.ParseIP(strings.TrimSpace(hops[i]))
+		if hop == nil {
+			break
+		}
+		ip = hop
+		if !t.contains(hop) {
+			break
+		}
+	}
+	return ip
+}
+
+// remoteIP returns the address of the connection's peer
+func remoteIP(r *http.Request) net.IP {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	return net.ParseIP(host)
+}
+
+// setForwardedHeaders describes the client to the backend. Forwarding
+// headers sent by untrusted peers are discarded rather than extended.
+func (p *Proxy) setForwardedHeaders(outReq, r *http.Request) {
+	h := outReq.Header
+	peer := remoteIP(r)
+
+	if !p.trusted.contains(peer) {
+		for _, name := range forwardingHeaders {
+			h.Del(name)
+		}
+	}
+
+	proto := "http"
+	if r.TLS != nil {
+		proto = "https"
+	}
+
+	forFor := "unknown"
+	if peer != nil {
+		forFor = peer.String()
+		if prior := strings.Join(h.Values("X-Forwarded-For"), ", "); prior != "" {
+			h.Set("X-Forwarded-For", prior+", "+forFor)
+		} else {
+			h.Set("X-Forwarded-For", forFor)
+		}
+		if peer.To4() == nil {
+			forFor = "[" + forFor + "]"
+		}
+	}
+
+	// A trusted proxy in front already knows what the client asked for
+	if h.Get("X-Forwarded-Proto") == "" {
+		h.Set("X-Forwarded-Proto", proto)
+	}
+	if h.Get("X-Forwarded-Host") == "" {
+		h.Set("X-Forwarded-Host", r.Host)
+	}
+	if h.Get("X-Forwarded-Port") == "" {
+		h.Set("X-Forwarded-Port", localPort(r, proto))
+	}
+
+	element := fmt.Sprintf("for=%s;host=%s;proto=%s",
+		forwardedValue(forFor), forwardedValue(r.Host), proto)
+	if prior := strings.Join(h.Values("Forwarded"), ", "); prior != "" {
+		element = prior + ", " + element
+	}
+	h.Set("Forwarded", element)
+
+	addVia(h, r.ProtoMajor, r.ProtoMinor)
+}
+
+// localPort returns the port the client connected to
+func localPort(r *http.Request, proto string) string {
+	if addr, ok := r.Context().Value(http.LocalAddrContextKey).(net.Addr); ok {
+		if _, port, err := net.SplitHostPort(addr.String()); err == nil {
+			return port
+		}
+	}
+	if _, port, err := net.SplitHostPort(r.Host); err == nil {
+		return port
+	}
+	if proto == "https" {
+		return "443"
+	}
+	return "80"
+}
+
+// forwardedValue quotes v when it isn't a valid RFC 7239 token
+func forwardedValue(v string) string {
+	if v == "" {
+		return `""`
+	}
+	for _, c := range v {
+		if !isTokenChar(c) {
+			return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(v) + `"`
+		}
+	}
+	return v
+}
+
+func isTokenChar(c rune) bool {
+	switch {
+	case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c >= '0' && c <= '9':
+		return true
+	}
+	return strings.ContainsRune("!#$%&'*+-.^_`|~", c)
+}
+
+// addVia records the proxy in a message's Via header
+func addVia(h http.Header, major, minor int) {
+	version := fmt.Sprintf("%d.%d", major, minor)
+	if major >= 2 {
+		version = fmt.Sprint(major)
+	}
+	h.Add("Via", version+" "+viaPseudonym)
+}
@@ -0,0 +1,172 @@
+package proxy
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/oabraham1/go-http-proxy/internal/config"
+)
+
+func TestForwardedHeaders(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Connection", "X-Backend-Hop")
+		w.Header().Set("X-Backend-Hop", "1")
+		w.Header().Set("Proxy-Authenticate", "Basic")
+		json.NewEncoder(w).Encode(r.Header)
+	}))
+	defer backend.Close()
+
+	cfg := &config.Config{
+		TrustedProxies: []string{"10.0.0.0/8", "192.0.2.1"},
+		Services: map[string]config.ServiceConfig{
+			"api": {URL: backend.URL},
+		},
+	}
+	proxy, err := New(cfg)
+	if err != nil {
+		t.Fatalf("Failed to create proxy: %v", err)
+	}
+	handler := proxy.handler()
+
+	tests := []struct {
+		name       string
+		remoteAddr string
+		header     map[string]string
+		want       map[string]string
+		absent     []string
+	}{
+		{
+			name:       "untrusted client headers replaced",
+			remoteAddr: "203.0.113.7:4000",
+			header: map[string]string{
+				"X-Forwarded-For":   "1.2.3.4",
+				"X-Forwarded-Proto": "https",
+				"Forwarded":         "for=1.2.3.4",
+			},
+			want: map[string]string{
+				"X-Forwarded-For":   "203.0.113.7",
+				"X-Forwarded-Proto": "http",
+				"X-Forwarded-Host":  "proxy.example.com",
+				"X-Forwarded-Port":  "80",
+				"Forwarded":         "for=203.0.113.7;host=proxy.example.com;proto=http",
+				"Via":               "1.1 go-http-proxy",
+			},
+		},
+		{
+			name:       "trusted proxy headers extended",
+			remoteAddr: "10.1.1.1:4000",
+			header: map[string]string{
+				"X-Forwarded-For":   "198.51.100.9",
+				"X-Forwarded-Proto": "https",
+				"Forwarded":         "for=198.51.100.9;proto=https",
+			},
+			want: map[string]string{
+				"X-Forwarded-For":   "198.51.100.9, 10.1.1.1",
+				"X-Forwarded-Proto": "https",
+				"Forwarded":         "for=198.51.100.9;proto=https, for=10.1.1.1;host=proxy.example.com;proto=http",
+			},
+		},
+		{
+			name:       "IPv6 client quoted in Forwarded",
+			remoteAddr: "[2001:db8::1]:4000",
+			want: map[string]string{
+				"X-Forwarded-For": "2001:db8::1",
+				"Forwarded":       `for="[2001:db8::1]";host=proxy.example.com;proto=http`,
+			},
+		},
+		{
+			name:       "hop-by-hop headers stripped",
+			remoteAddr: "203.0.113.7:4000",
+			header: map[string]string{
+				"Connection":          "X-Client-Hop",
+				"X-Client-Hop":        "1",
+				"Keep-Alive":          "timeout=5",
+				"Proxy-Authorization": "Basic Zm9vOmJhcg==",
+				"Te":                  "trailers, deflate",
+				"X-End-To-End":        "1",
+			},
+			want: map[string]string{
+				"Te":           "trailers",
+				"X-End-To-End": "1",
+			},
+			absent: []string{"Connection", "X-Client-Hop", "Keep-Alive", "Proxy-Authorization"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest("GET", "http://proxy.example.com/api/echo", nil)
+			req.RemoteAddr = tt.remoteAddr
+			for k, v := range tt.header {
+				req.Header.Set(k, v)
+			}
+
+			rec := httptest.NewRecorder()
+			handler.ServeHTTP(rec, req)
+
+			var received http.Header
+			if err := json.NewDecoder(rec.Body).Decode(&received); err != nil {
+				t.Fatalf("Failed to decode echoed headers: %v", err)
+			}
+
+			for k, v := range tt.want {
+				if got := received.Get(k); got != v {
+					t.Errorf("Expected %s %q, got %q", k, v, got)
+				}
+			}
+			for _, k := range tt.absent {
+				if got := received.Get(k); got != "" {
+					t.Errorf("Expected %s to be stripped, got %q", k, got)
+				}
+			}
+
+			for _, k := range []string{"X-Backend-Hop", "Proxy-Authenticate"} {
+				if got := rec.Header().Get(k); got != "" {
+					t.Errorf("Expected response header %s to be stripped, got %q", k, got)
+				}
+			}
+			if got := rec.Header().Get("Via"); got != "1.1 go-http-proxy" {
+				t.Errorf("Expected response Via header, got %q", got)
+			}
+		})
+	}
+}
+
+func TestTrustedClientIP(t *testing.T) {
+	trusted, err := parseTrustedProxies([]string{"10.0.0.0/8", "192.0.2.1"})
+	if err != nil {
+		t.Fatalf("Failed to parse trusted proxies: %v", err)
+	}
+
+	tests := []struct {
+		name       string
+		remoteAddr string
+		xff        string
+		want       string
+	}{
+		{name: "direct client", remoteAddr: "203.0.113.7:1", xff: "1.2.3.4", want: "203.0.113.7"},
+		{name: "via trusted proxy", remoteAddr: "10.0.0.1:1", xff: "198.51.100.9", want: "198.51.100.9"},
+		{name: "spoofed entry before client", remoteAddr: "10.0.0.1:1", xff: "1.2.3.4, 198.51.100.9, 192.0.2.1", want: "198.51.100.9"},
+		{name: "no forwarded header", remoteAddr: "10.0.0.1:1", want: "10.0.0.1"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest("GET", "/", nil)
+			req.RemoteAddr = tt.remoteAddr
+			if tt.xff != "" {
+				req.Header.Set("X-Forwarded-For", tt.xff)
+			}
+
+			if got := trusted.clientIP(req); got.String() != tt.want {
+				t.Errorf("Expected client %s, got %s", tt.want, got)
+			}
+		})
+	}
+
+	if _, err := parseTrustedProxies([]string{"not-an-ip"}); err == nil {
+		t.Error("Expected error for invalid trusted proxy")
+	}
+}
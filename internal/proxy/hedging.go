@@ -0,0 +1,129 @@
+package proxy
+
+import (
+	"context"
+	"net/http"
+	"time"
+
+	"github.com/oabraham1/go-http-proxy/internal/loadbalancer"
+)
+
+// hedgeResult is the outcome of one attempt of a hedged request
+type hedgeResult struct {
+	backend *loadbalancer.Backend
+	start   time.Time
+	resp    *http.Response
+	err     error
+	hedge   bool
+	release func() // cancels the attempt and returns its hedge slot
+}
+
+// pendingAttempt is an attempt of a hedged request that hasn't returned yet
+type pendingAttempt struct {
+	start  time.Time
+	cancel context.CancelFunc
+}
+
+// hedgedRoundTrip sends the request to backend and, if it hasn't answered
+// within the service's hedging delay, a second copy to another backend. The
+// first response wins and the other attempt is cancelled. Transport errors
+// only win when no other attempt is left. A hedged attempt holds its slot
+// until it's cancelled or, if it wins, its body is closed.
+func (p *Proxy) hedgedRoundTrip(r *http.Request, rt *route, backend *loadbalancer.Backend, body []byte, tried map[*loadbalancer.Backend]bool, attempts *[]Attempt) (*http.Response, error) {
+	service := rt.service
+	hedger := p.hedgers[service]
+	results := make(chan hedgeResult, 2)
+
+	launch := func(backend *loadbalancer.Backend, hedge bool) pendingAttempt {
+		ctx, cancel := context.WithCancel(r.Context())
+		outReq := p.outboundRequest(r, backend, rt).WithContext(ctx)
+		setBody(outReq, body)
+
+		release := cancel
+		if hedge {
+			release = func() {
+				cancel()
+				hedger.Done()
+			}
+		}
+
+		start := time.Now()
+		go func() {
+			resp, err := p.roundTrip(outReq, service, backend, rt.timeout(r))
+			results <- hedgeResult{backend: backend, start: start, resp: resp, err: err, hedge: hedge, release: release}
+		}()
+		return pendingAttempt{start: start, cancel: cancel}
+	}
+
+	pending := map[*loadbalancer.Backend]pendingAttempt{backend: launch(backend, false)}
+
+	var timerC <-chan time.Time
+	if delay, ok := hedger.Delay(); ok {
+		timer := time.NewTimer(delay)
+		defer timer.Stop()
+		timerC = timer.C
+	}
+
+	for {
+		select {
+		case <-timerC:
+			timerC = nil
+
+			hedgeBackend, err := nextBackend(p.balancers[service], r, tried)
+			if err != nil || tried[hedgeBackend] || !hedger.TryHedge() {
+				continue
+			}
+			tried[hedgeBackend] = true
+			p.metrics.hedges.Add(1)
+
+			pending[hedgeBackend] = launch(hedgeBackend, true)
+
+		case res := <-results:
+			delete(pending, res.backend)
+			*attempts = append(*attempts, newAttempt(res.backend, res.start, res.resp, res.err))
+
+			if res.err != nil && len(pending) > 0 {
+				res.release()
+				continue
+			}
+
+			if res.err != nil {
+				res.release()
+				return nil, res.err
+			}
+
+			hedger.Observe(time.Since(res.start))
+			if res.hedge {
+				p.metrics.hedgeWins.Add(1)
+			}
+			p.abandon(results, pending, attempts)
+
+			res.resp.Body = &releasingBody{ReadCloser: res.resp.Body, release: res.release}
+			return res.resp, nil
+		}
+	}
+}
+
+// abandon cancels the attempts that lost a hedged race and cleans up after
+// them once they return
+func (p *Proxy) abandon(results <-chan hedgeResult, pending map[*loadbalancer.Backend]pendingAttempt, attempts *[]Attempt) {
+	if len(pending) == 0 {
+		return
+	}
+
+	for backend, attempt := range pending {
+		attempt.cancel()
+		*attempts = append(*attempts, newAttempt(backend, attempt.start, nil, context.Canceled))
+	}
+
+	remaining := len(pending)
+	go func() {
+		for i := 0; i < remaining; i++ {
+			res := <-results
+			if res.resp != nil {
+				discard(res.resp)
+			}
+			res.release()
+		}
+	}()
+}
@@ -0,0 +1,170 @@
+package proxy
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/oabraham1/go-http-proxy/internal/config"
+)
+
+func TestHedgedRequests(t *testing.T) {
+	slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-time.After(2 * time.Second):
+		case <-r.Context().Done():
+			return
+		}
+		w.Write([]byte("slow"))
+	}))
+	defer slow.Close()
+
+	fast := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("fast"))
+	}))
+	defer fast.Close()
+
+	cfg := &config.Config{
+		Services: map[string]config.ServiceConfig{
+			"api": {
+				// Round robin sends each test request to the slow backend first
+				Backends: []config.BackendConfig{{URL: slow.URL}, {URL: fast.URL}},
+				Hedge:    &config.HedgeConfig{Delay: 20 * time.Millisecond},
+			},
+		},
+	}
+
+	proxy, err := New(cfg)
+	if err != nil {
+		t.Fatalf("Failed to create proxy: %v", err)
+	}
+	server := httptest.NewServer(proxy.handler())
+	defer server.Close()
+
+	tests := []struct {
+		name      string
+		method    string
+		wantBody  string
+		wantSlow  bool
+		wantHedge int64
+	}{
+		{name: "GET hedged to fast backend", method: http.MethodGet, wantBody: "fast", wantHedge: 1},
+		{name: "POST never hedged", method: http.MethodPost, wantBody: "slow", wantHedge: 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			before := proxy.metrics.hedges.Load()
+
+			req, _ := http.NewRequest(tt.method, server.URL+"/api/items", strings.NewReader(""))
+			start := time.Now()
+			resp, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Fatalf("Request failed: %v", err)
+			}
+			body, _ := io.ReadAll(resp.Body)
+			resp.Body.Close()
+
+			if !strings.HasPrefix(string(body), tt.wantBody) {
+				t.Errorf("Expected body %q, got %q", tt.wantBody, body)
+			}
+			if tt.wantBody == "fast" && time.Since(start) > time.Second {
+				t.Errorf("Hedged request took %v", time.Since(start))
+			}
+			if got := proxy.metrics.hedges.Load() - before; got != tt.wantHedge {
+				t.Errorf("Expected %d hedges, got %d", tt.wantHedge, got)
+			}
+		})
+	}
+
+	resp, err := http.Get(server.URL + "/metrics")
+	if err != nil {
+		t.Fatalf("Metrics request failed: %v", err)
+	}
+	defer resp.Body.Close()
+
+	var metrics ProxyMetrics
+	if err := json.NewDecoder(resp.Body).Decode(&metrics); err != nil {
+		t.Fatalf("Failed to decode metrics: %v", err)
+	}
+	if metrics.Hedges != 1 || metrics.HedgeWins != 1 {
+		t.Errorf("Expected 1 hedge and 1 hedge win, got %d and %d", metrics.Hedges, metrics.HedgeWins)
+	}
+}
+
+func TestHedgeSlotHeldUntilBodyClosed(t *testing.T) {
+	slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-r.Context().Done()
+	}))
+	defer slow.Close()
+
+	finish := make(chan struct{})
+	fast := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("fast "))
+		w.(http.Flusher).Flush()
+		<-finish
+		w.Write([]byte("done"))
+	}))
+	defer fast.Close()
+
+	cfg := &config.Config{
+		Services: map[string]config.ServiceConfig{
+			"api": {
+				Backends: []config.BackendConfig{{URL: slow.URL}, {URL: fast.URL}},
+				Hedge:    &config.HedgeConfig{Delay: 20 * time.Millisecond},
+				Routes:   []config.RouteConfig{{Path: "/", FlushInterval: -1}},
+			},
+		},
+	}
+	proxy, err := New(cfg)
+	if err != nil {
+		t.Fatalf("Failed to create proxy: %v", err)
+	}
+	server := httptest.NewServer(proxy.handler())
+	defer server.Close()
+	hedger := proxy.hedgers["api"]
+
+	resp, err := http.Get(server.URL + "/items")
+	if err != nil {
+		t.Fatalf("Request failed: %v", err)
+	}
+	defer resp.Body.Close()
+
+	buf := make([]byte, len("fast "))
+	if _, err := io.ReadFull(resp.Body, buf); err != nil || string(buf) != "fast " {
+		t.Fatalf("Expected the hedge's first bytes, got %q (%v)", buf, err)
+	}
+	if got := hedger.InFlight(); got != 1 {
+		t.Errorf("Expected the hedge to hold its slot while streaming, got %d in flight", got)
+	}
+
+	close(finish)
+	io.ReadAll(resp.Body)
+
+	deadline := time.Now().Add(time.Second)
+	for hedger.InFlight() != 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if got := hedger.InFlight(); got != 0 {
+		t.Errorf("Expected the slot back once the body was closed, got %d in flight", got)
+	}
+}
+
+func TestHedgingInvalidConfig(t *testing.T) {
+	cfg := &config.Config{
+		Services: map[string]config.ServiceConfig{
+			"api": {
+				URL:   "http://localhost:8081",
+				Hedge: &config.HedgeConfig{Percentile: 150},
+			},
+		},
+	}
+
+	if _, err := New(cfg); err == nil {
+		t.Error("Expected error for invalid hedging percentile")
+	}
+}
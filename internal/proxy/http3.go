@@ -0,0 +1,86 @@
+package proxy
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+
+	"github.com/quic-go/quic-go/http3"
+)
+
+// initHTTP3 prepares the HTTP/3 server. It shares the TCP server's TLS
+// settings and serves the same handler chain.
+func (p *Proxy) initHTTP3(handler http.Handler) error {
+	hc := p.cfg.Server.HTTP3
+	if hc == nil || !hc.Enabled {
+		return nil
+	}
+	if p.server.TLSConfig == nil {
+		return fmt.Errorf("HTTP/3 requires TLS to be enabled")
+	}
+
+	// QUIC always runs TLS 1.3, whatever the TCP listener allows
+	tlsConfig := p.server.TLSConfig.Clone()
+	tlsConfig.MaxVersion = 0
+
+	port := hc.Port
+	if port == 0 {
+		port = p.cfg.Server.Port
+	}
+
+	p.h3server = &http3.Server{
+		Addr:           fmt.Sprintf(":%d", port),
+		Port:           port,
+		Handler:        handler,
+		TLSConfig:      tlsConfig,
+		MaxHeaderBytes: p.cfg.Server.MaxHeaderBytes,
+	}
+	return nil
+}
+
+// startHTTP3 listens on UDP and serves HTTP/3 in the background
+func (p *Proxy) startHTTP3() error {
+	if p.h3server == nil {
+		return nil
+	}
+
+	conn, err := net.ListenPacket("udp", p.h3server.Addr)
+	if err != nil {
+		return fmt.Errorf("HTTP/3 listener: %w", err)
+	}
+	p.h3conn = conn
+
+	go func() {
+		if err := p.h3server.Serve(conn); err != nil && err != http.ErrServerClosed {
+			log.Printf("HTTP/3 server error: %v", err)
+		}
+	}()
+	return nil
+}
+
+// stopHTTP3 closes the HTTP/3 server and its socket. The server has no
+// graceful shutdown, so calls in progress are aborted.
+func (p *Proxy) stopHTTP3() error {
+	if p.h3server == nil {
+		return nil
+	}
+
+	err := p.h3server.Close()
+	if p.h3conn != nil {
+		p.h3conn.Close()
+	}
+	return err
+}
+
+// advertiseHTTP3 announces the HTTP/3 listener to HTTP/1.1 and HTTP/2
+// clients through Alt-Svc
+func (p *Proxy) advertiseHTTP3(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.ProtoMajor < 3 {
+			// Fails only until the listener is up
+			p.h3server.SetQuicHeaders(w.Header())
+		}
+		next.ServeHTTP(w, r)
+	})
+}
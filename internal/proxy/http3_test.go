@@ -0,0 +1,145 @@
+package proxy
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/quic-go/quic-go/http3"
+
+	"github.com/oabraham1/go-http-proxy/internal/config"
+)
+
+// writeTestCert writes a self-signed certificate for localhost and returns
+// the paths of its certificate and key files
+func writeTestCert(t *testing.T) (string, string) {
+	return writeNamedCert(t, "localhost", "127.0.0.1")
+}
+
+// writeNamedCert writes a self-signed certificate for names, the first
+// being its common name, and returns the paths of its certificate and key
+// files
+func writeNamedCert(t *testing.T, names ...string) (string, string) {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("Failed to generate key: %v", err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: names[0]},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	for _, name := range names {
+		if ip := net.ParseIP(name); ip != nil {
+			template.IPAddresses = append(template.IPAddresses, ip)
+		} else {
+			template.DNSNames = append(template.DNSNames, name)
+		}
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("Failed to create certificate: %v", err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatalf("Failed to marshal key: %v", err)
+	}
+
+	dir := t.TempDir()
+	certFile := filepath.Join(dir, "cert.pem")
+	keyFile := filepath.Join(dir, "key.pem")
+	os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0o600)
+	os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0o600)
+	return certFile, keyFile
+}
+
+func TestHTTP3Listener(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("hello"))
+	}))
+	defer backend.Close()
+
+	certFile, keyFile := writeTestCert(t)
+	cfg := &config.Config{
+		Services: map[string]config.ServiceConfig{
+			"api": {URL: backend.URL},
+		},
+	}
+	cfg.Server.TLS = &config.TLSConfig{Enabled: true, CertFile: certFile, KeyFile: keyFile}
+	cfg.Server.HTTP3 = &config.HTTP3Config{Enabled: true}
+
+	proxy, err := New(cfg)
+	if err != nil {
+		t.Fatalf("Failed to create proxy: %v", err)
+	}
+	if err := proxy.startHTTP3(); err != nil {
+		t.Fatalf("Failed to start HTTP/3: %v", err)
+	}
+	defer proxy.stopHTTP3()
+	port := proxy.h3conn.LocalAddr().(*net.UDPAddr).Port
+
+	client := &http.Client{
+		Transport: &http3.RoundTripper{TLSClientConfig: &tls.Config{InsecureSkipVerify: true}},
+		Timeout:   5 * time.Second,
+	}
+	resp, err := client.Get(fmt.Sprintf("https://127.0.0.1:%d/api/greeting", port))
+	if err != nil {
+		t.Fatalf("HTTP/3 request failed: %v", err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+
+	if resp.ProtoMajor != 3 || string(body) != "hello" {
+		t.Errorf("Expected %q over HTTP/3, got %q over %s", "hello", body, resp.Proto)
+	}
+
+	// TCP responses point clients at the QUIC listener
+	server := httptest.NewServer(proxy.server.Handler)
+	defer server.Close()
+
+	resp, err = http.Get(server.URL + "/api/greeting")
+	if err != nil {
+		t.Fatalf("HTTP/1.1 request failed: %v", err)
+	}
+	resp.Body.Close()
+
+	if got := resp.Header.Get("Alt-Svc"); !strings.Contains(got, fmt.Sprintf(`h3=":%d"`, port)) {
+		t.Errorf("Expected Alt-Svc to advertise h3 on port %d, got %q", port, got)
+	}
+
+	if got := proxy.metrics.http3Requests.Load(); got != 1 {
+		t.Errorf("Expected 1 HTTP/3 request, got %d", got)
+	}
+	if got := proxy.metrics.http1Requests.Load(); got != 1 {
+		t.Errorf("Expected 1 HTTP/1 request, got %d", got)
+	}
+}
+
+func TestHTTP3RequiresTLS(t *testing.T) {
+	cfg := &config.Config{}
+	cfg.Server.HTTP3 = &config.HTTP3Config{Enabled: true}
+
+	if _, err := New(cfg); err == nil {
+		t.Error("Expected HTTP/3 without TLS to be rejected")
+	}
+}
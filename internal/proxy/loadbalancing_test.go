@@ -0,0 +1,184 @@
+package proxy
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/oabraham1/go-http-proxy/internal/config"
+)
+
+func newBackendServer(name string, healthy bool) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/health" && !healthy {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.Write([]byte(name))
+	}))
+}
+
+func TestLoadBalancingWithHealthChecks(t *testing.T) {
+	healthy := newBackendServer("healthy", true)
+	defer healthy.Close()
+	unhealthy := newBackendServer("unhealthy", false)
+	defer unhealthy.Close()
+
+	cfg := &config.Config{
+		Services: map[string]config.ServiceConfig{
+			"web": {
+				Backends: []config.BackendConfig{
+					{URL: healthy.URL},
+					{URL: unhealthy.URL},
+				},
+				LoadBalancer: &config.LoadBalancerConfig{Algorithm: "round-robin"},
+				HealthCheck: &config.HealthCheckConfig{
+					Path:     "/health",
+					Interval: time.Second,
+				},
+			},
+			// Without a health check, a backend failing /health stays in
+			// rotation
+			"plain": {URL: unhealthy.URL},
+		},
+	}
+
+	proxy, err := New(cfg)
+	if err != nil {
+		t.Fatalf("Failed to create proxy: %v", err)
+	}
+	proxy.healthCheck.Start()
+	defer proxy.healthCheck.Stop()
+	if err := proxy.healthCheck.WaitForFirstCheck(time.Second); err != nil {
+		t.Fatalf("Failed to wait for health checks: %v", err)
+	}
+
+	server := httptest.NewServer(proxy.handler())
+	defer server.Close()
+
+	for i := 0; i < 4; i++ {
+		resp, err := http.Get(server.URL + "/web/page")
+		if err != nil {
+			t.Fatalf("Request failed: %v", err)
+		}
+		body, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+
+		if resp.StatusCode != http.StatusOK || string(body) != "healthy" {
+			t.Errorf("request %d: got %d %q, want 200 from the healthy backend", i, resp.StatusCode, body)
+		}
+	}
+
+	resp, err := http.Get(server.URL + "/plain/page")
+	if err != nil {
+		t.Fatalf("Request failed: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("got %d from an unchecked service, want 200", resp.StatusCode)
+	}
+
+	resp, err = http.Get(server.URL + "/health")
+	if err != nil {
+		t.Fatalf("Health request failed: %v", err)
+	}
+	defer resp.Body.Close()
+
+	var status HealthStatus
+	if err := json.NewDecoder(resp.Body).Decode(&status); err != nil {
+		t.Fatalf("Failed to decode health status: %v", err)
+	}
+	if !status.Services["web"] {
+		t.Error("expected service with one healthy backend to be reported healthy")
+	}
+	if status.Backends["web"][healthy.URL] != true || status.Backends["web"][unhealthy.URL] != false {
+		t.Errorf("unexpected backend health: %v", status.Backends["web"])
+	}
+}
+
+func TestLoadBalancingInvalidConfig(t *testing.T) {
+	tests := []struct {
+		name    string
+		service config.ServiceConfig
+	}{
+		{
+			name: "unknown algorithm",
+			service: config.ServiceConfig{
+				URL:          "http://localhost:8001",
+				LoadBalancer: &config.LoadBalancerConfig{Algorithm: "fastest"},
+			},
+		},
+		{
+			name:    "invalid backend URL",
+			service: config.ServiceConfig{Backends: []config.BackendConfig{{URL: "web1:8001"}}},
+		},
+		{
+			name: "invalid expected status",
+			service: config.ServiceConfig{
+				URL:         "http://localhost:8001",
+				HealthCheck: &config.HealthCheckConfig{ExpectedStatus: "2xx"},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := &config.Config{Services: map[string]config.ServiceConfig{"web": tt.service}}
+			if _, err := New(cfg); err == nil {
+				t.Error("expected configuration error")
+			}
+		})
+	}
+}
+
+func TestOutlierDetectionEjectsFailingBackend(t *testing.T) {
+	good := newBackendServer("good", true)
+	defer good.Close()
+	bad := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer bad.Close()
+
+	cfg := &config.Config{
+		Services: map[string]config.ServiceConfig{
+			"web": {
+				Backends: []config.BackendConfig{{URL: good.URL}, {URL: bad.URL}},
+				Outlier: &config.OutlierConfig{
+					Consecutive5xx:     2,
+					BaseEjectionTime:   time.Minute,
+					MaxEjectionPercent: 50,
+				},
+			},
+		},
+	}
+
+	proxy, err := New(cfg)
+	if err != nil {
+		t.Fatalf("Failed to create proxy: %v", err)
+	}
+	server := httptest.NewServer(proxy.handler())
+	defer server.Close()
+
+	// Round-robin alternates, so four requests hit the bad backend twice
+	for i := 0; i < 4; i++ {
+		resp, err := http.Get(server.URL + "/web/page")
+		if err != nil {
+			t.Fatalf("Request failed: %v", err)
+		}
+		resp.Body.Close()
+	}
+
+	for i := 0; i < 4; i++ {
+		resp, err := http.Get(server.URL + "/web/page")
+		if err != nil {
+			t.Fatalf("Request failed: %v", err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			t.Errorf("request %d after ejection: got status %d, want 200", i, resp.StatusCode)
+		}
+	}
+}
@@ -1,9 +1,12 @@
 package proxy
 
 import (
+	"bufio"
 	"encoding/json"
 	"fmt"
+	"io"
 	"log"
+	"net"
 	"net/http"
 	"strings"
 	"time"
@@ -23,14 +26,39 @@ type LogEntry struct {
 	Error        string                 `json:"error,omitempty"`
 	Service      string                 `json:"service,omitempty"`
 	Headers      map[string]string      `json:"headers,omitempty"`
+	Attempts     []Attempt              `json:"attempts,omitempty"`
+	TunnelUp     int64                  `json:"tunnel_bytes_up,omitempty"`
+	TunnelDown   int64                  `json:"tunnel_bytes_down,omitempty"`
 	ExtraData    map[string]interface{} `json:"extra_data,omitempty"`
 }
 
+// Attempt records a single upstream attempt made for a request
+type Attempt struct {
+	Backend    string        `json:"backend"`
+	StatusCode int           `json:"status_code,omitempty"`
+	Error      string        `json:"error,omitempty"`
+	Duration   time.Duration `json:"duration"`
+}
+
+func newAttempt(backend fmt.Stringer, start time.Time, resp *http.Response, err error) Attempt {
+	attempt := Attempt{
+		Backend:  backend.String(),
+		Duration: time.Since(start),
+	}
+	if err != nil {
+		attempt.Error = err.Error()
+	} else {
+		attempt.StatusCode = resp.StatusCode
+	}
+	return attempt
+}
+
 // loggedResponseWriter wraps http.ResponseWriter to capture response data
 type loggedResponseWriter struct {
 	http.ResponseWriter
 	statusCode   int
 	responseSize int64
+	hijacked     bool
 }
 
 func (w *loggedResponseWriter) WriteHeader(statusCode int) {
@@ -44,7 +72,42 @@ func (w *loggedResponseWriter) Write(b []byte) (int, error) {
 	return size, err
 }
 
-func (p *Proxy) logRequest(start time.Time, w http.ResponseWriter, r *http.Request, service string, cacheHit bool, err error) {
+func (w *loggedResponseWriter) ReadFrom(src io.Reader) (int64, error) {
+	size, err := io.Copy(w.ResponseWriter, src)
+	w.responseSize += size
+	return size, err
+}
+
+func (w *loggedResponseWriter) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (w *loggedResponseWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	h, ok := w.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, http.ErrNotSupported
+	}
+	conn, brw, err := h.Hijack()
+	if err == nil {
+		w.statusCode = http.StatusSwitchingProtocols
+		w.hijacked = true
+	}
+	return conn, brw, err
+}
+
+// Unwrap lets http.ResponseController reach the underlying writer
+func (w *loggedResponseWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+func (p *Proxy) logRequest(start time.Time, w http.ResponseWriter, r *http.Request, service string, cacheHit bool, attempts []Attempt, err error) {
+	p.writeLog(p.newLogEntry(start, w, r, service, cacheHit, attempts, err))
+}
+
+// newLogEntry describes a finished request
+func (p *Proxy) newLogEntry(start time.Time, w http.ResponseWriter, r *http.Request, service string, cacheHit bool, attempts []Attempt, err error) LogEntry {
 	duration := time.Since(start)
 
 	// Get response data if available
@@ -86,6 +149,7 @@ func (p *Proxy) logRequest(start time.Time, w http.ResponseWriter, r *http.Reque
 		CacheHit:     cacheHit,
 		Service:      service,
 		Headers:      headers,
+		Attempts:     attempts,
 		ExtraData:    make(map[string]interface{}),
 	}
 
@@ -95,6 +159,8 @@ func (p *Proxy) logRequest(start time.Time, w http.ResponseWriter, r *http.Reque
 		entry.ExtraData["error_type"] = fmt.Sprintf("%T", err)
 	}
 
+	grpcLogFields(&entry, w.Header())
+
 	// Add circuit breaker status if available
 	if breaker, exists := p.breakers[service]; exists {
 		entry.ExtraData["circuit_breaker_state"] = breaker.GetState()
@@ -104,8 +170,7 @@ func (p *Proxy) logRequest(start time.Time, w http.ResponseWriter, r *http.Reque
 	entry.ExtraData["cache_hits"] = p.metrics.cacheHits.Load()
 	entry.ExtraData["cache_misses"] = p.metrics.cacheMisses.Load()
 
-	// Log the entry
-	p.writeLog(entry)
+	return entry
 }
 
 func (p *Proxy) wrapResponseWriter(w http.ResponseWriter) *loggedResponseWriter {
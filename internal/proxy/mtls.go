@@ -0,0 +1,248 @@
+package proxy
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/oabraham1/go-http-proxy/internal/certs"
+	"github.com/oabraham1/go-http-proxy/internal/config"
+	"github.com/oabraham1/go-http-proxy/pkg/filters"
+)
+
+// Client certificate modes of a route
+const (
+	clientCertRequest = "request"
+	clientCertRequire = "require"
+	clientCertVerify  = "verify"
+)
+
+// headerClientCert forwards the verified client certificate to backends,
+// in the format Envoy uses
+const headerClientCert = "X-Forwarded-Client-Cert"
+
+// loadCertPool reads the PEM certificates in file
+func loadCertPool(file string) (*x509.CertPool, error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(data) {
+		return nil, fmt.Errorf("no certificates found in %s", file)
+	}
+	return pool, nil
+}
+
+// initClientCAs loads the CAs client certificates are verified against
+func (p *Proxy) initClientCAs() error {
+	tc := p.cfg.Server.TLS
+	if tc == nil || !tc.Enabled {
+		return nil
+	}
+	if tc.ClientCAFile == "" {
+		if tc.ClientRevocation != nil {
+			return fmt.Errorf("clientRevocation requires clientCAFile")
+		}
+		return nil
+	}
+
+	pool, err := loadCertPool(tc.ClientCAFile)
+	if err != nil {
+		return fmt.Errorf("clientCAFile: %w", err)
+	}
+	p.clientCAs = pool
+
+	if rc := tc.ClientRevocation; rc != nil {
+		checker, err := certs.NewRevocationChecker(certs.RevocationConfig{
+			CRLFile:   rc.CRLFile,
+			OCSP:      rc.OCSP,
+			Responder: rc.Responder,
+			FailOpen:  rc.FailOpen,
+		})
+		if err != nil {
+			return fmt.Errorf("clientRevocation: %w", err)
+		}
+		p.revocation = checker
+	}
+	return nil
+}
+
+// checkClientCertMode validates a route's client certificate mode
+func (p *Proxy) checkClientCertMode(mode string) error {
+	switch mode {
+	case "":
+		return nil
+	case clientCertRequest, clientCertRequire, clientCertVerify:
+		if p.clientCAs == nil {
+			return fmt.Errorf("clientCert %s requires server.tls.clientCAFile", mode)
+		}
+		return nil
+	default:
+		return fmt.Errorf("unknown clientCert mode %q, expected request, require or verify", mode)
+	}
+}
+
+// withoutClientCert drops the client certificate header from every
+// request, whether or not client certificates are in use, so clients can't
+// supply it themselves
+func withoutClientCert(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r.Header.Del(headerClientCert)
+		next.ServeHTTP(w, r)
+	})
+}
+
+// clientCertHandler enforces the route's client certificate mode and
+// exposes the certificate to filters. Only a verified certificate is
+// forwarded.
+func (p *Proxy) clientCertHandler(rt *route, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		cert := p.clientCert(r)
+
+		switch mode := rt.config.ClientCert; {
+		case mode == clientCertRequire && cert == nil,
+			mode == clientCertVerify && (cert == nil || !cert.Verified):
+			p.handleError(w, r, HTTPError{Code: http.StatusForbidden, Message: "Client certificate required"})
+			return
+		}
+
+		if cert != nil {
+			if cert.Verified {
+				r.Header.Set(headerClientCert, formatClientCert(cert))
+			}
+			r = r.WithContext(filters.WithClientCert(r.Context(), cert))
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// connClientCertKey holds a connection's *connClientCert in its context
+type connClientCertKey struct{}
+
+// connClientCert is the client certificate of a connection, described
+// once for all of its requests
+type connClientCert struct {
+	once sync.Once
+	cert *filters.ClientCert
+}
+
+// withConnClientCert gives each connection's context a place for its
+// client certificate. It suits http.Server.ConnContext.
+func withConnClientCert(ctx context.Context, _ net.Conn) context.Context {
+	return context.WithValue(ctx, connClientCertKey{}, &connClientCert{})
+}
+
+// clientCert describes the client certificate r was sent with, or returns
+// nil. Chain verification and revocation checks, which may ask an OCSP
+// responder, run once per connection where the server allows.
+func (p *Proxy) clientCert(r *http.Request) *filters.ClientCert {
+	if r.TLS == nil || len(r.TLS.PeerCertificates) == 0 {
+		return nil
+	}
+	held, ok := r.Context().Value(connClientCertKey{}).(*connClientCert)
+	if !ok {
+		return p.describeClientCert(r.TLS.PeerCertificates)
+	}
+	held.once.Do(func() {
+		held.cert = p.describeClientCert(r.TLS.PeerCertificates)
+	})
+	return held.cert
+}
+
+// describeClientCert summarises the leaf of a peer chain and checks it
+// against the client CAs
+func (p *Proxy) describeClientCert(chain []*x509.Certificate) *filters.ClientCert {
+	leaf := chain[0]
+	sum := sha256.Sum256(leaf.Raw)
+
+	cert := &filters.ClientCert{
+		Subject:        leaf.Subject.String(),
+		DNSNames:       leaf.DNSNames,
+		EmailAddresses: leaf.EmailAddresses,
+		Fingerprint:    hex.EncodeToString(sum[:]),
+	}
+	for _, uri := range leaf.URIs {
+		cert.URIs = append(cert.URIs, uri.String())
+	}
+	for _, ip := range leaf.IPAddresses {
+		cert.IPAddresses = append(cert.IPAddresses, ip.String())
+	}
+
+	intermediates := x509.NewCertPool()
+	for _, c := range chain[1:] {
+		intermediates.AddCert(c)
+	}
+	chains, err := leaf.Verify(x509.VerifyOptions{
+		Roots:         p.clientCAs,
+		Intermediates: intermediates,
+		KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	})
+	if err == nil && p.revocation != nil {
+		if err = p.revocation.Check(chains[0]); err != nil {
+			log.Printf("Client certificate %s rejected: %v", cert.Subject, err)
+		}
+	}
+	cert.Verified = err == nil
+	return cert
+}
+
+// formatClientCert renders cert as an X-Forwarded-Client-Cert element
+func formatClientCert(cert *filters.ClientCert) string {
+	parts := []string{
+		"Hash=" + cert.Fingerprint,
+		"Subject=" + quoteClientCertValue(cert.Subject, true),
+	}
+	for _, uri := range cert.URIs {
+		parts = append(parts, "URI="+quoteClientCertValue(uri, false))
+	}
+	for _, name := range cert.DNSNames {
+		parts = append(parts, "DNS="+quoteClientCertValue(name, false))
+	}
+	return strings.Join(parts, ";")
+}
+
+// quoteClientCertValue quotes values holding the header's separators
+func quoteClientCertValue(value string, always bool) string {
+	if !always && !strings.ContainsAny(value, `,;="`) {
+		return value
+	}
+	return `"` + strings.ReplaceAll(value, `"`, `\"`) + `"`
+}
+
+// upstreamTLS builds the TLS settings a service's backends are reached
+// with
+func upstreamTLS(cfg *config.UpstreamTLSConfig) (*tls.Config, error) {
+	tlsConfig := &tls.Config{
+		ServerName:         cfg.ServerName,
+		InsecureSkipVerify: cfg.InsecureSkipVerify,
+	}
+
+	if cfg.CertFile != "" || cfg.KeyFile != "" {
+		cert, err := certs.Load(cfg.CertFile, cfg.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("client certificate: %w", err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{*cert}
+	}
+
+	if cfg.CAFile != "" {
+		pool, err := loadCertPool(cfg.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("caFile: %w", err)
+		}
+		tlsConfig.RootCAs = pool
+	}
+
+	return tlsConfig, nil
+}
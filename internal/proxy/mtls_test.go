@@ -0,0 +1,457 @@
+package proxy
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/oabraham1/go-http-proxy/internal/config"
+	"github.com/oabraham1/go-http-proxy/pkg/filters"
+)
+
+// testCA issues client certificates
+type testCA struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	file string // the CA certificate in PEM
+}
+
+func newTestCA(t *testing.T) *testCA {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("Failed to generate key: %v", err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "Test Client CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("Failed to create CA: %v", err)
+	}
+	cert, _ := x509.ParseCertificate(der)
+
+	file := filepath.Join(t.TempDir(), "ca.pem")
+	os.WriteFile(file, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0o600)
+	return &testCA{cert: cert, key: key, file: file}
+}
+
+// writeClientCert writes a client certificate for cn, signed by ca or
+// self-signed when ca is nil, and returns the paths of its certificate and
+// key files
+func writeClientCert(t *testing.T, ca *testCA, cn string) (string, string) {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("Failed to generate key: %v", err)
+	}
+	spiffe, _ := url.Parse("spiffe://example.org/" + cn)
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: cn, Organization: []string{"Example"}},
+		DNSNames:     []string{cn + ".example.org"},
+		URIs:         []*url.URL{spiffe},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	parent, signer := template, key
+	if ca != nil {
+		parent, signer = ca.cert, ca.key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, parent, &key.PublicKey, signer)
+	if err != nil {
+		t.Fatalf("Failed to create certificate: %v", err)
+	}
+	keyDER, _ := x509.MarshalECPrivateKey(key)
+
+	dir := t.TempDir()
+	certFile := filepath.Join(dir, "client.pem")
+	keyFile := filepath.Join(dir, "client-key.pem")
+	os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0o600)
+	os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0o600)
+	return certFile, keyFile
+}
+
+// certFilter records the client certificate filters see
+type certFilter struct {
+	seen chan *filters.ClientCert
+}
+
+func (f certFilter) Process(r *http.Request) error {
+	f.seen <- filters.ClientCertFromContext(r.Context())
+	return nil
+}
+
+func (f certFilter) Name() string {
+	return "cert"
+}
+
+func TestRouteClientCertModes(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(r.Header.Get("X-Forwarded-Client-Cert")))
+	}))
+	defer backend.Close()
+
+	ca := newTestCA(t)
+	certFile, keyFile := writeTestCert(t)
+	cfg := &config.Config{
+		Services: map[string]config.ServiceConfig{
+			"api": {
+				URL: backend.URL,
+				Routes: []config.RouteConfig{
+					{Path: "/open"},
+					{Path: "/required", ClientCert: "require"},
+					{Path: "/verified", ClientCert: "verify"},
+				},
+			},
+		},
+	}
+	cfg.Server.TLS = &config.TLSConfig{Enabled: true, CertFile: certFile, KeyFile: keyFile, ClientCAFile: ca.file}
+
+	proxy, err := New(cfg)
+	if err != nil {
+		t.Fatalf("Failed to create proxy: %v", err)
+	}
+	seen := make(chan *filters.ClientCert, 1)
+	proxy.filters = append(proxy.filters, certFilter{seen})
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	go proxy.server.ServeTLS(ln, "", "")
+	defer proxy.server.Close()
+
+	clientFor := func(certFile, keyFile string) *http.Client {
+		tlsConfig := &tls.Config{InsecureSkipVerify: true}
+		if certFile != "" {
+			cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+			if err != nil {
+				t.Fatalf("Failed to load client certificate: %v", err)
+			}
+			// Sent even when the proxy doesn't list its issuer
+			tlsConfig.GetClientCertificate = func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+				return &cert, nil
+			}
+		}
+		return &http.Client{Transport: &http.Transport{TLSClientConfig: tlsConfig}, Timeout: 5 * time.Second}
+	}
+	anonymous := clientFor("", "")
+	selfSigned := clientFor(writeClientCert(t, nil, "stranger"))
+	trusted := clientFor(writeClientCert(t, ca, "web"))
+
+	tests := []struct {
+		name     string
+		client   *http.Client
+		path     string
+		expected int
+		header   bool
+	}{
+		{"open without certificate", anonymous, "/open", http.StatusOK, false},
+		{"open with trusted certificate", trusted, "/open", http.StatusOK, true},
+		{"required without certificate", anonymous, "/required", http.StatusForbidden, false},
+		{"required with self-signed certificate", selfSigned, "/required", http.StatusOK, false},
+		{"verified with self-signed certificate", selfSigned, "/verified", http.StatusForbidden, false},
+		{"verified with trusted certificate", trusted, "/verified", http.StatusOK, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req, _ := http.NewRequest("GET", "https://"+ln.Addr().String()+tt.path, nil)
+			req.Header.Set("X-Forwarded-Client-Cert", "Hash=spoofed")
+
+			resp, err := tt.client.Do(req)
+			if err != nil {
+				t.Fatalf("Request failed: %v", err)
+			}
+			body, _ := io.ReadAll(resp.Body)
+			resp.Body.Close()
+
+			if resp.StatusCode != tt.expected {
+				t.Fatalf("Expected status %d, got %d", tt.expected, resp.StatusCode)
+			}
+			if tt.expected != http.StatusOK {
+				return
+			}
+			cert := <-seen
+
+			header := string(body)
+			if strings.Contains(header, "spoofed") {
+				t.Errorf("Expected the client's header to be dropped, got %q", header)
+			}
+			if !tt.header {
+				if header != "" {
+					t.Errorf("Expected no forwarded certificate, got %q", header)
+				}
+				return
+			}
+
+			expected := []string{`Subject="CN=web,O=Example"`, "URI=spiffe://example.org/web", "DNS=web.example.org"}
+			for _, part := range expected {
+				if !strings.Contains(header, part) {
+					t.Errorf("Expected %s in %q", part, header)
+				}
+			}
+			if cert == nil || !cert.Verified || !strings.HasPrefix(header, "Hash="+cert.Fingerprint+";") {
+				t.Errorf("Expected filters to see the verified certificate, got %+v", cert)
+			}
+		})
+	}
+}
+
+func TestClientCertHeaderStripped(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(r.Header.Get("X-Forwarded-Client-Cert")))
+	}))
+	defer backend.Close()
+
+	// No client CA, so nothing would replace a spoofed header
+	cfg := &config.Config{
+		ForwardProxy: &config.ForwardProxyConfig{
+			Enabled:    true,
+			AllowPorts: []int{backend.Listener.Addr().(*net.TCPAddr).Port},
+			AllowCIDRs: []string{"127.0.0.0/8"},
+		},
+		Services: map[string]config.ServiceConfig{
+			"api": {URL: backend.URL, Routes: []config.RouteConfig{{Path: "/"}}},
+		},
+	}
+	proxy, err := New(cfg)
+	if err != nil {
+		t.Fatalf("Failed to create proxy: %v", err)
+	}
+	server := httptest.NewServer(proxy.server.Handler)
+	defer server.Close()
+
+	tests := []struct {
+		name   string
+		client *http.Client
+		url    string
+	}{
+		{"route", http.DefaultClient, server.URL + "/"},
+		{"forward proxy", forwardClient(t, server.URL), backend.URL + "/"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req, _ := http.NewRequest("GET", tt.url, nil)
+			req.Header.Set("X-Forwarded-Client-Cert", "Hash=spoofed")
+			resp, err := tt.client.Do(req)
+			if err != nil {
+				t.Fatalf("Request failed: %v", err)
+			}
+			body, _ := io.ReadAll(resp.Body)
+			resp.Body.Close()
+
+			if len(body) != 0 {
+				t.Errorf("Expected the spoofed header to be removed, backend got %q", body)
+			}
+		})
+	}
+}
+
+func TestClientCertConfigErrors(t *testing.T) {
+	certFile, keyFile := writeTestCert(t)
+	ca := newTestCA(t)
+
+	tests := []struct {
+		name     string
+		caFile   string
+		service  config.ServiceConfig
+		expected string
+	}{
+		{"mode without CA", "", config.ServiceConfig{URL: "http://backend", Routes: []config.RouteConfig{{ClientCert: "verify"}}}, "requires server.tls.clientCAFile"},
+		{"unknown mode", ca.file, config.ServiceConfig{URL: "http://backend", Routes: []config.RouteConfig{{ClientCert: "optional"}}}, "unknown clientCert mode"},
+		{"unreadable CA", "/nonexistent.pem", config.ServiceConfig{URL: "http://backend"}, "clientCAFile"},
+		{"upstream TLS over h2c", "", config.ServiceConfig{URL: "http://backend", Protocol: "h2c", TLS: &config.UpstreamTLSConfig{}}, "doesn't use TLS"},
+		{"upstream key missing", "", config.ServiceConfig{URL: "https://backend", TLS: &config.UpstreamTLSConfig{CertFile: certFile}}, "required"},
+		{"upstream CA without certificates", "", config.ServiceConfig{URL: "https://backend", TLS: &config.UpstreamTLSConfig{CAFile: keyFile}}, "no certificates found"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := &config.Config{Services: map[string]config.ServiceConfig{"api": tt.service}}
+			cfg.Server.TLS = &config.TLSConfig{Enabled: true, CertFile: certFile, KeyFile: keyFile, ClientCAFile: tt.caFile}
+
+			_, err := New(cfg)
+			if err == nil || !strings.Contains(err.Error(), tt.expected) {
+				t.Errorf("Expected error containing %q, got %v", tt.expected, err)
+			}
+		})
+	}
+}
+
+func TestUpstreamTLS(t *testing.T) {
+	ca := newTestCA(t)
+	backend := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(r.TLS.PeerCertificates[0].Subject.CommonName))
+	}))
+	backend.TLS = &tls.Config{ClientAuth: tls.RequireAndVerifyClientCert, ClientCAs: x509.NewCertPool()}
+	backend.TLS.ClientCAs.AddCert(ca.cert)
+	backend.StartTLS()
+	defer backend.Close()
+
+	// The backend's certificate is for example.com, not the address dialled
+	backendCA := filepath.Join(t.TempDir(), "backend-ca.pem")
+	os.WriteFile(backendCA, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: backend.Certificate().Raw}), 0o600)
+	certFile, keyFile := writeClientCert(t, ca, "proxy")
+
+	tests := []struct {
+		name     string
+		tls      *config.UpstreamTLSConfig
+		expected int
+	}{
+		{"client certificate", &config.UpstreamTLSConfig{CertFile: certFile, KeyFile: keyFile, CAFile: backendCA, ServerName: "example.com"}, http.StatusOK},
+		{"skip verification", &config.UpstreamTLSConfig{CertFile: certFile, KeyFile: keyFile, InsecureSkipVerify: true}, http.StatusOK},
+		{"wrong server name", &config.UpstreamTLSConfig{CertFile: certFile, KeyFile: keyFile, CAFile: backendCA, ServerName: "other.test"}, http.StatusInternalServerError},
+		{"no client certificate", &config.UpstreamTLSConfig{CAFile: backendCA, ServerName: "example.com"}, http.StatusInternalServerError},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := &config.Config{
+				Services: map[string]config.ServiceConfig{
+					"api": {URL: backend.URL, TLS: tt.tls},
+				},
+			}
+			proxy, err := New(cfg)
+			if err != nil {
+				t.Fatalf("Failed to create proxy: %v", err)
+			}
+
+			rec := httptest.NewRecorder()
+			proxy.handler().ServeHTTP(rec, httptest.NewRequest("GET", "/api/data", nil))
+
+			if rec.Code != tt.expected {
+				t.Fatalf("Expected status %d, got %d: %s", tt.expected, rec.Code, rec.Body.String())
+			}
+			if tt.expected == http.StatusOK && rec.Body.String() != "proxy" {
+				t.Errorf("Expected the backend to see the proxy's certificate, got %q", rec.Body.String())
+			}
+		})
+	}
+}
+
+func TestClientCertRevocation(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer backend.Close()
+
+	ca := newTestCA(t)
+	revokedCert, revokedKey := writeClientCert(t, ca, "revoked")
+	goodCert, goodKey := writeClientCert(t, ca, "good")
+
+	data, _ := os.ReadFile(revokedCert)
+	block, _ := pem.Decode(data)
+	revoked, _ := x509.ParseCertificate(block.Bytes)
+	crl, err := x509.CreateRevocationList(rand.Reader, &x509.RevocationList{
+		Number:     big.NewInt(1),
+		ThisUpdate: time.Now().Add(-time.Minute),
+		NextUpdate: time.Now().Add(time.Hour),
+		RevokedCertificateEntries: []x509.RevocationListEntry{
+			{SerialNumber: revoked.SerialNumber, RevocationTime: time.Now()},
+		},
+	}, ca.cert, ca.key)
+	if err != nil {
+		t.Fatalf("Failed to create CRL: %v", err)
+	}
+	crlFile := filepath.Join(t.TempDir(), "clients.crl")
+	os.WriteFile(crlFile, crl, 0o600)
+
+	certFile, keyFile := writeTestCert(t)
+	cfg := &config.Config{
+		Services: map[string]config.ServiceConfig{
+			"api": {URL: backend.URL, Routes: []config.RouteConfig{{Path: "/", ClientCert: "verify"}}},
+		},
+	}
+	cfg.Server.TLS = &config.TLSConfig{
+		Enabled:          true,
+		CertFile:         certFile,
+		KeyFile:          keyFile,
+		ClientCAFile:     ca.file,
+		ClientRevocation: &config.RevocationConfig{CRLFile: crlFile},
+	}
+	proxy, err := New(cfg)
+	if err != nil {
+		t.Fatalf("Failed to create proxy: %v", err)
+	}
+
+	tests := []struct {
+		certFile string
+		keyFile  string
+		expected int
+	}{
+		{goodCert, goodKey, http.StatusOK},
+		{revokedCert, revokedKey, http.StatusForbidden},
+	}
+
+	for _, tt := range tests {
+		cert, _ := tls.LoadX509KeyPair(tt.certFile, tt.keyFile)
+		leaf, _ := x509.ParseCertificate(cert.Certificate[0])
+
+		req := httptest.NewRequest("GET", "/", nil)
+		req.TLS = &tls.ConnectionState{PeerCertificates: []*x509.Certificate{leaf}}
+		rec := httptest.NewRecorder()
+		proxy.handler().ServeHTTP(rec, req)
+
+		if rec.Code != tt.expected {
+			t.Errorf("Expected %d for %s, got %d", tt.expected, leaf.Subject.CommonName, rec.Code)
+		}
+	}
+}
+
+func TestClientCertPerConnection(t *testing.T) {
+	ca := newTestCA(t)
+	clientCert, clientKey := writeClientCert(t, ca, "client")
+	certFile, keyFile := writeTestCert(t)
+
+	cfg := &config.Config{}
+	cfg.Server.TLS = &config.TLSConfig{Enabled: true, CertFile: certFile, KeyFile: keyFile, ClientCAFile: ca.file}
+	proxy, err := New(cfg)
+	if err != nil {
+		t.Fatalf("Failed to create proxy: %v", err)
+	}
+
+	cert, _ := tls.LoadX509KeyPair(clientCert, clientKey)
+	leaf, _ := x509.ParseCertificate(cert.Certificate[0])
+	request := func(ctx context.Context) *http.Request {
+		req := httptest.NewRequest("GET", "/", nil).WithContext(ctx)
+		req.TLS = &tls.ConnectionState{PeerCertificates: []*x509.Certificate{leaf}}
+		return req
+	}
+
+	// Requests on one connection share its verified certificate
+	conn := proxy.server.ConnContext(context.Background(), nil)
+	first, second := proxy.clientCert(request(conn)), proxy.clientCert(request(conn))
+	if first == nil || !first.Verified || first != second {
+		t.Errorf("Expected one verified certificate per connection, got %+v and %+v", first, second)
+	}
+	if other := proxy.clientCert(request(proxy.server.ConnContext(context.Background(), nil))); other == first {
+		t.Error("Expected another connection to verify its own certificate")
+	}
+}
@@ -3,23 +3,45 @@ package proxy
 import (
 	"context"
 	"crypto/tls"
+	"crypto/x509"
+	"errors"
 	"fmt"
+	"io"
 	"log"
+	"net"
 	"net/http"
+	"reflect"
+	"slices"
 	"sync"
 	"sync/atomic"
 	"time"
 
+	"github.com/quic-go/quic-go/http3"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
 	"golang.org/x/time/rate"
 
+	"github.com/oabraham1/go-http-proxy/internal/acme"
 	"github.com/oabraham1/go-http-proxy/internal/cache"
+	"github.com/oabraham1/go-http-proxy/internal/certs"
 	"github.com/oabraham1/go-http-proxy/internal/circuitbreaker"
 	"github.com/oabraham1/go-http-proxy/internal/config"
 	"github.com/oabraham1/go-http-proxy/internal/health"
+	"github.com/oabraham1/go-http-proxy/internal/hedge"
+	"github.com/oabraham1/go-http-proxy/internal/loadbalancer"
 	"github.com/oabraham1/go-http-proxy/internal/middleware"
+	"github.com/oabraham1/go-http-proxy/internal/outlier"
+	"github.com/oabraham1/go-http-proxy/internal/retry"
 	"github.com/oabraham1/go-http-proxy/pkg/filters"
 )
 
+// Upstream protocols
+const (
+	protocolAuto = "auto"
+	protocolH2C  = "h2c"
+	protocolH2   = "h2"
+)
+
 type metrics struct {
 	requests       atomic.Int64
 	cacheHits      atomic.Int64
@@ -27,19 +49,59 @@ type metrics struct {
 	errors         atomic.Int64
 	lastError      atomic.Int64
 	activeRequests atomic.Int64
+	hedges         atomic.Int64
+	hedgeWins      atomic.Int64
+	upgradedConns  atomic.Int64
+	http1Requests  atomic.Int64
+	http2Requests  atomic.Int64
+	http3Requests  atomic.Int64
+}
+
+// countProtocol records the HTTP version a request arrived over
+func (m *metrics) countProtocol(r *http.Request) {
+	switch r.ProtoMajor {
+	case 3:
+		m.http3Requests.Add(1)
+	case 2:
+		m.http2Requests.Add(1)
+	default:
+		m.http1Requests.Add(1)
+	}
 }
 
 type Proxy struct {
 	cfg         *config.Config
 	server      *http.Server
+	h3server    *http3.Server
+	h3conn      net.PacketConn
+	redirect    *http.Server // plain HTTP to HTTPS redirects
+	certs       *certs.Store
+	acme        *acme.Manager
+	clientCAs   *x509.CertPool // verify client certificates when set
+	revocation  *certs.RevocationChecker
 	cache       *cache.Cache
+	cacheConfig cache.Config
 	breakers    map[string]*circuitbreaker.CircuitBreaker
+	balancers   map[string]loadbalancer.Balancer
+	outliers    map[string]*outlier.Detector
+	retries     map[string]*retry.Policy
+	hedgers     map[string]*hedge.Hedger
+	routes      []*route
+	trusted     trustedProxies
+	routesCache *cache.Cache
+	validator   middleware.TokenValidator
 	healthCheck *health.Checker
 	filters     []filters.Filter
 	middlewares []middleware.Middleware
 	metrics     *metrics
 	client      *http.Client
+	clients     map[string]*http.Client // services that don't use client
+	forward     *forwardProxy
 	mu          sync.RWMutex
+
+	tunnelsMu sync.Mutex
+	tunnels   map[io.Closer]struct{} // hijacked connections
+	draining  bool
 }
 
 func New(cfg *config.Config) (*Proxy, error) {
@@ -48,9 +110,14 @@ func New(cfg *config.Config) (*Proxy, error) {
 	}
 
 	p := &Proxy{
-		cfg:      cfg,
-		breakers: make(map[string]*circuitbreaker.CircuitBreaker),
-		metrics:  &metrics{},
+		cfg:       cfg,
+		breakers:  make(map[string]*circuitbreaker.CircuitBreaker),
+		balancers: make(map[string]loadbalancer.Balancer),
+		outliers:  make(map[string]*outlier.Detector),
+		retries:   make(map[string]*retry.Policy),
+		hedgers:   make(map[string]*hedge.Hedger),
+		clients:   make(map[string]*http.Client),
+		metrics:   &metrics{},
 	}
 
 	if err := p.initialize(); err != nil {
@@ -72,14 +139,49 @@ func (p *Proxy) initialize() error {
 			ForceAttemptHTTP2:   true,
 			TLSHandshakeTimeout: p.cfg.Proxy.TLSHandshakeTimeout,
 		},
-		Timeout: p.cfg.Proxy.ResponseTimeout,
+	}
+
+	// Initialize clients for services that need a specific protocol or
+	// TLS settings
+	for service, cfg := range p.cfg.Services {
+		var tlsConfig *tls.Config
+		if cfg.TLS != nil {
+			var err error
+			if tlsConfig, err = upstreamTLS(cfg.TLS); err != nil {
+				return fmt.Errorf("service %s: %w", service, err)
+			}
+		}
+
+		transport, err := p.newTransport(cfg.Protocol, tlsConfig)
+		if err != nil {
+			return fmt.Errorf("service %s: %w", service, err)
+		}
+		if transport != nil {
+			p.clients[service] = &http.Client{Transport: transport}
+		}
 	}
 
 	// Initialize cache if enabled
+	cacheConfig, err := newCacheConfig(p.cfg.Cache)
+	if err != nil {
+		return err
+	}
+	p.cacheConfig = cacheConfig
 	if p.cfg.Cache.Enabled {
-		p.cache = cache.New(cache.Config{
-			TTL: p.cfg.Cache.TTL,
-		})
+		store, err := newCacheStore(p.cfg.Cache)
+		if err != nil {
+			return fmt.Errorf("cache store: %w", err)
+		}
+		cacheConfig.Store = store
+		p.cache = cache.New(cacheConfig)
+	}
+
+	// Validate tokens of routes with auth
+	if jc := p.cfg.Security.JWT; jc != nil {
+		if jc.Secret == "" {
+			return fmt.Errorf("security.jwt: secret is required")
+		}
+		p.validator = middleware.NewJWTValidator(jc.Secret, jc.Issuer, jc.Audience)
 	}
 
 	// Initialize circuit breakers
@@ -93,12 +195,89 @@ func (p *Proxy) initialize() error {
 		}
 	}
 
+	// Initialize load balancers
+	for service, cfg := range p.cfg.Services {
+		balancer, err := newBalancer(p.cfg.LoadBalancer, cfg)
+		if err != nil {
+			return fmt.Errorf("service %s: %w", service, err)
+		}
+		p.balancers[service] = balancer
+
+		if oc := cfg.Outlier; oc != nil {
+			p.outliers[service] = outlier.New(service, outlier.Config{
+				Consecutive5xx:           oc.Consecutive5xx,
+				ConsecutiveGatewayErrors: oc.ConsecutiveGatewayErrors,
+				SuccessRateStdevFactor:   oc.SuccessRateStdevFactor,
+				SuccessRateMinHosts:      oc.SuccessRateMinHosts,
+				SuccessRateRequestVolume: oc.SuccessRateRequestVolume,
+				Interval:                 oc.Interval,
+				BaseEjectionTime:         oc.BaseEjectionTime,
+				MaxEjectionTime:          oc.MaxEjectionTime,
+				MaxEjectionPercent:       oc.MaxEjectionPercent,
+			}, balancer.Backends())
+		}
+	}
+
+	// Initialize retry policies
+	for service, cfg := range p.cfg.Services {
+		rc := p.cfg.Retry
+		if cfg.Retry != nil {
+			rc = cfg.Retry
+		}
+		if rc == nil {
+			continue
+		}
+
+		policy, err := newRetryPolicy(rc)
+		if err != nil {
+			return fmt.Errorf("service %s: %w", service, err)
+		}
+		p.retries[service] = policy
+	}
+
+	// Initialize request hedging
+	for service, cfg := range p.cfg.Services {
+		if cfg.Hedge == nil {
+			continue
+		}
+
+		hedger, err := hedge.New(hedge.Config{
+			Delay:       cfg.Hedge.Delay,
+			Percentile:  cfg.Hedge.Percentile,
+			MaxInFlight: cfg.Hedge.MaxInFlight,
+		})
+		if err != nil {
+			return fmt.Errorf("service %s: %w", service, err)
+		}
+		p.hedgers[service] = hedger
+	}
+
+	// Initialize trusted proxies
+	trusted, err := parseTrustedProxies(p.cfg.TrustedProxies)
+	if err != nil {
+		return err
+	}
+	p.trusted = trusted
+
+	// Initialize client certificate verification
+	if err := p.initClientCAs(); err != nil {
+		return fmt.Errorf("TLS configuration error: %w", err)
+	}
+
+	// Initialize routes
+	if err := p.buildRoutes(); err != nil {
+		return err
+	}
+
+	// Initialize forward-proxy mode
+	if err := p.initForwardProxy(); err != nil {
+		return err
+	}
+
 	// Initialize health checker
-	serviceURLs := make(map[string]string)
-	for name, svc := range p.cfg.Services {
-		serviceURLs[name] = svc.URL
+	if err := p.initHealthChecks(); err != nil {
+		return fmt.Errorf("failed to initialize health checks: %w", err)
 	}
-	p.healthCheck = health.NewChecker(serviceURLs, time.Minute)
 
 	// Initialize middlewares
 	if err := p.initMiddlewares(); err != nil {
@@ -106,7 +285,11 @@ func (p *Proxy) initialize() error {
 	}
 
 	// Initialize server
-	serverHandler := p.handler()
+	handler := p.handler()
+	serverHandler := handler
+	if p.cfg.Server.H2C {
+		serverHandler = h2c.NewHandler(serverHandler, &http2.Server{})
+	}
 	p.server = &http.Server{
 		Addr:           fmt.Sprintf(":%d", p.cfg.Server.Port),
 		Handler:        serverHandler,
@@ -117,40 +300,223 @@ func (p *Proxy) initialize() error {
 
 	// Configure TLS if enabled
 	if p.cfg.Server.TLS != nil && p.cfg.Server.TLS.Enabled {
-		tlsConfig, err := configureTLS(p.cfg.Server.TLS)
+		tlsConfig, store, err := configureTLS(p.cfg.Server.TLS)
 		if err != nil {
 			return fmt.Errorf("TLS configuration error: %w", err)
 		}
 		p.server.TLSConfig = tlsConfig
+		p.certs = store
+
+		// Certificates are asked for on every connection, verified once
+		// per connection and checked by each route
+		if p.clientCAs != nil {
+			tlsConfig.ClientAuth = tls.RequestClientCert
+			tlsConfig.ClientCAs = p.clientCAs
+			p.server.ConnContext = withConnClientCert
+		}
+
+		// The server adds h2 to any TLS config unless told not to
+		if !slices.Contains(tlsConfig.NextProtos, alpnH2) {
+			p.server.TLSNextProto = make(map[string]func(*http.Server, *tls.Conn, http.Handler))
+		}
+
+		if err := p.initACME(tlsConfig); err != nil {
+			return fmt.Errorf("TLS configuration error: %w", err)
+		}
+		if err := p.initRedirect(); err != nil {
+			return fmt.Errorf("TLS configuration error: %w", err)
+		}
+	}
+
+	// Initialize HTTP/3 and advertise it on the TCP listener
+	if err := p.initHTTP3(handler); err != nil {
+		return err
+	}
+	if p.h3server != nil {
+		p.server.Handler = p.advertiseHTTP3(p.server.Handler)
 	}
 
 	return nil
 }
 
-func configureTLS(cfg *config.TLSConfig) (*tls.Config, error) {
-	var minVersion uint16
-	switch cfg.MinVersion {
-	case "1.2":
-		minVersion = tls.VersionTLS12
-	case "1.3":
-		minVersion = tls.VersionTLS13
+// newTransport builds the transport for a service's protocol and TLS
+// settings. It returns nil when the shared client will do.
+func (p *Proxy) newTransport(protocol string, tlsConfig *tls.Config) (http.RoundTripper, error) {
+	idleTimeout := p.cfg.Proxy.IdleConnTimeout
+
+	switch protocol {
+	case "", protocolAuto:
+		if tlsConfig == nil {
+			return nil, nil
+		}
+		transport := p.client.Transport.(*http.Transport).Clone()
+		transport.TLSClientConfig = tlsConfig
+		return transport, nil
+	case protocolH2C:
+		if tlsConfig != nil {
+			return nil, fmt.Errorf("protocol h2c doesn't use TLS")
+		}
+		return &http2.Transport{
+			AllowHTTP: true,
+			DialTLSContext: func(ctx context.Context, network, addr string, _ *tls.Config) (net.Conn, error) {
+				var d net.Dialer
+				return d.DialContext(ctx, network, addr)
+			},
+			IdleConnTimeout: idleTimeout,
+		}, nil
+	case protocolH2:
+		return &http2.Transport{TLSClientConfig: tlsConfig, IdleConnTimeout: idleTimeout}, nil
 	default:
-		minVersion = tls.VersionTLS12
+		return nil, fmt.Errorf("unknown protocol %q", protocol)
+	}
+}
+
+// clientFor returns the client used to reach a service's backends
+func (p *Proxy) clientFor(service string) *http.Client {
+	if client, ok := p.clients[service]; ok {
+		return client
+	}
+	return p.client
+}
+
+// newBalancer builds the backend pool for a service. A service without
+// explicit backends is served by its single URL.
+func newBalancer(defaults config.LoadBalancerConfig, cfg config.ServiceConfig) (loadbalancer.Balancer, error) {
+	backendConfigs := cfg.Backends
+	if len(backendConfigs) == 0 {
+		backendConfigs = []config.BackendConfig{{URL: cfg.URL}}
+	}
+
+	backends := make([]*loadbalancer.Backend, 0, len(backendConfigs))
+	for _, bc := range backendConfigs {
+		backend, err := loadbalancer.NewBackend(bc.URL, bc.Weight)
+		if err != nil {
+			return nil, err
+		}
+		backends = append(backends, backend)
+	}
+
+	lbConfig := defaults
+	if cfg.LoadBalancer != nil {
+		lbConfig = *cfg.LoadBalancer
 	}
 
-	return &tls.Config{
-		MinVersion:   minVersion,
-		CipherSuites: parseCipherSuites(cfg.CipherSuites),
-	}, nil
+	return loadbalancer.New(loadbalancer.Config{
+		Algorithm: lbConfig.Algorithm,
+		HashKey:   lbConfig.HashKey,
+	}, backends)
 }
 
-func parseCipherSuites(ciphers []string) []uint16 {
-	// Implementation to convert cipher suite strings to tls.uint16 values
-	// This would need a mapping of string names to actual cipher suite values
-	return nil // TODO: Implement cipher suite parsing
+func newRetryPolicy(rc *config.RetryConfig) (*retry.Policy, error) {
+	return retry.New(retry.Config{
+		MaxAttempts:        rc.MaxAttempts,
+		RetryOn:            rc.RetryOn,
+		StatusCodes:        rc.StatusCodes,
+		BackoffBase:        rc.BackoffBase,
+		BackoffMax:         rc.BackoffMax,
+		RetryNonIdempotent: rc.RetryNonIdempotent,
+		BudgetPercent:      rc.BudgetPercent,
+		MinRetries:         rc.MinRetries,
+		MaxBodyBytes:       rc.MaxBodyBytes,
+	})
+}
+
+// initHealthChecks registers the backends of services with a health check,
+// their own or the top-level one, with the health checker. A backend leaves
+// rotation when its checks fail and rejoins once they pass. Backends of
+// other services are never checked, so they stay in rotation.
+func (p *Proxy) initHealthChecks() error {
+	p.healthCheck = health.NewChecker(nil, time.Minute)
+	checkAll := !reflect.ValueOf(p.cfg.HealthCheck).IsZero()
+
+	for service, balancer := range p.balancers {
+		override := p.cfg.Services[service].HealthCheck
+		if override == nil && !checkAll {
+			continue
+		}
+		check := healthCheckConfig(p.cfg.HealthCheck, override)
+
+		// Probes go the way the service's requests do
+		var transport http.RoundTripper
+		if client, ok := p.clients[service]; ok {
+			transport = client.Transport
+		}
+
+		for _, backend := range balancer.Backends() {
+			backend := backend
+			err := p.healthCheck.AddTarget(health.Target{
+				Service:   service,
+				URL:       backend.String(),
+				Check:     check,
+				Transport: transport,
+				OnChange: func(status health.Status) {
+					log.Printf("Backend %s of service %s is now healthy=%t: %s",
+						backend, service, status.Healthy, status.Message)
+					backend.SetHealthy(status.Healthy)
+				},
+			})
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// healthCheckConfig merges a service's health check settings over the
+// global defaults
+func healthCheckConfig(defaults config.HealthCheckConfig, override *config.HealthCheckConfig) health.CheckConfig {
+	merged := defaults
+	if override != nil {
+		if override.Path != "" {
+			merged.Path = override.Path
+		}
+		if override.Method != "" {
+			merged.Method = override.Method
+		}
+		if override.ExpectedStatus != "" {
+			merged.ExpectedStatus = override.ExpectedStatus
+		}
+		if override.BodyContains != "" {
+			merged.BodyContains = override.BodyContains
+		}
+		if override.Interval > 0 {
+			merged.Interval = override.Interval
+		}
+		if override.Timeout > 0 {
+			merged.Timeout = override.Timeout
+		}
+		if override.HealthyThreshold > 0 {
+			merged.HealthyThreshold = override.HealthyThreshold
+		}
+		if override.UnhealthyThreshold > 0 {
+			merged.UnhealthyThreshold = override.UnhealthyThreshold
+		}
+		if len(override.Headers) > 0 {
+			merged.Headers = override.Headers
+		}
+	}
+
+	return health.CheckConfig{
+		Path:               merged.Path,
+		Method:             merged.Method,
+		ExpectedStatus:     merged.ExpectedStatus,
+		BodyContains:       merged.BodyContains,
+		Interval:           merged.Interval,
+		Timeout:            merged.Timeout,
+		HealthyThreshold:   merged.HealthyThreshold,
+		UnhealthyThreshold: merged.UnhealthyThreshold,
+		Headers:            merged.Headers,
+	}
 }
 
 func (p *Proxy) initMiddlewares() error {
+	if p.cfg.Security.Headers.Enabled {
+		p.middlewares = append(p.middlewares,
+			middleware.NewSecurityHeaders(p.cfg.Security.Headers.CSP))
+	}
+
 	if p.cfg.Tracing.Enabled {
 		p.middlewares = append(p.middlewares,
 			middleware.NewTracing(nil))
@@ -168,9 +534,33 @@ func (p *Proxy) initMiddlewares() error {
 
 func (p *Proxy) Start() error {
 	p.healthCheck.Start()
+	for _, detector := range p.outliers {
+		detector.Start()
+	}
 	go p.collectMetrics()
 
-	if err := p.server.ListenAndServe(); err != http.ErrServerClosed {
+	if err := p.startHTTP3(); err != nil {
+		return err
+	}
+
+	if p.certs != nil {
+		p.certs.Start()
+	}
+	if p.acme != nil {
+		p.acme.Start()
+	}
+	if err := p.startRedirect(); err != nil {
+		return err
+	}
+
+	var err error
+	if p.server.TLSConfig != nil {
+		// The certificate is already in the TLS config
+		err = p.server.ListenAndServeTLS("", "")
+	} else {
+		err = p.server.ListenAndServe()
+	}
+	if err != http.ErrServerClosed {
 		return fmt.Errorf("server error: %w", err)
 	}
 	return nil
@@ -181,12 +571,40 @@ func (p *Proxy) Shutdown() error {
 	defer cancel()
 
 	p.healthCheck.Stop()
+	for _, detector := range p.outliers {
+		detector.Stop()
+	}
+	if p.certs != nil {
+		p.certs.Stop()
+	}
+	if p.acme != nil {
+		p.acme.Stop()
+	}
 
+	// A failure to stop one part doesn't leave the rest running
+	var errs []error
 	if err := p.server.Shutdown(ctx); err != nil {
-		return fmt.Errorf("shutdown error: %w", err)
+		errs = append(errs, fmt.Errorf("shutdown error: %w", err))
 	}
+	p.closeTunnels()
 
-	return nil
+	if err := p.stopRedirect(ctx); err != nil {
+		errs = append(errs, fmt.Errorf("redirect shutdown error: %w", err))
+	}
+
+	if err := p.stopHTTP3(); err != nil {
+		errs = append(errs, fmt.Errorf("HTTP/3 shutdown error: %w", err))
+	}
+
+	for _, c := range []*cache.Cache{p.cache, p.routesCache} {
+		if c != nil {
+			if err := c.Close(); err != nil {
+				errs = append(errs, fmt.Errorf("cache shutdown error: %w", err))
+			}
+		}
+	}
+
+	return errors.Join(errs...)
 }
 
 func (p *Proxy) collectMetrics() {
@@ -200,11 +618,17 @@ func (p *Proxy) collectMetrics() {
 }
 
 func (p *Proxy) logMetrics() {
-	log.Printf("Proxy Metrics - Requests: %d, Cache Hits: %d, Cache Misses: %d, Errors: %d, Active Requests: %d",
+	log.Printf("Proxy Metrics - Requests: %d, Cache Hits: %d, Cache Misses: %d, Errors: %d, Active Requests: %d, Hedges: %d, Hedge Wins: %d, Upgraded Connections: %d, HTTP/1: %d, HTTP/2: %d, HTTP/3: %d",
 		p.metrics.requests.Load(),
 		p.metrics.cacheHits.Load(),
 		p.metrics.cacheMisses.Load(),
 		p.metrics.errors.Load(),
 		p.metrics.activeRequests.Load(),
+		p.metrics.hedges.Load(),
+		p.metrics.hedgeWins.Load(),
+		p.metrics.upgradedConns.Load(),
+		p.metrics.http1Requests.Load(),
+		p.metrics.http2Requests.Load(),
+		p.metrics.http3Requests.Load(),
 	)
 }
@@ -1,7 +1,9 @@
 package proxy
 
 import (
+	"errors"
 	"io"
+	"net"
 	"net/http"
 	"net/http/httptest"
 	"strings"
@@ -34,17 +36,6 @@ func TestProxyIntegration(t *testing.T) {
 
 	// Create proxy configuration with all required fields
 	cfg := &config.Config{
-		Server: struct {
-			Port           int           `yaml:"port"`
-			ReadTimeout    time.Duration `yaml:"readTimeout"`
-			WriteTimeout   time.Duration `yaml:"writeTimeout"`
-			MaxHeaderBytes int           `yaml:"maxHeaderBytes"`
-		}{
-			Port:           8080,
-			ReadTimeout:    5 * time.Second,
-			WriteTimeout:   5 * time.Second,
-			MaxHeaderBytes: 1 << 20,
-		},
 		Proxy: struct {
 			MaxIdleConns        int           `yaml:"maxIdleConns"`
 			MaxConnsPerHost     int           `yaml:"maxConnsPerHost"`
@@ -57,10 +48,7 @@ func TestProxyIntegration(t *testing.T) {
 			IdleConnTimeout: 90 * time.Second,
 			ResponseTimeout: 30 * time.Second,
 		},
-		Cache: struct {
-			Enabled bool          `yaml:"enabled"`
-			TTL     time.Duration `yaml:"ttl"`
-		}{
+		Cache: config.CacheConfig{
 			Enabled: true,
 			TTL:     time.Second,
 		},
@@ -83,6 +71,10 @@ func TestProxyIntegration(t *testing.T) {
 			},
 		},
 	}
+	cfg.Server.Port = 8080
+	cfg.Server.ReadTimeout = 5 * time.Second
+	cfg.Server.WriteTimeout = 5 * time.Second
+	cfg.Server.MaxHeaderBytes = 1 << 20
 
 	// Create and start proxy
 	proxy, err := New(cfg)
@@ -198,3 +190,73 @@ func TestProxyIntegration(t *testing.T) {
 		})
 	}
 }
+
+// failingListener reports an error when it's closed
+type failingListener struct {
+	net.Listener
+}
+
+func (l failingListener) Close() error {
+	l.Listener.Close()
+	return errors.New("close failed")
+}
+
+func TestShutdownStopsEverything(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer backend.Close()
+
+	cfg := &config.Config{
+		Cache: config.CacheConfig{Enabled: true},
+		Services: map[string]config.ServiceConfig{
+			"api": {URL: backend.URL, Routes: []config.RouteConfig{{Path: "/"}}},
+		},
+	}
+	proxy, err := New(cfg)
+	if err != nil {
+		t.Fatalf("Failed to create proxy: %v", err)
+	}
+
+	serve := func(server *http.Server, ln net.Listener) <-chan error {
+		done := make(chan error, 1)
+		go func() { done <- server.Serve(ln) }()
+		// Serving once a request has been answered
+		client := &http.Client{CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse }}
+		resp, err := client.Get("http://" + ln.Addr().String() + "/")
+		if err != nil {
+			t.Fatalf("Request failed: %v", err)
+		}
+		resp.Body.Close()
+		return done
+	}
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	serve(proxy.server, failingListener{ln})
+
+	redirectLn, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	proxy.redirect = &http.Server{Handler: redirectHandler(443)}
+	redirectDone := serve(proxy.redirect, redirectLn)
+
+	err = proxy.Shutdown()
+	if err == nil || !strings.Contains(err.Error(), "close failed") {
+		t.Errorf("Expected the listener's error, got %v", err)
+	}
+
+	// The rest is stopped regardless
+	select {
+	case err := <-redirectDone:
+		if err != http.ErrServerClosed {
+			t.Errorf("Expected the redirect server to be closed, got %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Error("Expected the redirect server to stop")
+	}
+	if !proxy.draining {
+		t.Error("Expected tunnels to be closed")
+	}
+}
@@ -0,0 +1,207 @@
+package proxy
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/oabraham1/go-http-proxy/internal/config"
+)
+
+func TestRetries(t *testing.T) {
+	var failingHits, healthyHits atomic.Int64
+
+	failing := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		failingHits.Add(1)
+		io.Copy(io.Discard, r.Body)
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer failing.Close()
+
+	healthy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		healthyHits.Add(1)
+		body, _ := io.ReadAll(r.Body)
+		w.Write([]byte("ok:" + string(body)))
+	}))
+	defer healthy.Close()
+
+	newProxy := func(retry *config.RetryConfig) *httptest.Server {
+		cfg := &config.Config{
+			Services: map[string]config.ServiceConfig{
+				"api": {
+					Backends: []config.BackendConfig{{URL: failing.URL}, {URL: healthy.URL}},
+					Retry:    retry,
+				},
+			},
+		}
+		proxy, err := New(cfg)
+		if err != nil {
+			t.Fatalf("Failed to create proxy: %v", err)
+		}
+		return httptest.NewServer(proxy.handler())
+	}
+
+	tests := []struct {
+		name       string
+		retry      *config.RetryConfig
+		method     string
+		wantStatus int
+		wantBody   string
+	}{
+		{
+			name:       "GET retried on another backend",
+			retry:      &config.RetryConfig{MaxAttempts: 2, BackoffBase: time.Millisecond},
+			method:     http.MethodGet,
+			wantStatus: http.StatusOK,
+			wantBody:   "ok:",
+		},
+		{
+			name:       "POST not retried by default",
+			retry:      &config.RetryConfig{MaxAttempts: 2, BackoffBase: time.Millisecond},
+			method:     http.MethodPost,
+			wantStatus: http.StatusServiceUnavailable,
+		},
+		{
+			name: "POST body replayed when opted in",
+			retry: &config.RetryConfig{
+				MaxAttempts:        2,
+				BackoffBase:        time.Millisecond,
+				RetryNonIdempotent: true,
+			},
+			method:     http.MethodPost,
+			wantStatus: http.StatusOK,
+			wantBody:   "ok:payload",
+		},
+		{
+			name:       "no retry policy",
+			method:     http.MethodGet,
+			wantStatus: http.StatusServiceUnavailable,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server := newProxy(tt.retry)
+			defer server.Close()
+			failingHits.Store(0)
+			healthyHits.Store(0)
+
+			// Round-robin starts at the failing backend
+			req, _ := http.NewRequest(tt.method, server.URL+"/api/items", strings.NewReader("payload"))
+			resp, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Fatalf("Request failed: %v", err)
+			}
+			body, _ := io.ReadAll(resp.Body)
+			resp.Body.Close()
+
+			if resp.StatusCode != tt.wantStatus {
+				t.Errorf("got status %d, want %d", resp.StatusCode, tt.wantStatus)
+			}
+			if tt.wantBody != "" && !strings.HasPrefix(string(body), tt.wantBody) {
+				t.Errorf("got body %q, want prefix %q", body, tt.wantBody)
+			}
+			if failingHits.Load() != 1 {
+				t.Errorf("failing backend got %d attempts, want 1", failingHits.Load())
+			}
+		})
+	}
+}
+
+func TestRetryBodyOverLimit(t *testing.T) {
+	var hits atomic.Int64
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hits.Add(1)
+		body, _ := io.ReadAll(r.Body)
+		if len(body) != 1024 {
+			t.Errorf("backend received %d body bytes, want 1024", len(body))
+		}
+		w.WriteHeader(http.StatusBadGateway)
+	}))
+	defer backend.Close()
+
+	cfg := &config.Config{
+		Services: map[string]config.ServiceConfig{
+			"api": {
+				URL: backend.URL,
+				Retry: &config.RetryConfig{
+					MaxAttempts:  3,
+					BackoffBase:  time.Millisecond,
+					MaxBodyBytes: 100,
+				},
+			},
+		},
+	}
+	proxy, err := New(cfg)
+	if err != nil {
+		t.Fatalf("Failed to create proxy: %v", err)
+	}
+	server := httptest.NewServer(proxy.handler())
+	defer server.Close()
+
+	req, _ := http.NewRequest(http.MethodPut, server.URL+"/api/items", strings.NewReader(strings.Repeat("x", 1024)))
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("Request failed: %v", err)
+	}
+	resp.Body.Close()
+
+	if hits.Load() != 1 {
+		t.Errorf("got %d attempts for a body over the buffer limit, want 1", hits.Load())
+	}
+}
+
+func TestRouteRetryOverride(t *testing.T) {
+	var hits atomic.Int64
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hits.Add(1)
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer backend.Close()
+
+	cfg := &config.Config{
+		Services: map[string]config.ServiceConfig{
+			"api": {
+				URL:   backend.URL,
+				Retry: &config.RetryConfig{MaxAttempts: 3, BackoffBase: time.Millisecond},
+				Routes: []config.RouteConfig{
+					{Path: "/api/once", Retry: &config.RetryConfig{MaxAttempts: 1}},
+					{Path: "/api"},
+				},
+			},
+		},
+	}
+	proxy, err := New(cfg)
+	if err != nil {
+		t.Fatalf("Failed to create proxy: %v", err)
+	}
+	server := httptest.NewServer(proxy.handler())
+	defer server.Close()
+
+	tests := []struct {
+		path     string
+		wantHits int64
+	}{
+		{path: "/api/once", wantHits: 1},
+		{path: "/api/items", wantHits: 3},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.path, func(t *testing.T) {
+			hits.Store(0)
+			resp, err := http.Get(server.URL + tt.path)
+			if err != nil {
+				t.Fatalf("Request failed: %v", err)
+			}
+			resp.Body.Close()
+
+			if hits.Load() != tt.wantHits {
+				t.Errorf("got %d attempts, want %d", hits.Load(), tt.wantHits)
+			}
+		})
+	}
+}
@@ -0,0 +1,146 @@
+package proxy
+
+import (
+	"fmt"
+	"net/url"
+	"regexp"
+	"strings"
+
+	"github.com/oabraham1/go-http-proxy/internal/config"
+)
+
+// Host header policies
+const (
+	hostPreserve = "preserve"
+	hostUpstream = "upstream"
+)
+
+// compileRewrite validates the route's rewrite rules
+func (rt *route) compileRewrite() error {
+	rw := rt.config.Rewrite
+	if rw == nil {
+		return nil
+	}
+
+	rules := 0
+	for _, rule := range []string{rw.StripPrefix, rw.ReplacePrefix, rw.Regex} {
+		if rule != "" {
+			rules++
+		}
+	}
+	if rules > 1 {
+		return fmt.Errorf("stripPrefix, replacePrefix and regex rewrites are exclusive")
+	}
+
+	if rw.ReplacePrefix != "" {
+		if rt.config.PathType != pathPrefix || strings.Contains(rt.config.Path, "{") {
+			return fmt.Errorf("replacePrefix needs a literal prefix path")
+		}
+	}
+
+	for _, prefix := range []string{rw.ReplacePrefix, rw.AddPrefix} {
+		if prefix != "" && !strings.HasPrefix(prefix, "/") {
+			return fmt.Errorf("rewrite prefix %q must start with /", prefix)
+		}
+	}
+
+	if rw.Regex != "" {
+		re, err := regexp.Compile(rw.Regex)
+		if err != nil {
+			return fmt.Errorf("invalid rewrite regex: %w", err)
+		}
+		rt.rewriteRegex = re
+	} else if rw.Replacement != "" {
+		return fmt.Errorf("rewrite replacement needs a regex")
+	}
+
+	switch rw.HostHeader {
+	case "", hostPreserve:
+	case hostUpstream:
+		rt.upstreamHost = true
+	default:
+		return fmt.Errorf("unknown host header policy %q", rw.HostHeader)
+	}
+
+	return nil
+}
+
+// rewriteURL applies the route's rewrite rules to an outbound URL and joins
+// the result to the backend's base path and query
+func (rt *route) rewriteURL(u, base *url.URL) {
+	rw := rt.config.Rewrite
+	if rw == nil && base.Path == "" && base.RawQuery == "" {
+		return
+	}
+
+	// Work on the escaped form so encoded characters such as %2F survive
+	path := u.EscapedPath()
+	if rw != nil {
+		path = rt.rewritePath(rw, path)
+	}
+	path = joinPath(base.EscapedPath(), path)
+	if !strings.HasPrefix(path, "/") {
+		path = "/" + path
+	}
+
+	if unescaped, err := url.PathUnescape(path); err == nil {
+		u.Path = unescaped
+		u.RawPath = path
+	} else {
+		u.Path = path
+		u.RawPath = ""
+	}
+
+	if base.RawQuery != "" {
+		if u.RawQuery == "" {
+			u.RawQuery = base.RawQuery
+		} else {
+			u.RawQuery = base.RawQuery + "&" + u.RawQuery
+		}
+	}
+}
+
+func (rt *route) rewritePath(rw *config.RewriteConfig, path string) string {
+	switch {
+	case rw.StripPrefix != "":
+		path = stripPrefix(path, rw.StripPrefix)
+	case rw.ReplacePrefix != "":
+		if rest, ok := strings.CutPrefix(path, rt.config.Path); ok {
+			path = joinPath(rw.ReplacePrefix, rest)
+		}
+	case rt.rewriteRegex != nil:
+		path = rt.rewriteRegex.ReplaceAllString(path, rw.Replacement)
+	}
+
+	if rw.AddPrefix != "" {
+		path = joinPath(rw.AddPrefix, path)
+	}
+	return path
+}
+
+// stripPrefix removes prefix from path when it ends on a segment boundary,
+// so /api is stripped from /api/users but not from /apiv2
+func stripPrefix(path, prefix string) string {
+	rest, ok := strings.CutPrefix(path, prefix)
+	if !ok {
+		return path
+	}
+	if rest != "" && !strings.HasPrefix(rest, "/") && !strings.HasSuffix(prefix, "/") {
+		return path
+	}
+	if !strings.HasPrefix(rest, "/") {
+		rest = "/" + rest
+	}
+	return rest
+}
+
+// joinPath joins two URL paths with exactly one slash between them
+func joinPath(base, path string) string {
+	switch {
+	case base == "" || base == "/":
+		return path
+	case path == "":
+		return base
+	}
+	return strings.TrimSuffix(base, "/") + "/" + strings.TrimPrefix(path, "/")
+}
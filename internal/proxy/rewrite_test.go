@@ -0,0 +1,169 @@
+package proxy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/oabraham1/go-http-proxy/internal/config"
+)
+
+func TestPathRewriting(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(r.Host + " " + r.URL.RequestURI()))
+	}))
+	defer backend.Close()
+	backendHost := strings.TrimPrefix(backend.URL, "http://")
+
+	tests := []struct {
+		name     string
+		url      string
+		route    *config.RouteConfig
+		path     string
+		wantHost string
+		wantURI  string
+	}{
+		{
+			name:    "no routes forwards path verbatim",
+			url:     backend.URL,
+			path:    "/api/users?page=2",
+			wantURI: "/api/users?page=2",
+		},
+		{
+			name:    "service base path joined",
+			url:     backend.URL + "/v1/?key=abc",
+			path:    "/api/users?page=2",
+			wantURI: "/v1/api/users?key=abc&page=2",
+		},
+		{
+			name: "strip prefix",
+			url:  backend.URL,
+			route: &config.RouteConfig{Path: "/api/users", Rewrite: &config.RewriteConfig{
+				StripPrefix: "/api",
+			}},
+			path:    "/api/users/42",
+			wantURI: "/users/42",
+		},
+		{
+			name: "strip whole path",
+			url:  backend.URL + "/base",
+			route: &config.RouteConfig{Path: "/api", Rewrite: &config.RewriteConfig{
+				StripPrefix: "/api",
+			}},
+			path:    "/api",
+			wantURI: "/base/",
+		},
+		{
+			name: "strip prefix respects segments",
+			url:  backend.URL,
+			route: &config.RouteConfig{Path: "/api", Rewrite: &config.RewriteConfig{
+				StripPrefix: "/api",
+			}},
+			path:    "/apiv2/users",
+			wantURI: "/apiv2/users",
+		},
+		{
+			name: "replace prefix",
+			url:  backend.URL,
+			route: &config.RouteConfig{Path: "/api/v1", Rewrite: &config.RewriteConfig{
+				ReplacePrefix: "/internal/v2",
+			}},
+			path:    "/api/v1/users",
+			wantURI: "/internal/v2/users",
+		},
+		{
+			name: "add prefix",
+			url:  backend.URL + "/svc",
+			route: &config.RouteConfig{Path: "/users", Rewrite: &config.RewriteConfig{
+				AddPrefix: "/v3",
+			}},
+			path:    "/users/42",
+			wantURI: "/svc/v3/users/42",
+		},
+		{
+			name: "regex with capture groups",
+			url:  backend.URL,
+			route: &config.RouteConfig{Path: "/users", Rewrite: &config.RewriteConfig{
+				Regex:       `^/users/([0-9]+)/orders$`,
+				Replacement: "/orders/by-user/$1",
+			}},
+			path:    "/users/42/orders",
+			wantURI: "/orders/by-user/42",
+		},
+		{
+			name: "encoded slash preserved",
+			url:  backend.URL,
+			route: &config.RouteConfig{Path: "/files", Rewrite: &config.RewriteConfig{
+				StripPrefix: "/files",
+			}},
+			path:    "/files/a%2Fb",
+			wantURI: "/a%2Fb",
+		},
+		{
+			name: "upstream host header",
+			url:  backend.URL,
+			route: &config.RouteConfig{Path: "/api", Rewrite: &config.RewriteConfig{
+				HostHeader: "upstream",
+			}},
+			path:     "/api",
+			wantHost: backendHost,
+			wantURI:  "/api",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			svc := config.ServiceConfig{URL: tt.url}
+			if tt.route != nil {
+				svc.Routes = []config.RouteConfig{*tt.route}
+			}
+			cfg := &config.Config{Services: map[string]config.ServiceConfig{"api": svc}}
+
+			proxy, err := New(cfg)
+			if err != nil {
+				t.Fatalf("Failed to create proxy: %v", err)
+			}
+
+			req := httptest.NewRequest("GET", "http://client.example.com"+tt.path, nil)
+			rec := httptest.NewRecorder()
+			proxy.handler().ServeHTTP(rec, req)
+
+			wantHost := tt.wantHost
+			if wantHost == "" {
+				wantHost = "client.example.com"
+			}
+			want := wantHost + " " + tt.wantURI
+			if rec.Code != http.StatusOK || !strings.HasPrefix(rec.Body.String(), want) {
+				t.Errorf("Expected %q, got %d %q", want, rec.Code, rec.Body.String())
+			}
+		})
+	}
+}
+
+func TestRewriteInvalidConfig(t *testing.T) {
+	tests := []struct {
+		name  string
+		route config.RouteConfig
+	}{
+		{name: "exclusive rules", route: config.RouteConfig{Path: "/a", Rewrite: &config.RewriteConfig{StripPrefix: "/a", ReplacePrefix: "/b"}}},
+		{name: "replace on template", route: config.RouteConfig{Path: "/a/{id}", Rewrite: &config.RewriteConfig{ReplacePrefix: "/b"}}},
+		{name: "relative prefix", route: config.RouteConfig{Path: "/a", Rewrite: &config.RewriteConfig{AddPrefix: "b"}}},
+		{name: "invalid regex", route: config.RouteConfig{Path: "/a", Rewrite: &config.RewriteConfig{Regex: "(", Replacement: "/b"}}},
+		{name: "replacement without regex", route: config.RouteConfig{Path: "/a", Rewrite: &config.RewriteConfig{Replacement: "/b"}}},
+		{name: "unknown host policy", route: config.RouteConfig{Path: "/a", Rewrite: &config.RewriteConfig{HostHeader: "rewrite"}}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := &config.Config{
+				Services: map[string]config.ServiceConfig{
+					"api": {URL: "http://localhost:8081", Routes: []config.RouteConfig{tt.route}},
+				},
+			}
+			if _, err := New(cfg); err == nil {
+				t.Error("Expected error for invalid rewrite")
+			}
+		})
+	}
+}
@@ -0,0 +1,330 @@
+package proxy
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"regexp"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/gorilla/mux"
+	"golang.org/x/time/rate"
+
+	"github.com/oabraham1/go-http-proxy/internal/cache"
+	"github.com/oabraham1/go-http-proxy/internal/config"
+	"github.com/oabraham1/go-http-proxy/internal/grpc"
+	"github.com/oabraham1/go-http-proxy/internal/middleware"
+	"github.com/oabraham1/go-http-proxy/internal/retry"
+)
+
+// Path match types
+const (
+	pathPrefix = "prefix"
+	pathExact  = "exact"
+	pathRegex  = "regex"
+)
+
+// route is a compiled routing rule together with the settings used to
+// serve the requests it matches
+type route struct {
+	name    string
+	service string
+	config  config.RouteConfig
+	cfg     config.ServiceConfig // service config with the route's overrides applied
+
+	pathRegex    *regexp.Regexp
+	networks     []*net.IPNet
+	limiter      *middleware.RateLimitMiddleware
+	retry        *retry.Policy // the route's, or else its service's
+	cors         *middleware.CORSMiddleware
+	cache        *cache.Cache
+	rewriteRegex *regexp.Regexp
+	upstreamHost bool
+	trusted      trustedProxies
+	upgrades     atomic.Int64 // active upgraded connections
+}
+
+// buildRoutes compiles the routes of every service, ordered the way they
+// are matched
+func (p *Proxy) buildRoutes() error {
+	var routes []*route
+
+	for service, cfg := range p.cfg.Services {
+		var serviceLimiter *middleware.RateLimitMiddleware
+		if cfg.RateLimit != nil {
+			serviceLimiter = middleware.NewRateLimit(rate.Limit(cfg.RateLimit.Rate), cfg.RateLimit.Burst)
+		}
+
+		routeConfigs := cfg.Routes
+		if len(routeConfigs) == 0 {
+			routeConfigs = []config.RouteConfig{{Path: "/" + service}}
+		}
+
+		for i, rc := range routeConfigs {
+			rt, err := p.newRoute(service, cfg, rc)
+			if err != nil {
+				name := rc.Name
+				if name == "" {
+					name = fmt.Sprintf("#%d", i+1)
+				}
+				return fmt.Errorf("service %s route %s: %w", service, name, err)
+			}
+			if rt.limiter == nil {
+				rt.limiter = serviceLimiter
+			}
+			routes = append(routes, rt)
+		}
+	}
+
+	// Higher priority first, then the more specific path. Names and
+	// services keep the order stable across restarts.
+	sort.SliceStable(routes, func(i, j int) bool {
+		a, b := routes[i].config, routes[j].config
+		if a.Priority != b.Priority {
+			return a.Priority > b.Priority
+		}
+		if len(a.Path) != len(b.Path) {
+			return len(a.Path) > len(b.Path)
+		}
+		if routes[i].service != routes[j].service {
+			return routes[i].service < routes[j].service
+		}
+		return routes[i].name < routes[j].name
+	})
+
+	p.routes = routes
+	return nil
+}
+
+func (p *Proxy) newRoute(service string, cfg config.ServiceConfig, rc config.RouteConfig) (*route, error) {
+	// gRPC calls are POSTs to /pkg.Service/Method
+	if rc.GRPCService != "" {
+		if rc.Path != "" {
+			return nil, fmt.Errorf("path and grpcService are exclusive")
+		}
+		rc.Path, rc.PathType = "/"+rc.GRPCService+"/", pathPrefix
+		if rc.GRPCMethod != "" {
+			rc.Path, rc.PathType = rc.Path+rc.GRPCMethod, pathExact
+		}
+	} else if rc.GRPCMethod != "" {
+		return nil, fmt.Errorf("grpcMethod requires grpcService")
+	}
+
+	if rc.PathType == "" {
+		rc.PathType = pathPrefix
+	}
+	if rc.Path == "" {
+		rc.Path = "/"
+	}
+
+	rt := &route{
+		name:    rc.Name,
+		service: service,
+		config:  rc,
+		cfg:     cfg,
+		cache:   p.cache,
+		retry:   p.retries[service],
+		trusted: p.trusted,
+	}
+	if rt.name == "" {
+		rt.name = service + " " + rc.Path
+	}
+
+	switch rc.PathType {
+	case pathPrefix, pathExact:
+		if !strings.HasPrefix(rc.Path, "/") {
+			return nil, fmt.Errorf("path %q must start with /", rc.Path)
+		}
+	case pathRegex:
+		re, err := regexp.Compile(rc.Path)
+		if err != nil {
+			return nil, fmt.Errorf("invalid path regex: %w", err)
+		}
+		rt.pathRegex = re
+	default:
+		return nil, fmt.Errorf("unknown path type %q", rc.PathType)
+	}
+
+	for _, cidr := range rc.SourceCIDRs {
+		_, network, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, fmt.Errorf("invalid source CIDR: %w", err)
+		}
+		rt.networks = append(rt.networks, network)
+	}
+
+	if err := rt.compileRewrite(); err != nil {
+		return nil, err
+	}
+	if err := p.checkClientCertMode(rc.ClientCert); err != nil {
+		return nil, err
+	}
+
+	if rc.Timeout > 0 {
+		rt.cfg.Timeout = rc.Timeout
+	}
+	if rc.RateLimit != nil {
+		rt.limiter = middleware.NewRateLimit(rate.Limit(rc.RateLimit.Rate), rc.RateLimit.Burst)
+	}
+	if rc.Retry != nil {
+		policy, err := newRetryPolicy(rc.Retry)
+		if err != nil {
+			return nil, err
+		}
+		rt.cfg.Retry = rc.Retry
+		rt.retry = policy
+	}
+	if rc.Cache != nil && !*rc.Cache {
+		rt.cache = nil
+	} else if rc.Cache != nil && rt.cache == nil {
+		c, err := p.routeCache()
+		if err != nil {
+			return nil, fmt.Errorf("cache store: %w", err)
+		}
+		rt.cache = c
+	}
+	if rc.GRPCWeb && p.cfg.Security.CORS.Enabled {
+		rt.cors = middleware.NewCORS(p.grpcWebCORS())
+	}
+
+	// Let mux validate host and path templates up front
+	if err := rt.register(mux.NewRouter(), http.NotFoundHandler()).GetError(); err != nil {
+		return nil, err
+	}
+
+	return rt, nil
+}
+
+// routeCache returns the cache shared by routes that opt into caching
+// while the global cache is disabled
+func (p *Proxy) routeCache() (*cache.Cache, error) {
+	if p.routesCache == nil {
+		cc := p.cacheConfig
+		if cc.TTL <= 0 {
+			cc.TTL = 5 * time.Minute
+		}
+		store, err := newCacheStore(p.cfg.Cache)
+		if err != nil {
+			return nil, err
+		}
+		cc.Store = store
+		p.routesCache = cache.New(cc)
+	}
+	return p.routesCache, nil
+}
+
+// register adds the route's matchers to router
+func (rt *route) register(router *mux.Router, handler http.Handler) *mux.Route {
+	mr := router.NewRoute()
+	rc := rt.config
+
+	if rc.Host != "" {
+		if domain, ok := strings.CutPrefix(rc.Host, "*."); ok {
+			mr.MatcherFunc(func(r *http.Request, _ *mux.RouteMatch) bool {
+				return matchWildcardHost(r.Host, "."+domain)
+			})
+		} else {
+			mr.Host(rc.Host)
+		}
+	}
+
+	switch rc.PathType {
+	case pathPrefix:
+		mr.PathPrefix(rc.Path)
+	case pathExact:
+		mr.Path(rc.Path)
+	case pathRegex:
+		mr.MatcherFunc(func(r *http.Request, _ *mux.RouteMatch) bool {
+			return rt.pathRegex.MatchString(r.URL.Path)
+		})
+	}
+
+	if len(rc.Methods) > 0 {
+		mr.Methods(rc.Methods...)
+	}
+
+	if rc.GRPCService != "" {
+		mr.MatcherFunc(func(r *http.Request, _ *mux.RouteMatch) bool {
+			if isGRPCRequest(r) {
+				return true
+			}
+			return rc.GRPCWeb && (grpc.IsWeb(r.Header.Get("Content-Type")) || middleware.IsPreflight(r))
+		})
+	}
+
+	for name, value := range rc.Headers {
+		mr.Headers(name, value)
+	}
+
+	for name, value := range rc.Query {
+		name := name
+		if value == "" {
+			mr.MatcherFunc(func(r *http.Request, _ *mux.RouteMatch) bool {
+				return r.URL.Query().Has(name)
+			})
+			continue
+		}
+		mr.Queries(name, value)
+	}
+
+	if len(rt.networks) > 0 {
+		mr.MatcherFunc(func(r *http.Request, _ *mux.RouteMatch) bool {
+			return rt.matchSource(r)
+		})
+	}
+
+	return mr.Handler(handler)
+}
+
+// matchSource reports whether the client address lies in one of the
+// route's source networks
+func (rt *route) matchSource(r *http.Request) bool {
+	ip := rt.trusted.clientIP(r)
+	if ip == nil {
+		return false
+	}
+
+	for _, network := range rt.networks {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// matchWildcardHost reports whether host, ignoring any port, is a subdomain
+// of suffix (".example.com")
+func matchWildcardHost(host, suffix string) bool {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+
+	host = strings.ToLower(host)
+	suffix = strings.ToLower(suffix)
+	return len(host) > len(suffix) && strings.HasSuffix(host, suffix)
+}
+
+// tokenValidator defers to the validator installed with SetTokenValidator,
+// or else configured by Security.JWT. Until there is one every token is
+// rejected.
+type tokenValidator struct {
+	p *Proxy
+}
+
+func (v tokenValidator) ValidateToken(token string) bool {
+	v.p.mu.RLock()
+	validator := v.p.validator
+	v.p.mu.RUnlock()
+
+	return validator != nil && validator.ValidateToken(token)
+}
+
+// SetTokenValidator installs the validator used by routes that require auth
+func (p *Proxy) SetTokenValidator(validator middleware.TokenValidator) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.validator = validator
+}
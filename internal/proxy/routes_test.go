@@ -0,0 +1,238 @@
+package proxy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/oabraham1/go-http-proxy/internal/config"
+)
+
+type staticValidator string
+
+func (v staticValidator) ValidateToken(token string) bool {
+	return token == string(v)
+}
+
+func boolPtr(b bool) *bool {
+	return &b
+}
+
+func TestRouteMatching(t *testing.T) {
+	var servers []*httptest.Server
+	backend := func(name string) string {
+		server := newBackendServer(name, true)
+		servers = append(servers, server)
+		return server.URL
+	}
+	defer func() {
+		for _, server := range servers {
+			server.Close()
+		}
+	}()
+
+	cfg := &config.Config{
+		Services: map[string]config.ServiceConfig{
+			"users": {
+				URL: backend("users"),
+				Routes: []config.RouteConfig{
+					{Path: "/api/users/{id:[0-9]+}", PathType: "exact", Methods: []string{"GET", "PUT"}},
+					{Path: "/api/users", Methods: []string{"GET", "POST"}},
+				},
+			},
+			"users-beta": {
+				URL: backend("users-beta"),
+				Routes: []config.RouteConfig{
+					{Path: "/api/users", Headers: map[string]string{"X-Beta": "1"}, Priority: 10},
+					{Path: "/api/users", Query: map[string]string{"beta": ""}, Priority: 10},
+				},
+			},
+			"tenants": {
+				URL: backend("tenants"),
+				Routes: []config.RouteConfig{
+					{Host: "*.tenants.example.com", Path: "/"},
+				},
+			},
+			"reports": {
+				URL: backend("reports"),
+				Routes: []config.RouteConfig{
+					{Path: `^/reports/[a-z]+\.csv$`, PathType: "regex"},
+				},
+			},
+			"admin": {
+				URL: backend("admin"),
+				Routes: []config.RouteConfig{
+					{Path: "/admin", SourceCIDRs: []string{"10.0.0.0/8"}},
+				},
+			},
+			"legacy": {
+				URL: backend("legacy"),
+			},
+		},
+	}
+
+	proxy, err := New(cfg)
+	if err != nil {
+		t.Fatalf("Failed to create proxy: %v", err)
+	}
+	handler := proxy.handler()
+
+	tests := []struct {
+		name       string
+		method     string
+		host       string
+		path       string
+		header     map[string]string
+		remoteAddr string
+		wantStatus int
+		wantBody   string
+	}{
+		{name: "template path", method: "GET", path: "/api/users/42", wantStatus: 200, wantBody: "users"},
+		{name: "template constraint", method: "GET", path: "/api/users/abc", wantStatus: 200, wantBody: "users"},
+		{name: "method mismatch", method: "DELETE", path: "/api/users", wantStatus: 405},
+		{name: "prefix path", method: "POST", path: "/api/users", wantStatus: 200, wantBody: "users"},
+		{name: "header match wins by priority", method: "GET", path: "/api/users", header: map[string]string{"X-Beta": "1"}, wantStatus: 200, wantBody: "users-beta"},
+		{name: "header value mismatch", method: "GET", path: "/api/users", header: map[string]string{"X-Beta": "2"}, wantStatus: 200, wantBody: "users"},
+		{name: "query presence", method: "GET", path: "/api/users?beta", wantStatus: 200, wantBody: "users-beta"},
+		{name: "wildcard host", method: "GET", host: "acme.tenants.example.com:8080", path: "/dashboard", wantStatus: 200, wantBody: "tenants"},
+		{name: "wildcard host needs subdomain", method: "GET", host: "tenants.example.com", path: "/dashboard", wantStatus: 404},
+		{name: "regex path", method: "GET", path: "/reports/sales.csv", wantStatus: 200, wantBody: "reports"},
+		{name: "regex path mismatch", method: "GET", path: "/reports/sales.pdf", wantStatus: 404},
+		{name: "source CIDR", method: "GET", path: "/admin", remoteAddr: "10.1.2.3:5000", wantStatus: 200, wantBody: "admin"},
+		{name: "source CIDR mismatch", method: "GET", path: "/admin", remoteAddr: "192.168.1.1:5000", wantStatus: 404},
+		{name: "service without routes", method: "GET", path: "/legacy/items", wantStatus: 200, wantBody: "legacy"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(tt.method, "http://proxy.local"+tt.path, nil)
+			if tt.host != "" {
+				req.Host = tt.host
+			}
+			if tt.remoteAddr != "" {
+				req.RemoteAddr = tt.remoteAddr
+			}
+			for k, v := range tt.header {
+				req.Header.Set(k, v)
+			}
+
+			rec := httptest.NewRecorder()
+			handler.ServeHTTP(rec, req)
+
+			if rec.Code != tt.wantStatus {
+				t.Errorf("Expected status %d, got %d", tt.wantStatus, rec.Code)
+			}
+			if tt.wantBody != "" && !strings.HasPrefix(rec.Body.String(), tt.wantBody) {
+				t.Errorf("Expected body %q, got %q", tt.wantBody, rec.Body.String())
+			}
+		})
+	}
+}
+
+func TestRouteOverrides(t *testing.T) {
+	var hits atomic.Int64
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hits.Add(1)
+		if r.URL.Path == "/slow" {
+			time.Sleep(200 * time.Millisecond)
+		}
+		w.Write([]byte("ok"))
+	}))
+	defer backend.Close()
+
+	cfg := &config.Config{
+		Services: map[string]config.ServiceConfig{
+			"api": {
+				URL: backend.URL,
+				Routes: []config.RouteConfig{
+					{Path: "/private", Auth: true},
+					{Path: "/cached", Cache: boolPtr(true)},
+					{Path: "/slow", Timeout: 50 * time.Millisecond},
+					{Path: "/limited", RateLimit: &config.RateLimitConfig{Rate: 0.001, Burst: 1}},
+				},
+			},
+		},
+	}
+
+	proxy, err := New(cfg)
+	if err != nil {
+		t.Fatalf("Failed to create proxy: %v", err)
+	}
+	proxy.SetTokenValidator(staticValidator("secret"))
+	handler := proxy.handler()
+
+	do := func(path, token string) int {
+		req := httptest.NewRequest("GET", "http://proxy.local"+path, nil)
+		if token != "" {
+			req.Header.Set("Authorization", token)
+		}
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		return rec.Code
+	}
+
+	t.Run("auth", func(t *testing.T) {
+		if code := do("/private", ""); code != http.StatusUnauthorized {
+			t.Errorf("Expected 401 without token, got %d", code)
+		}
+		if code := do("/private", "wrong"); code != http.StatusForbidden {
+			t.Errorf("Expected 403 with invalid token, got %d", code)
+		}
+		if code := do("/private", "secret"); code != http.StatusOK {
+			t.Errorf("Expected 200 with valid token, got %d", code)
+		}
+	})
+
+	t.Run("cache", func(t *testing.T) {
+		before := hits.Load()
+		do("/cached", "")
+		do("/cached", "")
+		if got := hits.Load() - before; got != 1 {
+			t.Errorf("Expected 1 upstream request, got %d", got)
+		}
+	})
+
+	t.Run("timeout", func(t *testing.T) {
+		if code := do("/slow", ""); code == http.StatusOK {
+			t.Error("Expected route timeout to fail the request")
+		}
+	})
+
+	t.Run("rate limit", func(t *testing.T) {
+		if code := do("/limited", ""); code != http.StatusOK {
+			t.Errorf("Expected first request to pass, got %d", code)
+		}
+		if code := do("/limited", ""); code != http.StatusTooManyRequests {
+			t.Errorf("Expected 429, got %d", code)
+		}
+	})
+}
+
+func TestRouteInvalidConfig(t *testing.T) {
+	tests := []struct {
+		name  string
+		route config.RouteConfig
+	}{
+		{name: "unknown path type", route: config.RouteConfig{Path: "/a", PathType: "glob"}},
+		{name: "invalid regex", route: config.RouteConfig{Path: "(", PathType: "regex"}},
+		{name: "relative path", route: config.RouteConfig{Path: "a"}},
+		{name: "invalid CIDR", route: config.RouteConfig{Path: "/a", SourceCIDRs: []string{"10.0.0.0/33"}}},
+		{name: "invalid template", route: config.RouteConfig{Path: "/a/{id", PathType: "exact"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := &config.Config{
+				Services: map[string]config.ServiceConfig{
+					"api": {URL: "http://localhost:8081", Routes: []config.RouteConfig{tt.route}},
+				},
+			}
+			if _, err := New(cfg); err == nil {
+				t.Error("Expected error for invalid route")
+			}
+		})
+	}
+}
@@ -2,7 +2,6 @@ package proxy
 
 import (
 	"crypto/tls"
-	"fmt"
 	"net/http"
 	"net/http/httptest"
 	"testing"
@@ -12,33 +11,35 @@ import (
 	"github.com/oabraham1/go-http-proxy/internal/config"
 )
 
-// Helper function to setup a secure proxy for testing
-func setupSecureProxy(securityConfig config.SecurityConfig) *Proxy {
+// Helper function to setup a secure proxy for testing, in front of a
+// backend answering 200
+func setupSecureProxy(t *testing.T, configure func(*config.Config)) *Proxy {
+	t.Helper()
+
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok"))
+	}))
+	t.Cleanup(backend.Close)
+
 	cfg := &config.Config{
-		Server: struct {
-			Port           int           `yaml:"port"`
-			ReadTimeout    time.Duration `yaml:"readTimeout"`
-			WriteTimeout   time.Duration `yaml:"writeTimeout"`
-			MaxHeaderBytes int           `yaml:"maxHeaderBytes"`
-		}{
-			Port:           8080,
-			ReadTimeout:    5 * time.Second,
-			WriteTimeout:   5 * time.Second,
-			MaxHeaderBytes: 1 << 20,
-		},
 		Services: map[string]config.ServiceConfig{
 			"test": {
-				URL: "http://localhost:8081",
+				URL:    backend.URL,
+				Routes: []config.RouteConfig{{Path: "/"}},
 			},
 		},
 	}
+	cfg.Server.Port = 8080
+	cfg.Server.ReadTimeout = 5 * time.Second
+	cfg.Server.WriteTimeout = 5 * time.Second
+	cfg.Server.MaxHeaderBytes = 1 << 20
 
 	// Add security configuration
-	cfg.Security = securityConfig
+	configure(cfg)
 
 	proxy, err := New(cfg)
 	if err != nil {
-		panic(fmt.Sprintf("Failed to create proxy: %v", err))
+		t.Fatalf("Failed to create proxy: %v", err)
 	}
 
 	return proxy
@@ -79,86 +80,22 @@ func generateExpiredJWT(t *testing.T, secret string) string {
 func TestSecurityHeaders(t *testing.T) {
 	tests := []struct {
 		name        string
-		config      config.SecurityConfig
-		wantHeaders map[string]string
-	}{
-		{
-			name: "default security headers",
-			config: config.SecurityConfig{
-				Headers: config.SecurityHeaders{
-					Enabled: true,
-				},
-			},
-			wantHeaders: map[string]string{
-				"X-Frame-Options":           "DENY",
-				"X-Content-Type-Options":    "nosniff",
-				"X-XSS-Protection":          "1; mode=block",
-				"Strict-Transport-Security": "max-age=31536000; includeSubDomains",
-			},
-		},
-		{
-			name: "custom CSP header",
-			config: config.SecurityConfig{
-				Headers: config.SecurityHeaders{
-					Enabled: true,
-					CSP:     "default-src 'self'; script-src 'self' 'unsafe-inline'",
-				},
-			},
-			wantHeaders: map[string]string{
-				"Content-Security-Policy": "default-src 'self'; script-src 'self' 'unsafe-inline'",
-			},
-		},
-	}
-
-	for _, tt := range tests {
-		t.Run(tt.name, func(t *testing.T) {
-			proxy := setupSecureProxy(tt.config)
-			server := httptest.NewServer(proxy.handler())
-			defer server.Close()
-
-			resp, err := http.Get(server.URL)
-			if err != nil {
-				t.Fatalf("Failed to make request: %v", err)
-			}
-			defer resp.Body.Close()
-
-			for header, want := range tt.wantHeaders {
-				if got := resp.Header.Get(header); got != want {
-					t.Errorf("header %s = %q; want %q", header, got, want)
-				}
-			}
-		})
-	}
-}
-
-func TestSecurityHeaders(t *testing.T) {
-	tests := []struct {
-		name        string
-		config      config.SecurityConfig
+		csp         string
 		wantHeaders map[string]string
 	}{
 		{
 			name: "default security headers",
-			config: config.SecurityConfig{
-				Headers: config.SecurityHeaders{
-					Enabled: true,
-				},
-			},
 			wantHeaders: map[string]string{
 				"X-Frame-Options":           "DENY",
 				"X-Content-Type-Options":    "nosniff",
 				"X-XSS-Protection":          "1; mode=block",
 				"Strict-Transport-Security": "max-age=31536000; includeSubDomains",
+				"Content-Security-Policy":   "",
 			},
 		},
 		{
 			name: "custom CSP header",
-			config: config.SecurityConfig{
-				Headers: config.SecurityHeaders{
-					Enabled: true,
-					CSP:     "default-src 'self'; script-src 'self' 'unsafe-inline'",
-				},
-			},
+			csp:  "default-src 'self'; script-src 'self' 'unsafe-inline'",
 			wantHeaders: map[string]string{
 				"Content-Security-Policy": "default-src 'self'; script-src 'self' 'unsafe-inline'",
 			},
@@ -167,7 +104,10 @@ func TestSecurityHeaders(t *testing.T) {
 
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			proxy := setupSecureProxy(tt.config)
+			proxy := setupSecureProxy(t, func(cfg *config.Config) {
+				cfg.Security.Headers.Enabled = true
+				cfg.Security.Headers.CSP = tt.csp
+			})
 			server := httptest.NewServer(proxy.handler())
 			defer server.Close()
 
@@ -187,15 +127,11 @@ func TestSecurityHeaders(t *testing.T) {
 }
 
 func TestRateLimiting(t *testing.T) {
-	config := config.SecurityConfig{
-		RateLimit: config.RateLimitConfig{
-			Enabled: true,
-			Rate:    2,
-			Burst:   1,
-		},
-	}
-
-	proxy := setupSecureProxy(config)
+	proxy := setupSecureProxy(t, func(cfg *config.Config) {
+		cfg.RateLimit.Enabled = true
+		cfg.RateLimit.Rate = 1
+		cfg.RateLimit.Burst = 2
+	})
 	server := httptest.NewServer(proxy.handler())
 	defer server.Close()
 
@@ -207,6 +143,7 @@ func TestRateLimiting(t *testing.T) {
 		if err != nil {
 			t.Fatalf("Request %d failed: %v", i, err)
 		}
+		resp.Body.Close()
 		if resp.StatusCode != http.StatusOK {
 			t.Errorf("Request %d: got status %d; want %d", i, resp.StatusCode, http.StatusOK)
 		}
@@ -217,22 +154,19 @@ func TestRateLimiting(t *testing.T) {
 	if err != nil {
 		t.Fatalf("Rate limited request failed: %v", err)
 	}
+	resp.Body.Close()
 	if resp.StatusCode != http.StatusTooManyRequests {
 		t.Errorf("Rate limit: got status %d; want %d", resp.StatusCode, http.StatusTooManyRequests)
 	}
 }
 
 func TestJWTAuthentication(t *testing.T) {
-	config := config.SecurityConfig{
-		Auth: config.AuthConfig{
-			Type: "jwt",
-			JWT: config.JWTConfig{
-				Secret: "test-secret",
-			},
-		},
-	}
-
-	proxy := setupSecureProxy(config)
+	proxy := setupSecureProxy(t, func(cfg *config.Config) {
+		cfg.Security.JWT = &config.JWTConfig{Secret: "test-secret"}
+		service := cfg.Services["test"]
+		service.Routes[0].Auth = true
+		cfg.Services["test"] = service
+	})
 	server := httptest.NewServer(proxy.handler())
 	defer server.Close()
 
@@ -249,7 +183,7 @@ func TestJWTAuthentication(t *testing.T) {
 		{
 			name:       "invalid token",
 			token:      "invalid.token.here",
-			wantStatus: http.StatusUnauthorized,
+			wantStatus: http.StatusForbidden,
 		},
 		{
 			name:       "valid token",
@@ -259,7 +193,12 @@ func TestJWTAuthentication(t *testing.T) {
 		{
 			name:       "expired token",
 			token:      generateExpiredJWT(t, "test-secret"),
-			wantStatus: http.StatusUnauthorized,
+			wantStatus: http.StatusForbidden,
+		},
+		{
+			name:       "wrong secret",
+			token:      generateValidJWT(t, "other-secret"),
+			wantStatus: http.StatusForbidden,
 		},
 	}
 
@@ -274,6 +213,7 @@ func TestJWTAuthentication(t *testing.T) {
 			if err != nil {
 				t.Fatalf("Request failed: %v", err)
 			}
+			resp.Body.Close()
 
 			if resp.StatusCode != tt.wantStatus {
 				t.Errorf("got status %d; want %d", resp.StatusCode, tt.wantStatus)
@@ -283,18 +223,25 @@ func TestJWTAuthentication(t *testing.T) {
 }
 
 func TestTLSConfiguration(t *testing.T) {
-	config := config.SecurityConfig{
-		TLS: config.TLSConfig{
-			MinVersion: "1.2",
-			CipherSuites: []string{
-				"TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256",
-				"TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256",
-			},
+	certFile, keyFile := writeTestCert(t)
+	tlsConfig, _, err := configureTLS(&config.TLSConfig{
+		Enabled:    true,
+		CertFile:   certFile,
+		KeyFile:    keyFile,
+		MinVersion: "1.2",
+		CipherSuites: []string{
+			"TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256",
+			"TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256",
 		},
+	})
+	if err != nil {
+		t.Fatalf("Failed to configure TLS: %v", err)
 	}
 
-	proxy := setupSecureProxy(config)
-	server := httptest.NewTLSServer(proxy.handler())
+	proxy := setupSecureProxy(t, func(*config.Config) {})
+	server := httptest.NewUnstartedServer(proxy.handler())
+	server.TLS = tlsConfig
+	server.StartTLS()
 	defer server.Close()
 
 	tests := []struct {
@@ -305,15 +252,26 @@ func TestTLSConfiguration(t *testing.T) {
 		{
 			name: "modern TLS config",
 			tlsConfig: &tls.Config{
-				MinVersion: tls.VersionTLS12,
+				MinVersion:         tls.VersionTLS12,
+				InsecureSkipVerify: true,
 			},
 			wantError: false,
 		},
 		{
 			name: "old TLS version",
 			tlsConfig: &tls.Config{
-				MinVersion: tls.VersionTLS10,
-				MaxVersion: tls.VersionTLS10,
+				MinVersion:         tls.VersionTLS10,
+				MaxVersion:         tls.VersionTLS11,
+				InsecureSkipVerify: true,
+			},
+			wantError: true,
+		},
+		{
+			name: "suite not offered",
+			tlsConfig: &tls.Config{
+				MaxVersion:         tls.VersionTLS12,
+				CipherSuites:       []uint16{tls.TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384},
+				InsecureSkipVerify: true,
 			},
 			wantError: true,
 		},
@@ -327,7 +285,10 @@ func TestTLSConfiguration(t *testing.T) {
 				},
 			}
 
-			_, err := client.Get(server.URL)
+			resp, err := client.Get(server.URL)
+			if err == nil {
+				resp.Body.Close()
+			}
 			if (err != nil) != tt.wantError {
 				t.Errorf("got error %v; wantError %v", err, tt.wantError)
 			}
@@ -0,0 +1,211 @@
+package proxy
+
+import (
+	"bytes"
+	"io"
+	"mime"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// streamBufferSize is the size of the buffer used to relay response bodies
+	streamBufferSize = 32 * 1024
+	// maxCachedBodyBytes bounds the response bodies kept for the cache while
+	// they stream to the client
+	maxCachedBodyBytes = 10 << 20
+)
+
+// writeResponse relays a response to the client. Bodies are streamed, and
+// flushed according to flushInterval: negative flushes after every write,
+// zero leaves flushing to the server, and anything else bounds how long
+// written data may wait. Event streams and bodies of unknown length are
+// always flushed immediately. Trailers are forwarded once the body is done.
+func (p *Proxy) writeResponse(w http.ResponseWriter, resp *http.Response, flushInterval time.Duration) error {
+	for k, vv := range resp.Header {
+		for _, v := range vv {
+			w.Header().Add(k, v)
+		}
+	}
+
+	announced := len(resp.Trailer)
+	if announced > 0 {
+		names := make([]string, 0, announced)
+		for name := range resp.Trailer {
+			names = append(names, name)
+		}
+		w.Header().Set("Trailer", strings.Join(names, ", "))
+	}
+
+	w.WriteHeader(resp.StatusCode)
+
+	// Flushing before the body forces chunking, which trailers need
+	if announced > 0 {
+		http.NewResponseController(w).Flush()
+	}
+
+	var err error
+	if resp.Body != nil {
+		err = copyBody(w, resp.Body, streamFlushInterval(resp, flushInterval))
+	}
+
+	// Trailers are only known once the body has been read. Any not announced
+	// up front must be sent with the trailer prefix.
+	if len(resp.Trailer) == announced {
+		for k, vv := range resp.Trailer {
+			w.Header()[k] = vv
+		}
+	} else {
+		for k, vv := range resp.Trailer {
+			for _, v := range vv {
+				w.Header().Add(http.TrailerPrefix+k, v)
+			}
+		}
+	}
+
+	return err
+}
+
+// streamFlushInterval picks the flush interval for a response
+func streamFlushInterval(resp *http.Response, configured time.Duration) time.Duration {
+	if isEventStream(resp) {
+		return -1
+	}
+	if resp.ContentLength == -1 {
+		return -1
+	}
+	return configured
+}
+
+func isEventStream(resp *http.Response) bool {
+	mediaType, _, _ := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+	return mediaType == "text/event-stream"
+}
+
+func copyBody(w http.ResponseWriter, body io.Reader, flushInterval time.Duration) error {
+	var dst io.Writer = w
+	if flushInterval != 0 {
+		fw := &flushWriter{
+			w:          w,
+			controller: http.NewResponseController(w),
+			interval:   flushInterval,
+		}
+		defer fw.stop()
+		dst = fw
+	}
+
+	buf := make([]byte, streamBufferSize)
+	for {
+		n, readErr := body.Read(buf)
+		if n > 0 {
+			if _, err := dst.Write(buf[:n]); err != nil {
+				return err
+			}
+		}
+		if readErr == io.EOF {
+			return nil
+		}
+		if readErr != nil {
+			return readErr
+		}
+	}
+}
+
+// flushWriter flushes data written to the client either immediately or at
+// most interval after it was written
+type flushWriter struct {
+	w          io.Writer
+	controller *http.ResponseController
+	interval   time.Duration
+
+	mu      sync.Mutex
+	timer   *time.Timer
+	pending bool
+}
+
+func (fw *flushWriter) Write(b []byte) (int, error) {
+	fw.mu.Lock()
+	defer fw.mu.Unlock()
+
+	n, err := fw.w.Write(b)
+	if err != nil {
+		return n, err
+	}
+
+	if fw.interval < 0 {
+		fw.controller.Flush()
+		return n, nil
+	}
+
+	if !fw.pending {
+		fw.pending = true
+		if fw.timer == nil {
+			fw.timer = time.AfterFunc(fw.interval, fw.delayedFlush)
+		} else {
+			fw.timer.Reset(fw.interval)
+		}
+	}
+	return n, nil
+}
+
+func (fw *flushWriter) delayedFlush() {
+	fw.mu.Lock()
+	defer fw.mu.Unlock()
+
+	if fw.pending {
+		fw.controller.Flush()
+		fw.pending = false
+	}
+}
+
+func (fw *flushWriter) stop() {
+	fw.mu.Lock()
+	defer fw.mu.Unlock()
+
+	fw.pending = false
+	if fw.timer != nil {
+		fw.timer.Stop()
+	}
+}
+
+// captureBody keeps a copy of a response body as it streams to the client
+// so the response can be cached afterwards. Bodies larger than limit are
+// not kept.
+type captureBody struct {
+	io.ReadCloser
+	buf      bytes.Buffer
+	limit    int
+	overflow bool
+	complete bool
+}
+
+func (c *captureBody) Read(b []byte) (int, error) {
+	n, err := c.ReadCloser.Read(b)
+	if !c.overflow {
+		if c.buf.Len()+n > c.limit {
+			c.overflow = true
+			c.buf = bytes.Buffer{}
+		} else {
+			c.buf.Write(b[:n])
+		}
+	}
+	if err == io.EOF {
+		c.complete = true
+	}
+	return n, err
+}
+
+// cachedResponse returns a copy of resp carrying the captured body, or nil
+// when the body wasn't captured in full
+func (c *captureBody) cachedResponse(resp *http.Response) *http.Response {
+	if !c.complete || c.overflow {
+		return nil
+	}
+
+	cached := *resp
+	cached.Body = io.NopCloser(bytes.NewReader(c.buf.Bytes()))
+	cached.ContentLength = int64(c.buf.Len())
+	return &cached
+}
@@ -0,0 +1,205 @@
+package proxy
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/oabraham1/go-http-proxy/internal/config"
+)
+
+func TestStreamingResponses(t *testing.T) {
+	release := make(chan struct{})
+	defer close(release)
+
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/api/events":
+			w.Header().Set("Content-Type", "text/event-stream")
+			w.Write([]byte("data: first\n\n"))
+		case "/api/download":
+			// Known length, so only the route's flush interval pushes it out
+			w.Header().Set("Content-Length", "10")
+			w.Write([]byte("part1"))
+		case "/api/trailers":
+			w.Header().Set("Trailer", "X-Checksum")
+			w.Write([]byte("body"))
+			w.Header().Set("X-Checksum", "abc123")
+			return
+		}
+
+		w.(http.Flusher).Flush()
+		select {
+		case <-release:
+		case <-r.Context().Done():
+			return
+		}
+		w.Write([]byte("part2"))
+	}))
+	defer backend.Close()
+
+	cfg := &config.Config{
+		Services: map[string]config.ServiceConfig{
+			"api": {
+				URL: backend.URL,
+				Routes: []config.RouteConfig{
+					{Path: "/api/download", FlushInterval: 10 * time.Millisecond},
+					{Path: "/api"},
+				},
+			},
+		},
+	}
+	proxy, err := New(cfg)
+	if err != nil {
+		t.Fatalf("Failed to create proxy: %v", err)
+	}
+	server := httptest.NewServer(proxy.handler())
+	defer server.Close()
+
+	readWithin := func(t *testing.T, r io.Reader, want string) {
+		t.Helper()
+		got := make(chan string, 1)
+		go func() {
+			buf := make([]byte, len(want))
+			io.ReadFull(r, buf)
+			got <- string(buf)
+		}()
+
+		select {
+		case s := <-got:
+			if s != want {
+				t.Errorf("Expected %q, got %q", want, s)
+			}
+		case <-time.After(2 * time.Second):
+			t.Errorf("Timed out waiting for %q, response was buffered", want)
+		}
+	}
+
+	t.Run("event stream flushed immediately", func(t *testing.T) {
+		resp, err := http.Get(server.URL + "/api/events")
+		if err != nil {
+			t.Fatalf("Request failed: %v", err)
+		}
+		defer resp.Body.Close()
+
+		readWithin(t, bufio.NewReader(resp.Body), "data: first\n\n")
+	})
+
+	t.Run("route flush interval", func(t *testing.T) {
+		resp, err := http.Get(server.URL + "/api/download")
+		if err != nil {
+			t.Fatalf("Request failed: %v", err)
+		}
+		defer resp.Body.Close()
+
+		readWithin(t, resp.Body, "part1")
+	})
+
+	t.Run("trailers forwarded", func(t *testing.T) {
+		resp, err := http.Get(server.URL + "/api/trailers")
+		if err != nil {
+			t.Fatalf("Request failed: %v", err)
+		}
+		defer resp.Body.Close()
+
+		body, _ := io.ReadAll(resp.Body)
+		if !strings.HasPrefix(string(body), "body") {
+			t.Errorf("Expected body %q, got %q", "body", body)
+		}
+		if got := resp.Trailer.Get("X-Checksum"); got != "abc123" {
+			t.Errorf("Expected trailer X-Checksum %q, got %q", "abc123", got)
+		}
+	})
+}
+
+func TestResponseTimeout(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/api/slow" {
+			time.Sleep(200 * time.Millisecond)
+		}
+		w.Header().Set("Content-Type", "text/event-stream")
+		for i := 0; i < 4; i++ {
+			w.Write([]byte("data: tick\n\n"))
+			w.(http.Flusher).Flush()
+			time.Sleep(50 * time.Millisecond)
+		}
+	}))
+	defer backend.Close()
+
+	cfg := &config.Config{
+		Services: map[string]config.ServiceConfig{
+			"api": {URL: backend.URL},
+		},
+	}
+	cfg.Proxy.ResponseTimeout = 100 * time.Millisecond
+	proxy, err := New(cfg)
+	if err != nil {
+		t.Fatalf("Failed to create proxy: %v", err)
+	}
+	server := httptest.NewServer(proxy.handler())
+	defer server.Close()
+
+	// The stream runs for about twice the timeout once its headers arrive
+	resp, err := http.Get(server.URL + "/api/events")
+	if err != nil {
+		t.Fatalf("Request failed: %v", err)
+	}
+	body, err := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil || strings.Count(string(body), "data: tick") != 4 {
+		t.Errorf("Expected the whole stream, got %q, %v", body, err)
+	}
+
+	// Headers later than the timeout fail the request
+	resp, err = http.Get(server.URL + "/api/slow")
+	if err != nil {
+		t.Fatalf("Request failed: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusGatewayTimeout {
+		t.Errorf("Expected 504 for late headers, got %d", resp.StatusCode)
+	}
+}
+
+func TestCaptureBody(t *testing.T) {
+	tests := []struct {
+		name       string
+		body       string
+		limit      int
+		readAll    bool
+		wantCached bool
+	}{
+		{name: "small body captured", body: "hello", limit: 10, readAll: true, wantCached: true},
+		{name: "body over limit", body: "hello world", limit: 5, readAll: true, wantCached: false},
+		{name: "body not fully read", body: "hello", limit: 10, readAll: false, wantCached: false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resp := &http.Response{StatusCode: http.StatusOK, Header: make(http.Header)}
+			capture := &captureBody{ReadCloser: io.NopCloser(strings.NewReader(tt.body)), limit: tt.limit}
+
+			if tt.readAll {
+				io.Copy(io.Discard, capture)
+			} else {
+				capture.Read(make([]byte, 2))
+			}
+
+			cached := capture.cachedResponse(resp)
+			if (cached != nil) != tt.wantCached {
+				t.Fatalf("Expected cached=%v, got %v", tt.wantCached, cached != nil)
+			}
+			if cached != nil {
+				body, _ := io.ReadAll(cached.Body)
+				if !bytes.Equal(body, []byte(tt.body)) || cached.ContentLength != int64(len(tt.body)) {
+					t.Errorf("Expected cached body %q, got %q (%d)", tt.body, body, cached.ContentLength)
+				}
+			}
+		})
+	}
+}
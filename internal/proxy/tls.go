@@ -0,0 +1,318 @@
+package proxy
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/oabraham1/go-http-proxy/internal/acme"
+	"github.com/oabraham1/go-http-proxy/internal/certs"
+	"github.com/oabraham1/go-http-proxy/internal/config"
+)
+
+// ALPN protocols the server can speak over TLS
+const (
+	alpnH2     = "h2"
+	alpnHTTP11 = "http/1.1"
+)
+
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+var tlsCurves = map[string]tls.CurveID{
+	"X25519": tls.X25519,
+	"P-256":  tls.CurveP256,
+	"P-384":  tls.CurveP384,
+	"P-521":  tls.CurveP521,
+}
+
+// configureTLS builds the server's TLS settings, loading its certificates
+// and rejecting anything the standard library wouldn't honour
+func configureTLS(cfg *config.TLSConfig) (*tls.Config, *certs.Store, error) {
+	minVersion, err := parseVersion(cfg.MinVersion, tls.VersionTLS12)
+	if err != nil {
+		return nil, nil, fmt.Errorf("minVersion: %w", err)
+	}
+	maxVersion, err := parseVersion(cfg.MaxVersion, 0)
+	if err != nil {
+		return nil, nil, fmt.Errorf("maxVersion: %w", err)
+	}
+	if maxVersion != 0 && maxVersion < minVersion {
+		return nil, nil, fmt.Errorf("maxVersion %s is below minVersion %s", cfg.MaxVersion, cfg.MinVersion)
+	}
+
+	cipherSuites, err := parseCipherSuites(cfg.CipherSuites)
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(cipherSuites) > 0 && minVersion == tls.VersionTLS13 {
+		return nil, nil, fmt.Errorf("cipherSuites have no effect when minVersion is 1.3")
+	}
+
+	curves, err := parseCurves(cfg.Curves)
+	if err != nil {
+		return nil, nil, err
+	}
+	alpn, err := parseALPN(cfg.ALPN)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	tlsConfig := &tls.Config{
+		MinVersion:       minVersion,
+		MaxVersion:       maxVersion,
+		CipherSuites:     cipherSuites,
+		CurvePreferences: curves,
+		NextProtos:       alpn,
+	}
+
+	// ACME can stand in for certificate files
+	certsCfg := certsConfig(cfg)
+	if len(certsCfg.Pairs) == 0 && certsCfg.Dir == "" && cfg.ACME != nil && cfg.ACME.Enabled {
+		return tlsConfig, nil, nil
+	}
+
+	store, err := certs.New(certsCfg)
+	if err != nil {
+		return nil, nil, err
+	}
+	tlsConfig.GetCertificate = store.GetCertificate
+	return tlsConfig, store, nil
+}
+
+// certsConfig lists the certificate sources of a TLS config, the main
+// certificate first so it's the default
+func certsConfig(cfg *config.TLSConfig) certs.Config {
+	var pairs []certs.Pair
+	if cfg.CertFile != "" || cfg.KeyFile != "" {
+		pairs = append(pairs, certs.Pair{CertFile: cfg.CertFile, KeyFile: cfg.KeyFile})
+	}
+	for _, c := range cfg.Certificates {
+		pairs = append(pairs, certs.Pair{CertFile: c.CertFile, KeyFile: c.KeyFile})
+	}
+
+	return certs.Config{
+		Pairs:          pairs,
+		Dir:            cfg.CertDir,
+		ReloadInterval: cfg.ReloadInterval,
+		ExpiryWarning:  cfg.ExpiryWarning,
+		OCSPStapling:   cfg.OCSPStapling,
+	}
+}
+
+// parseVersion turns a version such as "1.2" into its TLS constant. An
+// empty version is def.
+func parseVersion(version string, def uint16) (uint16, error) {
+	if version == "" {
+		return def, nil
+	}
+	v, ok := tlsVersions[version]
+	if !ok {
+		return 0, fmt.Errorf("unknown TLS version %q, expected 1.0, 1.1, 1.2 or 1.3", version)
+	}
+	return v, nil
+}
+
+// parseCipherSuites maps Go's cipher suite names to their IDs. Only the
+// suites tls.CipherSuites reports as secure are accepted.
+func parseCipherSuites(ciphers []string) ([]uint16, error) {
+	if len(ciphers) == 0 {
+		return nil, nil
+	}
+
+	secure := make(map[string]*tls.CipherSuite)
+	for _, suite := range tls.CipherSuites() {
+		secure[suite.Name] = suite
+	}
+	insecure := make(map[string]bool)
+	for _, suite := range tls.InsecureCipherSuites() {
+		insecure[suite.Name] = true
+	}
+
+	ids := make([]uint16, 0, len(ciphers))
+	for _, name := range ciphers {
+		suite, ok := secure[name]
+		switch {
+		case insecure[name]:
+			return nil, fmt.Errorf("cipher suite %s is insecure", name)
+		case !ok:
+			return nil, fmt.Errorf("unknown cipher suite %q", name)
+		case len(suite.SupportedVersions) == 1 && suite.SupportedVersions[0] == tls.VersionTLS13:
+			return nil, fmt.Errorf("cipher suite %s is a TLS 1.3 suite, which can't be configured", name)
+		}
+		ids = append(ids, suite.ID)
+	}
+	return ids, nil
+}
+
+func parseCurves(names []string) ([]tls.CurveID, error) {
+	if len(names) == 0 {
+		return nil, nil
+	}
+
+	curves := make([]tls.CurveID, 0, len(names))
+	for _, name := range names {
+		curve, ok := tlsCurves[name]
+		if !ok {
+			return nil, fmt.Errorf("unknown curve %q, expected X25519, P-256, P-384 or P-521", name)
+		}
+		curves = append(curves, curve)
+	}
+	return curves, nil
+}
+
+func parseALPN(protocols []string) ([]string, error) {
+	if len(protocols) == 0 {
+		return []string{alpnH2, alpnHTTP11}, nil
+	}
+
+	for _, proto := range protocols {
+		if proto != alpnH2 && proto != alpnHTTP11 {
+			return nil, fmt.Errorf("unsupported ALPN protocol %q, expected h2 or http/1.1", proto)
+		}
+	}
+	return protocols, nil
+}
+
+// initACME serves the certificates of the ACME hosts, and of ACME
+// challenges, from the ACME manager and the other names from tlsConfig's
+// certificates
+func (p *Proxy) initACME(tlsConfig *tls.Config) error {
+	ac := p.cfg.Server.TLS.ACME
+	if ac == nil || !ac.Enabled {
+		return nil
+	}
+
+	var storage acme.Storage
+	if ac.StorageDir != "" {
+		storage = acme.DirStorage(ac.StorageDir)
+	}
+	var client *http.Client
+	if ac.DirectoryCAFile != "" {
+		pool, err := loadCertPool(ac.DirectoryCAFile)
+		if err != nil {
+			return fmt.Errorf("acme directoryCAFile: %w", err)
+		}
+		client = &http.Client{
+			Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: pool}},
+			Timeout:   time.Minute,
+		}
+	}
+
+	manager, err := acme.New(acme.Config{
+		Hosts:        ac.Hosts,
+		Email:        ac.Email,
+		DirectoryURL: ac.DirectoryURL,
+		Storage:      storage,
+		RenewBefore:  ac.RenewBefore,
+		HTTPClient:   client,
+	})
+	if err != nil {
+		return fmt.Errorf("acme: %w", err)
+	}
+
+	files := tlsConfig.GetCertificate
+	tlsConfig.GetCertificate = func(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+		if files == nil || manager.Handles(hello) {
+			return manager.GetCertificate(hello)
+		}
+		return files(hello)
+	}
+	tlsConfig.NextProtos = append(tlsConfig.NextProtos, acme.ALPNProto)
+
+	p.acme = manager
+	return nil
+}
+
+// initRedirect prepares the plain HTTP listener that sends clients to
+// HTTPS
+func (p *Proxy) initRedirect() error {
+	port := p.cfg.Server.TLS.RedirectPort
+	if port == 0 {
+		return nil
+	}
+	if port == p.cfg.Server.Port {
+		return fmt.Errorf("redirectPort %d is the HTTPS port", port)
+	}
+
+	// ACME HTTP-01 challenges arrive over plain HTTP
+	handler := redirectHandler(p.cfg.Server.Port)
+	if p.acme != nil {
+		handler = p.acme.HTTPHandler(handler)
+	}
+
+	p.redirect = &http.Server{
+		Addr:              fmt.Sprintf(":%d", port),
+		Handler:           handler,
+		ReadHeaderTimeout: 10 * time.Second,
+		MaxHeaderBytes:    p.cfg.Server.MaxHeaderBytes,
+	}
+	return nil
+}
+
+// startRedirect listens for plain HTTP and serves redirects in the
+// background
+func (p *Proxy) startRedirect() error {
+	if p.redirect == nil {
+		return nil
+	}
+
+	ln, err := net.Listen("tcp", p.redirect.Addr)
+	if err != nil {
+		return fmt.Errorf("redirect listener: %w", err)
+	}
+
+	go func() {
+		if err := p.redirect.Serve(ln); err != nil && err != http.ErrServerClosed {
+			log.Printf("Redirect server error: %v", err)
+		}
+	}()
+	return nil
+}
+
+func (p *Proxy) stopRedirect(ctx context.Context) error {
+	if p.redirect == nil {
+		return nil
+	}
+	return p.redirect.Shutdown(ctx)
+}
+
+// redirectHandler sends requests to the same URL over HTTPS on port
+func redirectHandler(port int) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		host := r.Host
+		if h, _, err := net.SplitHostPort(host); err == nil {
+			host = h
+		}
+		host = strings.TrimSuffix(strings.TrimPrefix(host, "["), "]")
+		if host == "" {
+			http.Error(w, "Host header required", http.StatusBadRequest)
+			return
+		}
+
+		switch {
+		case port != 443:
+			host = net.JoinHostPort(host, strconv.Itoa(port))
+		case strings.Contains(host, ":"):
+			host = "[" + host + "]"
+		}
+
+		// 301 lets old clients turn a POST into a GET, so other methods
+		// get a 308
+		code := http.StatusPermanentRedirect
+		if r.Method == http.MethodGet || r.Method == http.MethodHead {
+			code = http.StatusMovedPermanently
+		}
+		http.Redirect(w, r, "https://"+host+r.URL.RequestURI(), code)
+	})
+}
@@ -0,0 +1,313 @@
+package proxy
+
+import (
+	"crypto/tls"
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/oabraham1/go-http-proxy/internal/config"
+)
+
+func TestConfigureTLS(t *testing.T) {
+	certFile, keyFile := writeTestCert(t)
+
+	cfg := &config.TLSConfig{
+		Enabled:      true,
+		CertFile:     certFile,
+		KeyFile:      keyFile,
+		MinVersion:   "1.2",
+		MaxVersion:   "1.3",
+		CipherSuites: []string{"TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256", "TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305_SHA256"},
+		Curves:       []string{"X25519", "P-256"},
+	}
+	tlsConfig, _, err := configureTLS(cfg)
+	if err != nil {
+		t.Fatalf("Failed to configure TLS: %v", err)
+	}
+
+	if tlsConfig.MinVersion != tls.VersionTLS12 || tlsConfig.MaxVersion != tls.VersionTLS13 {
+		t.Errorf("Expected TLS 1.2 to 1.3, got %x to %x", tlsConfig.MinVersion, tlsConfig.MaxVersion)
+	}
+	expectedSuites := []uint16{tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256, tls.TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305_SHA256}
+	if len(tlsConfig.CipherSuites) != 2 || tlsConfig.CipherSuites[0] != expectedSuites[0] || tlsConfig.CipherSuites[1] != expectedSuites[1] {
+		t.Errorf("Expected cipher suites %v, got %v", expectedSuites, tlsConfig.CipherSuites)
+	}
+	if len(tlsConfig.CurvePreferences) != 2 || tlsConfig.CurvePreferences[0] != tls.X25519 {
+		t.Errorf("Expected X25519 then P-256, got %v", tlsConfig.CurvePreferences)
+	}
+	if strings.Join(tlsConfig.NextProtos, ",") != "h2,http/1.1" {
+		t.Errorf("Expected ALPN to default to h2 and http/1.1, got %v", tlsConfig.NextProtos)
+	}
+	if tlsConfig.GetCertificate == nil {
+		t.Error("Expected certificates to be served by SNI")
+	}
+}
+
+func TestConfigureTLSErrors(t *testing.T) {
+	certFile, keyFile := writeTestCert(t)
+
+	tests := []struct {
+		name     string
+		modify   func(*config.TLSConfig)
+		expected string
+	}{
+		{"unknown version", func(c *config.TLSConfig) { c.MinVersion = "1.4" }, "unknown TLS version"},
+		{"inverted versions", func(c *config.TLSConfig) { c.MinVersion, c.MaxVersion = "1.3", "1.2" }, "below minVersion"},
+		{"unknown cipher", func(c *config.TLSConfig) { c.CipherSuites = []string{"TLS_MADE_UP"} }, "unknown cipher suite"},
+		{"insecure cipher", func(c *config.TLSConfig) { c.CipherSuites = []string{"TLS_RSA_WITH_RC4_128_SHA"} }, "insecure"},
+		{"TLS 1.3 cipher", func(c *config.TLSConfig) { c.CipherSuites = []string{"TLS_AES_128_GCM_SHA256"} }, "can't be configured"},
+		{"ciphers with TLS 1.3 only", func(c *config.TLSConfig) {
+			c.MinVersion = "1.3"
+			c.CipherSuites = []string{"TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256"}
+		}, "no effect"},
+		{"unknown curve", func(c *config.TLSConfig) { c.Curves = []string{"P-224"} }, "unknown curve"},
+		{"unknown ALPN", func(c *config.TLSConfig) { c.ALPN = []string{"spdy/3"} }, "unsupported ALPN"},
+		{"missing key", func(c *config.TLSConfig) { c.KeyFile = "" }, "required"},
+		{"unreadable certificate", func(c *config.TLSConfig) { c.CertFile = "/nonexistent.pem" }, "loading certificate"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := &config.TLSConfig{Enabled: true, CertFile: certFile, KeyFile: keyFile}
+			tt.modify(cfg)
+
+			_, _, err := configureTLS(cfg)
+			if err == nil || !strings.Contains(err.Error(), tt.expected) {
+				t.Errorf("Expected error containing %q, got %v", tt.expected, err)
+			}
+		})
+	}
+}
+
+func TestTLSListener(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("secure"))
+	}))
+	defer backend.Close()
+
+	tests := []struct {
+		name     string
+		alpn     []string
+		expected int
+	}{
+		{"h2 by default", nil, 2},
+		{"http/1.1 only", []string{"http/1.1"}, 1},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			certFile, keyFile := writeTestCert(t)
+			cfg := &config.Config{
+				Services: map[string]config.ServiceConfig{
+					"api": {URL: backend.URL},
+				},
+			}
+			cfg.Server.TLS = &config.TLSConfig{Enabled: true, CertFile: certFile, KeyFile: keyFile, ALPN: tt.alpn}
+
+			proxy, err := New(cfg)
+			if err != nil {
+				t.Fatalf("Failed to create proxy: %v", err)
+			}
+
+			// Serve through the proxy's own server so its ALPN handling applies
+			ln, err := net.Listen("tcp", "127.0.0.1:0")
+			if err != nil {
+				t.Fatalf("Failed to listen: %v", err)
+			}
+			go proxy.server.ServeTLS(ln, "", "")
+			defer proxy.server.Close()
+
+			client := &http.Client{
+				Transport: &http.Transport{
+					TLSClientConfig:   &tls.Config{InsecureSkipVerify: true},
+					ForceAttemptHTTP2: true,
+				},
+				Timeout: 5 * time.Second,
+			}
+			resp, err := client.Get("https://" + ln.Addr().String() + "/api/data")
+			if err != nil {
+				t.Fatalf("Request failed: %v", err)
+			}
+			resp.Body.Close()
+
+			if resp.StatusCode != http.StatusOK || resp.ProtoMajor != tt.expected {
+				t.Errorf("Expected 200 over HTTP/%d, got %d over %s", tt.expected, resp.StatusCode, resp.Proto)
+			}
+		})
+	}
+}
+
+func TestRedirectHandler(t *testing.T) {
+	tests := []struct {
+		method   string
+		host     string
+		port     int
+		target   string
+		location string
+		code     int
+	}{
+		{"GET", "example.com:8080", 8443, "/path?q=1", "https://example.com:8443/path?q=1", http.StatusMovedPermanently},
+		{"GET", "example.com", 443, "/", "https://example.com/", http.StatusMovedPermanently},
+		{"POST", "example.com", 443, "/submit", "https://example.com/submit", http.StatusPermanentRedirect},
+		{"GET", "[::1]:8080", 443, "/", "https://[::1]/", http.StatusMovedPermanently},
+	}
+
+	for _, tt := range tests {
+		req := httptest.NewRequest(tt.method, tt.target, nil)
+		req.Host = tt.host
+		rec := httptest.NewRecorder()
+
+		redirectHandler(tt.port).ServeHTTP(rec, req)
+
+		if rec.Code != tt.code || rec.Header().Get("Location") != tt.location {
+			t.Errorf("Expected %d to %s, got %d to %s", tt.code, tt.location, rec.Code, rec.Header().Get("Location"))
+		}
+	}
+}
+
+func TestRedirectPortMustDiffer(t *testing.T) {
+	certFile, keyFile := writeTestCert(t)
+	cfg := &config.Config{}
+	cfg.Server.Port = 8443
+	cfg.Server.TLS = &config.TLSConfig{Enabled: true, CertFile: certFile, KeyFile: keyFile, RedirectPort: 8443}
+
+	if _, err := New(cfg); err == nil {
+		t.Error("Expected a redirect port equal to the HTTPS port to be rejected")
+	}
+}
+
+func TestTLSSelectsCertificateBySNI(t *testing.T) {
+	defaultCert, defaultKey := writeNamedCert(t, "default.example.org")
+	apiCert, apiKey := writeNamedCert(t, "api.example.com")
+	wildCert, wildKey := writeNamedCert(t, "*.example.com")
+
+	cfg := &config.Config{}
+	cfg.Server.TLS = &config.TLSConfig{
+		Enabled:  true,
+		CertFile: defaultCert,
+		KeyFile:  defaultKey,
+		Certificates: []config.CertificateConfig{
+			{CertFile: apiCert, KeyFile: apiKey},
+			{CertFile: wildCert, KeyFile: wildKey},
+		},
+	}
+	proxy, err := New(cfg)
+	if err != nil {
+		t.Fatalf("Failed to create proxy: %v", err)
+	}
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	go proxy.server.ServeTLS(ln, "", "")
+	defer proxy.server.Close()
+
+	tests := []struct {
+		sni      string
+		expected string
+	}{
+		{"api.example.com", "api.example.com"},
+		{"www.example.com", "*.example.com"},
+		{"unknown.test", "default.example.org"},
+	}
+
+	for _, tt := range tests {
+		conn, err := tls.Dial("tcp", ln.Addr().String(), &tls.Config{ServerName: tt.sni, InsecureSkipVerify: true})
+		if err != nil {
+			t.Fatalf("Handshake for %s failed: %v", tt.sni, err)
+		}
+		got := conn.ConnectionState().PeerCertificates[0].Subject.CommonName
+		conn.Close()
+
+		if got != tt.expected {
+			t.Errorf("Expected %s for SNI %s, got %s", tt.expected, tt.sni, got)
+		}
+	}
+
+	// The metrics endpoint reports when each certificate expires
+	rec := httptest.NewRecorder()
+	proxy.handleMetrics(rec, httptest.NewRequest("GET", "/metrics", nil))
+
+	var metrics ProxyMetrics
+	json.NewDecoder(rec.Body).Decode(&metrics)
+	if len(metrics.Certificates) != 3 || metrics.Certificates[0].NotAfter.IsZero() {
+		t.Errorf("Expected 3 certificate expiries, got %+v", metrics.Certificates)
+	}
+}
+
+func TestACMEAlongsideCertificateFiles(t *testing.T) {
+	// No certificate is issued unless a client asks for an ACME host
+	directory := httptest.NewServer(http.NotFoundHandler())
+	defer directory.Close()
+
+	certFile, keyFile := writeNamedCert(t, "files.example.org")
+	cfg := &config.Config{}
+	cfg.Server.Port = 8443
+	cfg.Server.TLS = &config.TLSConfig{
+		Enabled:      true,
+		CertFile:     certFile,
+		KeyFile:      keyFile,
+		RedirectPort: 8080,
+		ACME: &config.ACMEConfig{
+			Enabled:      true,
+			Hosts:        []string{"auto.example.com"},
+			DirectoryURL: directory.URL,
+			StorageDir:   t.TempDir(),
+		},
+	}
+	proxy, err := New(cfg)
+	if err != nil {
+		t.Fatalf("Failed to create proxy: %v", err)
+	}
+
+	if !strings.HasSuffix(strings.Join(proxy.server.TLSConfig.NextProtos, ","), ",acme-tls/1") {
+		t.Errorf("Expected TLS-ALPN-01 to be offered, got %v", proxy.server.TLSConfig.NextProtos)
+	}
+
+	// Other names are still served from the files
+	cert, err := proxy.server.TLSConfig.GetCertificate(&tls.ClientHelloInfo{ServerName: "files.example.org"})
+	if err != nil || cert.Leaf.Subject.CommonName != "files.example.org" {
+		t.Errorf("Expected the file certificate, got %v", err)
+	}
+
+	// HTTP-01 challenges are answered on the redirect port
+	tests := []struct {
+		path     string
+		expected int
+	}{
+		{"/.well-known/acme-challenge/unknown", http.StatusNotFound},
+		{"/page", http.StatusMovedPermanently},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest("GET", tt.path, nil)
+		req.Host = "auto.example.com"
+		rec := httptest.NewRecorder()
+		proxy.redirect.Handler.ServeHTTP(rec, req)
+
+		if rec.Code != tt.expected {
+			t.Errorf("Expected %d for %s, got %d", tt.expected, tt.path, rec.Code)
+		}
+	}
+}
+
+func TestACMEWithoutCertificateFiles(t *testing.T) {
+	cfg := &config.Config{}
+	cfg.Server.TLS = &config.TLSConfig{
+		Enabled: true,
+		ACME:    &config.ACMEConfig{Enabled: true, Hosts: []string{"auto.example.com"}, StorageDir: t.TempDir()},
+	}
+	if _, err := New(cfg); err != nil {
+		t.Errorf("Expected ACME to stand in for certificate files, got %v", err)
+	}
+
+	cfg.Server.TLS.ACME.StorageDir = ""
+	if _, err := New(cfg); err == nil || !strings.Contains(err.Error(), "storage") {
+		t.Errorf("Expected ACME without storage to be rejected, got %v", err)
+	}
+}
@@ -0,0 +1,315 @@
+package proxy
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// defaultUpgradeIdleTimeout closes tunnels that carried no traffic in
+// either direction for this long
+const defaultUpgradeIdleTimeout = 5 * time.Minute
+
+// isUpgrade reports whether r asks to switch to another protocol, such as
+// WebSocket. Upgrades only exist in HTTP/1.1.
+func isUpgrade(r *http.Request) bool {
+	return r.ProtoMajor == 1 &&
+		r.Header.Get("Upgrade") != "" &&
+		headerHasToken(r.Header, "Connection", "upgrade")
+}
+
+// headerHasToken reports whether a comma-separated header contains token
+func headerHasToken(h http.Header, name, token string) bool {
+	for _, value := range headerTokens(h, name) {
+		if strings.EqualFold(value, token) {
+			return true
+		}
+	}
+	return false
+}
+
+// headerTokens splits every value of a comma-separated header
+func headerTokens(h http.Header, name string) []string {
+	var tokens []string
+	for _, field := range h.Values(name) {
+		for _, token := range strings.Split(field, ",") {
+			if token = strings.TrimSpace(token); token != "" {
+				tokens = append(tokens, token)
+			}
+		}
+	}
+	return tokens
+}
+
+// handleUpgrade forwards an upgrade handshake to a backend and, once the
+// backend switches protocols, relays bytes between the client and the
+// backend until either side closes, the tunnel idles out or the proxy
+// shuts down
+func (p *Proxy) handleUpgrade(w http.ResponseWriter, r *http.Request, rt *route) ([]Attempt, error) {
+	protocol := r.Header.Get("Upgrade")
+	idleTimeout := defaultUpgradeIdleTimeout
+	var allowed []string
+	var maxConns int64
+	if uc := rt.config.Upgrade; uc != nil {
+		allowed = uc.Subprotocols
+		maxConns = int64(uc.MaxConnections)
+		if uc.IdleTimeout > 0 {
+			idleTimeout = uc.IdleTimeout
+		}
+	}
+
+	// Only offer the backend subprotocols the route allows
+	offered := headerTokens(r.Header, "Sec-WebSocket-Protocol")
+	accepted := offered
+	if len(allowed) > 0 {
+		accepted = nil
+		for _, subprotocol := range offered {
+			if containsFold(allowed, subprotocol) {
+				accepted = append(accepted, subprotocol)
+			}
+		}
+		if len(offered) > 0 && len(accepted) == 0 {
+			return nil, HTTPError{Code: http.StatusBadRequest, Message: "Unsupported WebSocket subprotocol"}
+		}
+	}
+
+	if active := rt.upgrades.Add(1); maxConns > 0 && active > maxConns {
+		rt.upgrades.Add(-1)
+		return nil, HTTPError{Code: http.StatusServiceUnavailable, Message: "Too many upgraded connections"}
+	}
+	defer rt.upgrades.Add(-1)
+
+	backend, err := p.balancers[rt.service].Next(r)
+	if err != nil {
+		return nil, HTTPError{Code: http.StatusServiceUnavailable, Message: "No backend available"}
+	}
+	backend.Acquire()
+	defer backend.Release()
+
+	outReq := p.outboundRequest(r, backend, rt)
+	outReq.Header.Set("Connection", "Upgrade")
+	outReq.Header.Set("Upgrade", protocol)
+	outReq.Header.Del("Sec-WebSocket-Protocol")
+	if len(accepted) > 0 {
+		outReq.Header.Set("Sec-WebSocket-Protocol", strings.Join(accepted, ", "))
+	}
+
+	// The timeout covers the handshake only. The client's Timeout would also
+	// cover the tunnel, so go to the transport directly.
+	if rt.cfg.Timeout > 0 {
+		ctx, cancel := context.WithTimeout(outReq.Context(), rt.cfg.Timeout)
+		defer cancel()
+		outReq = outReq.WithContext(ctx)
+	}
+
+	// Upgrades need HTTP/1.1, so HTTP/2-only services use the shared
+	// transport
+	transport := p.client.Transport
+	if t, ok := p.clientFor(rt.service).Transport.(*http.Transport); ok {
+		transport = t
+	}
+
+	start := time.Now()
+	resp, err := transport.RoundTrip(outReq)
+	attempts := []Attempt{newAttempt(backend, start, resp, err)}
+	p.recordOutcome(r.Context(), rt.service, backend, resp, err)
+	if err != nil {
+		return attempts, err
+	}
+
+	switched := resp.Header.Get("Upgrade")
+	removeHopHeaders(resp.Header)
+	addVia(resp.Header, resp.ProtoMajor, resp.ProtoMinor)
+
+	// A backend that declines the upgrade answers with a normal response
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		defer resp.Body.Close()
+		return attempts, p.writeResponse(w, resp, 0)
+	}
+
+	backConn, ok := resp.Body.(io.ReadWriteCloser)
+	if !ok {
+		resp.Body.Close()
+		return attempts, HTTPError{Code: http.StatusBadGateway, Message: "Backend upgrade failed"}
+	}
+
+	if !strings.EqualFold(switched, protocol) {
+		backConn.Close()
+		return attempts, HTTPError{Code: http.StatusBadGateway, Message: "Backend switched to an unexpected protocol"}
+	}
+	chosen := resp.Header.Get("Sec-WebSocket-Protocol")
+	if chosen != "" && !containsFold(accepted, chosen) {
+		backConn.Close()
+		return attempts, HTTPError{Code: http.StatusBadGateway, Message: "Backend chose an unsupported subprotocol"}
+	}
+
+	conn, brw, err := http.NewResponseController(w).Hijack()
+	if err != nil {
+		backConn.Close()
+		return attempts, err
+	}
+	defer conn.Close()
+
+	// Deadlines set by the server for the handshake must not apply to the
+	// tunnel, which has its own idle timeout
+	conn.SetDeadline(time.Time{})
+
+	resp.Header.Set("Connection", "Upgrade")
+	resp.Header.Set("Upgrade", switched)
+	resp.Body = nil
+	if err := resp.Write(brw); err != nil {
+		backConn.Close()
+		return attempts, nil
+	}
+	if err := brw.Flush(); err != nil {
+		backConn.Close()
+		return attempts, nil
+	}
+
+	// Pass on anything the client sent right behind the handshake
+	if buffered := brw.Reader.Buffered(); buffered > 0 {
+		data, _ := brw.Reader.Peek(buffered)
+		if _, err := backConn.Write(data); err != nil {
+			backConn.Close()
+			return attempts, nil
+		}
+	}
+
+	t := &tunnel{client: conn, backend: backConn, idleTimeout: idleTimeout}
+	if !p.trackTunnel(t) {
+		t.close()
+		return attempts, nil
+	}
+	defer p.untrackTunnel(t)
+
+	p.metrics.upgradedConns.Add(1)
+	defer p.metrics.upgradedConns.Add(-1)
+
+	t.run()
+	return attempts, nil
+}
+
+func containsFold(values []string, value string) bool {
+	for _, v := range values {
+		if strings.EqualFold(v, value) {
+			return true
+		}
+	}
+	return false
+}
+
+// tunnel relays bytes between a client and a backend after an upgrade
+type tunnel struct {
+	client      io.ReadWriteCloser
+	backend     io.ReadWriteCloser
+	idleTimeout time.Duration
+	lastActive  atomic.Int64
+	closeOnce   sync.Once
+
+	up   atomic.Int64 // bytes from the client to the backend
+	down atomic.Int64 // bytes from the backend to the client
+}
+
+// run copies in both directions until either side is done or the tunnel
+// has been idle for too long
+func (t *tunnel) run() {
+	t.touch()
+
+	done := make(chan struct{}, 2)
+	go t.pipe(t.backend, t.client, &t.up, done)
+	go t.pipe(t.client, t.backend, &t.down, done)
+
+	idle := time.NewTimer(t.idleTimeout)
+	defer idle.Stop()
+
+	for finished := 0; finished < 2; {
+		select {
+		case <-done:
+			finished++
+			// Once one side is gone the other has nobody to talk to
+			t.close()
+		case <-idle.C:
+			since := time.Since(time.Unix(0, t.lastActive.Load()))
+			if since >= t.idleTimeout {
+				t.close()
+			} else {
+				idle.Reset(t.idleTimeout - since)
+			}
+		}
+	}
+}
+
+func (t *tunnel) pipe(dst io.Writer, src io.Reader, count *atomic.Int64, done chan<- struct{}) {
+	defer func() { done <- struct{}{} }()
+
+	buf := make([]byte, streamBufferSize)
+	for {
+		n, err := src.Read(buf)
+		if n > 0 {
+			t.touch()
+			written, werr := dst.Write(buf[:n])
+			count.Add(int64(written))
+			if werr != nil {
+				return
+			}
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+func (t *tunnel) touch() {
+	t.lastActive.Store(time.Now().UnixNano())
+}
+
+func (t *tunnel) close() {
+	t.closeOnce.Do(func() {
+		t.client.Close()
+		t.backend.Close()
+	})
+}
+
+// Close lets shutdown close tunnels along with other hijacked connections
+func (t *tunnel) Close() error {
+	t.close()
+	return nil
+}
+
+// trackTunnel registers a hijacked connection so shutdown can close it. It
+// reports false once the proxy is shutting down.
+func (p *Proxy) trackTunnel(t io.Closer) bool {
+	p.tunnelsMu.Lock()
+	defer p.tunnelsMu.Unlock()
+
+	if p.draining {
+		return false
+	}
+	if p.tunnels == nil {
+		p.tunnels = make(map[io.Closer]struct{})
+	}
+	p.tunnels[t] = struct{}{}
+	return true
+}
+
+func (p *Proxy) untrackTunnel(t io.Closer) {
+	p.tunnelsMu.Lock()
+	defer p.tunnelsMu.Unlock()
+	delete(p.tunnels, t)
+}
+
+// closeTunnels closes every hijacked connection and refuses new ones. The
+// server doesn't track hijacked connections, so Shutdown relies on this.
+func (p *Proxy) closeTunnels() {
+	p.tunnelsMu.Lock()
+	defer p.tunnelsMu.Unlock()
+
+	p.draining = true
+	for t := range p.tunnels {
+		t.Close()
+	}
+}
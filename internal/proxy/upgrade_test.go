@@ -0,0 +1,189 @@
+package proxy
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/oabraham1/go-http-proxy/internal/config"
+)
+
+// echoUpgradeBackend switches to the "echo" protocol, picks the first
+// offered subprotocol and echoes everything it reads
+func echoUpgradeBackend(t *testing.T) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Upgrade") != "echo" {
+			http.Error(w, "upgrade required", http.StatusUpgradeRequired)
+			return
+		}
+
+		conn, brw, err := http.NewResponseController(w).Hijack()
+		if err != nil {
+			t.Errorf("Backend hijack failed: %v", err)
+			return
+		}
+		defer conn.Close()
+
+		fmt.Fprint(brw, "HTTP/1.1 101 Switching Protocols\r\nConnection: Upgrade\r\nUpgrade: echo\r\n")
+		if offered := r.Header.Get("Sec-WebSocket-Protocol"); offered != "" {
+			fmt.Fprintf(brw, "Sec-WebSocket-Protocol: %s\r\n", strings.TrimSpace(strings.Split(offered, ",")[0]))
+		}
+		fmt.Fprint(brw, "\r\n")
+		brw.Flush()
+
+		io.Copy(conn, brw)
+	}))
+}
+
+// dialUpgrade sends an upgrade request over a raw connection and returns
+// the connection along with the proxy's response
+func dialUpgrade(t *testing.T, addr, path, subprotocols string) (net.Conn, *bufio.Reader, *http.Response) {
+	t.Helper()
+
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("Dial failed: %v", err)
+	}
+
+	req := "GET " + path + " HTTP/1.1\r\nHost: " + addr + "\r\nConnection: Upgrade\r\nUpgrade: echo\r\n"
+	if subprotocols != "" {
+		req += "Sec-WebSocket-Protocol: " + subprotocols + "\r\n"
+	}
+	if _, err := io.WriteString(conn, req+"\r\n"); err != nil {
+		t.Fatalf("Write failed: %v", err)
+	}
+
+	br := bufio.NewReader(conn)
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	resp, err := http.ReadResponse(br, nil)
+	if err != nil {
+		t.Fatalf("Reading handshake failed: %v", err)
+	}
+	return conn, br, resp
+}
+
+func TestUpgradeProxying(t *testing.T) {
+	backend := echoUpgradeBackend(t)
+	defer backend.Close()
+
+	cfg := &config.Config{
+		Services: map[string]config.ServiceConfig{
+			"ws": {
+				URL: backend.URL,
+				Routes: []config.RouteConfig{
+					{
+						Path:    "/ws/chat",
+						Timeout: 50 * time.Millisecond,
+						Upgrade: &config.UpgradeConfig{
+							Subprotocols:   []string{"chat.v2"},
+							MaxConnections: 1,
+						},
+					},
+					{
+						Path:    "/ws/idle",
+						Upgrade: &config.UpgradeConfig{IdleTimeout: 50 * time.Millisecond},
+					},
+				},
+			},
+		},
+	}
+	proxy, err := New(cfg)
+	if err != nil {
+		t.Fatalf("Failed to create proxy: %v", err)
+	}
+	server := httptest.NewServer(proxy.handler())
+	defer server.Close()
+	addr := server.Listener.Addr().String()
+
+	echo := func(t *testing.T, conn net.Conn, br *bufio.Reader, msg string) {
+		t.Helper()
+		if _, err := io.WriteString(conn, msg); err != nil {
+			t.Fatalf("Write failed: %v", err)
+		}
+		buf := make([]byte, len(msg))
+		conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+		if _, err := io.ReadFull(br, buf); err != nil {
+			t.Fatalf("Read failed: %v", err)
+		}
+		if string(buf) != msg {
+			t.Errorf("Expected echo %q, got %q", msg, buf)
+		}
+	}
+
+	t.Run("tunnel outlives handshake timeout", func(t *testing.T) {
+		conn, br, resp := dialUpgrade(t, addr, "/ws/chat", "chat.v1, chat.v2")
+		defer conn.Close()
+
+		if resp.StatusCode != http.StatusSwitchingProtocols {
+			t.Fatalf("Expected status 101, got %d", resp.StatusCode)
+		}
+		if got := resp.Header.Get("Sec-WebSocket-Protocol"); got != "chat.v2" {
+			t.Errorf("Expected subprotocol chat.v2, got %q", got)
+		}
+		if got := proxy.metrics.upgradedConns.Load(); got != 1 {
+			t.Errorf("Expected 1 upgraded connection, got %d", got)
+		}
+
+		echo(t, conn, br, "hello")
+		time.Sleep(100 * time.Millisecond)
+		echo(t, conn, br, "still there")
+	})
+
+	t.Run("unsupported subprotocol", func(t *testing.T) {
+		conn, _, resp := dialUpgrade(t, addr, "/ws/chat", "chat.v1")
+		defer conn.Close()
+
+		if resp.StatusCode != http.StatusBadRequest {
+			t.Errorf("Expected status 400, got %d", resp.StatusCode)
+		}
+	})
+
+	t.Run("connection limit", func(t *testing.T) {
+		conn, br, resp := dialUpgrade(t, addr, "/ws/chat", "")
+		defer conn.Close()
+		if resp.StatusCode != http.StatusSwitchingProtocols {
+			t.Fatalf("Expected status 101, got %d", resp.StatusCode)
+		}
+		echo(t, conn, br, "ping")
+
+		extra, _, resp := dialUpgrade(t, addr, "/ws/chat", "")
+		defer extra.Close()
+		if resp.StatusCode != http.StatusServiceUnavailable {
+			t.Errorf("Expected status 503, got %d", resp.StatusCode)
+		}
+	})
+
+	t.Run("idle tunnel closed", func(t *testing.T) {
+		conn, br, resp := dialUpgrade(t, addr, "/ws/idle", "")
+		defer conn.Close()
+		if resp.StatusCode != http.StatusSwitchingProtocols {
+			t.Fatalf("Expected status 101, got %d", resp.StatusCode)
+		}
+
+		conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+		if _, err := br.ReadByte(); err != io.EOF {
+			t.Errorf("Expected idle tunnel to be closed, got %v", err)
+		}
+	})
+
+	t.Run("shutdown closes tunnels", func(t *testing.T) {
+		conn, br, resp := dialUpgrade(t, addr, "/ws/idle", "")
+		defer conn.Close()
+		if resp.StatusCode != http.StatusSwitchingProtocols {
+			t.Fatalf("Expected status 101, got %d", resp.StatusCode)
+		}
+
+		proxy.closeTunnels()
+
+		conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+		if _, err := br.ReadByte(); err != io.EOF {
+			t.Errorf("Expected tunnel to be closed, got %v", err)
+		}
+	})
+}
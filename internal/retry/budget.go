@@ -0,0 +1,38 @@
+package retry
+
+import "sync/atomic"
+
+// Budget caps concurrent retries to a share of the live requests, so a
+// struggling backend isn't buried under a retry storm
+type Budget struct {
+	percent    float64
+	minRetries int64
+	requests   atomic.Int64
+	retries    atomic.Int64
+}
+
+// Begin records a live request and returns a func that ends it
+func (b *Budget) Begin() func() {
+	b.requests.Add(1)
+	return func() { b.requests.Add(-1) }
+}
+
+// TryRetry reserves a retry if the budget allows it. A successful
+// reservation must be returned with RetryDone.
+func (b *Budget) TryRetry() bool {
+	limit := int64(float64(b.requests.Load()) * b.percent / 100)
+	if limit < b.minRetries {
+		limit = b.minRetries
+	}
+
+	if b.retries.Add(1) > limit {
+		b.retries.Add(-1)
+		return false
+	}
+	return true
+}
+
+// RetryDone returns a retry reserved with TryRetry
+func (b *Budget) RetryDone() {
+	b.retries.Add(-1)
+}
@@ -0,0 +1,170 @@
+package retry
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"net"
+	"net/http"
+	"syscall"
+	"time"
+)
+
+// Conditions that can trigger a retry
+const (
+	ConnectFailure = "connect-failure" // The backend could not be reached
+	Reset          = "reset"           // The connection dropped before a response arrived
+	GatewayError   = "gateway-error"   // 502, 503 or 504 responses
+	ServerError    = "5xx"             // Any 5xx response
+)
+
+// Config describes when and how often a request is retried
+type Config struct {
+	MaxAttempts        int           // Total attempts including the first, 1 disables retries
+	RetryOn            []string      // Retry conditions, see the constants above
+	StatusCodes        []int         // Additional response codes that trigger a retry
+	BackoffBase        time.Duration // Upper bound of the first back-off, doubled per attempt
+	BackoffMax         time.Duration // Upper bound of any back-off
+	RetryNonIdempotent bool          // Also retry POST, PATCH and other unsafe methods
+	BudgetPercent      float64       // Concurrent retries allowed as a share of live requests
+	MinRetries         int           // Concurrent retries always allowed regardless of the budget
+	MaxBodyBytes       int64         // Largest request body buffered for replay
+}
+
+// Policy decides whether a failed attempt is retried
+type Policy struct {
+	config         Config
+	connectFailure bool
+	reset          bool
+	statuses       map[int]bool
+	serverErrors   bool
+	budget         *Budget
+}
+
+func New(config Config) (*Policy, error) {
+	if config.MaxAttempts < 1 {
+		config.MaxAttempts = 1
+	}
+	if len(config.RetryOn) == 0 && len(config.StatusCodes) == 0 {
+		config.RetryOn = []string{ConnectFailure, Reset, GatewayError}
+	}
+	if config.BackoffBase <= 0 {
+		config.BackoffBase = 25 * time.Millisecond
+	}
+	if config.BackoffMax <= 0 {
+		config.BackoffMax = 10 * config.BackoffBase
+	}
+	if config.BudgetPercent <= 0 {
+		config.BudgetPercent = 20
+	}
+	if config.MinRetries <= 0 {
+		config.MinRetries = 3
+	}
+	if config.MaxBodyBytes <= 0 {
+		config.MaxBodyBytes = 1 << 20
+	}
+
+	p := &Policy{
+		config:   config,
+		statuses: make(map[int]bool),
+		budget: &Budget{
+			percent:    config.BudgetPercent,
+			minRetries: int64(config.MinRetries),
+		},
+	}
+
+	for _, condition := range config.RetryOn {
+		switch condition {
+		case ConnectFailure:
+			p.connectFailure = true
+		case Reset:
+			p.reset = true
+		case GatewayError:
+			p.statuses[http.StatusBadGateway] = true
+			p.statuses[http.StatusServiceUnavailable] = true
+			p.statuses[http.StatusGatewayTimeout] = true
+		case ServerError:
+			p.serverErrors = true
+		default:
+			return nil, fmt.Errorf("unknown retry condition %q", condition)
+		}
+	}
+
+	for _, code := range config.StatusCodes {
+		if code < 100 || code > 599 {
+			return nil, fmt.Errorf("invalid retry status code %d", code)
+		}
+		p.statuses[code] = true
+	}
+
+	return p, nil
+}
+
+// MaxAttempts returns the total number of attempts, including the first
+func (p *Policy) MaxAttempts() int {
+	return p.config.MaxAttempts
+}
+
+// MaxBodyBytes returns the largest request body that may be buffered for
+// replay. Requests with larger bodies are sent once.
+func (p *Policy) MaxBodyBytes() int64 {
+	return p.config.MaxBodyBytes
+}
+
+// Budget returns the budget shared by all requests using the policy
+func (p *Policy) Budget() *Budget {
+	return p.budget
+}
+
+// AllowsMethod reports whether requests with the given method may be retried
+func (p *Policy) AllowsMethod(method string) bool {
+	return p.config.RetryNonIdempotent || IsIdempotent(method)
+}
+
+// RetryableError reports whether a transport error should be retried
+func (p *Policy) RetryableError(err error) bool {
+	if err == nil {
+		return false
+	}
+
+	var opErr *net.OpError
+	if errors.As(err, &opErr) && opErr.Op == "dial" {
+		return p.connectFailure
+	}
+
+	if errors.Is(err, syscall.ECONNRESET) || errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+		return p.reset
+	}
+
+	return false
+}
+
+// RetryableStatus reports whether a response status should be retried
+func (p *Policy) RetryableStatus(code int) bool {
+	return p.statuses[code] || (p.serverErrors && code >= 500)
+}
+
+// Backoff returns how long to wait before the given retry (1 for the first
+// retry), using exponential back-off with full jitter
+func (p *Policy) Backoff(retry int) time.Duration {
+	ceiling := p.config.BackoffBase
+	for i := 1; i < retry && ceiling < p.config.BackoffMax; i++ {
+		ceiling *= 2
+	}
+	if ceiling > p.config.BackoffMax {
+		ceiling = p.config.BackoffMax
+	}
+
+	return time.Duration(rand.Int63n(int64(ceiling) + 1))
+}
+
+// IsIdempotent reports whether a method is idempotent per RFC 9110
+func IsIdempotent(method string) bool {
+	switch method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodTrace,
+		http.MethodPut, http.MethodDelete:
+		return true
+	}
+	return false
+}
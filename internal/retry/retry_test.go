@@ -0,0 +1,127 @@
+package retry
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestPolicyConditions(t *testing.T) {
+	dialErr := &net.OpError{Op: "dial", Net: "tcp", Err: syscall.ECONNREFUSED}
+	resetErr := &net.OpError{Op: "read", Net: "tcp", Err: syscall.ECONNRESET}
+
+	tests := []struct {
+		name      string
+		config    Config
+		err       error
+		status    int
+		wantRetry bool
+	}{
+		{name: "default connect failure", config: Config{}, err: dialErr, wantRetry: true},
+		{name: "default reset", config: Config{}, err: resetErr, wantRetry: true},
+		{name: "default unexpected EOF", config: Config{}, err: fmt.Errorf("read: %w", io.ErrUnexpectedEOF), wantRetry: true},
+		{name: "default 503", config: Config{}, status: 503, wantRetry: true},
+		{name: "default 500", config: Config{}, status: 500, wantRetry: false},
+		{name: "5xx condition", config: Config{RetryOn: []string{ServerError}}, status: 500, wantRetry: true},
+		{name: "connect failure only", config: Config{RetryOn: []string{ConnectFailure}}, err: resetErr, wantRetry: false},
+		{name: "explicit status code", config: Config{StatusCodes: []int{429}}, status: 429, wantRetry: true},
+		{name: "explicit codes only", config: Config{StatusCodes: []int{429}}, err: dialErr, wantRetry: false},
+		{name: "success", config: Config{RetryOn: []string{ServerError}}, status: 200, wantRetry: false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p, err := New(tt.config)
+			if err != nil {
+				t.Fatalf("failed to create policy: %v", err)
+			}
+
+			var got bool
+			if tt.err != nil {
+				got = p.RetryableError(tt.err)
+			} else {
+				got = p.RetryableStatus(tt.status)
+			}
+			if got != tt.wantRetry {
+				t.Errorf("got retry %v, want %v", got, tt.wantRetry)
+			}
+		})
+	}
+}
+
+func TestPolicyInvalidConfig(t *testing.T) {
+	if _, err := New(Config{RetryOn: []string{"timeout-ish"}}); err == nil {
+		t.Error("expected an error for an unknown condition")
+	}
+	if _, err := New(Config{StatusCodes: []int{999}}); err == nil {
+		t.Error("expected an error for an invalid status code")
+	}
+}
+
+func TestPolicyMethods(t *testing.T) {
+	p, _ := New(Config{MaxAttempts: 3})
+	for _, method := range []string{http.MethodGet, http.MethodHead, http.MethodPut, http.MethodDelete} {
+		if !p.AllowsMethod(method) {
+			t.Errorf("expected %s to be retryable", method)
+		}
+	}
+	for _, method := range []string{http.MethodPost, http.MethodPatch} {
+		if p.AllowsMethod(method) {
+			t.Errorf("expected %s not to be retryable without opt-in", method)
+		}
+	}
+
+	p, _ = New(Config{MaxAttempts: 3, RetryNonIdempotent: true})
+	if !p.AllowsMethod(http.MethodPost) {
+		t.Error("expected POST to be retryable with opt-in")
+	}
+}
+
+func TestBackoff(t *testing.T) {
+	p, _ := New(Config{BackoffBase: 10 * time.Millisecond, BackoffMax: 35 * time.Millisecond})
+
+	ceilings := []time.Duration{10 * time.Millisecond, 20 * time.Millisecond, 35 * time.Millisecond, 35 * time.Millisecond}
+	for i, ceiling := range ceilings {
+		for n := 0; n < 100; n++ {
+			if got := p.Backoff(i + 1); got < 0 || got > ceiling {
+				t.Fatalf("retry %d: back-off %v outside [0, %v]", i+1, got, ceiling)
+			}
+		}
+	}
+}
+
+func TestBudget(t *testing.T) {
+	p, _ := New(Config{BudgetPercent: 20, MinRetries: 1})
+	b := p.Budget()
+
+	// With no live traffic only the minimum is allowed
+	if !b.TryRetry() {
+		t.Fatal("expected the minimum retry to be allowed")
+	}
+	if b.TryRetry() {
+		t.Fatal("expected a second concurrent retry to be refused")
+	}
+	b.RetryDone()
+
+	// 20% of 10 live requests allows two concurrent retries
+	var done []func()
+	for i := 0; i < 10; i++ {
+		done = append(done, b.Begin())
+	}
+	if !b.TryRetry() || !b.TryRetry() {
+		t.Fatal("expected two retries to fit the budget")
+	}
+	if b.TryRetry() {
+		t.Error("expected a third concurrent retry to be refused")
+	}
+
+	b.RetryDone()
+	b.RetryDone()
+	for _, d := range done {
+		d()
+	}
+}
@@ -0,0 +1,28 @@
+package filters
+
+import "context"
+
+// ClientCert describes the TLS client certificate a request was made with
+type ClientCert struct {
+	Subject        string
+	DNSNames       []string
+	URIs           []string
+	EmailAddresses []string
+	IPAddresses    []string
+	Fingerprint    string // hex SHA-256 of the DER certificate
+	Verified       bool   // issued by one of the proxy's client CAs
+}
+
+type clientCertKey struct{}
+
+// WithClientCert returns a copy of ctx carrying cert
+func WithClientCert(ctx context.Context, cert *ClientCert) context.Context {
+	return context.WithValue(ctx, clientCertKey{}, cert)
+}
+
+// ClientCertFromContext returns the client certificate stored in ctx, or
+// nil if the request didn't present one
+func ClientCertFromContext(ctx context.Context) *ClientCert {
+	cert, _ := ctx.Value(clientCertKey{}).(*ClientCert)
+	return cert
+}